@@ -17,18 +17,42 @@ limitations under the License.
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
+	"fmt"
 	"github.com/google/git-appraise/repository"
 	"github.com/google/git-phabricator-mirror/mirror"
+	"github.com/google/git-phabricator-mirror/mirror/arcanist"
+	"github.com/google/git-phabricator-mirror/mirror/parallel"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"sync"
+	"syscall"
 	"time"
 )
 
 var searchDir = flag.String("search_dir", "/var/repo", "Directory under which to search for git repos")
 var syncToRemote = flag.Bool("sync_to_remote", false, "Sync the local repos (including git notes) to their remotes")
 var syncPeriod = flag.Int("sync_period", 30, "Expected number of seconds between subsequent syncs of a repo.")
+var maxSyncBackoff = flag.Int("max_sync_backoff", 600, "Maximum number of seconds to wait between syncs when every repo is failing to sync.")
+var configFile = flag.String("config", "", "Optional JSON file with additional settings, such as per-repo sync periods.")
+var noteCommitterName = flag.String("note_committer_name", "", "Committer name to use for the git-notes commits created by the mirror. Defaults to the git configuration.")
+var noteCommitterEmail = flag.String("note_committer_email", "", "Committer email to use for the git-notes commits created by the mirror. Defaults to the git configuration.")
+var logConduit = flag.Bool("log_conduit", false, "Log the full request and response of each Conduit call, with credentials redacted.")
+var redactEmails = flag.Bool("redact_emails", false, "Also redact email addresses from the Conduit calls logged with -log_conduit.")
+var verbose = flag.Bool("verbose", false, "Log details that are only needed for debugging, such as the unexpected hash entries of revisions.")
+var userCacheTTL = flag.Int("user_cache_ttl", 300, "Number of seconds to cache the details of Phabricator users, including the mirror's own account.")
+var maxConcurrency = flag.Int("max_concurrency", 1, "Maximum number of repos to mirror at once. The Conduit requests and database queries for different repos may then overlap.")
+var stateFile = flag.String("state_file", "", "Optional JSON file in which to save the state of each mirrored repo after every pass, and from which to load it on startup, so that unchanged repos are not processed again after a restart.")
+var once = flag.Bool("once", false, "Make a single pass over the repos and then exit, with a nonzero status if any of them failed to sync.")
+var statusAddr = flag.String("status_addr", "", "Optional address (e.g. \":8080\") on which to serve the /healthz, /status, and /metrics HTTP endpoints, for monitoring the mirror.")
+var maxGitProcesses = flag.Int("max_git_processes", 0, "Maximum number of git subprocesses to run at once. Zero means no limit.")
 
 func findRepos(searchDir string) ([]repository.Repo, error) {
 	// This method finds repos by recursively traversing the given directory,
@@ -52,22 +76,320 @@ func findRepos(searchDir string) ([]repository.Repo, error) {
 	return repos, nil
 }
 
+// nextSyncDelay returns how long to wait between the start of one sync pass and the start of the next.
+//
+// When every repo failed to sync during the last pass (e.g. because Phabricator or the remote
+// is down), we double the previous delay, up to maxBackoff, to avoid hammering the servers and
+// spamming the logs. As soon as a pass has any success, the delay goes back to the sync period.
+func nextSyncDelay(previous, period, maxBackoff time.Duration, failures, total int) time.Duration {
+	if total == 0 || failures < total {
+		return period
+	}
+	delay := previous * 2
+	if delay > maxBackoff {
+		delay = maxBackoff
+	}
+	if delay < period {
+		delay = period
+	}
+	return delay
+}
+
+// listRepos runs the "list-repos" subcommand, which prints the path and callsign of each repo
+// that would be mirrored with the current flags and config.
+func listRepos(config mirror.Config) {
+	repos, err := findRepos(*searchDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, repo := range repos {
+		if !config.IsAllowed(repo) {
+			continue
+		}
+		callsign := config.Callsign(repo)
+		if callsign == "" {
+			callsign = "unknown"
+		}
+		fmt.Printf("%s\t%s\n", repo.GetPath(), callsign)
+	}
+}
+
+// rebuild runs the "rebuild" subcommand, which takes a repo path and the revision of a
+// review, and recreates the Phabricator diffs for that review.
+func rebuild(config mirror.Config, args []string) {
+	if len(args) != 2 {
+		log.Fatal("Usage: git-phabricator-mirror [flags] rebuild <repo path> <review revision>")
+	}
+	repo, err := repository.NewGitRepo(args[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := mirror.Rebuild(repo, config, args[1]); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// previewDiff runs the "preview-diff" subcommand, which takes a repo path and the revision of a
+// review, and writes the raw diff that would be uploaded for that review to the given file, or
+// to stdout if no file is given.
+func previewDiff(config mirror.Config, args []string) {
+	if len(args) != 2 && len(args) != 3 {
+		log.Fatal("Usage: git-phabricator-mirror [flags] preview-diff <repo path> <review revision> [<output file>]")
+	}
+	repo, err := repository.NewGitRepo(args[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+	diff, err := mirror.PreviewDiff(repo, config, args[1])
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(args) == 2 {
+		fmt.Print(diff)
+		return
+	}
+	if err := ioutil.WriteFile(args[2], []byte(diff), 0644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// check runs the "check" subcommand, which takes a repo path and prints the ways in which the
+// reviews of that repo differ between git-notes and Phabricator, without fixing any of them.
+//
+// It returns the status with which to exit: 1 if there are any divergences, and 0 otherwise.
+func check(config mirror.Config, args []string) int {
+	if len(args) != 1 {
+		log.Fatal("Usage: git-phabricator-mirror [flags] check <repo path>")
+	}
+	repo, err := repository.NewGitRepo(args[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+	divergences, err := mirror.Check(repo, config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, divergence := range divergences {
+		fmt.Println(divergence)
+	}
+	if len(divergences) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// setFlagsFromEnvironment sets each flag that has a corresponding environment variable
+// (e.g. GPM_SYNC_PERIOD for -sync_period) to the value of that variable.
+//
+// This runs before the command line is parsed, so flags given on the command line still win.
+func setFlagsFromEnvironment() {
+	flag.VisitAll(func(f *flag.Flag) {
+		name := mirror.FlagEnvironmentVariable(f.Name)
+		if value, ok := os.LookupEnv(name); ok {
+			if err := f.Value.Set(value); err != nil {
+				log.Fatalf("Invalid value %q for %s: %v", value, name, err)
+			}
+		}
+	})
+}
+
+// mirrorRepos mirrors the given repos, running at most the given number of them at a time, and
+// returns how many of them failed.
+func mirrorRepos(ctx context.Context, repos []repository.Repo, config mirror.Config, concurrency int) int {
+	var mutex sync.Mutex
+	failures := 0
+	parallel.Run(len(repos), concurrency, func(i int) {
+		if err := mirror.RepoContext(ctx, repos[i], config, *syncToRemote); err != nil {
+			log.Print(err)
+			mutex.Lock()
+			failures++
+			mutex.Unlock()
+		}
+	})
+	return failures
+}
+
+// allowedRepos returns the given repos that are allowed by the callsign allowlist in the config.
+//
+// The others are left out of the sync passes entirely, so that they do not count as successes
+// when deciding whether to back off. Each of them is logged the first time it is skipped, with
+// its path recorded in the given map.
+func allowedRepos(repos []repository.Repo, config mirror.Config, skipped map[string]bool) []repository.Repo {
+	var allowed []repository.Repo
+	for _, repo := range repos {
+		if config.IsAllowed(repo) {
+			delete(skipped, repo.GetPath())
+			allowed = append(allowed, repo)
+		} else if !skipped[repo.GetPath()] {
+			skipped[repo.GetPath()] = true
+			log.Printf("Skipping repo %v, as its callsign is not in the allowlist", repo)
+		}
+	}
+	return allowed
+}
+
+// firstPassDone is closed once the first sync pass over the repos has completed.
+var firstPassDone = make(chan struct{})
+
+// statusHandler serves "/healthz", which succeeds once the first sync pass has completed,
+// "/status", which lists the path, processed state, last sync time, and number of open reviews
+// of each repo as JSON, and "/metrics", which exports the Prometheus metrics of the mirror.
+func statusHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-firstPassDone:
+			fmt.Fprintln(w, "ok")
+		default:
+			http.Error(w, "The first sync pass has not completed yet", http.StatusServiceUnavailable)
+		}
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(mirror.Statuses()); err != nil {
+			log.Print(err)
+		}
+	})
+	mux.Handle("/metrics", promhttp.Handler())
+	return mux
+}
+
+// shutdownContext returns a context that is cancelled once the process is asked to stop by
+// SIGINT or SIGTERM. That cancels the database queries and git commands in progress, and stops
+// the mirror from starting on any more reviews or repos once its Conduit requests finish.
+func shutdownContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		s := <-signals
+		log.Printf("Received %v; cancelling the requests in progress and stopping", s)
+		cancel()
+		// A second signal stops the process immediately.
+		signal.Stop(signals)
+	}()
+	return ctx
+}
+
 func main() {
+	setFlagsFromEnvironment()
 	flag.Parse()
+	mirror.LimitGitProcesses(*maxGitProcesses)
+	arcanist.SetUserCacheTTL(time.Duration(*userCacheTTL) * time.Second)
+	if *verbose {
+		arcanist.LogVerbosely()
+	}
+	if *logConduit {
+		arcanist.LogConduitPayloads(*redactEmails)
+	}
+	// The git subprocesses that write notes inherit our environment, so this sets the committer
+	// identity for their commits without changing the author.
+	if *noteCommitterName != "" {
+		os.Setenv("GIT_COMMITTER_NAME", *noteCommitterName)
+	}
+	if *noteCommitterEmail != "" {
+		os.Setenv("GIT_COMMITTER_EMAIL", *noteCommitterEmail)
+	}
+	var config mirror.Config
+	if *configFile != "" {
+		var err error
+		config, err = mirror.ReadConfig(*configFile)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+	}
+	mirror.ApplyEnvironment(&config, os.LookupEnv)
+	if err := arcanist.UseConnection(config.Arcanist); err != nil {
+		log.Fatal(err)
+	}
+	defer arcanist.CloseConnection()
+	switch flag.Arg(0) {
+	case "rebuild":
+		rebuild(config, flag.Args()[1:])
+		return
+	case "list-repos":
+		listRepos(config)
+		return
+	case "preview-diff":
+		previewDiff(config, flag.Args()[1:])
+		return
+	case "check":
+		if status := check(config, flag.Args()[1:]); status != 0 {
+			// Exiting skips the deferred calls, so this closes the connection itself.
+			arcanist.CloseConnection()
+			os.Exit(status)
+		}
+		return
+	}
 	// We want to always start processing new repos that are added after the binary has started,
 	// so we need to run the findRepos method in an infinite loop.
 
-	ticker := time.Tick(time.Duration(*syncPeriod) * time.Second)
-	for {
+	defaultPeriod := time.Duration(*syncPeriod) * time.Second
+	period := config.ShortestSyncPeriod(defaultPeriod)
+	maxBackoff := time.Duration(*maxSyncBackoff) * time.Second
+	delay := period
+	lastSyncs := make(map[string]time.Time)
+	skippedRepos := make(map[string]bool)
+	if *stateFile != "" {
 		repos, err := findRepos(*searchDir)
 		if err != nil {
 			log.Fatal(err.Error())
 		}
-		for _, repo := range repos {
-			mirror.Repo(repo, *syncToRemote)
+		if err := mirror.LoadProcessedStates(*stateFile, repos); err != nil {
+			log.Printf("Failed to load the saved repo states from %s: %v", *stateFile, err)
 		}
-		if *syncToRemote {
-			<-ticker
+	}
+	if *statusAddr != "" {
+		go func() {
+			log.Fatal(http.ListenAndServe(*statusAddr, statusHandler()))
+		}()
+	}
+	ctx := shutdownContext()
+	failures := 0
+	firstPass := true
+	for ctx.Err() == nil {
+		passStart := time.Now()
+		repos, err := findRepos(*searchDir)
+		if err != nil {
+			log.Fatal(err.Error())
 		}
+		var due []repository.Repo
+		for _, repo := range allowedRepos(repos, config, skippedRepos) {
+			repoPeriod := config.SyncPeriod(repo.GetPath(), defaultPeriod)
+			if lastSync, ok := lastSyncs[repo.GetPath()]; ok && passStart.Sub(lastSync) < repoPeriod {
+				continue
+			}
+			lastSyncs[repo.GetPath()] = passStart
+			due = append(due, repo)
+		}
+		attempts := len(due)
+		failures = mirrorRepos(ctx, due, config, *maxConcurrency)
+		if *stateFile != "" {
+			if err := mirror.SaveProcessedStates(*stateFile); err != nil {
+				log.Printf("Failed to save the repo states to %s: %v", *stateFile, err)
+			}
+		}
+		if firstPass {
+			close(firstPassDone)
+			firstPass = false
+		}
+		if *once {
+			break
+		}
+		delay = nextSyncDelay(delay, period, maxBackoff, failures, attempts)
+		if delay > period {
+			log.Printf("Every repo failed to sync; waiting %v before the next pass", delay)
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(delay - time.Since(passStart)):
+		}
+	}
+	log.Print("Stopped mirroring")
+	if *once && failures > 0 {
+		log.Printf("Failed to sync %d repos", failures)
+		// Exiting skips the deferred calls, so this closes the connection itself.
+		arcanist.CloseConnection()
+		os.Exit(1)
 	}
 }
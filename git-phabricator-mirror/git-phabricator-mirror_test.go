@@ -0,0 +1,52 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNextSyncDelay(t *testing.T) {
+	const (
+		period     = 30 * time.Second
+		maxBackoff = 5 * time.Minute
+	)
+	testCases := []struct {
+		name     string
+		previous time.Duration
+		failures int
+		total    int
+		expected time.Duration
+	}{
+		{"No repos", 4 * time.Minute, 0, 0, period},
+		{"All succeeded", period, 0, 3, period},
+		{"Partial failure", period, 2, 3, period},
+		{"Reset after a partial failure", 4 * time.Minute, 2, 3, period},
+		{"Reset after a success", 4 * time.Minute, 0, 3, period},
+		{"All failed", period, 3, 3, 2 * period},
+		{"All failed again", 2 * period, 3, 3, 4 * period},
+		{"All failed up to the limit", 4 * time.Minute, 3, 3, maxBackoff},
+		{"All failed at the limit", maxBackoff, 3, 3, maxBackoff},
+		{"All failed without a previous delay", 0, 1, 1, period},
+	}
+	for _, testCase := range testCases {
+		if delay := nextSyncDelay(testCase.previous, period, maxBackoff, testCase.failures, testCase.total); delay != testCase.expected {
+			t.Errorf("%s: unexpected delay %v, expected %v", testCase.name, delay, testCase.expected)
+		}
+	}
+}
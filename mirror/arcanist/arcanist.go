@@ -19,7 +19,9 @@ package arcanist
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/google/git-appraise/repository"
 	"github.com/google/git-appraise/review"
@@ -27,12 +29,14 @@ import (
 	"github.com/google/git-appraise/review/ci"
 	"github.com/google/git-appraise/review/comment"
 	"github.com/google/git-appraise/review/request"
+	"github.com/google/git-phabricator-mirror/mirror/metrics"
+	"github.com/google/git-phabricator-mirror/mirror/parallel"
 	review_utils "github.com/google/git-phabricator-mirror/mirror/review"
 	"log"
-	"os/exec"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -40,22 +44,33 @@ import (
 // hashes for commit objects from hashes for other types of objects (such as trees or file blobs).
 const commitHashType = "gtcm"
 
-// Differential (Phabricator's code review tool) limits review titles to 40 characters.
-const differentialTitleLengthLimit = 256
+// treeHashType is the string that Phabricator uses to distinguish the hashes of tree objects.
+const treeHashType = "gttr"
+
+// defaultTitleLengthLimit is the default maximum length of the titles of Differential
+// (Phabricator's code review tool) revisions.
+const defaultTitleLengthLimit = 256
+
+// minTitleLengthLimit is the smallest title length limit we allow, as a truncated title ends
+// with "...", and the limit includes a character beyond that.
+const minTitleLengthLimit = 4
 
 // Differential stores review status as a string, so we have to maintain a mapping of
 // the status strings that we care about.
 const (
-	differentialNeedsReviewStatus = "0"
-	differentialClosedStatus      = "3"
-	differentialAbandonedStatus   = "4"
+	differentialNeedsReviewStatus    = "0"
+	differentialNeedsRevisionStatus  = "1"
+	differentialAcceptedStatus       = "2"
+	differentialClosedStatus         = "3"
+	differentialAbandonedStatus      = "4"
+	differentialChangesPlannedStatus = "5"
 )
 
 // defaultRepoDirPrefix is the default parent directory Phabricator uses to store repos.
 const defaultRepoDirPrefix = "/var/repo/"
 
-// arcanistRequestTimeout is the amount of time we allow arcanist requests to wait before interrupting them.
-const arcanistRequestTimeout = 1 * time.Minute
+// defaultRequestTimeout is the default amount of time we allow arcanist requests to wait before interrupting them.
+const defaultRequestTimeout = 1 * time.Minute
 
 // unitDiffPropertyName is the name of the property that Phabricator uses for storing the unit test
 // results for a given Differential diff
@@ -64,45 +79,660 @@ const (
 	lintDiffPropertyName = "arc:lint"
 )
 
+// Config holds the settings that control how we mirror reviews into Phabricator.
+type Config struct {
+	// MarkProvenance specifies whether or not to append the review.ProvenanceTrailer
+	// to the comments that we post into Phabricator.
+	MarkProvenance bool `json:"markProvenance,omitempty"`
+
+	// MirrorOwnsDescription specifies whether or not changes to a review's description
+	// in git-notes should overwrite the revision's title and summary in Phabricator, even
+	// if those were edited directly in Phabricator.
+	MirrorOwnsDescription bool `json:"mirrorOwnsDescription,omitempty"`
+
+	// UnitResultName is the name used to label unit test results in Phabricator when
+	// the CI report does not specify an agent.
+	UnitResultName string `json:"unitResultName,omitempty"`
+
+	// CIBackend is either "diff-property" (the default), in which case CI results are reported by
+	// setting the "arc:unit" property of each diff, or "harbormaster", in which case they are
+	// sent to Harbormaster as build messages for each diff.
+	CIBackend string `json:"ciBackend,omitempty"`
+
+	// LintResultName is the name used to label static analysis results in Phabricator.
+	LintResultName string `json:"lintResultName,omitempty"`
+
+	// PostCIReportLinks specifies whether or not to post a comment linking to each new
+	// CI build, regardless of whether or not its status could be reported as a unit result.
+	PostCIReportLinks bool `json:"postCIReportLinks,omitempty"`
+
+	// CommentTransactionTypes lists the types of Differential transactions (e.g. "core:comment"
+	// or "differential:inline") that are mirrored into git-notes as comments. Transactions that
+	// accept or reject the review are always mirrored, as they determine whether or not it is
+	// resolved. If empty, every type of transaction is mirrored.
+	CommentTransactionTypes []string `json:"commentTransactionTypes,omitempty"`
+
+	// CommentAuthors, if non-empty, restricts the transactions mirrored into git-notes to those
+	// by the listed users, and IgnoredCommentAuthors excludes the transactions by the listed users
+	// (e.g. bots such as Herald). Users are matched by username, email, or PHID.
+	CommentAuthors        []string `json:"commentAuthors,omitempty"`
+	IgnoredCommentAuthors []string `json:"ignoredCommentAuthors,omitempty"`
+
+	// ParseCommitMessage specifies whether or not to have Phabricator parse a review's
+	// description as a commit message when creating its revision, so that custom fields
+	// (e.g. "Test Plan:" or "Tasks:") are set rather than left in the summary.
+	ParseCommitMessage bool `json:"parseCommitMessage,omitempty"`
+
+	// CommitMessageFields maps the field headers (e.g. "Test Plan") that are parsed out of a
+	// review's description to the names of the Differential fields that they set. A header
+	// mapped to the empty string is removed from the description without setting any field.
+	// If nil, then no fields are parsed out, and the whole description is kept in the summary.
+	CommitMessageFields map[string]string `json:"commitMessageFields,omitempty"`
+
+	// StrippedTrailers lists the git trailers (e.g. "Signed-off-by" or "Change-Id") that are
+	// removed from the end of a review's description before it is used for the revision's
+	// summary. The "Differential Revision" trailer is always kept.
+	StrippedTrailers []string `json:"strippedTrailers,omitempty"`
+
+	// MergedAction is what we do to the revisions of a review once its change has been merged.
+	// It is one of "close" (the default), "close-with-comment" (which also posts a comment naming
+	// the commit that landed the change), or "tag" (which adds MergedProject instead of closing).
+	MergedAction string `json:"mergedAction,omitempty"`
+
+	// MergedProject is the name of the project (e.g. "#landed") that is added to merged revisions
+	// when MergedAction is "tag".
+	MergedProject string `json:"mergedProject,omitempty"`
+
+	// ActAsCommentAuthors specifies whether or not to post inline comments as their authors,
+	// rather than quoting them in comments from the mirror's own account. This requires a
+	// Phabricator instance that allows the mirror's account to act as other users. Comments
+	// whose authors do not have Phabricator accounts are still quoted.
+	ActAsCommentAuthors bool `json:"actAsCommentAuthors,omitempty"`
+
+	// AbandonDeletedReviews specifies whether or not to abandon the revisions of reviews whose
+	// review refs have been deleted without the change being merged.
+	AbandonDeletedReviews bool `json:"abandonDeletedReviews,omitempty"`
+
+	// AbandonComment is the message posted to a revision when it is abandoned, so that its
+	// reviewers know why. If empty, then revisions are abandoned without a comment.
+	AbandonComment string `json:"abandonComment,omitempty"`
+
+	// DefaultCCs lists the Phabricator users (by username or email) to CC on every revision.
+	DefaultCCs []string `json:"defaultCCs,omitempty"`
+
+	// DefaultTestPlan is the test plan of revisions created for reviews whose descriptions do
+	// not have one, for installs that require every revision to have a test plan. If empty, then
+	// such revisions are created without a test plan.
+	DefaultTestPlan string `json:"defaultTestPlan,omitempty"`
+
+	// Accounts maps from git email addresses to the Phabricator usernames of their owners,
+	// for users whose git email does not match their Phabricator account.
+	Accounts map[string]string `json:"accounts,omitempty"`
+
+	// DiffMode is either "squashed" (the default), in which case each update to a review is
+	// uploaded as a single diff from the merge base to the review's head, or "per-commit", in
+	// which case a diff is uploaded for each new commit in the review. Each of those diffs spans
+	// from the merge base to its commit, so Differential's history view shows the change made
+	// by each commit.
+	DiffMode string `json:"diffMode,omitempty"`
+
+	// BaseImportTimeout is the maximum number of seconds to wait for Phabricator to import the base
+	// commit of a diff before uploading it. If the base commit has not been imported by then, the
+	// diff is uploaded without a base revision, so that it does not depend on the missing commit.
+	// If this is zero (the default), the base revision is always set, without checking for it.
+	BaseImportTimeout int `json:"baseImportTimeout,omitempty"`
+
+	// CommentLoadConcurrency is the maximum number of comments of a single review that are read
+	// from Phabricator at the same time. Values less than 2 mean that comments are read one at a time.
+	CommentLoadConcurrency int `json:"commentLoadConcurrency,omitempty"`
+
+	// CommentPostConcurrency is the maximum number of inline comments that are posted into a single
+	// review at the same time. Values less than 2 mean that inline comments are posted one at a time.
+	CommentPostConcurrency int `json:"commentPostConcurrency,omitempty"`
+
+	// MirrorRejections specifies that review-wide comments in git-notes which reject a review are
+	// mirrored into Phabricator as "request changes" actions, rather than being left out.
+	MirrorRejections bool `json:"mirrorRejections,omitempty"`
+
+	// ClosedStatuses lists the revision statuses that mean a revision is closed or abandoned. Each
+	// entry is matched against both the status code and the status name reported by Phabricator,
+	// as the codes differ between Phabricator versions. Defaults to the codes "3" and "4".
+	ClosedStatuses []string `json:"closedStatuses,omitempty"`
+
+	// OrphanedComments is what we do with inline comments on lines that do not exist in the diff
+	// to which we would attach them: "nearest-line" (the default) moves them to the closest line
+	// that does exist, "file" moves them to the start of the file, and "top-level" posts them as
+	// review-wide comments that quote their original location. Comments on files that do not
+	// exist in the diff are always posted as review-wide comments.
+	OrphanedComments string `json:"orphanedComments,omitempty"`
+
+	// MaxChangedFiles is the maximum number of files that a review may change for us to upload
+	// its diffs. Larger reviews get a comment explaining why their diffs are missing instead.
+	// Zero means there is no limit.
+	MaxChangedFiles int `json:"maxChangedFiles,omitempty"`
+
+	// DiffNotesRef, if set, is the notes ref in which we record the Differential diff that we
+	// uploaded for each commit, so that other tools can tell which patchset a commit corresponds to.
+	DiffNotesRef string `json:"diffNotesRef,omitempty"`
+
+	// UseEditAPI specifies that revisions are created and modified using the
+	// differential.revision.edit API of newer Phabricator versions, rather than the older,
+	// per-action APIs (e.g. differential.createrevision), which are kept for older installs.
+	UseEditAPI bool `json:"useEditAPI,omitempty"`
+
+	// DuplicateRevisions is which of the open revisions to update when more than one of them is
+	// for the same review (e.g. because someone also ran "arc diff" on it): "all" (the default),
+	// "mirror-owned" for those created by the mirror's own account, or "newest".
+	DuplicateRevisions string `json:"duplicateRevisions,omitempty"`
+
+	// VerifyComments specifies whether or not to re-read a revision's comments after mirroring
+	// comments into it, in order to repost (once) any comments that Phabricator accepted but did
+	// not attach, e.g. because they referenced a stale diff.
+	VerifyComments bool `json:"verifyComments,omitempty"`
+
+	// DiffContextLines is the number of lines of context around each change in the uploaded diffs.
+	// If it is not set, then the diffs include the whole of each changed file, as Differential can
+	// only show (and expand) the context that is in the diff, at the cost of much larger diffs.
+	DiffContextLines int `json:"diffContextLines,omitempty"`
+
+	// MaxWholeFileDiffSize is the size in bytes above which a diff with whole-file context is
+	// regenerated with only a few lines of context, so that changes to large files stay manageable.
+	MaxWholeFileDiffSize int `json:"maxWholeFileDiffSize,omitempty"`
+
+	// SubscriberRulesFile is the path of a file that maps path patterns to the Phabricator users
+	// to CC on new revisions that change a matching path. Each line holds a pattern followed by
+	// the users, e.g. "docs/ tech-writers". Unlike reviewers, these users are only notified.
+	SubscriberRulesFile string `json:"subscriberRulesFile,omitempty"`
+
+	// ExcludedPaths lists the patterns of paths (e.g. generated or vendored files) to leave out
+	// of the diffs uploaded to Phabricator. They only affect what is shown, not how the base of
+	// each diff is chosen. A pattern ending in "/" matches everything under that directory.
+	ExcludedPaths []string `json:"excludedPaths,omitempty"`
+
+	// RecreateMissingDiffs specifies whether or not to upload the diffs for commits that have
+	// inline comments but no diff in the revision (e.g. because the review was picked up part
+	// way through), so that those comments are anchored to the commit they were made on,
+	// rather than moved to the latest diff.
+	RecreateMissingDiffs bool `json:"recreateMissingDiffs,omitempty"`
+
+	// MaxTransactions is the maximum number of a revision's transactions (comments, inline
+	// comments, and actions) that are read from Phabricator. Only the latest ones are read, so
+	// that a huge revision cannot exhaust the mirror's memory. As we cannot tell whether older
+	// git-appraise comments are already in such a revision, only the comment threads (and
+	// build results) created since its oldest transaction that was read are mirrored into it.
+	MaxTransactions int `json:"maxTransactions,omitempty"`
+
+	// TransactionPageSize is the maximum number of transactions read by a single query of the
+	// Phabricator database. Defaults to 1000.
+	TransactionPageSize int `json:"transactionPageSize,omitempty"`
+
+	// CommentLoadChunkSize is the maximum number of transaction comments that are held in memory
+	// at once while loading the comments of a revision. Defaults to 500.
+	CommentLoadChunkSize int `json:"commentLoadChunkSize,omitempty"`
+
+	// ConduitURI and ConduitToken are the Conduit API endpoint and credentials that "arc" uses.
+	// If they are not set, then "arc" falls back to its own configuration (e.g. ~/.arcrc).
+	ConduitURI   string `json:"conduitURI,omitempty"`
+	ConduitToken string `json:"conduitToken,omitempty"`
+
+	// MySQLHost, MySQLPort, MySQLUser, and MySQLPassword are used to connect to Phabricator's
+	// database. The host and port default to "127.0.0.1" and 3306. If MySQLSocket is set, then
+	// we connect through that Unix socket instead of the host and port.
+	MySQLHost     string `json:"mysqlHost,omitempty"`
+	MySQLPort     int    `json:"mysqlPort,omitempty"`
+	MySQLSocket   string `json:"mysqlSocket,omitempty"`
+	MySQLUser     string `json:"mysqlUser,omitempty"`
+	MySQLPassword string `json:"mysqlPassword,omitempty"`
+	// MySQLDefaultsFile is a MySQL option file (as read by the mysql client's --defaults-file flag)
+	// from whose [client] section the MySQL settings that are not set above are read. Defaults to
+	// ~/.my.cnf, which is where the mysql client reads them from, if that exists.
+	MySQLDefaultsFile string `json:"mysqlDefaultsFile,omitempty"`
+
+	// CloseEmptyReviews, if set, treats every review whose first commit is already in its target
+	// ref as merged. By default, that is only done once the review has a revision with diffs, as
+	// otherwise it may be a review ref that was just created at the head of its target, with
+	// nothing to review yet, rather than a change that was merged.
+	CloseEmptyReviews bool `json:"closeEmptyReviews,omitempty"`
+
+	// TransactionSource is where the transactions of revisions are read from: either directly
+	// from Phabricator's database (TransactionSourceDatabase, the default), or through the
+	// transaction.search API of newer Phabricator versions (TransactionSourceConduit).
+	TransactionSource string `json:"transactionSource,omitempty"`
+
+	// RequestTimeout is the number of seconds to allow each Conduit request before interrupting
+	// it. Defaults to one minute.
+	RequestTimeout int `json:"requestTimeout,omitempty"`
+
+	// RepoDirPrefix is the parent directory under which Phabricator stores repos, and from which
+	// the callsigns of repos are guessed. Defaults to "/var/repo/".
+	RepoDirPrefix string `json:"repoDirPrefix,omitempty"`
+
+	// TitleLengthLimit is the maximum length of the titles of revisions. Longer titles are
+	// truncated. Defaults to 256.
+	TitleLengthLimit int `json:"titleLengthLimit,omitempty"`
+
+	// RemoteCallsigns maps the URLs of the "origin" remotes of repos to their callsigns, for repos
+	// whose callsigns are not set by their paths.
+	RemoteCallsigns map[string]string `json:"remoteCallsigns,omitempty"`
+
+	// ListRevisionsWithoutRepository specifies whether or not to also list the open revisions
+	// that are not in any Diffusion repository (e.g. those created before we set the repository
+	// of revisions) when listing the open revisions of a repo. That searches every open revision
+	// on the instance, so it is off by default.
+	ListRevisionsWithoutRepository bool `json:"listRevisionsWithoutRepository,omitempty"`
+
+	// ctx cancels the database queries made with the config. It is set with WithContext.
+	ctx context.Context
+}
+
+// WithContext returns a copy of the config whose database queries, and waits for imports, are
+// cancelled once the given context is done.
+//
+// Conduit requests are not cancelled, as a failed request is fatal, and killing one would leave
+// the operation it is part of (e.g. creating a diff and then attaching it) half done. Instead,
+// the mirror stops between reviews. Each request still times out on its own.
+func (config Config) WithContext(ctx context.Context) Config {
+	config.ctx = ctx
+	return config
+}
+
+// context returns the context for the database queries made with the config.
+func (config Config) context() context.Context {
+	if config.ctx == nil {
+		return context.Background()
+	}
+	return config.ctx
+}
+
+// transactionPageSize returns the maximum number of transactions to read with each database query.
+func (config Config) transactionPageSize() int {
+	if config.TransactionPageSize <= 0 {
+		return defaultTransactionPageSize
+	}
+	return config.TransactionPageSize
+}
+
+// commentLoadChunkSize returns the maximum number of transaction comments to hold in memory at once.
+func (config Config) commentLoadChunkSize() int {
+	if config.CommentLoadChunkSize <= 0 {
+		return defaultCommentLoadChunkSize
+	}
+	return config.CommentLoadChunkSize
+}
+
+// requestTimeout returns the amount of time we allow each Conduit request to run.
+func (config Config) requestTimeout() time.Duration {
+	if config.RequestTimeout <= 0 {
+		return defaultRequestTimeout
+	}
+	return time.Duration(config.RequestTimeout) * time.Second
+}
+
+// repoDirPrefix returns the parent directory under which Phabricator stores repos.
+func (config Config) repoDirPrefix() string {
+	if config.RepoDirPrefix == "" {
+		return defaultRepoDirPrefix
+	}
+	if !strings.HasSuffix(config.RepoDirPrefix, "/") {
+		return config.RepoDirPrefix + "/"
+	}
+	return config.RepoDirPrefix
+}
+
+// titleLengthLimit returns the maximum length of the titles of revisions.
+func (config Config) titleLengthLimit() int {
+	if config.TitleLengthLimit <= 0 {
+		return defaultTitleLengthLimit
+	}
+	if config.TitleLengthLimit < minTitleLengthLimit {
+		return minTitleLengthLimit
+	}
+	return config.TitleLengthLimit
+}
+
+// The supported values of Config.TransactionSource.
+const (
+	TransactionSourceDatabase = "database"
+	TransactionSourceConduit  = "conduit"
+)
+
+// transactionReaders returns the functions with which to read the transactions of revisions,
+// and the comments of those transactions.
+func (config Config) transactionReaders() (ReadTransactions, ReadTransactionComment) {
+	if config.TransactionSource == TransactionSourceConduit {
+		reader := newConduitTransactionReader(config)
+		return reader.readTransactions, reader.readTransactionComment
+	}
+	return config.readDatabaseTransactions, config.readDatabaseTransactionComment
+}
+
+// The supported values of Config.OrphanedComments.
+const (
+	OrphanedCommentsNearestLine = "nearest-line"
+	OrphanedCommentsFile        = "file"
+	OrphanedCommentsTopLevel    = "top-level"
+)
+
+// The supported values of Config.DuplicateRevisions.
+const (
+	DuplicateRevisionsAll         = "all"
+	DuplicateRevisionsMirrorOwned = "mirror-owned"
+	DuplicateRevisionsNewest      = "newest"
+)
+
+// The supported values of Config.DiffMode.
+const (
+	DiffModeSquashed  = "squashed"
+	DiffModePerCommit = "per-commit"
+)
+
+// The supported values of Config.CIBackend.
+const (
+	CIBackendDiffProperty = "diff-property"
+	CIBackendHarbormaster = "harbormaster"
+)
+
+// account returns the Phabricator username or email with which to look up the given git user.
+func (config Config) account(gitUser string) string {
+	if account, ok := config.Accounts[gitUser]; ok {
+		return account
+	}
+	return gitUser
+}
+
+// The supported values of Config.MergedAction.
+const (
+	MergedActionClose            = "close"
+	MergedActionCloseWithComment = "close-with-comment"
+	MergedActionTag              = "tag"
+)
+
+// Validate reports the settings in the config that are not supported, so that they are caught
+// when the config is loaded, rather than once a review is merged.
+func (config Config) Validate() error {
+	switch config.MergedAction {
+	case "", MergedActionClose, MergedActionCloseWithComment:
+	case MergedActionTag:
+		if config.MergedProject == "" {
+			return fmt.Errorf("The merged action %q requires a merged project", config.MergedAction)
+		}
+	default:
+		return fmt.Errorf("Unsupported merged action %q; expected %q, %q, or %q",
+			config.MergedAction, MergedActionClose, MergedActionCloseWithComment, MergedActionTag)
+	}
+	return nil
+}
+
+// mirrorsTransactionType reports whether or not comments from transactions of the given type should be mirrored.
+func (config Config) mirrorsTransactionType(transactionType string) bool {
+	if len(config.CommentTransactionTypes) == 0 {
+		return true
+	}
+	for _, t := range config.CommentTransactionTypes {
+		if t == transactionType {
+			return true
+		}
+	}
+	return false
+}
+
+// filtersAuthors reports whether or not only some authors' transactions are mirrored into git-notes.
+func (config Config) filtersAuthors() bool {
+	return len(config.CommentAuthors) > 0 || len(config.IgnoredCommentAuthors) > 0
+}
+
+// mirrorsAuthor reports whether or not transactions by the given user should be mirrored into git-notes.
+//
+// The author is nil if the user with the given PHID could not be found.
+func (config Config) mirrorsAuthor(authorPHID string, author *user) bool {
+	matches := func(users []string) bool {
+		for _, u := range users {
+			if u == authorPHID || (author != nil && (u == author.UserName || u == author.Email)) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(config.CommentAuthors) > 0 && !matches(config.CommentAuthors) {
+		return false
+	}
+	return !matches(config.IgnoredCommentAuthors)
+}
+
 // Arcanist represents an instance of the "arcanist" command-line tool.
 type Arcanist struct {
+	Config Config
+
+	// Callsign is the callsign of the repo being mirrored. If empty, then it is found from the
+	// repo's remote URL, or guessed from the repo's path.
+	Callsign string
+
+	// RemoteURL is the URL of the "origin" remote of the repo being mirrored, if it has one.
+	RemoteURL string
+
+	// DefaultTargetRef is the ref into which reviews of the repo being mirrored are merged when
+	// their requests do not specify a target ref. If empty, then such requests are left as is.
+	DefaultTargetRef string
+}
+
+// NewArcanist returns an Arcanist that mirrors reviews into Phabricator as specified by the given config.
+func NewArcanist(config Config) Arcanist {
+	return Arcanist{Config: config}
+}
+
+// withDefaultTargetRef fills in the target ref of the given review's request, if it does not have one.
+//
+// The review's summary is copied rather than modified, as it may be shared with other reviews.
+func (arc Arcanist) withDefaultTargetRef(r *review.Review) {
+	if r.Request.TargetRef != "" || arc.DefaultTargetRef == "" {
+		return
+	}
+	summary := *r.Summary
+	summary.Request.TargetRef = arc.DefaultTargetRef
+	if !strings.HasPrefix(summary.Request.TargetRef, "refs/") {
+		summary.Request.TargetRef = "refs/heads/" + summary.Request.TargetRef
+	}
+	r.Summary = &summary
+}
+
+// RepoCallsign returns the callsign of the given repo, or the empty string if it is unknown.
+//
+// The callsign set for the Arcanist wins, followed by the one mapped to the repo's remote URL in
+// the config, then the one of the Diffusion repository that has that remote as a URI, and
+// finally the one guessed from the repo's path.
+func (arc Arcanist) RepoCallsign(repo repository.Repo) string {
+	if arc.Callsign != "" {
+		return arc.Callsign
+	}
+	if url := arc.RemoteURL; url != "" {
+		if callsign := arc.Config.RemoteCallsigns[url]; callsign != "" {
+			return callsign
+		}
+		if callsign := arc.lookupCallsign(url); callsign != "" {
+			return callsign
+		}
+	}
+	return arc.Config.GuessCallsign(repo.GetPath())
 }
 
+// cachesMutex guards the caches below, which are shared by every repo being mirrored, as repos
+// may be mirrored concurrently.
+var cachesMutex sync.Mutex
+
 // Filter processing of previously closed revisions.
 var closedRevisionsMap = make(map[string]bool)
 
-// runArcCommandOrDie runs the given Conduit API call using the "arc" command line tool.
+// emptyMergedReviews maps the revision of each review that is already in its target, but has no
+// revision with diffs, to its head commit when we last looked for its revisions. That is only
+// looked for again once the head commit changes, i.e. once there may be something to review.
+var emptyMergedReviews = make(map[string]string)
+
+// isUnchangedEmptyReview reports whether or not the given review was found to have no revision
+// with diffs when it had the given head commit, while holding cachesMutex.
+func isUnchangedEmptyReview(revision, head string) bool {
+	cachedHead, ok := lookupCache(emptyMergedReviews, revision)
+	return ok && cachedHead == head
+}
+
+// maxCloseAttempts is how many passes try to close the revisions of a merged review before we
+// give up on them. Closing fails for reasons that retrying rarely fixes, such as the revision not
+// being accepted, or not being owned by the mirror's account.
+const maxCloseAttempts = 3
+
+// closeFailures counts the passes that failed to close the revisions of each merged review.
+var closeFailures = make(map[string]int)
+
+// recordCloseFailure records that closing the revisions of the given merged review failed, and
+// reports whether we have now tried that enough times to give up, while holding cachesMutex.
+func recordCloseFailure(revision string) bool {
+	cachesMutex.Lock()
+	defer cachesMutex.Unlock()
+	closeFailures[revision]++
+	if closeFailures[revision] < maxCloseAttempts {
+		return false
+	}
+	delete(closeFailures, revision)
+	return true
+}
+
+// postedDrafts holds the keys of the inline comments that were posted as drafts, but whose
+// publishing was held back because other inline comments in the same pass failed to post. They are
+// not visible in the revision until they are published, so this stops us from posting them again.
+var postedDrafts = make(map[string]bool)
+
+// draftKey returns the key under which the given inline comment request is held in postedDrafts.
+func draftKey(request createInlineRequest) string {
+	hash, err := request.comment.Hash()
+	if err != nil {
+		hash = request.Content
+	}
+	return fmt.Sprintf("%s %s %s:%d:%d %s", request.RevisionID, request.DiffID, request.FilePath, request.LineNumber, request.IsNewFile, hash)
+}
+
+// isCached reports whether or not the given key is in the given set, while holding cachesMutex.
+func isCached(cache map[string]bool, key string) bool {
+	cachesMutex.Lock()
+	defer cachesMutex.Unlock()
+	return cache[key]
+}
+
+// addToCache adds the given key to the given set, while holding cachesMutex.
+func addToCache(cache map[string]bool, key string) {
+	cachesMutex.Lock()
+	defer cachesMutex.Unlock()
+	cache[key] = true
+}
+
+// lookupCache reads the given key from the given cache, while holding cachesMutex.
+func lookupCache(cache map[string]string, key string) (string, bool) {
+	cachesMutex.Lock()
+	defer cachesMutex.Unlock()
+	value, ok := cache[key]
+	return value, ok
+}
+
+// storeInCache writes the given value for the given key into the given cache, while holding cachesMutex.
+func storeInCache(cache map[string]string, key, value string) {
+	cachesMutex.Lock()
+	defer cachesMutex.Unlock()
+	cache[key] = value
+}
+
+// runArcCommandOrDie runs the given Conduit API call using the "arc" command line tool, with the
+// endpoint and timeout from the config.
 //
 // Any errors that could occur here would be a sign of something being seriously
 // wrong, so they are treated as fatal. This makes it more evident that something
 // has gone wrong when the command is manually run by a user, and gives further
 // operations a clean-slate when this is run by supervisord with automatic restarts.
-func runArcCommandOrDie(method string, request interface{}, response interface{}) {
-	cmd := exec.Command("arc", "call-conduit", method)
+//
+// The request is not cancelled when the config's context is done, so that shutting down the
+// mirror does not make it fail.
+func (config Config) runArcCommandOrDie(method string, request interface{}, response interface{}) {
+	callConduit(config, method, request, response)
+}
+
+// callConduit runs the given Conduit API call for runArcCommandOrDie. Tests replace it to stub out Phabricator.
+var callConduit = Config.execArcCommandOrDie
+
+// execArcCommandOrDie runs the given Conduit API call by executing the "arc" command line tool.
+func (config Config) execArcCommandOrDie(method string, request interface{}, response interface{}) {
 	input, err := json.Marshal(request)
 	if err != nil {
 		log.Fatal(err)
 	}
-	log.Print("Running conduit request: ", method, string(input))
-	cmd.Stdin = strings.NewReader(string(input))
+	log.Print("Running conduit request: ", method)
+	logConduitPayload("request", input)
+	stdout, err := config.execArcCommand(method, input)
+	if err != nil {
+		metrics.ConduitCalls.WithLabelValues(method, metrics.ResultError).Inc()
+		log.Print("Failed conduit request: ", method)
+		logConduitPayload("request", input)
+		logConduitPayload("response", stdout)
+		log.Fatal(err)
+	}
+	logConduitPayload("response", stdout)
+	output, skipped := extractJSON(stdout)
+	if len(skipped) > 0 {
+		log.Printf("Ignoring non-JSON output of the conduit request %s: %q", method, skipped)
+	}
+	if err = json.Unmarshal(output, response); err != nil {
+		metrics.ConduitCalls.WithLabelValues(method, metrics.ResultError).Inc()
+		log.Fatal(err)
+	}
+	metrics.ConduitCalls.WithLabelValues(method, conduitResult(output)).Inc()
+}
 
+// execArcCommand runs the "arc" command for the given Conduit API method with the given input,
+// returning its output. The command is killed if it runs past the request timeout.
+func (config Config) execArcCommand(method string, input []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), config.requestTimeout())
+	defer cancel()
+	cmd := config.arcCommand(ctx, method)
+	cmd.Stdin = bytes.NewReader(input)
 	var stdout bytes.Buffer
 	cmd.Stdout = &stdout
-	if err := cmd.Start(); err != nil {
-		log.Fatal(err)
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			err = fmt.Errorf("%v (%v)", err, ctx.Err())
+		}
+		return stdout.Bytes(), err
 	}
-	go func() {
-		time.Sleep(arcanistRequestTimeout)
-		cmd.Process.Kill()
-	}()
-	if err := cmd.Wait(); err != nil {
-		log.Print("arc", "call-conduit", method, string(input), stdout.String())
-		log.Fatal(err)
+	return stdout.Bytes(), nil
+}
+
+// conduitResult returns the result with which to count a Conduit call that returned the given
+// response: metrics.ResultError if the response holds an error, and metrics.ResultSuccess otherwise.
+func conduitResult(response []byte) string {
+	var result struct {
+		Error *string `json:"error"`
 	}
-	log.Print("Received conduit response ", stdout.String())
-	if err = json.Unmarshal(stdout.Bytes(), response); err != nil {
-		log.Fatal(err)
+	if json.Unmarshal(response, &result) == nil && result.Error != nil && *result.Error != "" {
+		return metrics.ResultError
+	}
+	return metrics.ResultSuccess
+}
+
+// extractJSON splits the output of "arc call-conduit" into the JSON response, and any text that
+// precedes it.
+//
+// Some versions of arc print warnings to stdout before the response, so we skip every line
+// before the first one that starts a JSON object or array.
+func extractJSON(output []byte) (response, skipped []byte) {
+	remaining := output
+	for len(remaining) > 0 {
+		trimmed := bytes.TrimLeft(remaining, " \t\r")
+		if len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') {
+			return remaining, output[:len(output)-len(remaining)]
+		}
+		newline := bytes.IndexByte(remaining, '\n')
+		if newline < 0 {
+			break
+		}
+		remaining = remaining[newline+1:]
 	}
+	// There is no line that looks like JSON, so leave it to the caller to report the malformed output.
+	return output, nil
 }
 
 func abbreviateRefName(ref string) string {
@@ -116,27 +746,109 @@ type DifferentialReview struct {
 	ID         string     `json:"id,omitempty"`
 	PHID       string     `json:"phid,omitempty"`
 	Title      string     `json:"title,omitempty"`
+	Summary    string     `json:"summary,omitempty"`
 	Branch     string     `json:"branch,omitempty"`
 	Status     string     `json:"status,omitempty"`
 	StatusName string     `json:"statusName,omitempty"`
 	AuthorPHID string     `json:"authorPHID,omitempty"`
 	Reviewers  []string   `json:"reviewers,omitempty"`
+	CCs        []string   `json:"ccs,omitempty"`
 	Hashes     [][]string `json:"hashes,omitempty"`
 	Diffs      []string   `json:"diffs,omitempty"`
+
+	// config holds the settings of the Arcanist instance that loaded the review.
+	config Config
+
+	// repo is the repo into which the review's comments are mirrored, if any.
+	repo repository.Repo
+
+	// mirrored holds the PHIDs of transactions and comments that the mirror created, and which
+	// thus must not be mirrored back into git-notes.
+	mirrored map[string]bool
 }
 
-// GetFirstCommit returns the first commit that is included in the review
-func (r DifferentialReview) GetFirstCommit(repo repository.Repo) string {
+// findFirstParentCommit walks the first-parent history of the given head commit, and returns
+// the oldest of the review commits found along the way.
+//
+// The walk stops once it reaches commits older than the given timestamp, as those cannot be
+// part of the review.
+func findFirstParentCommit(repo repository.Repo, head string, reviewCommits map[string]bool, oldestTimestamp int) string {
+	firstCommit := ""
+	for commit := head; commit != ""; {
+		if reviewCommits[commit] {
+			firstCommit = commit
+		}
+		details, err := repo.GetCommitDetails(commit)
+		if err != nil || len(details.Parents) == 0 {
+			break
+		}
+		timestamp, err := strconv.Atoi(details.Time)
+		if err != nil || timestamp < oldestTimestamp {
+			break
+		}
+		commit = details.Parents[0]
+	}
+	return firstCommit
+}
+
+// commitHashes returns the hashes of the commits included in the review.
+//
+// We only care about the hashes for commits, which have exactly two elements, the
+// first of which is "gtcm". Other entries are skipped, and those that are not tree
+// hashes are logged when verbose logging is on, so that it is possible to diagnose why a
+// commit was not matched.
+func (r DifferentialReview) commitHashes() []string {
 	var commits []string
 	for _, hashPair := range r.Hashes {
-		// We only care about the hashes for commits, which have exactly two
-		// elements, the first of which is "gtcm".
-		if len(hashPair) == 2 && hashPair[0] == commitHashType {
+		if len(hashPair) != 2 {
+			logVerbose("Skipping malformed hash entry %q for the revision %s", hashPair, r.ID)
+		} else if hashPair[0] == commitHashType {
 			commits = append(commits, hashPair[1])
+		} else if hashPair[0] != treeHashType {
+			logVerbose("Skipping hash entry of unexpected type %q for the revision %s", hashPair, r.ID)
+		}
+	}
+	return commits
+}
+
+// GetFirstCommit returns the first commit that is included in the review
+//
+// If the review includes a merge, then the oldest of its commits may come from the
+// merged-in branch rather than from the review itself. To avoid picking such a commit,
+// we only consider the commits in the first-parent history of the newest one.
+//
+// If there is no such commit, then the empty string is returned. This is called for every review
+// on every pass, so the reason is only logged the first time that the commits of a review are
+// missing from the local repo, and not at all for reviews without any commits.
+func (r DifferentialReview) GetFirstCommit(repo repository.Repo) string {
+	commit, err := r.findFirstCommit(repo)
+	if err != nil && err != errNoCommits {
+		key := r.ID + " " + strings.Join(r.commitHashes(), " ")
+		if !isCached(missingCommitsLogged, key) {
+			addToCache(missingCommitsLogged, key)
+			log.Print(err)
 		}
 	}
+	return commit
+}
+
+// errNoCommits is returned by findFirstCommit for a review that does not include any commits.
+var errNoCommits = errors.New("The revision does not include any commits")
+
+// missingCommitsLogged holds the revision IDs and commits of the reviews for which we logged that
+// the commits are missing from the local repo.
+var missingCommitsLogged = make(map[string]bool)
+
+// findFirstCommit returns the first commit that is included in the review, or an error that
+// distinguishes a review without any commits from one whose commits are missing locally.
+func (r DifferentialReview) findFirstCommit(repo repository.Repo) (string, error) {
+	commits := r.commitHashes()
+	if len(commits) == 0 {
+		return "", errNoCommits
+	}
 	var commitTimestamps []int
 	commitsByTimestamp := make(map[int]string)
+	reviewCommits := make(map[string]bool)
 	for _, commit := range commits {
 		if _, err := repo.GetLastParent(commit); err == nil {
 			timeString, err1 := repo.GetCommitTime(commit)
@@ -145,21 +857,29 @@ func (r DifferentialReview) GetFirstCommit(repo repository.Repo) string {
 				commitTimestamps = append(commitTimestamps, timestamp)
 				// If there are multiple, equally old commits, then the last one wins.
 				commitsByTimestamp[timestamp] = commit
+				reviewCommits[commit] = true
 			}
 		}
 	}
 	if len(commitTimestamps) == 0 {
-		return ""
+		// This usually means the commits have not been fetched yet (or were garbage collected), so
+		// the review will be found once the repo is updated.
+		return "", fmt.Errorf("None of the %d commits of revision D%s (e.g. %s) could be found in the local repo", len(commits), r.ID, commits[0])
 	}
 	sort.Ints(commitTimestamps)
+	newestCommit := commitsByTimestamp[commitTimestamps[len(commitTimestamps)-1]]
+	if revision := findFirstParentCommit(repo, newestCommit, reviewCommits, commitTimestamps[0]); revision != "" {
+		return revision, nil
+	}
 	revision := commitsByTimestamp[commitTimestamps[0]]
-	return revision
+	return revision, nil
 }
 
 // queryRequest specifies filters for review queries. Specifically, CommitHashes filters
 // reviews to only those that contain the specified hashes, and Status filters reviews to
 // only those that match the given status (e.g. "status-any", "status-open", etc.)
 type queryRequest struct {
+	IDs          []int      `json:"ids,omitempty"`
 	CommitHashes [][]string `json:"commitHashes,omitempty"`
 	Status       string     `json:"status,omitempty"`
 }
@@ -175,21 +895,170 @@ func (arc Arcanist) listDifferentialReviewsOrDie(revision string) []Differential
 		CommitHashes: [][]string{[]string{commitHashType, revision}},
 	}
 	var response queryResponse
-	runArcCommandOrDie("differential.query", request, &response)
-	return response.Response
+	arc.Config.runArcCommandOrDie("differential.query", request, &response)
+	return arc.withConfig(response.Response)
+}
+
+// GetReviewers returns the users who are reviewing the revision.
+//
+// Reviewers that are not users (e.g. projects) are skipped.
+func (r DifferentialReview) GetReviewers() []string {
+	var reviewers []string
+	for _, reviewerPHID := range r.Reviewers {
+		reviewer, err := r.config.lookupUser(reviewerPHID)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if reviewer != nil {
+			reviewers = append(reviewers, reviewer.identity())
+		}
+	}
+	return reviewers
+}
+
+// getDifferentialReviewOrDie reads the revision with the given ID.
+//
+// Unlike searching by commit hash, this finds the revision even if Phabricator has not yet indexed it.
+func (arc Arcanist) getDifferentialReviewOrDie(revisionID int) *DifferentialReview {
+	request := queryRequest{IDs: []int{revisionID}}
+	var response queryResponse
+	arc.Config.runArcCommandOrDie("differential.query", request, &response)
+	if response.Error != "" {
+		log.Fatal(response.ErrorMessage)
+	}
+	for _, differentialReview := range arc.withConfig(response.Response) {
+		if differentialReview.ID == strconv.Itoa(revisionID) {
+			return &differentialReview
+		}
+	}
+	return nil
+}
+
+// withConfig attaches the Arcanist's settings to the given reviews.
+func (arc Arcanist) withConfig(reviews []DifferentialReview) []DifferentialReview {
+	for i := range reviews {
+		reviews[i].config = arc.Config
+	}
+	return reviews
+}
+
+// revisionSearchPageSize is the maximum number of revisions read by a single differential.revision.search call.
+const revisionSearchPageSize = 100
+
+type revisionSearchConstraints struct {
+	RepositoryPHIDs []string `json:"repositoryPHIDs,omitempty"`
+	Statuses        []string `json:"statuses,omitempty"`
+}
+
+type revisionSearchRequest struct {
+	Constraints revisionSearchConstraints `json:"constraints"`
+	After       string                    `json:"after,omitempty"`
+	Limit       int                       `json:"limit"`
+}
+
+type revisionSearchResult struct {
+	ID     int `json:"id"`
+	Fields struct {
+		RepositoryPHID string `json:"repositoryPHID"`
+	} `json:"fields"`
+}
+
+type revisionSearchResponse struct {
+	Error        string `json:"error,omitempty"`
+	ErrorMessage string `json:"errorMessage,omitempty"`
+	Response     struct {
+		Data   []revisionSearchResult `json:"data"`
+		Cursor struct {
+			After *string `json:"after"`
+		} `json:"cursor"`
+	} `json:"response,omitempty"`
+}
+
+// searchOpenRevisions returns the open revisions in the Diffusion repositories with the given
+// PHIDs, or in any repository (or none) if no PHIDs are given.
+//
+// This corresponds to calling the differential.revision.search API, which, unlike differential.query,
+// can filter revisions by their repository.
+func (arc Arcanist) searchOpenRevisions(repositoryPHIDs []string) ([]revisionSearchResult, error) {
+	var revisions []revisionSearchResult
+	request := revisionSearchRequest{
+		Constraints: revisionSearchConstraints{
+			RepositoryPHIDs: repositoryPHIDs,
+			Statuses:        []string{"open()"},
+		},
+		Limit: revisionSearchPageSize,
+	}
+	for {
+		var response revisionSearchResponse
+		arc.Config.runArcCommandOrDie("differential.revision.search", request, &response)
+		if response.Error != "" {
+			return nil, errors.New(response.ErrorMessage)
+		}
+		revisions = append(revisions, response.Response.Data...)
+		after := response.Response.Cursor.After
+		if after == nil || *after == "" {
+			return revisions, nil
+		}
+		request.After = *after
+	}
+}
+
+// listOpenRevisionIDs returns the IDs of the open revisions in the Diffusion repository with the
+// given PHID.
+//
+// If the config's ListRevisionsWithoutRepository is set, then this also returns the IDs of the
+// open revisions that are not in any repository, for the caller to match against the repo by
+// their commits. Finding those means searching every open revision on the instance.
+func (arc Arcanist) listOpenRevisionIDs(repositoryPHID string) ([]int, error) {
+	revisions, err := arc.searchOpenRevisions([]string{repositoryPHID})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list the open revisions of %s: %v", repositoryPHID, err)
+	}
+	var ids []int
+	for _, revision := range revisions {
+		ids = append(ids, revision.ID)
+	}
+	if !arc.Config.ListRevisionsWithoutRepository {
+		return ids, nil
+	}
+	revisions, err = arc.searchOpenRevisions(nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list the open revisions without a repository: %v", err)
+	}
+	for _, revision := range revisions {
+		if revision.Fields.RepositoryPHID == "" {
+			ids = append(ids, revision.ID)
+		}
+	}
+	return ids, nil
 }
 
+// ListOpenReviews returns the open revisions for the given repo, plus, if the config's
+// ListRevisionsWithoutRepository is set, those that are not in any repo, which the caller has to filter.
+//
+// If the repo's Diffusion repository cannot be found, or its revisions cannot be searched (e.g.
+// because Phabricator predates differential.revision.search), then the open revisions for every
+// repo are returned, and the caller has to filter them.
 func (arc Arcanist) ListOpenReviews(repo repository.Repo) []review_utils.PhabricatorReview {
-	// TODO(ojarjur): Filter the query by the repo.
-	// As is, we simply return all open reviews for *any* repo, and then filter in
-	// the calling level.
 	request := queryRequest{
 		Status: "status-open",
 	}
+	if repositoryPHID := arc.repositoryPHID(repo); repositoryPHID != "" {
+		ids, err := arc.listOpenRevisionIDs(repositoryPHID)
+		switch {
+		case err != nil:
+			log.Printf("Listing the open revisions for every repo: %v", err)
+		case len(ids) == 0:
+			return nil
+		default:
+			request.IDs = ids
+		}
+	}
 	var response queryResponse
-	runArcCommandOrDie("differential.query", request, &response)
+	arc.Config.runArcCommandOrDie("differential.query", request, &response)
 	var reviews []review_utils.PhabricatorReview
-	for _, r := range response.Response {
+	for _, r := range arc.withConfig(response.Response) {
+		r.repo = repo
 		reviews = append(reviews, r)
 	}
 	return reviews
@@ -198,13 +1067,94 @@ func (arc Arcanist) ListOpenReviews(repo repository.Repo) []review_utils.Phabric
 type revisionFields struct {
 	Title     string   `json:"title,omitempty"`
 	Summary   string   `json:"summary,omitempty"`
+	TestPlan  string   `json:"testPlan,omitempty"`
 	Reviewers []string `json:"reviewerPHIDs,omitempty"`
 	CCs       []string `json:"ccPHIDs,omitempty"`
 }
 
+// testPlanField is the name of the Differential revision field that holds the test plan.
+const testPlanField = "testPlan"
+
 type createRevisionRequest struct {
-	DiffID int            `json:"diffid"`
-	Fields revisionFields `json:"fields,omitempty"`
+	DiffID int `json:"diffid"`
+	// Fields is either a revisionFields struct, or a map of field values from parseCommitMessage.
+	Fields interface{} `json:"fields,omitempty"`
+}
+
+type parseCommitMessageRequest struct {
+	Corpus  string `json:"corpus"`
+	Partial bool   `json:"partial"`
+}
+
+type parsedCommitMessage struct {
+	Errors []string               `json:"errors,omitempty"`
+	Fields map[string]interface{} `json:"fields,omitempty"`
+}
+
+type parseCommitMessageResponse struct {
+	Error        string              `json:"error,omitempty"`
+	ErrorMessage string              `json:"errorMessage,omitempty"`
+	Response     parsedCommitMessage `json:"response,omitempty"`
+}
+
+// parseCommitMessage uses Phabricator to parse the given review description as a commit message.
+//
+// This corresponds to calling the differential.parsecommitmessage API, which honors any custom
+// fields configured in Phabricator.
+func (config Config) parseCommitMessage(description string) (map[string]interface{}, error) {
+	request := parseCommitMessageRequest{Corpus: description, Partial: true}
+	var response parseCommitMessageResponse
+	config.runArcCommandOrDie("differential.parsecommitmessage", request, &response)
+	if response.Error != "" {
+		return nil, fmt.Errorf("Failed to parse the commit message: %s", response.ErrorMessage)
+	}
+	if len(response.Response.Errors) > 0 {
+		return nil, fmt.Errorf("Failed to parse the commit message: %v", response.Response.Errors)
+	}
+	return response.Response.Fields, nil
+}
+
+// appendPHIDs returns the given field value (a list of PHIDs) with the given PHIDs appended.
+func appendPHIDs(value interface{}, phids []string) []interface{} {
+	var merged []interface{}
+	if existing, ok := value.([]interface{}); ok {
+		merged = append(merged, existing...)
+	}
+	for _, phid := range phids {
+		merged = append(merged, phid)
+	}
+	return merged
+}
+
+// mergeParsedFields combines the fields parsed from a commit message with those that we
+// generated for the revision.
+//
+// The parsed title, summary, and test plan take precedence, while the reviewers and CCs are
+// combined. An empty test plan is dropped, rather than sent to Phabricator.
+func mergeParsedFields(fields revisionFields, parsed map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{})
+	for name, value := range parsed {
+		merged[name] = value
+	}
+	if title, ok := merged["title"].(string); !ok || title == "" {
+		merged["title"] = fields.Title
+	}
+	if _, ok := merged["summary"]; !ok && fields.Summary != "" {
+		merged["summary"] = fields.Summary
+	}
+	if testPlan, ok := merged[testPlanField].(string); !ok || strings.TrimSpace(testPlan) == "" {
+		delete(merged, testPlanField)
+		if fields.TestPlan != "" {
+			merged[testPlanField] = fields.TestPlan
+		}
+	}
+	if len(fields.Reviewers) > 0 {
+		merged["reviewerPHIDs"] = appendPHIDs(merged["reviewerPHIDs"], fields.Reviewers)
+	}
+	if len(fields.CCs) > 0 {
+		merged["ccPHIDs"] = appendPHIDs(merged["ccPHIDs"], fields.CCs)
+	}
+	return merged
 }
 
 type differentialRevision struct {
@@ -221,44 +1171,138 @@ type createRevisionResponse struct {
 	Response     differentialRevision `json:"response,omitempty"`
 }
 
-func (arc Arcanist) createDifferentialRevision(repo repository.Repo, revision string, diffID int, req request.Request) (*differentialRevision, error) {
+// titleAndSummary generates the title and summary of a Differential revision from a review description.
+func titleAndSummary(description string, limit int) (title, summary string) {
 	// If the description is multiple lines, then treat the first as the title.
-	fields := revisionFields{Title: strings.Split(req.Description, "\n")[0]}
+	title = strings.Split(description, "\n")[0]
 	// Truncate the title if it is too long.
-	if len(fields.Title) > differentialTitleLengthLimit {
-		truncatedLimit := differentialTitleLengthLimit - 4
-		fields.Title = fields.Title[0:truncatedLimit] + "..."
+	if len(title) > limit {
+		truncatedLimit := limit - 4
+		title = title[0:truncatedLimit] + "..."
 	}
 	// If we modified the title from the description, then put the full description in the summary.
-	if fields.Title != req.Description {
-		fields.Summary = req.Description
+	if title != description {
+		summary = description
 	}
-	for _, reviewer := range req.Reviewers {
-		user, err := queryUser(reviewer)
-		if err != nil {
-			log.Print(err)
-		} else if user != nil {
-			fields.Reviewers = append(fields.Reviewers, user.PHID)
-		}
+	return title, summary
+}
+
+// resolveCCs returns the PHIDs of the users to CC on the revision for a review with the given
+// requester and path-based subscribers.
+//
+// Users that cannot be found in Phabricator are logged and skipped.
+func (arc Arcanist) resolveCCs(requester string, subscribers []string, lookupUser UserLookup) []string {
+	var names []string
+	if requester != "" {
+		names = append(names, arc.Config.account(requester))
 	}
-	if req.Requester != "" {
-		user, err := queryUser(req.Requester)
+	names = append(names, arc.Config.DefaultCCs...)
+	names = append(names, subscribers...)
+	var ccs []string
+	seen := make(map[string]bool)
+	for _, name := range names {
+		user, err := lookupUser(name)
 		if err != nil {
 			log.Print(err)
-		} else if user != nil {
-			fields.CCs = append(fields.CCs, user.PHID)
+		} else if user == nil {
+			log.Printf("Not CCing %q, as there is no such Phabricator user", name)
+		} else if !seen[user.PHID] {
+			seen[user.PHID] = true
+			ccs = append(ccs, user.PHID)
 		}
 	}
-	createRequest := createRevisionRequest{diffID, fields}
-	var createResponse createRevisionResponse
-	runArcCommandOrDie("differential.createrevision", createRequest, &createResponse)
-	if createResponse.Error != "" {
-		return nil, fmt.Errorf("Failed to create the differential revision: %s", createResponse.ErrorMessage)
-	}
-	return &createResponse.Response, nil
+	return ccs
 }
 
-type differentialUpdateRevisionRequest struct {
+// pathSubscribers returns the users that the subscriber rules file says to CC on a revision
+// for the changes between the given commits.
+func (arc Arcanist) pathSubscribers(repo repository.Repo, from, to string) []string {
+	if arc.Config.SubscriberRulesFile == "" {
+		return nil
+	}
+	rules, err := readSubscriberRules(arc.Config.SubscriberRulesFile)
+	if err != nil {
+		log.Printf("Failed to read the subscriber rules: %v", err)
+		return nil
+	}
+	changedPaths, err := changedFiles(repo, from, to)
+	if err != nil {
+		log.Printf("Failed to list the files changed in %s..%s: %v", from, to, err)
+		return nil
+	}
+	return pathSubscribers(rules, changedPaths)
+}
+
+// describe generates the title, summary, and other recognized fields of a Differential revision from
+// a review description.
+func (arc Arcanist) describe(description string) (title, summary string, fields map[string]string) {
+	description = stripTrailers(description, arc.Config.StrippedTrailers)
+	description, fields = splitCommitMessageFields(description, arc.Config.CommitMessageFields)
+	title, summary = titleAndSummary(description, arc.Config.titleLengthLimit())
+	return title, summary, fields
+}
+
+// testPlan returns the test plan for a revision with the given fields from its review's description.
+func (arc Arcanist) testPlan(messageFields map[string]string) string {
+	if testPlan := messageFields[testPlanField]; testPlan != "" {
+		return testPlan
+	}
+	return arc.Config.DefaultTestPlan
+}
+
+func (arc Arcanist) createDifferentialRevision(repo repository.Repo, base, revision string, diff differentialDiff, req request.Request) (*differentialRevision, error) {
+	var fields revisionFields
+	var messageFields map[string]string
+	fields.Title, fields.Summary, messageFields = arc.describe(req.Description)
+	fields.TestPlan = arc.testPlan(messageFields)
+	for _, reviewer := range req.Reviewers {
+		user, err := arc.Config.queryUser(reviewer)
+		if err != nil {
+			log.Print(err)
+		} else if user != nil {
+			fields.Reviewers = append(fields.Reviewers, user.PHID)
+		}
+	}
+	fields.CCs = arc.resolveCCs(req.Requester, arc.pathSubscribers(repo, base, revision), arc.Config.queryUser)
+	createRequest := createRevisionRequest{diff.ID, fields}
+	var values map[string]interface{}
+	if len(messageFields) > 0 {
+		values = revisionFieldValues(messageFields, arc.Config.lookupPHIDs)
+	}
+	if arc.Config.ParseCommitMessage {
+		if parsed, err := arc.Config.parseCommitMessage(req.Description); err != nil {
+			log.Print(err)
+		} else {
+			// The configured commit message fields take precedence over what Phabricator parsed.
+			if values == nil {
+				values = make(map[string]interface{})
+			}
+			for name, value := range parsed {
+				if _, ok := values[name]; !ok {
+					values[name] = value
+				}
+			}
+		}
+	}
+	if values != nil {
+		createRequest.Fields = mergeParsedFields(fields, values)
+	}
+	if arc.Config.UseEditAPI {
+		values, ok := createRequest.Fields.(map[string]interface{})
+		if !ok {
+			values = mergeParsedFields(fields, nil)
+		}
+		return arc.Config.createRevisionWithEditAPI(diff.PHID, values)
+	}
+	var createResponse createRevisionResponse
+	arc.Config.runArcCommandOrDie("differential.createrevision", createRequest, &createResponse)
+	if createResponse.Error != "" {
+		return nil, fmt.Errorf("Failed to create the differential revision: %s", createResponse.ErrorMessage)
+	}
+	return &createResponse.Response, nil
+}
+
+type differentialUpdateRevisionRequest struct {
 	ID     string `json:"id"`
 	DiffID string `json:"diffid"`
 	// Fields is a map of new values for the fields of the revision object. Any fields
@@ -271,8 +1315,276 @@ type differentialUpdateRevisionResponse struct {
 	ErrorMessage string `json:"errorMessage,omitempty"`
 }
 
+// latestDiffID returns the ID of the most recent diff in the review, or the empty string if there are none.
+func (differentialReview DifferentialReview) latestDiffID() string {
+	latestID := -1
+	for _, diffIDString := range differentialReview.Diffs {
+		if diffID, err := strconv.Atoi(diffIDString); err == nil && diffID > latestID {
+			latestID = diffID
+		}
+	}
+	if latestID < 0 {
+		return ""
+	}
+	return strconv.Itoa(latestID)
+}
+
+// buildDescriptionUpdate returns the new values for a revision's title and summary, or nil
+// if they do not need to change.
+//
+// The given requests are the history of the review's request, with the latest one last.
+//
+// Unless the mirror owns the description, we only overwrite a title and summary that were
+// generated from one of the earlier requests. Anything else means that they were edited in
+// Phabricator, and we do not want to clobber those edits.
+func (arc Arcanist) buildDescriptionUpdate(differentialReview DifferentialReview, requests []request.Request) map[string]interface{} {
+	if len(requests) == 0 {
+		return nil
+	}
+	title, summary, _ := arc.describe(requests[len(requests)-1].Description)
+	if title == differentialReview.Title && summary == differentialReview.Summary {
+		return nil
+	}
+	if !arc.Config.MirrorOwnsDescription {
+		generatedByMirror := false
+		for _, req := range requests[:len(requests)-1] {
+			priorTitle, priorSummary, _ := arc.describe(req.Description)
+			if priorTitle == differentialReview.Title && priorSummary == differentialReview.Summary {
+				generatedByMirror = true
+			}
+		}
+		if !generatedByMirror {
+			log.Printf("Not updating the description of D%s, as it was edited in Phabricator", differentialReview.ID)
+			return nil
+		}
+	}
+	return map[string]interface{}{
+		"title":   title,
+		"summary": summary,
+	}
+}
+
+// reviewerKeys returns the set of reviewers of the given request, and the account of its requester.
+func (arc Arcanist) reviewerKeys(req request.Request) (reviewers map[string]bool, requester string) {
+	reviewers = make(map[string]bool)
+	for _, reviewer := range req.Reviewers {
+		reviewers[reviewer] = true
+	}
+	if req.Requester != "" {
+		requester = arc.Config.account(req.Requester)
+	}
+	return reviewers, requester
+}
+
+// buildReviewerUpdate returns the PHIDs of the reviewers, and of the requester to CC, that the
+// latest of the given requests added since the one with the given timestamp, which is the last
+// one mirrored into the revision, and that the revision does not have yet.
+//
+// The given requests are the history of the review's request, with the latest one last. Only
+// the changes since the mirrored request are considered, so that the reviewers and CCs that were
+// removed in Phabricator are not added back. If the mirrored request is not known (e.g. for a
+// revision created before they were recorded), then nothing is added. Users that cannot be found
+// in Phabricator are logged and skipped.
+func (arc Arcanist) buildReviewerUpdate(differentialReview DifferentialReview, requests []request.Request, mirroredTimestamp string, lookupUser UserLookup) (reviewers, ccs []string) {
+	mirrored := -1
+	for i, req := range requests {
+		if mirroredTimestamp != "" && req.Timestamp == mirroredTimestamp {
+			mirrored = i
+		}
+	}
+	if mirrored < 0 || mirrored == len(requests)-1 {
+		return nil, nil
+	}
+	previousReviewers, previousRequester := arc.reviewerKeys(requests[mirrored])
+	latest := requests[len(requests)-1]
+	existingReviewers := make(map[string]bool)
+	for _, phid := range differentialReview.Reviewers {
+		existingReviewers[phid] = true
+	}
+	for _, reviewer := range latest.Reviewers {
+		if previousReviewers[reviewer] {
+			continue
+		}
+		user, err := lookupUser(reviewer)
+		if err != nil {
+			log.Print(err)
+		} else if user != nil && !existingReviewers[user.PHID] {
+			existingReviewers[user.PHID] = true
+			reviewers = append(reviewers, user.PHID)
+		}
+	}
+	_, latestRequester := arc.reviewerKeys(latest)
+	if latestRequester == "" || latestRequester == previousRequester {
+		return reviewers, nil
+	}
+	requester, err := lookupUser(latestRequester)
+	if err != nil {
+		log.Print(err)
+		return reviewers, nil
+	}
+	if requester == nil || existingReviewers[requester.PHID] {
+		return reviewers, nil
+	}
+	for _, phid := range differentialReview.CCs {
+		if phid == requester.PHID {
+			return reviewers, nil
+		}
+	}
+	return reviewers, []string{requester.PHID}
+}
+
+// addReviewerFields adds the fields that add the given reviewers and CCs to the revision to the
+// given fields, creating them if they are nil.
+//
+// The differential.revision.edit API adds the given users, but the differential.updaterevision
+// fields replace the revision's existing reviewers and CCs, so for the latter those include
+// everyone already on the revision, including anyone added in Phabricator.
+func (arc Arcanist) addReviewerFields(fields map[string]interface{}, differentialReview DifferentialReview, reviewers, ccs []string) map[string]interface{} {
+	if len(reviewers) == 0 && len(ccs) == 0 {
+		return fields
+	}
+	if fields == nil {
+		fields = make(map[string]interface{})
+	}
+	if !arc.Config.UseEditAPI {
+		reviewers = append(append([]string{}, differentialReview.Reviewers...), reviewers...)
+		ccs = append(append([]string{}, differentialReview.CCs...), ccs...)
+	}
+	if len(reviewers) > 0 {
+		fields["reviewerPHIDs"] = reviewers
+	}
+	if len(ccs) > 0 {
+		fields["ccPHIDs"] = ccs
+	}
+	return fields
+}
+
+// updateRevision updates the title and summary of the given revision if the review's description
+// has changed, and adds the reviewers, and the requester as a CC, that the review's requests
+// added since the last one mirrored into the revision, all in a single call.
+//
+// Reviewers and CCs are never removed, and each request is only mirrored once, so that we do not
+// clobber the reviewers and CCs that were changed in Phabricator. The last request mirrored is
+// recorded in MirroredTransactionsRef, so that this holds across restarts.
+func (arc Arcanist) updateRevision(repo repository.Repo, differentialReview DifferentialReview, r review.Review) {
+	fields := arc.buildDescriptionUpdate(differentialReview, r.AllRequests)
+	latestTimestamp := ""
+	if len(r.AllRequests) > 0 {
+		latestTimestamp = r.AllRequests[len(r.AllRequests)-1].Timestamp
+		if mirroredTimestamp := loadMirroredRequest(repo, r.Revision, differentialReview.ID); mirroredTimestamp == latestTimestamp {
+			latestTimestamp = ""
+		} else {
+			reviewers, ccs := arc.buildReviewerUpdate(differentialReview, r.AllRequests, mirroredTimestamp, arc.Config.queryUser)
+			fields = arc.addReviewerFields(fields, differentialReview, reviewers, ccs)
+		}
+	}
+	if fields != nil && arc.Config.UseEditAPI {
+		request := editRevisionRequest{
+			ObjectIdentifier: differentialReview.PHID,
+			Transactions:     editTransactions(fields),
+		}
+		var response editRevisionResponse
+		arc.Config.runArcCommandOrDie("differential.revision.edit", request, &response)
+		if response.Error != "" {
+			log.Println(response.ErrorMessage)
+			return
+		}
+	} else if fields != nil {
+		diffID := differentialReview.latestDiffID()
+		if diffID == "" {
+			return
+		}
+		updateRequest := differentialUpdateRevisionRequest{ID: differentialReview.ID, DiffID: diffID, Fields: fields}
+		var updateResponse differentialUpdateRevisionResponse
+		arc.Config.runArcCommandOrDie("differential.updaterevision", updateRequest, &updateResponse)
+		if updateResponse.Error != "" {
+			log.Println(updateResponse.ErrorMessage)
+			return
+		}
+	}
+	if latestTimestamp == "" {
+		return
+	}
+	if err := recordMirroredRequest(repo, r.Revision, differentialReview.ID, latestTimestamp); err != nil {
+		log.Printf("Failed to record the request mirrored into D%s: %v", differentialReview.ID, err)
+	}
+}
+
+// closedStatuses returns the revision statuses that mean a revision is closed or abandoned.
+func (config Config) closedStatuses() []string {
+	if len(config.ClosedStatuses) > 0 {
+		return config.ClosedStatuses
+	}
+	return []string{differentialClosedStatus, differentialAbandonedStatus}
+}
+
 func (differentialReview DifferentialReview) isClosed() bool {
-	return differentialReview.Status == differentialClosedStatus || differentialReview.Status == differentialAbandonedStatus
+	for _, status := range differentialReview.config.closedStatuses() {
+		if differentialReview.Status == status || strings.EqualFold(differentialReview.StatusName, status) {
+			return true
+		}
+	}
+	return false
+}
+
+// revisionStatus is the category of a Differential revision's status.
+type revisionStatus int
+
+const (
+	// statusOpen is the category of open revisions whose status we do not recognize.
+	statusOpen revisionStatus = iota
+	statusNeedsReview
+	statusNeedsRevision
+	statusChangesPlanned
+	statusAccepted
+	statusClosed
+	statusAbandoned
+)
+
+// revisionStatuses maps the statuses of Differential revisions to their categories.
+//
+// It is keyed by the lower case forms of the legacy numeric statuses, the statuses used by
+// newer versions of Phabricator, and the status names.
+var revisionStatuses = map[string]revisionStatus{
+	differentialNeedsReviewStatus:    statusNeedsReview,
+	differentialNeedsRevisionStatus:  statusNeedsRevision,
+	differentialAcceptedStatus:       statusAccepted,
+	differentialClosedStatus:         statusClosed,
+	differentialAbandonedStatus:      statusAbandoned,
+	differentialChangesPlannedStatus: statusChangesPlanned,
+	"needs-review":                   statusNeedsReview,
+	"needs-revision":                 statusNeedsRevision,
+	"accepted":                       statusAccepted,
+	"published":                      statusClosed,
+	"abandoned":                      statusAbandoned,
+	"changes-planned":                statusChangesPlanned,
+	"needs review":                   statusNeedsReview,
+	"needs revision":                 statusNeedsRevision,
+	"closed":                         statusClosed,
+	"changes planned":                statusChangesPlanned,
+}
+
+// statusCategory returns the category of the revision's status.
+//
+// Whether or not the revision is closed is decided by isClosed, so that the configured closed
+// statuses are honored. Closed revisions whose status we do not recognize are treated as closed
+// rather than abandoned.
+func (differentialReview DifferentialReview) statusCategory() revisionStatus {
+	status, ok := revisionStatuses[strings.ToLower(differentialReview.Status)]
+	if !ok {
+		status = revisionStatuses[strings.ToLower(differentialReview.StatusName)]
+	}
+	closed := status == statusClosed || status == statusAbandoned
+	if differentialReview.isClosed() {
+		if closed {
+			return status
+		}
+		return statusClosed
+	}
+	if closed {
+		return statusOpen
+	}
+	return status
 }
 
 type differentialCloseRequest struct {
@@ -284,42 +1596,256 @@ type differentialCloseResponse struct {
 	ErrorMessage string `json:"errorMessage,omitempty"`
 }
 
-func (differentialReview DifferentialReview) close() {
+// buildCloseEditRequest generates the differential.revision.edit request that closes the given
+// revision, explaining why with the given reason if it is not empty.
+func buildCloseEditRequest(differentialReview DifferentialReview, reason string) editRevisionRequest {
+	request := editRevisionRequest{
+		ObjectIdentifier: differentialReview.PHID,
+		Transactions:     []editRevisionTransaction{{Type: "close", Value: true}},
+	}
+	if reason != "" {
+		request.Transactions = append(request.Transactions, editRevisionTransaction{Type: "comment", Value: reason})
+	}
+	return request
+}
+
+// close marks the given revision as closed.
+//
+// The reason is only included when using the edit API, as differential.close does not take one.
+func (differentialReview DifferentialReview) close(reason string) error {
+	if differentialReview.config.UseEditAPI {
+		request := buildCloseEditRequest(differentialReview, reason)
+		var response editRevisionResponse
+		differentialReview.config.runArcCommandOrDie("differential.revision.edit", request, &response)
+		if response.Error != "" {
+			return fmt.Errorf("Failed to close D%s: %s", differentialReview.ID, response.ErrorMessage)
+		}
+		metrics.ReviewsClosed.WithLabelValues(metrics.ActionClosed).Inc()
+		return nil
+	}
 	reviewID, err := strconv.Atoi(differentialReview.ID)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	closeRequest := differentialCloseRequest{reviewID}
 	var closeResponse differentialCloseResponse
-	runArcCommandOrDie("differential.close", closeRequest, &closeResponse)
+	differentialReview.config.runArcCommandOrDie("differential.close", closeRequest, &closeResponse)
 	if closeResponse.Error != "" {
 		// This might happen if someone merged in a review that wasn't accepted yet, or if the review is not owned by the robot account.
-		log.Println(closeResponse.ErrorMessage)
+		return fmt.Errorf("Failed to close D%s: %s", differentialReview.ID, closeResponse.ErrorMessage)
+	}
+	metrics.ReviewsClosed.WithLabelValues(metrics.ActionClosed).Inc()
+	return nil
+}
+
+// buildAbandonRequest generates the request that abandons the given revision, explaining why
+// with the given message if it is not empty.
+func buildAbandonRequest(differentialReview DifferentialReview, message string) createCommentRequest {
+	return createCommentRequest{
+		RevisionID: differentialReview.ID,
+		Message:    message,
+		Action:     "abandon",
+	}
+}
+
+// abandon marks the given revision as abandoned, posting the configured comment along with it.
+func (arc Arcanist) abandon(differentialReview DifferentialReview) {
+	if err := arc.Config.createComment(buildAbandonRequest(differentialReview, arc.Config.AbandonComment)); err != nil {
+		// This might happen if the revision is not owned by the robot account.
+		log.Println(err)
+		return
+	}
+	metrics.ReviewsClosed.WithLabelValues(metrics.ActionAbandoned).Inc()
+}
+
+// findLandingCommit returns the commit that landed the given head commit in the given target ref.
+//
+// If the head commit was merged in with a merge commit, then that is returned. Otherwise the head
+// commit itself landed (e.g. by a fast-forward), so it is returned instead.
+func findLandingCommit(repo repository.Repo, head, targetRef string) string {
+	descendants, err := repo.ListCommitsBetween(head, targetRef)
+	if err != nil || len(descendants) == 0 {
+		return head
+	}
+	details, err := repo.GetCommitDetails(descendants[0])
+	if err != nil || len(details.Parents) < 2 {
+		return head
+	}
+	for _, parent := range details.Parents[1:] {
+		if parent == head {
+			return descendants[0]
+		}
+	}
+	return head
+}
+
+// buildMergedComment generates the comment that tells reviewers which commit landed the review.
+func buildMergedComment(differentialReview DifferentialReview, landingCommit, targetRef string) createCommentRequest {
+	return createCommentRequest{
+		RevisionID: differentialReview.ID,
+		Message:    fmt.Sprintf("Landed in %s as %s", abbreviateRefName(targetRef), landingCommit),
+	}
+}
+
+type editRevisionTransaction struct {
+	Type  string      `json:"type"`
+	Value interface{} `json:"value"`
+}
+
+// editRevisionRequest is a request to the differential.revision.edit API. A request without an
+// ObjectIdentifier creates a new revision.
+type editRevisionRequest struct {
+	ObjectIdentifier string                    `json:"objectIdentifier,omitempty"`
+	Transactions     []editRevisionTransaction `json:"transactions"`
+	Conduit          *conduitMetadata          `json:"__conduit__,omitempty"`
+}
+
+type editedRevision struct {
+	Object struct {
+		ID   int    `json:"id"`
+		PHID string `json:"phid"`
+	} `json:"object"`
+	Transactions []struct {
+		PHID string `json:"phid"`
+	} `json:"transactions"`
+}
+
+type editRevisionResponse struct {
+	Error        string         `json:"error,omitempty"`
+	ErrorMessage string         `json:"errorMessage,omitempty"`
+	Response     editedRevision `json:"response,omitempty"`
+}
+
+// editTransactionTypes maps the revision fields that we set when using the older APIs to the
+// corresponding differential.revision.edit transaction types.
+var editTransactionTypes = map[string]string{
+	"title":              "title",
+	"summary":            "summary",
+	testPlanField:        "testPlan",
+	"reviewerPHIDs":      "reviewers.add",
+	"ccPHIDs":            "subscribers.add",
+	"maniphestTaskPHIDs": "tasks.add",
+}
+
+// editTransactions converts the given revision field values into differential.revision.edit
+// transactions, ordered by field name.
+//
+// Fields that have no corresponding transaction type are logged and skipped.
+func editTransactions(fields map[string]interface{}) []editRevisionTransaction {
+	var names []string
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var transactions []editRevisionTransaction
+	for _, name := range names {
+		transactionType, ok := editTransactionTypes[name]
+		if !ok {
+			log.Printf("Not setting the %q field, as it is not supported by differential.revision.edit", name)
+			continue
+		}
+		transactions = append(transactions, editRevisionTransaction{Type: transactionType, Value: fields[name]})
 	}
+	return transactions
 }
 
-func findCommitForDiff(diffIDString string) string {
-	diffID, err := strconv.Atoi(diffIDString)
+// buildCreateEditRequest generates the differential.revision.edit request that creates a
+// revision for the diff with the given PHID, and with the given field values.
+func buildCreateEditRequest(diffPHID string, fields map[string]interface{}) editRevisionRequest {
+	transactions := []editRevisionTransaction{{Type: "update", Value: diffPHID}}
+	return editRevisionRequest{Transactions: append(transactions, editTransactions(fields)...)}
+}
+
+// createRevisionWithEditAPI creates a revision for the diff with the given PHID, and with the
+// given field values, using the differential.revision.edit API.
+func (config Config) createRevisionWithEditAPI(diffPHID string, fields map[string]interface{}) (*differentialRevision, error) {
+	request := buildCreateEditRequest(diffPHID, fields)
+	var response editRevisionResponse
+	config.runArcCommandOrDie("differential.revision.edit", request, &response)
+	if response.Error != "" {
+		return nil, fmt.Errorf("Failed to create the differential revision: %s", response.ErrorMessage)
+	}
+	return &differentialRevision{RevisionID: response.Response.Object.ID}, nil
+}
+
+// addProject tags the revision with the project with the given name.
+//
+// This corresponds to calling the differential.revision.edit API.
+func (differentialReview DifferentialReview) addProject(project string) {
+	projectPHIDs, err := differentialReview.config.lookupPHIDs([]string{project})
 	if err != nil {
-		return ""
+		log.Println(err)
+		return
+	}
+	if len(projectPHIDs) == 0 {
+		log.Printf("Failed to tag D%s, as there is no project named %q", differentialReview.ID, project)
+		return
+	}
+	request := editRevisionRequest{
+		ObjectIdentifier: differentialReview.PHID,
+		Transactions:     []editRevisionTransaction{{Type: "projects.add", Value: projectPHIDs}},
 	}
-	diff, err := readDiff(diffID)
+	var response editRevisionResponse
+	differentialReview.config.runArcCommandOrDie("differential.revision.edit", request, &response)
+	if response.Error != "" {
+		log.Println(response.ErrorMessage)
+	}
+}
+
+// handleMerged updates the given revision to reflect that the change under review has been merged.
+//
+// The returned error reports a failure to close the revision, which may be worth retrying. With
+// MergedActionCloseWithComment on the legacy API, the comment is only posted once the revision
+// is closed, so that retries do not post it again.
+func (arc Arcanist) handleMerged(repo repository.Repo, differentialReview DifferentialReview, r review.Review) error {
+	if arc.Config.MergedAction == MergedActionTag {
+		differentialReview.addProject(arc.Config.MergedProject)
+		return nil
+	}
+	head, err := r.GetHeadCommit()
 	if err != nil {
-		return ""
+		head = r.Revision
 	}
+	landingCommit := findLandingCommit(repo, head, r.Request.TargetRef)
+	mergedComment := buildMergedComment(differentialReview, landingCommit, r.Request.TargetRef)
+	if err := differentialReview.close(mergedComment.Message); err != nil {
+		return err
+	}
+	if arc.Config.MergedAction == MergedActionCloseWithComment && !arc.Config.UseEditAPI {
+		if err := arc.Config.createComment(mergedComment); err != nil {
+			log.Println(err)
+		}
+	}
+	return nil
+}
 
-	return diff.findLastCommit()
+// conduitMetadata holds the Conduit parameters that apply to any API method.
+type conduitMetadata struct {
+	// ActAsUser is the PHID of the user on whose behalf the request is made.
+	ActAsUser string `json:"actAsUser,omitempty"`
 }
 
 // createCommentRequest models the request format for
 // Phabricator's differential.createcomment API method.
 type createCommentRequest struct {
-	RevisionID    string `json:"revision_id,omitempty"`
-	Message       string `json:"content,omitempty"`
-	Action        string `json:"action,omitempty"`
-	AttachInlines bool   `json:"attach_inlines,omitempty"`
+	RevisionID string `json:"revision_id,omitempty"`
+	// Message is the text of the comment. The API method names this parameter "message", and
+	// silently ignores any other name (such as "content", which createinline uses), in which
+	// case the comment is posted without any text.
+	Message       string           `json:"message,omitempty"`
+	Action        string           `json:"action,omitempty"`
+	AttachInlines bool             `json:"attach_inlines,omitempty"`
+	Conduit       *conduitMetadata `json:"__conduit__,omitempty"`
 }
 
+// The values of createInlineRequest.IsNewFile for comments on each side of a diff.
+const (
+	// leftHandSide is the side of a diff that shows the code before its changes.
+	leftHandSide uint32 = 0
+	// rightHandSide is the side of a diff that shows the code after its changes.
+	rightHandSide uint32 = 1
+)
+
 // createInlineRequest models the request format for
 // Phabricator's differential.createinline API method.
 type createInlineRequest struct {
@@ -327,8 +1853,20 @@ type createInlineRequest struct {
 	DiffID     string `json:"diffID,omitempty"`
 	FilePath   string `json:"filePath,omitempty"`
 	LineNumber uint32 `json:"lineNumber,omitempty"`
+	// LineLength is the number of lines that the comment spans after its first one.
+	LineLength uint32 `json:"lineLength,omitempty"`
 	Content    string `json:"content,omitempty"`
 	IsNewFile  uint32 `json:"isNewFile"`
+	// ReplyToCommentPHID is the PHID of the inline comment that this one replies to, if any.
+	//
+	// The differential.createinline API cannot post replies, so requests with a reply target are
+	// posted using the differential.revision.edit API instead, if Config.UseEditAPI is set.
+	ReplyToCommentPHID string `json:"-"`
+
+	Conduit *conduitMetadata `json:"__conduit__,omitempty"`
+
+	// comment is the comment that the request mirrors into Phabricator.
+	comment comment.Comment
 }
 
 // createInlineResponse models the response format for
@@ -336,6 +1874,11 @@ type createInlineRequest struct {
 type createInlineResponse struct {
 	Error        string `json:"error,omitempty"`
 	ErrorMessage string `json:"errorMessage,omitempty"`
+	Response     struct {
+		// PHID is the PHID of the inline comment, which is the comment PHID of the transaction
+		// that publishes it.
+		PHID string `json:"phid"`
+	} `json:"response,omitempty"`
 }
 
 // createCommentResponse models the response format for
@@ -345,6 +1888,18 @@ type createCommentResponse struct {
 	ErrorMessage string `json:"errorMessage,omitempty"`
 }
 
+// createComment posts the given comment, or performs the given action, on a revision.
+//
+// This corresponds to calling the differential.createcomment API.
+func (config Config) createComment(request createCommentRequest) error {
+	var response createCommentResponse
+	config.runArcCommandOrDie("differential.createcomment", request, &response)
+	if response.Error != "" {
+		return errors.New(response.ErrorMessage)
+	}
+	return nil
+}
+
 func overlapsAny(c comment.Comment, existingComments []comment.Comment) bool {
 	for _, existing := range existingComments {
 		if review_utils.Overlaps(c, existing) {
@@ -354,166 +1909,904 @@ func overlapsAny(c comment.Comment, existingComments []comment.Comment) bool {
 	return false
 }
 
-func (differentialReview DifferentialReview) buildCommentRequestsForThread(existingComments []comment.Comment, commentThread review.CommentThread, diffID, path string, lineNumber uint32) []createInlineRequest {
+// quoteDescription generates the description for a comment that we post into Phabricator on behalf of its author.
+func (arc Arcanist) quoteDescription(c comment.Comment) string {
+	if arc.Config.MarkProvenance {
+		return review_utils.QuoteDescriptionWithProvenance(c)
+	}
+	return review_utils.QuoteDescription(c)
+}
+
+// authoredDescription generates the description for a comment that we post into Phabricator as its author.
+func (arc Arcanist) authoredDescription(c comment.Comment) string {
+	if arc.Config.MarkProvenance {
+		return review_utils.AppendProvenance(c.Description)
+	}
+	return c.Description
+}
+
+// buildCommentRequestsForThread builds the requests that post the given comment thread on the
+// given lines and side of a file in the diff of the given commit.
+//
+// If the thread was moved there from another location, then it is compared to the existing
+// comments at its new location, as that is where Phabricator reports it once posted.
+func (arc Arcanist) buildCommentRequestsForThread(differentialReview DifferentialReview, existingComments []comment.Comment, commentThread review.CommentThread, diffID, commit, path string, lineNumber, lineLength, isNewFile uint32, moved bool) []createInlineRequest {
 	var requests []createInlineRequest
-	if !overlapsAny(commentThread.Comment, existingComments) {
-		content := review_utils.QuoteDescription(commentThread.Comment)
+	posted := commentThread.Comment
+	if moved {
+		posted.Location = &comment.Location{
+			Commit: commit,
+			Path:   path,
+			Range:  &comment.Range{StartLine: lineNumber},
+		}
+		if lineLength > 0 {
+			posted.Location.Range.EndLine = lineNumber + lineLength
+		}
+	}
+	if !overlapsAny(posted, existingComments) {
+		content := arc.quoteDescription(commentThread.Comment)
 		request := createInlineRequest{
 			RevisionID: differentialReview.ID,
 			DiffID:     diffID,
 			FilePath:   path,
 			LineNumber: lineNumber,
-			// IsNewFile indicates if the comment is on the left-hand side (0) or the right-hand side (1).
-			// We always post comments to the right-hand side.
-			IsNewFile: 1,
-			Content:   content,
+			LineLength: lineLength,
+			IsNewFile:  isNewFile,
+			Content:    content,
+			comment:    commentThread.Comment,
 		}
 		requests = append(requests, request)
 	}
 	for _, child := range commentThread.Children {
-		requests = append(requests, differentialReview.buildCommentRequestsForThread(existingComments, child, diffID, path, lineNumber)...)
+		requests = append(requests, arc.buildCommentRequestsForThread(differentialReview, existingComments, child, diffID, commit, path, lineNumber, lineLength, isNewFile, moved)...)
+	}
+	return requests
+}
+
+// buildOrphanedCommentRequests builds the requests that post the given comment thread, which
+// was made on the given line of a file, as review-wide comments that quote that location.
+func (arc Arcanist) buildOrphanedCommentRequests(differentialReview DifferentialReview, existingComments []comment.Comment, commentThread review.CommentThread, commit, path string, lineNumber uint32) []createCommentRequest {
+	var requests []createCommentRequest
+	message := fmt.Sprintf("On line %d of %s at %s, %s", lineNumber, path, commit, arc.quoteDescription(commentThread.Comment))
+	posted := comment.Comment{Description: message}
+	escaped := comment.Comment{Description: strings.Replace(message, "\n", "\\n", -1)}
+	if !overlapsAny(posted, existingComments) && !overlapsAny(escaped, existingComments) {
+		requests = append(requests, createCommentRequest{
+			RevisionID: differentialReview.ID,
+			Message:    message,
+			Action:     "comment",
+		})
+	}
+	for _, child := range commentThread.Children {
+		requests = append(requests, arc.buildOrphanedCommentRequests(differentialReview, existingComments, child, commit, path, lineNumber)...)
 	}
 	return requests
 }
 
-func (differentialReview DifferentialReview) buildCommentRequests(commentThreads []review.CommentThread, existingComments []comment.Comment, commitToDiffMap map[string]string) ([]createInlineRequest, []createCommentRequest) {
+// countLines returns the number of lines in the given file at the given commit, and whether
+// or not the file exists there.
+func countLines(repo repository.Repo, commit, path string) (int, bool) {
+	contents, err := repo.Show(commit, path)
+	if err != nil {
+		return 0, false
+	}
+	if contents == "" {
+		return 0, true
+	}
+	return strings.Count(strings.TrimSuffix(contents, "\n"), "\n") + 1, true
+}
+
+// latestDiff returns the newest of the given diffs, along with the commit for which it was generated.
+func latestDiff(commitToDiffMap map[string]string) (commit, diffID string) {
+	latest := -1
+	for diffCommit, diffIDString := range commitToDiffMap {
+		id, err := strconv.Atoi(diffIDString)
+		if err == nil && id > latest {
+			latest, commit, diffID = id, diffCommit, diffIDString
+		}
+	}
+	return commit, diffID
+}
+
+// buildCommentRequests builds the requests that post the given comment threads into the given revision.
+//
+// Each inline comment is attached to the diff of the commit on which it was made, or to the latest
+// diff if that commit has no diff of its own. Comments made on the given base commit of the review
+// are about the code before its changes, so they are posted on the left-hand side of the latest
+// diff instead. Comments on ranges of lines are posted on all of the lines in their range that
+// exist in the diff. Comments on lines that do not exist in that diff are
+// handled as specified by Config.OrphanedComments, so that none of them are dropped.
+func (arc Arcanist) buildCommentRequests(repo repository.Repo, differentialReview DifferentialReview, commentThreads []review.CommentThread, existingComments []comment.Comment, commitToDiffMap map[string]string, baseCommit string) ([]createInlineRequest, []createCommentRequest) {
 	var inlineRequests []createInlineRequest
-	var commentRequests []createCommentRequest
+	var orphanedRequests []createCommentRequest
 
 	for _, c := range commentThreads {
-		if c.Comment.Location != nil && c.Comment.Location.Path != "" {
+		if c.Comment.Location == nil || c.Comment.Location.Path == "" {
 			// TODO(ojarjur): Also mirror whole-review comments.
-			var lineNumber uint32 = 1
-			if c.Comment.Location.Range != nil {
-				lineNumber = c.Comment.Location.Range.StartLine
+			if arc.Config.MirrorRejections && isOutstandingRejection(c) {
+				// The rejection itself is mirrored by buildRejectionRequests, but not its replies.
+				for _, child := range c.Children {
+					recordDroppedThread(child, DropReasonReviewWide)
+				}
+			} else {
+				recordDroppedThread(c, DropReasonReviewWide)
 			}
-			diffID := commitToDiffMap[c.Comment.Location.Commit]
-			if diffID != "" {
-				inlineRequests = append(inlineRequests, differentialReview.buildCommentRequestsForThread(existingComments, c, diffID, c.Comment.Location.Path, lineNumber)...)
+			continue
+		}
+		path := c.Comment.Location.Path
+		var lineNumber, endLine uint32 = 1, 1
+		if c.Comment.Location.Range != nil {
+			lineNumber = c.Comment.Location.Range.StartLine
+			endLine = review_utils.EndLine(*c.Comment.Location.Range)
+		}
+		commit := c.Comment.Location.Commit
+		diffID := commitToDiffMap[commit]
+		isNewFile := rightHandSide
+		if diffID == "" && baseCommit != "" && commit == baseCommit {
+			_, diffID = latestDiff(commitToDiffMap)
+			isNewFile = leftHandSide
+		}
+		if diffID == "" {
+			commit, diffID = latestDiff(commitToDiffMap)
+			if diffID == "" {
+				log.Printf("Dropping the comment %s on %s, as none of the diffs of D%s could be found", c.Hash, path, differentialReview.ID)
+				recordDroppedThread(c, DropReasonNoDiff)
+				continue
 			}
 		}
+		moved := commit != c.Comment.Location.Commit
+		lines, exists := countLines(repo, commit, path)
+		switch {
+		case exists && int(lineNumber) <= lines:
+			lineLength := endLine - lineNumber
+			if int(endLine) > lines {
+				// The range runs past the end of the file, so we only post the part of it that exists.
+				lineLength = uint32(lines) - lineNumber
+				moved = true
+			}
+			inlineRequests = append(inlineRequests, arc.buildCommentRequestsForThread(differentialReview, existingComments, c, diffID, commit, path, lineNumber, lineLength, isNewFile, moved)...)
+		case lines == 0 || arc.Config.OrphanedComments == OrphanedCommentsTopLevel:
+			orphanedRequests = append(orphanedRequests, arc.buildOrphanedCommentRequests(differentialReview, existingComments, c, c.Comment.Location.Commit, path, lineNumber)...)
+		case arc.Config.OrphanedComments == OrphanedCommentsFile:
+			inlineRequests = append(inlineRequests, arc.buildCommentRequestsForThread(differentialReview, existingComments, c, diffID, commit, path, 1, 0, isNewFile, true)...)
+		default:
+			inlineRequests = append(inlineRequests, arc.buildCommentRequestsForThread(differentialReview, existingComments, c, diffID, commit, path, uint32(lines), 0, isNewFile, true)...)
+		}
 	}
+	var commentRequests []createCommentRequest
 	if len(inlineRequests) > 0 {
 		request := createCommentRequest{
 			RevisionID:    differentialReview.ID,
 			Action:        "comment",
 			AttachInlines: true,
 		}
-		commentRequests = append(commentRequests, request)
+		commentRequests = append(commentRequests, request)
+	}
+	return inlineRequests, append(commentRequests, orphanedRequests...)
+}
+
+// indexThreads adds every comment in the given threads to the given map, keyed by its hash.
+func indexThreads(threads []review.CommentThread, byHash map[string]comment.Comment) {
+	for _, thread := range threads {
+		byHash[thread.Hash] = thread.Comment
+		indexThreads(thread.Children, byHash)
+	}
+}
+
+// setReplyTargets makes each of the given inline comment requests for a reply in git-notes
+// reply to the Phabricator comment that its parent corresponds to, so that the conversation
+// keeps its structure.
+//
+// The given PHIDs are those of the given existing comments. If the parent of a reply has not
+// been mirrored into Phabricator yet, then the reply is posted without a parent.
+func setReplyTargets(requests []createInlineRequest, threads []review.CommentThread, existingComments []comment.Comment, existingPHIDs []string) {
+	byHash := make(map[string]comment.Comment)
+	indexThreads(threads, byHash)
+	for i, request := range requests {
+		if request.comment.Parent == "" {
+			continue
+		}
+		parent, ok := byHash[request.comment.Parent]
+		if !ok {
+			continue
+		}
+		for j, existing := range existingComments {
+			if j < len(existingPHIDs) && existingPHIDs[j] != "" && review_utils.Overlaps(existing, parent) {
+				requests[i].ReplyToCommentPHID = existingPHIDs[j]
+				break
+			}
+		}
+		if requests[i].ReplyToCommentPHID == "" {
+			log.Printf("Posting a reply to %s without its parent, as the parent has not been mirrored yet", request.comment.Parent)
+		}
+	}
+}
+
+// isSuperseded reports whether or not the given rejection was followed by a reply that resolves it.
+func isSuperseded(rejection review.CommentThread) bool {
+	for _, child := range rejection.Children {
+		if child.Comment.Resolved != nil && *child.Comment.Resolved {
+			return true
+		}
+		if isSuperseded(child) {
+			return true
+		}
+	}
+	return false
+}
+
+// isBefore reports whether or not the given git-appraise timestamp is before the given time.
+// Timestamps that cannot be parsed are never before it.
+func isBefore(timestamp string, since uint32) bool {
+	t, err := strconv.ParseUint(timestamp, 10, 32)
+	return err == nil && t < uint64(since)
+}
+
+// threadsSince returns the given comment threads, except for those started before the given time.
+//
+// That is for revisions whose older transactions were not read, in which case we cannot tell
+// whether or not the older threads are already in the revision, so mirroring them again could
+// post duplicates.
+func threadsSince(threads []review.CommentThread, since uint32) []review.CommentThread {
+	var recent []review.CommentThread
+	for _, thread := range threads {
+		if !isBefore(thread.Comment.Timestamp, since) {
+			recent = append(recent, thread)
+		}
+	}
+	return recent
+}
+
+// ciReportsSince returns the given CI reports, except for those made before the given time, for
+// the same reason as threadsSince.
+func ciReportsSince(reportsByCommit map[string][]ci.Report, since uint32) map[string][]ci.Report {
+	recent := make(map[string][]ci.Report)
+	for commit, reports := range reportsByCommit {
+		for _, report := range reports {
+			if !isBefore(report.Timestamp, since) {
+				recent[commit] = append(recent[commit], report)
+			}
+		}
+	}
+	return recent
+}
+
+// isOutstandingRejection reports whether or not the given thread rejects the review, and has not
+// been resolved by a reply since.
+func isOutstandingRejection(thread review.CommentThread) bool {
+	resolved := thread.Comment.Resolved
+	return resolved != nil && !*resolved && !isSuperseded(thread)
+}
+
+// buildRejectionRequests builds the requests that reject the given revision, for each of the
+// review-wide rejections in the given comment threads that have not yet been mirrored.
+//
+// Phabricator stores the message of a rejection separately from the action, so a rejection is
+// considered mirrored once its message exists in Phabricator, regardless of the action.
+func (arc Arcanist) buildRejectionRequests(differentialReview DifferentialReview, commentThreads []review.CommentThread, existingComments []comment.Comment) []createCommentRequest {
+	var requests []createCommentRequest
+	for _, thread := range commentThreads {
+		c := thread.Comment
+		if !isOutstandingRejection(thread) || (c.Location != nil && c.Location.Path != "") {
+			continue
+		}
+		message := c
+		message.Resolved = nil
+		if overlapsAny(message, existingComments) {
+			continue
+		}
+		requests = append(requests, createCommentRequest{
+			RevisionID: differentialReview.ID,
+			Message:    arc.quoteDescription(c),
+			Action:     "reject",
+		})
+	}
+	return requests
+}
+
+type differentialUnitDiffProperty struct {
+	Name   string `json:"name"`
+	Link   string `json:"link"`
+	Result string `json:"result"`
+}
+
+func translateReportStatusToDifferentialUnitResult(status string) string {
+	if status == "success" {
+		return "pass"
+	} else if status == "failure" {
+		return "fail"
+	} else {
+		// TODO(ojarjur): This is less than ideal. Phabricator no longer has a concept
+		// of pending unit tests, so the closest match we have is that the tests have been
+		// skipped.
+		return "skip"
+	}
+}
+
+type LintDiffProperty struct {
+	Name        string `json:"name,omitempty"`
+	Code        string `json:"code,omitempty"`
+	Severity    string `json:"severity,omitempty"`
+	Path        string `json:"path,omitempty"`
+	Line        int    `json:"line,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// mirrorStatusesForEachCommit reports the CI and static analysis results for each of the given commits.
+//
+// The return value maps each commit to the latest CI report from each of its agents, if it has any.
+//
+// Commits without any CI or static analysis notes (e.g. because the repo has no CI
+// notes ref at all) are silently skipped.
+func (arc Arcanist) mirrorStatusesForEachCommit(r review.Review, commitToDiffIDMap map[string]int) map[string][]ci.Report {
+	latestCIReports := make(map[string][]ci.Report)
+	for commitHash, diffID := range commitToDiffIDMap {
+		if ciNotes := r.Repo.GetNotes(ci.Ref, commitHash); len(ciNotes) > 0 {
+			reports, err := review_utils.GetAllLatestCIReports(ciNotes)
+			if err != nil {
+				log.Printf("Failed to load the continuous integration reports for %s: %v", commitHash, err)
+			} else if len(reports) > 0 {
+				arc.reportUnitResults(diffID, reports)
+				latestCIReports[commitHash] = reports
+			}
+		}
+
+		analysesNotes := r.Repo.GetNotes(analyses.Ref, commitHash)
+		if len(analysesNotes) == 0 {
+			continue
+		}
+		analysesReports := analyses.ParseAllValid(analysesNotes)
+		latestAnalysesReport, err := analyses.GetLatestAnalysesReport(analysesReports)
+		if err != nil {
+			log.Println("Failed to load the static analysis reports: " + err.Error())
+		} else if latestAnalysesReport != nil {
+			lintResults, err := latestAnalysesReport.GetLintReportResult()
+			if err != nil {
+				log.Println("Failed to load the static analysis reports: " + err.Error())
+			} else {
+				arc.reportLintResults(diffID, lintResults)
+			}
+		}
+	}
+	return latestCIReports
+}
+
+// buildCIReportCommentRequests builds the requests for comments that link to the given CI reports
+// for each commit.
+//
+// Reports without a URL, and reports whose URL is already included in an existing comment, are skipped.
+func buildCIReportCommentRequests(differentialReview DifferentialReview, latestCIReports map[string][]ci.Report, existingComments []comment.Comment) []createCommentRequest {
+	var commits []string
+	for commit := range latestCIReports {
+		commits = append(commits, commit)
+	}
+	sort.Strings(commits)
+
+	var requests []createCommentRequest
+	for _, commit := range commits {
+		for _, report := range latestCIReports[commit] {
+			if report.URL == "" {
+				continue
+			}
+			alreadyPosted := false
+			for _, existing := range existingComments {
+				if strings.Contains(existing.Description, report.URL) {
+					alreadyPosted = true
+				}
+			}
+			if alreadyPosted {
+				continue
+			}
+			message := fmt.Sprintf("Build results for %s: %s", commit, report.URL)
+			if report.Status != "" {
+				message = fmt.Sprintf("Build %s for %s: %s", report.Status, commit, report.URL)
+			}
+			requests = append(requests, createCommentRequest{
+				RevisionID: differentialReview.ID,
+				Message:    message,
+				Action:     "comment",
+			})
+		}
+	}
+	return requests
+}
+
+// actAsCommentAuthors updates the given inline comment requests to be posted by the authors of the
+// comments, and generates the requests that publish those inline comments.
+//
+// Phabricator only publishes a user's inline comments when that user posts a top-level comment, so
+// this generates one such comment for each author, plus one for the inline comments that we could
+// not attribute to their authors and thus post (quoted) as ourselves.
+func (arc Arcanist) actAsCommentAuthors(differentialReview DifferentialReview, inlineRequests []createInlineRequest, lookupUser UserLookup) ([]createInlineRequest, []createCommentRequest) {
+	var requests []createInlineRequest
+	var authorPHIDs []string
+	seenAuthors := make(map[string]bool)
+	for _, request := range inlineRequests {
+		author, err := lookupUser(request.comment.Author)
+		if err != nil {
+			log.Print(err)
+		}
+		if author != nil && author.PHID != "" {
+			request.Conduit = &conduitMetadata{ActAsUser: author.PHID}
+			request.Content = arc.authoredDescription(request.comment)
+		}
+		authorPHID := ""
+		if request.Conduit != nil {
+			authorPHID = request.Conduit.ActAsUser
+		}
+		if !seenAuthors[authorPHID] {
+			seenAuthors[authorPHID] = true
+			authorPHIDs = append(authorPHIDs, authorPHID)
+		}
+		requests = append(requests, request)
+	}
+	var commentRequests []createCommentRequest
+	for _, authorPHID := range authorPHIDs {
+		request := createCommentRequest{
+			RevisionID:    differentialReview.ID,
+			Action:        "comment",
+			AttachInlines: true,
+		}
+		if authorPHID != "" {
+			request.Conduit = &conduitMetadata{ActAsUser: authorPHID}
+		}
+		commentRequests = append(commentRequests, request)
+	}
+	return requests, commentRequests
+}
+
+func (arc Arcanist) mirrorCommentsIntoReview(repo repository.Repo, differentialReview DifferentialReview, r review.Review) {
+	if len(differentialReview.Diffs) == 0 {
+		// There is nothing to which we could attach comments or build results yet.
+		log.Printf("Not mirroring comments into D%s, as it has no diffs", differentialReview.ID)
+		return
+	}
+	var diffIDs []int
+	for _, diffIDString := range differentialReview.Diffs {
+		diffID, err := strconv.Atoi(diffIDString)
+		if err != nil {
+			log.Printf("Skipping the diff %q of D%s, as its ID is not a number", diffIDString, differentialReview.ID)
+			continue
+		}
+		diffIDs = append(diffIDs, diffID)
+	}
+	diffs, err := arc.Config.readDiffs(diffIDs)
+	if err != nil {
+		log.Printf("Not mirroring comments into D%s, as we could not read its diffs: %v", differentialReview.ID, err)
+		return
+	}
+	commitToDiffMap, commitToDiffIDMap := mapCommitsToDiffs(diffIDs, diffs)
+	if arc.Config.RecreateMissingDiffs {
+		arc.recreateMissingDiffs(repo, differentialReview, r, commitToDiffMap, commitToDiffIDMap)
+	}
+	latestCIReports := arc.mirrorStatusesForEachCommit(r, commitToDiffIDMap)
+
+	existingComments, existingPHIDs, since, err := differentialReview.loadCommentsWithPHIDs()
+	if err != nil {
+		log.Printf("Not mirroring comments into D%s, as we could not read its comments: %v", differentialReview.ID, err)
+		return
+	}
+	if since != 0 {
+		log.Printf("Only mirroring the comments made since %d into D%s, as its older transactions were not read", since, differentialReview.ID)
+		r.Comments = threadsSince(r.Comments, since)
+		latestCIReports = ciReportsSince(latestCIReports, since)
+	}
+	inlineRequests, commentRequests := arc.prepareCommentRequests(repo, differentialReview, r, existingComments, existingPHIDs, commitToDiffMap)
+	if arc.Config.PostCIReportLinks {
+		commentRequests = append(commentRequests, buildCIReportCommentRequests(differentialReview, latestCIReports, existingComments)...)
+	}
+	if arc.Config.MirrorRejections {
+		commentRequests = append(commentRequests, arc.buildRejectionRequests(differentialReview, r.Comments, existingComments)...)
+	}
+	log.Printf("Posting %d inline comments and %d comments into D%s for the review of %s, which has %d comment threads",
+		len(inlineRequests), len(commentRequests), differentialReview.ID, r.Revision, len(r.Comments))
+	if len(inlineRequests) == 0 && len(commentRequests) == 0 {
+		return
+	}
+	readTransactions, _ := arc.Config.transactionReaders()
+	before, err := readTransactions(differentialReview.PHID)
+	if err != nil {
+		log.Printf("Not mirroring comments into D%s, as we could not read its transactions: %v", differentialReview.ID, err)
+		return
+	}
+	posted := newPostedComments()
+	arc.Config.postCommentRequests(inlineRequests, commentRequests, posted)
+	if arc.Config.VerifyComments {
+		arc.verifyMirroredComments(repo, differentialReview, r, commitToDiffMap, posted)
+	}
+	arc.recordMirroredComments(repo, differentialReview, r.Revision, before, posted)
+}
+
+// missingDiffCommits returns the commits that have inline comments in the given threads, but
+// which do not have a diff in the given map from commits to diffs.
+func missingDiffCommits(threads []review.CommentThread, commitToDiffMap map[string]string) []string {
+	var missing []string
+	seen := make(map[string]bool)
+	var visit func(thread review.CommentThread)
+	visit = func(thread review.CommentThread) {
+		if location := thread.Comment.Location; location != nil && location.Path != "" && location.Commit != "" {
+			if _, ok := commitToDiffMap[location.Commit]; !ok && !seen[location.Commit] {
+				seen[location.Commit] = true
+				missing = append(missing, location.Commit)
+			}
+		}
+		for _, child := range thread.Children {
+			visit(child)
+		}
+	}
+	for _, thread := range threads {
+		visit(thread)
+	}
+	return missing
+}
+
+// recreateMissingDiffs uploads diffs for the commits that have inline comments but no diff in the
+// given revision, and adds those diffs to the given maps.
+//
+// Attaching a diff makes it the revision's current diff, so if any diffs were recreated, then the
+// diff for the head of the review is uploaded again afterwards.
+func (arc Arcanist) recreateMissingDiffs(repo repository.Repo, differentialReview DifferentialReview, r review.Review, commitToDiffMap map[string]string, commitToDiffIDMap map[string]int) {
+	missing := missingDiffCommits(r.Comments, commitToDiffMap)
+	if len(missing) == 0 {
+		return
+	}
+	head, err := r.GetHeadCommit()
+	if err != nil {
+		log.Printf("Not recreating the missing diffs of D%s: %v", differentialReview.ID, err)
+		return
+	}
+	priorDiffs := differentialReview.Diffs
+	recreate := func(commit string) bool {
+		if err := repo.VerifyCommit(commit); err != nil {
+			log.Printf("Not recreating the diff for %s in D%s, as the commit is unknown: %v", commit, differentialReview.ID, err)
+			return false
+		}
+		mergeBase, err := repo.MergeBase(r.Request.TargetRef, commit)
+		if err != nil || mergeBase == commit {
+			// The commit has already been merged, so it cannot be part of the review.
+			return false
+		}
+		diff, err := arc.createDifferentialDiff(repo, mergeBase, commit, r.Request, priorDiffs)
+		if err != nil || diff == nil {
+			log.Printf("Failed to recreate the diff for %s in D%s: %v", commit, differentialReview.ID, err)
+			return false
+		}
+		if err := differentialReview.attachDiff(*diff); err != nil {
+			log.Printf("Failed to attach the recreated diff %d to D%s: %v", diff.ID, differentialReview.ID, err)
+			return false
+		}
+		log.Printf("Recreated the diff %d for %s in D%s", diff.ID, commit, differentialReview.ID)
+		arc.recordDiff(repo, commit, differentialReview.ID, diff.ID)
+		priorDiffs = append(priorDiffs, strconv.Itoa(diff.ID))
+		commitToDiffMap[commit] = strconv.Itoa(diff.ID)
+		commitToDiffIDMap[commit] = diff.ID
+		return true
+	}
+	recreated := false
+	for _, commit := range missing {
+		if commit != head && recreate(commit) {
+			recreated = true
+		}
+	}
+	if recreated || commitToDiffMap[head] == "" {
+		recreate(head)
+	}
+}
+
+// baseCommitOf returns the base commit of the given review, or the empty string if it cannot be computed.
+func baseCommitOf(r review.Review) string {
+	base, err := r.GetBaseCommit()
+	if err != nil {
+		return ""
+	}
+	return base
+}
+
+// prepareCommentRequests builds the requests that mirror the comments of the given review which
+// are not already in the given existing comments, including those that publish inline comments.
+//
+// The given PHIDs are those of the given existing comments, which are used to post replies as
+// replies to the comments that their parents were mirrored as.
+func (arc Arcanist) prepareCommentRequests(repo repository.Repo, differentialReview DifferentialReview, r review.Review, existingComments []comment.Comment, existingPHIDs []string, commitToDiffMap map[string]string) ([]createInlineRequest, []createCommentRequest) {
+	inlineRequests, commentRequests := arc.buildCommentRequests(repo, differentialReview, r.Comments, existingComments, commitToDiffMap, baseCommitOf(r))
+	setReplyTargets(inlineRequests, r.Comments, existingComments, existingPHIDs)
+	if arc.Config.ActAsCommentAuthors {
+		var publishRequests []createCommentRequest
+		inlineRequests, publishRequests = arc.actAsCommentAuthors(differentialReview, inlineRequests, arc.Config.queryUser)
+		for _, request := range commentRequests {
+			if !request.AttachInlines {
+				publishRequests = append(publishRequests, request)
+			}
+		}
+		commentRequests = publishRequests
 	}
 	return inlineRequests, commentRequests
 }
 
-type differentialUnitDiffProperty struct {
-	Name   string `json:"name"`
-	Link   string `json:"link"`
-	Result string `json:"result"`
+// editInlineValue is the value of an "inline" transaction of the differential.revision.edit API.
+type editInlineValue struct {
+	DiffID             string `json:"diffID"`
+	Path               string `json:"path"`
+	Line               uint32 `json:"line"`
+	Length             uint32 `json:"length"`
+	IsNewFile          bool   `json:"isNewFile"`
+	Content            string `json:"content"`
+	ReplyToCommentPHID string `json:"replyToCommentPHID,omitempty"`
 }
 
-func translateReportStatusToDifferentialUnitResult(status string) string {
-	if status == "success" {
-		return "pass"
-	} else if status == "failure" {
-		return "fail"
-	} else {
-		// TODO(ojarjur): This is less than ideal. Phabricator no longer has a concept
-		// of pending unit tests, so the closest match we have is that the tests have been
-		// skipped.
-		return "skip"
+// buildReplyEditRequest generates the differential.revision.edit request that posts the given
+// inline comment as a reply to the comment that is its reply target.
+func buildReplyEditRequest(request createInlineRequest) editRevisionRequest {
+	return editRevisionRequest{
+		ObjectIdentifier: "D" + request.RevisionID,
+		Transactions: []editRevisionTransaction{{
+			Type: "inline",
+			Value: editInlineValue{
+				DiffID:             request.DiffID,
+				Path:               request.FilePath,
+				Line:               request.LineNumber,
+				Length:             request.LineLength,
+				IsNewFile:          request.IsNewFile == rightHandSide,
+				Content:            request.Content,
+				ReplyToCommentPHID: request.ReplyToCommentPHID,
+			},
+		}},
+		Conduit: request.Conduit,
 	}
 }
 
-type LintDiffProperty struct {
-	Code        string `json:"code,omitempty"`
-	Severity    string `json:"severity,omitempty"`
-	Path        string `json:"path,omitempty"`
-	Line        int    `json:"line,omitempty"`
-	Description string `json:"description,omitempty"`
+// createInline posts the given inline comment, returning the PHIDs that Phabricator reported for
+// it, or the error it reported, if any.
+//
+// Replies are posted as replies to their targets if Config.UseEditAPI is set, which also publishes
+// them right away. Otherwise they are posted as drafts without a parent, like any other comment.
+func (config Config) createInline(request createInlineRequest) ([]string, error) {
+	if request.ReplyToCommentPHID != "" && config.UseEditAPI {
+		var response editRevisionResponse
+		config.runArcCommandOrDie("differential.revision.edit", buildReplyEditRequest(request), &response)
+		if response.Error != "" {
+			return nil, fmt.Errorf("%s: %s", response.Error, response.ErrorMessage)
+		}
+		var phids []string
+		for _, transaction := range response.Response.Transactions {
+			phids = append(phids, transaction.PHID)
+		}
+		return phids, nil
+	}
+	var response createInlineResponse
+	config.runArcCommandOrDie("differential.createinline", request, &response)
+	if response.Error != "" {
+		return nil, fmt.Errorf("%s: %s", response.Error, response.ErrorMessage)
+	}
+	if response.Response.PHID == "" {
+		return nil, nil
+	}
+	return []string{response.Response.PHID}, nil
 }
 
-func (arc Arcanist) mirrorStatusesForEachCommit(r review.Review, commitToDiffIDMap map[string]int) {
-	for commitHash, diffID := range commitToDiffIDMap {
-		ciNotes := r.Repo.GetNotes(ci.Ref, commitHash)
-		ciReports := ci.ParseAllValid(ciNotes)
-		latestCIReport, err := ci.GetLatestCIReport(ciReports)
-		if err != nil {
-			log.Println("Failed to load the continuous integration reports: " + err.Error())
-		} else if latestCIReport != nil {
-			arc.reportUnitResults(diffID, *latestCIReport)
+// sameThread reports whether or not the given inline comment requests are posted at the same
+// location, which is the case for the requests built for a comment and its replies.
+func sameThread(a, b createInlineRequest) bool {
+	return a.RevisionID == b.RevisionID && a.DiffID == b.DiffID && a.FilePath == b.FilePath &&
+		a.LineNumber == b.LineNumber && a.IsNewFile == b.IsNewFile
+}
+
+// postInlineRequests posts the given inline comments with the given function, running at most
+// the given number of posts at a time.
+//
+// Adjacent requests at the same location are a comment followed by its replies, so those are
+// posted one after another, in order, and the replies are not posted if an earlier comment in
+// their thread fails. Every other request is posted even if others fail. The returned errors are
+// indexed the same as the requests.
+func postInlineRequests(requests []createInlineRequest, createInline func(request createInlineRequest) error, concurrency int) []error {
+	// threadStarts holds the index of the first request of each thread.
+	var threadStarts []int
+	for i := range requests {
+		if i == 0 || !sameThread(requests[i-1], requests[i]) {
+			threadStarts = append(threadStarts, i)
+		}
+	}
+	errs := make([]error, len(requests))
+	parallel.Run(len(threadStarts), concurrency, func(thread int) {
+		start, end := threadStarts[thread], len(requests)
+		if thread+1 < len(threadStarts) {
+			end = threadStarts[thread+1]
+		}
+		for i := start; i < end; i++ {
+			if i > start && errs[i-1] != nil {
+				errs[i] = fmt.Errorf("Not posted, as an earlier comment in its thread failed: %v", errs[i-1])
+				continue
+			}
+			errs[i] = createInline(requests[i])
 		}
+	})
+	return errs
+}
 
-		analysesNotes := r.Repo.GetNotes(analyses.Ref, commitHash)
-		analysesReports := analyses.ParseAllValid(analysesNotes)
-		latestAnalysesReport, err := analyses.GetLatestAnalysesReport(analysesReports)
+// postCommentRequests sends the given requests to Phabricator, adding what was posted to the
+// given postedComments.
+//
+// The inline comments are posted first, as drafts, and the comments that publish the drafts only
+// once all of those posts succeeded. If any inline comment fails to post, then it is logged, and
+// the publishing comments are held back until a later pass has posted it, so that the threads are
+// published together and in order. The drafts that were posted are remembered in postedDrafts, so
+// that the later pass does not post them again.
+func (config Config) postCommentRequests(inlineRequests []createInlineRequest, commentRequests []createCommentRequest, postedComments *postedComments) {
+	var pending []createInlineRequest
+	for _, request := range inlineRequests {
+		if !isCached(postedDrafts, draftKey(request)) {
+			pending = append(pending, request)
+		}
+	}
+	createInline := func(request createInlineRequest) error {
+		phids, err := config.createInline(request)
+		postedComments.addPHIDs(phids)
+		return err
+	}
+	var posted []createInlineRequest
+	for i, err := range postInlineRequests(pending, createInline, config.CommentPostConcurrency) {
+		request := pending[i]
 		if err != nil {
-			log.Println("Failed to load the static analysis reports: " + err.Error())
-		} else if latestAnalysesReport != nil {
-			lintResults, err := latestAnalysesReport.GetLintReportResult()
-			if err != nil {
-				log.Println("Failed to load the static analysis reports: " + err.Error())
-			} else {
-				arc.reportLintResults(diffID, lintResults)
-			}
+			log.Printf("Failed to post the comment on line %d of %s into D%s: %v", request.LineNumber, request.FilePath, request.RevisionID, err)
+		} else {
+			posted = append(posted, request)
+			metrics.CommentsMirrored.WithLabelValues(metrics.DirectionToPhabricator).Inc()
+		}
+	}
+	inlinesFailed := len(posted) < len(pending)
+	if inlinesFailed {
+		for _, request := range posted {
+			addToCache(postedDrafts, draftKey(request))
+		}
+	}
+	for _, request := range commentRequests {
+		if request.AttachInlines && inlinesFailed {
+			log.Printf("Not publishing the inline comments in D%s yet, as some of them failed to post", request.RevisionID)
+			continue
+		}
+		if err := config.createComment(request); err != nil {
+			log.Println(err)
+			continue
+		}
+		postedComments.addMessage(request)
+		if !request.AttachInlines {
+			// The requests that attach inline comments only publish those, which were counted above.
+			metrics.CommentsMirrored.WithLabelValues(metrics.DirectionToPhabricator).Inc()
 		}
 	}
 }
 
-func (arc Arcanist) mirrorCommentsIntoReview(repo repository.Repo, differentialReview DifferentialReview, r review.Review) {
-	commitToDiffMap := make(map[string]string)
-	commitToDiffIDMap := make(map[string]int)
-	for _, diffIDString := range differentialReview.Diffs {
-		lastCommit := findCommitForDiff(diffIDString)
-		commitToDiffMap[lastCommit] = diffIDString
-		diffID, err := strconv.Atoi(diffIDString)
-		if err == nil {
-			commitToDiffIDMap[lastCommit] = diffID
+// commentVerificationRetries is how many times we repost comments that did not show up in a revision.
+const commentVerificationRetries = 1
+
+// commentVerificationDelay is how long we wait before re-reading the comments that seem to be
+// missing from a revision, as the comments we just posted may not be readable right away.
+const commentVerificationDelay = 2 * time.Second
+
+// verifyMirroredComments re-reads the comments of the given revision to confirm that the comments
+// we just mirrored into it are all there, and reposts any that are missing.
+//
+// Comments that are still missing after that are logged, and will be retried on the next pass.
+func (arc Arcanist) verifyMirroredComments(repo repository.Repo, differentialReview DifferentialReview, r review.Review, commitToDiffMap map[string]string, posted *postedComments) {
+	findMissing := func() ([]createInlineRequest, []createCommentRequest) {
+		existingComments, existingPHIDs, since, err := differentialReview.loadCommentsWithPHIDs()
+		if err != nil {
+			log.Printf("Not verifying the comments mirrored into D%s, as we could not read them: %v", differentialReview.ID, err)
+			return nil, nil
+		}
+		verified := r
+		if since != 0 {
+			verified.Comments = threadsSince(r.Comments, since)
 		}
+		return arc.prepareCommentRequests(repo, differentialReview, verified, existingComments, existingPHIDs, commitToDiffMap)
 	}
-	arc.mirrorStatusesForEachCommit(r, commitToDiffIDMap)
+	repost := func(inlineRequests []createInlineRequest, commentRequests []createCommentRequest) {
+		arc.Config.postCommentRequests(inlineRequests, commentRequests, posted)
+	}
+	verifyComments(differentialReview.ID, findMissing, repost, time.Sleep)
+}
 
-	existingComments := differentialReview.LoadComments()
-	inlineRequests, commentRequests := differentialReview.buildCommentRequests(r.Comments, existingComments, commitToDiffMap)
-	for _, request := range inlineRequests {
-		var response createInlineResponse
-		runArcCommandOrDie("differential.createinline", request, &response)
-		if response.Error != "" {
-			log.Println(response.ErrorMessage)
+// verifyComments confirms that the comments mirrored into the revision with the given ID are all
+// there, by building the requests for those that are missing with the given function, and reposts
+// those with the given function.
+//
+// A comment is only reposted if it is missing from two reads, with the given function waiting
+// for commentVerificationDelay in between, so that we do not post duplicates of the comments that
+// were simply not readable yet.
+func verifyComments(revisionID string, findMissing func() ([]createInlineRequest, []createCommentRequest), repost func([]createInlineRequest, []createCommentRequest), sleep func(time.Duration)) {
+	for attempt := 0; ; attempt++ {
+		if inlineRequests, commentRequests := findMissing(); len(inlineRequests) == 0 && len(commentRequests) == 0 {
+			return
+		}
+		sleep(commentVerificationDelay)
+		inlineRequests, commentRequests := findMissing()
+		if len(inlineRequests) == 0 && len(commentRequests) == 0 {
+			return
+		}
+		for _, request := range inlineRequests {
+			log.Printf("The comment on line %d of %s was not attached to D%s", request.LineNumber, request.FilePath, revisionID)
+		}
+		if attempt >= commentVerificationRetries {
+			log.Printf("Warning: %d inline comments and %d comments are still missing from D%s after mirroring them",
+				len(inlineRequests), len(commentRequests), revisionID)
+			return
 		}
+		log.Printf("Reposting %d inline comments and %d comments that are missing from D%s",
+			len(inlineRequests), len(commentRequests), revisionID)
+		repost(inlineRequests, commentRequests)
 	}
-	for _, request := range commentRequests {
-		var response createCommentResponse
-		runArcCommandOrDie("differential.createcomment", request, &response)
-		if response.Error != "" {
-			log.Println(response.ErrorMessage)
+}
+
+// recordMirroredComments records the transactions and comments that we just created on the given
+// revision, so that they are never mirrored back into git-notes.
+//
+// Those are the ones that Phabricator reported creating, plus the comments posted with
+// differential.createcomment, which does not report what it created. Those are found by
+// comparing the revision's current transactions to the given ones from before we posted our
+// comments, and only match the exact messages that we posted as each user, so that comments
+// posted by people in the meantime are still mirrored.
+func (arc Arcanist) recordMirroredComments(repo repository.Repo, differentialReview DifferentialReview, reviewCommit string, before []differentialDatabaseTransaction, posted *postedComments) {
+	phids := posted.phids
+	if len(posted.messages) > 0 {
+		self, err := arc.Config.whoAmI()
+		if err != nil {
+			log.Print(err)
+			return
+		}
+		readTransactions, readTransactionComment := arc.Config.transactionReaders()
+		if after, err := readTransactions(differentialReview.PHID); err != nil {
+			log.Printf("Failed to find the comments mirrored into D%s: %v", differentialReview.ID, err)
+		} else {
+			phids = append(phids, postedMessageTransactions(before, after, posted.messagesByAuthor(self.PHID), readTransactionComment)...)
 		}
 	}
+	if err := recordMirroredTransactions(repo, reviewCommit, phids); err != nil {
+		log.Printf("Failed to record the comments mirrored into D%s: %v", differentialReview.ID, err)
+	}
 }
 
-func generateUnitDiffProperty(report ci.Report) (string, error) {
-	if report.URL == "" {
-		return "", nil
+// generateUnitDiffProperty generates the "arc:unit" diff property for the given CI reports, with
+// one result for each report that has a URL.
+//
+// Each result is labeled with its report's agent, or with the given default name if the report has no agent.
+func generateUnitDiffProperty(reports []ci.Report, defaultName string) (string, error) {
+	var unitDiffProperties []differentialUnitDiffProperty
+	for _, report := range reports {
+		if report.URL == "" {
+			continue
+		}
+		name := report.Agent
+		if name == "" {
+			name = defaultName
+		}
+		unitDiffProperties = append(unitDiffProperties, differentialUnitDiffProperty{
+			Name:   name,
+			Link:   report.URL,
+			Result: translateReportStatusToDifferentialUnitResult(report.Status),
+		})
 	}
-	unitDiffProperty := differentialUnitDiffProperty{
-		Name:   report.Agent,
-		Link:   report.URL,
-		Result: translateReportStatusToDifferentialUnitResult(report.Status),
+	if len(unitDiffProperties) == 0 {
+		return "", nil
 	}
-	// Note that although the unit tests property is a JSON object, Phabricator
-	// expects there to be a list of such objects for any given diff. Therefore
-	// we wrap the object in a list before marshaling it to send to the server.
-	// TODO(ojarjur): We should take advantage of the fact that this is a list,
-	// and include the latest CI report for each agent. That would allow us to
-	// display results from multiple test runners in a code review.
-	propertyBytes, err := json.Marshal([]differentialUnitDiffProperty{unitDiffProperty})
+	// Phabricator expects a list of results for any given diff, so that the results from
+	// multiple test runners show up as separate rows.
+	propertyBytes, err := json.Marshal(unitDiffProperties)
 	if err != nil {
 		return "", err
 	}
 	return string(propertyBytes), nil
 }
 
-func (arc Arcanist) reportUnitResults(diffID int, unitReport ci.Report) {
-	log.Printf("The latest unit report for diff %d is %s ", diffID, unitReport)
-	diffProperty, err := generateUnitDiffProperty(unitReport)
+func (arc Arcanist) reportUnitResults(diffID int, unitReports []ci.Report) {
+	log.Printf("The latest unit reports for diff %d are %v ", diffID, unitReports)
+	if arc.Config.CIBackend == CIBackendHarbormaster {
+		if err := arc.sendHarbormasterMessage(diffID, unitReports); err != nil {
+			// We will try again the next time the review is mirrored.
+			log.Print(err)
+		}
+		return
+	}
+	diffProperty, err := generateUnitDiffProperty(unitReports, arc.Config.UnitResultName)
 	if err == nil && diffProperty != "" {
 		err = arc.setDiffProperty(diffID, unitDiffPropertyName, diffProperty)
 	}
@@ -522,12 +2815,16 @@ func (arc Arcanist) reportUnitResults(diffID int, unitReport ci.Report) {
 	}
 }
 
-func generateLintDiffProperty(lintResults []analyses.AnalyzeResponse) (string, error) {
+// generateLintDiffProperty generates the "arc:lint" diff property for the given analysis results.
+//
+// Each result is labeled with the given name, which may be empty.
+func generateLintDiffProperty(lintResults []analyses.AnalyzeResponse, name string) (string, error) {
 	var lintDiffProperties []LintDiffProperty
 	for _, analyzeResponse := range lintResults {
 		for _, note := range analyzeResponse.Notes {
 			if note.Location != nil && note.Location.Range != nil {
 				lintProperty := LintDiffProperty{
+					Name: name,
 					Code: note.Category,
 					// TODO(ojarjur): Don't just treat everything as a warning.
 					Severity:    "warning",
@@ -548,7 +2845,7 @@ func generateLintDiffProperty(lintResults []analyses.AnalyzeResponse) (string, e
 
 func (arc Arcanist) reportLintResults(diffID int, lintResults []analyses.AnalyzeResponse) {
 	log.Printf("The latest lint report for diff %d is %s ", diffID, lintResults)
-	diffProperty, err := generateLintDiffProperty(lintResults)
+	diffProperty, err := generateLintDiffProperty(lintResults, arc.Config.LintResultName)
 	if err == nil && diffProperty != "" {
 		err = arc.setDiffProperty(diffID, lintDiffPropertyName, diffProperty)
 	}
@@ -557,6 +2854,28 @@ func (arc Arcanist) reportLintResults(diffID int, lintResults []analyses.Analyze
 	}
 }
 
+// targetRefDeleted reports whether or not the target ref of the given review request no longer exists.
+//
+// The target ref can be deleted while we are in the middle of mirroring a review. When that happens,
+// we skip the rest of the review's processing, so that we do not leave the revision partially updated,
+// and let the next pass pick up whatever state the repo is in then. The review is skipped on every
+// pass until then, so that is only logged the first time.
+func targetRefDeleted(repo repository.Repo, revision string, req request.Request) bool {
+	if err := repo.VerifyGitRef(req.TargetRef); err == nil {
+		return false
+	}
+	key := revision + " " + req.TargetRef
+	if !isCached(deletedTargetRefsLogged, key) {
+		addToCache(deletedTargetRefsLogged, key)
+		log.Printf("Skipping the review of %s, as its target ref %q no longer exists", revision, req.TargetRef)
+	}
+	return true
+}
+
+// deletedTargetRefsLogged holds the revisions and target refs of the reviews for which we logged
+// that the target ref no longer exists.
+var deletedTargetRefsLogged = make(map[string]bool)
+
 // updateReviewDiffs updates the status of a differential review so that it matches the state of the repo.
 //
 // This consists of making sure the latest commit pushed to the review ref has a corresponding
@@ -569,10 +2888,14 @@ func (arc Arcanist) updateReviewDiffs(repo repository.Repo, differentialReview D
 	headRevision := headCommit
 	mergeBase, err := repo.MergeBase(req.TargetRef, headRevision)
 	if err != nil {
+		if targetRefDeleted(repo, r.Revision, req) {
+			return
+		}
 		log.Fatal(err)
 	}
-	for _, hashPair := range differentialReview.Hashes {
-		if len(hashPair) == 2 && hashPair[0] == commitHashType && hashPair[1] == headCommit {
+	arc.updateRevision(repo, differentialReview, r)
+	for _, commit := range differentialReview.commitHashes() {
+		if commit == headCommit {
 			// The review already has the hash of the HEAD commit, so we have nothing to do beyond mirroring comments
 			// and build status if applicable
 			arc.mirrorCommentsIntoReview(repo, differentialReview, r)
@@ -580,46 +2903,315 @@ func (arc Arcanist) updateReviewDiffs(repo repository.Repo, differentialReview D
 		}
 	}
 
-	diff, err := arc.createDifferentialDiff(repo, mergeBase, headRevision, req, differentialReview.Diffs)
+	if arc.skipOversizedDiff(repo, &differentialReview, mergeBase, headRevision) {
+		return
+	}
+	commits := []string{headRevision}
+	if arc.Config.DiffMode == DiffModePerCommit {
+		reviewCommits, err := repo.ListCommitsBetween(mergeBase, headRevision)
+		if err != nil {
+			log.Fatal(err)
+		}
+		commits = commitsToMirror(reviewCommits, differentialReview.commitHashes(), headRevision)
+	}
+	priorDiffs := differentialReview.Diffs
+	for _, commit := range commits {
+		diff, err := arc.createDifferentialDiff(repo, mergeBase, commit, req, priorDiffs)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if diff == nil {
+			// This means that phabricator silently refused to create the diff. Just move on.
+			return
+		}
+
+		if err := differentialReview.attachDiff(*diff); err != nil {
+			log.Fatal(err)
+		}
+		arc.recordDiff(repo, commit, differentialReview.ID, diff.ID)
+		priorDiffs = append(priorDiffs, strconv.Itoa(diff.ID))
+	}
+}
+
+// skippedDiffs holds the head commits whose diffs we skipped for changing too many files, so that
+// we only explain that once per commit.
+var skippedDiffs = make(map[string]bool)
+
+// buildOversizedDiffComment generates the comment that explains why the diff of the given commit was not uploaded.
+func buildOversizedDiffComment(differentialReview DifferentialReview, head string, changedFiles, limit int) createCommentRequest {
+	return createCommentRequest{
+		RevisionID: differentialReview.ID,
+		Message: fmt.Sprintf("The diff for %s was not uploaded, as it changes %d files, which is more than the limit of %d.",
+			head, changedFiles, limit),
+		Action: "comment",
+	}
+}
+
+// skipOversizedDiff reports whether or not the diff from the given base to head changes more
+// files than we are configured to upload.
+//
+// If so, and the diff would have been added to an existing revision, then we post a comment on
+// that revision explaining why the diff is missing.
+func (arc Arcanist) skipOversizedDiff(repo repository.Repo, differentialReview *DifferentialReview, base, head string) bool {
+	if arc.Config.MaxChangedFiles <= 0 {
+		return false
+	}
+	changedFiles, err := countChangedFiles(repo, base, head)
 	if err != nil {
 		log.Fatal(err)
 	}
-	if diff == nil {
-		// This means that phabricator silently refused to create the diff. Just move on.
-		return
+	if changedFiles <= arc.Config.MaxChangedFiles {
+		return false
+	}
+	if isCached(skippedDiffs, head) {
+		return true
+	}
+	log.Printf("Skipping the diff for %s, as it changes %d files", head, changedFiles)
+	if differentialReview != nil {
+		request := buildOversizedDiffComment(*differentialReview, head, changedFiles, arc.Config.MaxChangedFiles)
+		if err := arc.Config.createComment(request); err != nil {
+			log.Println(err)
+		}
+	}
+	addToCache(skippedDiffs, head)
+	return true
+}
+
+// commitsToMirror returns the commits for which to upload diffs, in order, given the commits in
+// the review (oldest first) and those that have already been uploaded.
+//
+// The head commit is always included, even if it is not in the list of review commits.
+func commitsToMirror(reviewCommits, mirroredCommits []string, head string) []string {
+	mirrored := make(map[string]bool)
+	for _, commit := range mirroredCommits {
+		mirrored[commit] = true
+	}
+	var commits []string
+	for _, commit := range reviewCommits {
+		if !mirrored[commit] && commit != head {
+			commits = append(commits, commit)
+		}
 	}
+	return append(commits, head)
+}
 
+// attachDiff updates the revision to use the given diff.
+func (differentialReview DifferentialReview) attachDiff(diff differentialDiff) error {
+	if differentialReview.config.UseEditAPI {
+		request := editRevisionRequest{
+			ObjectIdentifier: differentialReview.PHID,
+			Transactions:     []editRevisionTransaction{{Type: "update", Value: diff.PHID}},
+		}
+		var response editRevisionResponse
+		differentialReview.config.runArcCommandOrDie("differential.revision.edit", request, &response)
+		if response.Error != "" {
+			return errors.New(response.ErrorMessage)
+		}
+		return nil
+	}
 	updateRequest := differentialUpdateRevisionRequest{ID: differentialReview.ID, DiffID: strconv.Itoa(diff.ID)}
 	var updateResponse differentialUpdateRevisionResponse
-	runArcCommandOrDie("differential.updaterevision", updateRequest, &updateResponse)
+	differentialReview.config.runArcCommandOrDie("differential.updaterevision", updateRequest, &updateResponse)
 	if updateResponse.Error != "" {
-		log.Fatal(updateResponse.ErrorMessage)
+		return errors.New(updateResponse.ErrorMessage)
+	}
+	return nil
+}
+
+// RebuildDiffs recreates the diff of each open revision for the review of the given
+// revision from the current state of the repo, and attaches it to the revision.
+//
+// This is a repair tool for revisions whose diffs are in a bad state (e.g. with the wrong
+// base commit or corrupted diff properties). The new diff does not carry over any of the
+// properties of the prior diffs, such as their "local:commits", and the unit and lint
+// results for the review's head commit are reported again.
+func (arc Arcanist) RebuildDiffs(repo repository.Repo, revision string) error {
+	r, base, head, err := arc.reviewRange(repo, revision)
+	if err != nil {
+		return err
+	}
+	rebuilt := 0
+	for _, differentialReview := range arc.listDifferentialReviewsOrDie(revision) {
+		if differentialReview.isClosed() {
+			continue
+		}
+		diff, err := arc.createDifferentialDiff(repo, base, head, r.Request, nil)
+		if err != nil {
+			return err
+		}
+		if diff == nil {
+			return fmt.Errorf("Phabricator refused to create a diff for %s..%s", base, head)
+		}
+		if err := differentialReview.attachDiff(*diff); err != nil {
+			return err
+		}
+		arc.recordDiff(repo, head, differentialReview.ID, diff.ID)
+		arc.mirrorStatusesForEachCommit(*r, map[string]int{head: diff.ID})
+		log.Printf("Rebuilt D%s with the diff %d", differentialReview.ID, diff.ID)
+		rebuilt++
+	}
+	if rebuilt == 0 {
+		return fmt.Errorf("There are no open revisions for the review of %s", revision)
+	}
+	return nil
+}
+
+// reviewRange loads the review of the given revision, along with the base and head commits of its diff.
+func (arc Arcanist) reviewRange(repo repository.Repo, revision string) (r *review.Review, base, head string, err error) {
+	summary, err := review.GetSummary(repo, revision)
+	if err != nil {
+		return nil, "", "", err
+	}
+	if summary == nil {
+		return nil, "", "", fmt.Errorf("There is no review of %s", revision)
+	}
+	r, err = summary.Details()
+	if err != nil {
+		return nil, "", "", err
+	}
+	arc.withDefaultTargetRef(r)
+	base, err = r.GetBaseCommit()
+	if err != nil {
+		return nil, "", "", fmt.Errorf("Failed to compute the base commit for the review of %s: %v", revision, err)
+	}
+	head, err = r.GetHeadCommit()
+	if err != nil {
+		return nil, "", "", fmt.Errorf("Failed to compute the head commit for the review of %s: %v", revision, err)
+	}
+	return r, base, head, nil
+}
+
+// PreviewDiff returns the raw diff that would be uploaded to Phabricator for the review of the
+// given revision, without creating anything in Phabricator.
+//
+// This is meant for debugging, to tell problems with how we generate diffs apart from problems
+// with how Phabricator parses them.
+func (arc Arcanist) PreviewDiff(repo repository.Repo, revision string) (string, error) {
+	_, base, head, err := arc.reviewRange(repo, revision)
+	if err != nil {
+		return "", err
+	}
+	return arc.getRawDiff(repo, base, head)
+}
+
+// selectRevisions picks which of the given open revisions for a single review to update,
+// according to the given policy for duplicate revisions.
+func selectRevisions(open []DifferentialReview, policy, mirrorPHID string) []DifferentialReview {
+	if len(open) <= 1 {
+		return open
+	}
+	switch policy {
+	case DuplicateRevisionsMirrorOwned:
+		var owned []DifferentialReview
+		for _, differentialReview := range open {
+			if differentialReview.AuthorPHID == mirrorPHID {
+				owned = append(owned, differentialReview)
+			}
+		}
+		return owned
+	case DuplicateRevisionsNewest:
+		newest := open[0]
+		for _, differentialReview := range open[1:] {
+			newestID, _ := strconv.Atoi(newest.ID)
+			if id, err := strconv.Atoi(differentialReview.ID); err == nil && id > newestID {
+				newest = differentialReview
+			}
+		}
+		return []DifferentialReview{newest}
+	default:
+		return open
+	}
+}
+
+// revisionsToUpdate returns which of the given revisions for the review of the given commit should be updated.
+//
+// Closed revisions are never updated, and if more than one revision is open, then we warn about it
+// and follow the configured policy for duplicate revisions.
+func (arc Arcanist) revisionsToUpdate(revision string, existingReviews []DifferentialReview) []DifferentialReview {
+	var open []DifferentialReview
+	var ids []string
+	for _, differentialReview := range existingReviews {
+		if !differentialReview.isClosed() {
+			open = append(open, differentialReview)
+			ids = append(ids, "D"+differentialReview.ID)
+		}
 	}
+	if len(open) <= 1 {
+		return open
+	}
+	mirrorPHID := ""
+	if arc.Config.DuplicateRevisions == DuplicateRevisionsMirrorOwned {
+		self, err := arc.Config.whoAmI()
+		if err != nil {
+			log.Print(err)
+			return nil
+		}
+		mirrorPHID = self.PHID
+	}
+	selected := selectRevisions(open, arc.Config.DuplicateRevisions, mirrorPHID)
+	var selectedIDs []string
+	for _, differentialReview := range selected {
+		selectedIDs = append(selectedIDs, "D"+differentialReview.ID)
+	}
+	log.Printf("Warning: the review of %s has multiple open revisions (%s); only updating %v",
+		revision, strings.Join(ids, ", "), selectedIDs)
+	return selected
 }
 
 // EnsureRequestExists runs the "arcanist" command-line tool to create a Differential diff for the given request, if one does not already exist.
 func (arc Arcanist) EnsureRequestExists(repo repository.Repo, review review.Review) {
+	arc.withDefaultTargetRef(&review)
 	revision := review.Revision
 	req := review.Request
 
 	// If this revision has been previously closed shortcut all processing
-	if closedRevisionsMap[revision] {
+	if isCached(closedRevisionsMap, revision) {
+		return
+	}
+	// The review ref is the revision itself if it cannot be read (e.g. once it is deleted).
+	emptyHead, err := review.GetHeadCommit()
+	if err != nil {
+		emptyHead = revision
+	}
+	if review.Submitted && !arc.Config.CloseEmptyReviews && isUnchangedEmptyReview(revision, emptyHead) {
 		return
 	}
 	existingReviews := arc.listDifferentialReviewsOrDie(revision)
+	if review.Submitted && !arc.Config.CloseEmptyReviews && !hasDiffs(existingReviews) {
+		// Nothing was ever reviewed, so we do not know that the change was merged. We also do
+		// not remember the review as closed, as its review ref may still get commits to review,
+		// but we do not look for its revisions again until it does.
+		log.Printf("Not treating the review of %s as merged, as it has no revision with diffs", revision)
+		storeInCache(emptyMergedReviews, revision, emptyHead)
+		return
+	}
 	if review.Submitted {
-		// The change has already been merged in, so we should simply close any open reviews.
+		// The change has already been merged in, so we should close (or otherwise mark) any open reviews.
+		handled := true
 		for _, differentialReview := range existingReviews {
 			if !differentialReview.isClosed() {
-				differentialReview.close()
+				if err := arc.handleMerged(repo, differentialReview, review); err != nil {
+					// We will try again on the next pass, up to maxCloseAttempts times.
+					log.Print(err)
+					handled = false
+				}
 			}
 		}
-		closedRevisionsMap[revision] = true
+		if !handled && recordCloseFailure(revision) {
+			log.Printf("Giving up on closing the revisions of %s after %d attempts", revision, maxCloseAttempts)
+			handled = true
+		}
+		if handled {
+			addToCache(closedRevisionsMap, revision)
+		}
 		return
 	}
 
 	base, err := review.GetBaseCommit()
 	if err != nil {
+		if targetRefDeleted(repo, revision, req) {
+			return
+		}
 		// There are lots of reasons that we might not be able to compute a base commit,
 		// (e.g. the revision already being merged in, or being dropped and garbage collected),
 		// but they all indicate that the review request is no longer valid.
@@ -630,19 +3222,31 @@ func (arc Arcanist) EnsureRequestExists(repo repository.Repo, review review.Revi
 	head, err := review.GetHeadCommit()
 	if err != nil {
 		// The given review ref has been deleted (or never existed), but the change wasn't merged.
-		// TODO(ojarjur): We should mark the existing reviews as abandoned.
 		log.Printf("Ignoring review because the review ref '%s' does not exist", req.ReviewRef)
+		if arc.Config.AbandonDeletedReviews {
+			for _, differentialReview := range existingReviews {
+				if differentialReview.statusCategory() == statusAccepted {
+					// The change was most likely landed by some other means (e.g. a squash merge).
+					log.Printf("Not abandoning D%s, as it was accepted", differentialReview.ID)
+				} else if !differentialReview.isClosed() {
+					arc.abandon(differentialReview)
+				}
+			}
+		}
 		return
 	}
 
 	if len(existingReviews) > 0 {
 		// The change is still pending, but we already have existing reviews, so we should just update those.
-		for _, existing := range existingReviews {
+		for _, existing := range arc.revisionsToUpdate(revision, existingReviews) {
 			arc.updateReviewDiffs(repo, existing, head, req, review)
 		}
 		return
 	}
 
+	if arc.skipOversizedDiff(repo, nil, base, revision) {
+		return
+	}
 	diff, err := arc.createDifferentialDiff(repo, base, revision, req, []string{})
 	if err != nil {
 		log.Fatal(err)
@@ -651,18 +3255,143 @@ func (arc Arcanist) EnsureRequestExists(repo repository.Repo, review review.Revi
 		// The revision is already merged in, ignore it.
 		return
 	}
-	rev, err := arc.createDifferentialRevision(repo, revision, diff.ID, req)
+	rev, err := arc.createDifferentialRevision(repo, base, revision, *diff, req)
 	if err != nil {
 		log.Fatal(err)
 	}
+	metrics.ReviewsCreated.Inc()
 	log.Printf("Created diff %v and revision %v for the review of %s", diff, rev, revision)
+	arc.recordDiff(repo, revision, strconv.Itoa(rev.RevisionID), diff.ID)
+	if err := recordMirroredRequest(repo, revision, strconv.Itoa(rev.RevisionID), req.Timestamp); err != nil {
+		log.Printf("Failed to record the request mirrored into D%d: %v", rev.RevisionID, err)
+	}
 
 	// If the review already contains multiple commits by the time we mirror it, then
 	// we need to ensure that at least the first and last ones are added.
-	existingReviews = arc.listDifferentialReviewsOrDie(revision)
-	for _, existing := range existingReviews {
-		arc.updateReviewDiffs(repo, existing, head, req, review)
+	created := arc.getDifferentialReviewOrDie(rev.RevisionID)
+	if created == nil {
+		log.Printf("Failed to read the newly created revision D%d; it will be updated the next time the review is mirrored", rev.RevisionID)
+		return
+	}
+	arc.updateReviewDiffs(repo, *created, head, req, review)
+}
+
+// hasDiffs reports whether or not any of the given revisions have diffs.
+func hasDiffs(differentialReviews []DifferentialReview) bool {
+	for _, differentialReview := range differentialReviews {
+		if len(differentialReview.Diffs) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// GuessCallsign returns the likely callsign (the identifier Phabricator uses for a repo)
+// of the repo at the given path, or the empty string if it cannot be guessed.
+//
+// We cannot determine the repo's callsign in all cases, but we can figure it out in the
+// case that the mirror runs on the same directories that Phabricator is using. In that
+// scenario, the repo directories default to being named "/var/repo/<CALLSIGN>", so if the
+// repo path starts with that prefix then we can try to strip out that prefix and use the
+// rest as a callsign.
+func GuessCallsign(repoPath string) string {
+	return Config{}.GuessCallsign(repoPath)
+}
+
+// GuessCallsign is like the GuessCallsign function, but for the repo directory prefix in the config.
+func (config Config) GuessCallsign(repoPath string) string {
+	prefix := config.repoDirPrefix()
+	if !strings.HasPrefix(repoPath, prefix) {
+		return ""
+	}
+	return strings.TrimPrefix(repoPath, prefix)
+}
+
+type repositorySearchRequest struct {
+	Constraints struct {
+		URIs      []string `json:"uris,omitempty"`
+		Callsigns []string `json:"callsigns,omitempty"`
+	} `json:"constraints"`
+}
+
+type repositorySearchResponse struct {
+	Error        string `json:"error,omitempty"`
+	ErrorMessage string `json:"errorMessage,omitempty"`
+	Response     struct {
+		Data []struct {
+			PHID   string `json:"phid"`
+			Fields struct {
+				Callsign *string `json:"callsign"`
+			} `json:"fields"`
+		} `json:"data"`
+	} `json:"response,omitempty"`
+}
+
+// remoteCallsigns caches the callsigns of the Diffusion repositories, keyed by their remote URLs.
+var remoteCallsigns = make(map[string]string)
+
+// lookupCallsign returns the callsign of the Diffusion repository with the given URI, or the
+// empty string if it cannot be determined.
+//
+// This corresponds to calling the diffusion.repository.search API.
+func (arc Arcanist) lookupCallsign(url string) string {
+	if callsign, ok := lookupCache(remoteCallsigns, url); ok {
+		return callsign
+	}
+	var request repositorySearchRequest
+	request.Constraints.URIs = []string{url}
+	var response repositorySearchResponse
+	arc.Config.runArcCommandOrDie("diffusion.repository.search", request, &response)
+	if response.Error != "" {
+		log.Printf("Failed to look up the repository for %s: %s", url, response.ErrorMessage)
+		return ""
+	}
+	callsign := ""
+	for _, r := range response.Response.Data {
+		if r.Fields.Callsign != nil && *r.Fields.Callsign != "" {
+			callsign = *r.Fields.Callsign
+			break
+		}
+	}
+	storeInCache(remoteCallsigns, url, callsign)
+	return callsign
+}
+
+// repositoryPHIDs caches the Diffusion PHIDs of repos, keyed by callsign.
+var repositoryPHIDs = make(map[string]string)
+
+// repositoryPHID returns the PHID of the Diffusion repository for the given repo, or the
+// empty string if it cannot be determined.
+//
+// This corresponds to calling the diffusion.repository.search API, which replaces the deprecated
+// repository.query API.
+func (arc Arcanist) repositoryPHID(repo repository.Repo) string {
+	callsign := arc.RepoCallsign(repo)
+	if callsign == "" {
+		return ""
+	}
+	if phid, ok := lookupCache(repositoryPHIDs, callsign); ok {
+		return phid
+	}
+	var request repositorySearchRequest
+	request.Constraints.Callsigns = []string{callsign}
+	var response repositorySearchResponse
+	arc.Config.runArcCommandOrDie("diffusion.repository.search", request, &response)
+	if response.Error != "" {
+		log.Printf("Failed to look up the repository %s: %s", callsign, response.ErrorMessage)
+		return ""
+	}
+	phid := ""
+	for _, r := range response.Response.Data {
+		if r.Fields.Callsign != nil && *r.Fields.Callsign == callsign {
+			phid = r.PHID
+		}
+	}
+	if phid == "" {
+		log.Printf("No Diffusion repository has the callsign %s", callsign)
 	}
+	storeInCache(repositoryPHIDs, callsign, phid)
+	return phid
 }
 
 // lookSoonRequest specifies a list of callsigns (repo identifier) for repos that have recently changed.
@@ -674,15 +3403,9 @@ type lookSoonRequest struct {
 //
 // This corresponds to calling the diffusion.looksoon API.
 func (arc Arcanist) Refresh(repo repository.Repo) {
-	// We cannot determine the repo's callsign (the identifier Phabricator uses for the repo)
-	// in all cases, but we can figure it out in the case that the mirror runs on the same
-	// directories that Phabricator is using. In that scenario, the repo directories default
-	// to being named "/var/repo/<CALLSIGN>", so if the repo path starts with that prefix then
-	// we can try to strip out that prefix and use the rest as a callsign.
-	if strings.HasPrefix(repo.GetPath(), defaultRepoDirPrefix) {
-		possibleCallsign := strings.TrimPrefix(repo.GetPath(), defaultRepoDirPrefix)
+	if possibleCallsign := arc.RepoCallsign(repo); possibleCallsign != "" {
 		request := lookSoonRequest{Callsigns: []string{possibleCallsign}}
 		response := make(map[string]interface{})
-		runArcCommandOrDie("diffusion.looksoon", request, &response)
+		arc.Config.runArcCommandOrDie("diffusion.looksoon", request, &response)
 	}
 }
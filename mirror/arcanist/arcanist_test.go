@@ -17,14 +17,536 @@ limitations under the License.
 package arcanist
 
 import (
+	"encoding/json"
+	"fmt"
+	"github.com/google/git-appraise/repository"
 	"github.com/google/git-appraise/review"
 	"github.com/google/git-appraise/review/analyses"
 	"github.com/google/git-appraise/review/ci"
 	"github.com/google/git-appraise/review/comment"
+	"github.com/google/git-appraise/review/request"
+	"github.com/google/git-phabricator-mirror/mirror/metrics"
+	review_utils "github.com/google/git-phabricator-mirror/mirror/review"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
+// listingRepo is a commitGraphRepo that lists the given commits as descendants of any commit.
+type listingRepo struct {
+	commitGraphRepo
+	descendants []string
+}
+
+func (repo listingRepo) ListCommitsBetween(from, to string) ([]string, error) {
+	return repo.descendants, nil
+}
+
+// deletedRefRepo is a repository.Repo from which the given ref has been deleted.
+type deletedRefRepo struct {
+	repository.Repo
+	deletedRef string
+}
+
+func (repo deletedRefRepo) VerifyGitRef(ref string) error {
+	if ref == repo.deletedRef {
+		return fmt.Errorf("Unknown ref %q", ref)
+	}
+	return repo.Repo.VerifyGitRef(ref)
+}
+
+func (repo deletedRefRepo) MergeBase(a, b string) (string, error) {
+	if a == repo.deletedRef || b == repo.deletedRef {
+		return "", fmt.Errorf("Unknown ref %q", repo.deletedRef)
+	}
+	return repo.Repo.MergeBase(a, b)
+}
+
+func TestUpdateReviewDiffsWithDeletedTargetRef(t *testing.T) {
+	mockRepo := repository.NewMockRepoForTest()
+	var r review.Summary
+	for _, summary := range review.ListAll(mockRepo) {
+		if !summary.Submitted {
+			r = summary
+		}
+	}
+	if r.Revision == "" {
+		t.Fatal("The mock repo has no open reviews")
+	}
+	repo := deletedRefRepo{mockRepo, r.Request.TargetRef}
+	for i := 0; i < 2; i++ {
+		if !targetRefDeleted(repo, r.Revision, r.Request) {
+			t.Errorf("The deleted target ref %q was not detected", r.Request.TargetRef)
+		}
+	}
+	if !isCached(deletedTargetRefsLogged, r.Revision+" "+r.Request.TargetRef) {
+		t.Errorf("The deleted target ref %q was not recorded as logged", r.Request.TargetRef)
+	}
+	if targetRefDeleted(mockRepo, r.Revision, r.Request) {
+		t.Errorf("The target ref %q was reported as deleted", r.Request.TargetRef)
+	}
+	details, err := r.Details()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	originalCallConduit := callConduit
+	defer func() { callConduit = originalCallConduit }()
+	callConduit = func(config Config, method string, request interface{}, response interface{}) {
+		t.Errorf("Unexpected Conduit call %s for a review whose target ref was deleted", method)
+	}
+	// The revision's description differs from the review's, so if this did not skip the review,
+	// then it would try to update the revision through Conduit.
+	differentialReview := DifferentialReview{ID: "1", Title: "Edited in Phabricator"}
+	Arcanist{Config: Config{MirrorOwnsDescription: true}}.updateReviewDiffs(repo, differentialReview, r.Revision, r.Request, *details)
+}
+
+func TestRebuildDiffsWithoutReview(t *testing.T) {
+	if err := (Arcanist{}).RebuildDiffs(repository.NewMockRepoForTest(), "UNKNOWN"); err == nil {
+		t.Errorf("Failed to report that there is no review to rebuild")
+	}
+}
+
+func TestCreateComment(t *testing.T) {
+	originalCallConduit := callConduit
+	defer func() { callConduit = originalCallConduit }()
+	var encoded []byte
+	callConduit = func(config Config, method string, request interface{}, response interface{}) {
+		if method != "differential.createcomment" {
+			t.Fatalf("Unexpected Conduit call %s", method)
+		}
+		encoded, _ = json.Marshal(request)
+		json.Unmarshal([]byte(`{"error": "ERR-CONDUIT-CORE", "errorMessage": "Not the author"}`), response)
+	}
+	err := Config{}.createComment(createCommentRequest{RevisionID: "1", Message: "Build passed"})
+	if err == nil || err.Error() != "Not the author" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	var params map[string]interface{}
+	if err := json.Unmarshal(encoded, &params); err != nil || params["message"] != "Build passed" {
+		t.Errorf("The comment was not sent as the \"message\" parameter: %s", encoded)
+	}
+}
+
+func TestRebuildDiffs(t *testing.T) {
+	repo := repository.NewMockRepoForTest()
+	var r review.Summary
+	for _, summary := range review.ListAll(repo) {
+		if !summary.Submitted {
+			r = summary
+		}
+	}
+	if r.Revision == "" {
+		t.Fatal("The mock repo has no open reviews")
+	}
+	originalCallConduit := callConduit
+	defer func() { callConduit = originalCallConduit }()
+	var created int
+	var updates []differentialUpdateRevisionRequest
+	callConduit = func(config Config, method string, request interface{}, response interface{}) {
+		switch method {
+		case "differential.query":
+			json.Unmarshal([]byte(`{"response": [{"id": "7", "phid": "PHID-DREV-7", "status": "0", "diffs": ["3"]}]}`), response)
+		case "differential.creatediff":
+			created++
+			json.Unmarshal([]byte(`{"response": {"diffid": 10, "phid": "PHID-DIFF-10"}}`), response)
+		case "differential.updaterevision":
+			updates = append(updates, request.(differentialUpdateRevisionRequest))
+		case "differential.createrevision", "differential.revision.edit":
+			t.Errorf("Unexpected Conduit call %s while rebuilding an existing revision", method)
+		}
+	}
+	if err := (Arcanist{Callsign: "TEST"}).RebuildDiffs(repo, r.Revision); err != nil {
+		t.Fatal(err)
+	}
+	if created != 1 {
+		t.Errorf("Unexpected number of diffs created: %d", created)
+	}
+	if len(updates) != 1 || updates[0].ID != "7" || updates[0].DiffID != "10" {
+		t.Errorf("The new diff was not attached to the existing revision: %v", updates)
+	}
+}
+
+// diffRecordingRepo is a repository.Repo that records the commits it is asked to diff.
+type diffRecordingRepo struct {
+	repository.Repo
+	diffs *[]string
+}
+
+func (repo diffRecordingRepo) Diff(left, right string, diffArgs ...string) (string, error) {
+	*repo.diffs = append(*repo.diffs, left+".."+right)
+	return "diff of " + left + ".." + right, nil
+}
+
+func TestPreviewDiff(t *testing.T) {
+	var diffs []string
+	repo := diffRecordingRepo{repository.NewMockRepoForTest(), &diffs}
+	if _, err := (Arcanist{}).PreviewDiff(repo, "UNKNOWN"); err == nil {
+		t.Errorf("Failed to report that there is no review to preview")
+	}
+	revision := review.ListAll(repo)[0].Revision
+	diff, err := (Arcanist{}).PreviewDiff(repo, revision)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 1 || diff != "diff of "+diffs[0] {
+		t.Errorf("Unexpected diff preview %q for the diffs %v", diff, diffs)
+	}
+}
+
+func TestGetFirstCommit(t *testing.T) {
+	// The review consists of the commits "B" and "D", where "D" merges in the
+	// commit "X", which is older than the review but was never part of it.
+	repo := commitGraphRepo{
+		commits: map[string]repository.CommitDetails{
+			"A": repository.CommitDetails{Time: "0"},
+			"X": repository.CommitDetails{Time: "1", Parents: []string{"A"}},
+			"B": repository.CommitDetails{Time: "2", Parents: []string{"A"}},
+			"C": repository.CommitDetails{Time: "3", Parents: []string{"B"}},
+			"D": repository.CommitDetails{Time: "4", Parents: []string{"C", "X"}},
+		},
+	}
+	review := DifferentialReview{
+		Hashes: [][]string{
+			[]string{commitHashType, "D"},
+			[]string{commitHashType, "X"},
+			[]string{commitHashType, "B"},
+			[]string{"gttr", "T"},
+			[]string{commitHashType, "UNKNOWN"},
+		},
+	}
+	if first := review.GetFirstCommit(repo); first != "B" {
+		t.Errorf("Unexpected first commit for a review with a merge: %q", first)
+	}
+
+	linearReview := DifferentialReview{
+		Hashes: [][]string{
+			[]string{commitHashType, "C"},
+			[]string{commitHashType, "B"},
+		},
+	}
+	if first := linearReview.GetFirstCommit(repo); first != "B" {
+		t.Errorf("Unexpected first commit for a linear review: %q", first)
+	}
+
+	if first := (DifferentialReview{}).GetFirstCommit(repo); first != "" {
+		t.Errorf("Unexpected first commit for an empty review: %q", first)
+	}
+
+	_, err := (DifferentialReview{ID: "1"}).findFirstCommit(repo)
+	if err != errNoCommits {
+		t.Errorf("Unexpected error for an empty review: %v", err)
+	}
+	missingReview := DifferentialReview{
+		ID:     "2",
+		Hashes: [][]string{[]string{commitHashType, "GARBAGE-COLLECTED"}},
+	}
+	_, err = missingReview.findFirstCommit(repo)
+	if err == nil || !strings.Contains(err.Error(), "could be found in the local repo") {
+		t.Errorf("Unexpected error for a review whose commits are missing: %v", err)
+	}
+}
+
+func TestFindLandingCommit(t *testing.T) {
+	repo := commitGraphRepo{
+		commits: map[string]repository.CommitDetails{
+			"M": repository.CommitDetails{Time: "3", Parents: []string{"A", "H"}},
+		},
+	}
+	mergedRepo := listingRepo{repo, []string{"M", "N"}}
+	if landing := findLandingCommit(mergedRepo, "H", "refs/heads/master"); landing != "M" {
+		t.Errorf("Unexpected landing commit for a merged change: %q", landing)
+	}
+	fastForwardedRepo := listingRepo{repo, nil}
+	if landing := findLandingCommit(fastForwardedRepo, "H", "refs/heads/master"); landing != "H" {
+		t.Errorf("Unexpected landing commit for a fast-forwarded change: %q", landing)
+	}
+	request := buildMergedComment(DifferentialReview{ID: "1"}, "M", "refs/heads/master")
+	if request.RevisionID != "1" || request.Message != "Landed in master as M" {
+		t.Errorf("Unexpected merged comment: %v", request)
+	}
+}
+
+func TestRecordCloseFailure(t *testing.T) {
+	defer delete(closeFailures, "ABCD")
+	for attempt := 1; attempt < maxCloseAttempts; attempt++ {
+		if recordCloseFailure("ABCD") {
+			t.Errorf("Gave up on closing the revisions after %d attempts", attempt)
+		}
+	}
+	if !recordCloseFailure("ABCD") {
+		t.Errorf("Did not give up on closing the revisions after %d attempts", maxCloseAttempts)
+	}
+	if recordCloseFailure("ABCD") {
+		t.Error("The failures to close the revisions were not forgotten after giving up")
+	}
+}
+
+func TestResolveCCs(t *testing.T) {
+	arc := Arcanist{Config: Config{
+		DefaultCCs: []string{"lead", "unknown@example.com", "bot-owner"},
+		Accounts:   map[string]string{"bot@example.com": "bot-owner"},
+	}}
+	lookupUser := func(name string) (*user, error) {
+		if name == "lead" || name == "bot-owner" {
+			return &user{PHID: "PHID-USER-" + name, UserName: name}, nil
+		}
+		return nil, nil
+	}
+	ccs := arc.resolveCCs("bot@example.com", nil, lookupUser)
+	if len(ccs) != 2 || ccs[0] != "PHID-USER-bot-owner" || ccs[1] != "PHID-USER-lead" {
+		t.Errorf("Unexpected CCs: %v", ccs)
+	}
+	ccs = arc.resolveCCs("", []string{"bot-owner", "unknown-subscriber"}, lookupUser)
+	if len(ccs) != 2 || ccs[0] != "PHID-USER-lead" || ccs[1] != "PHID-USER-bot-owner" {
+		t.Errorf("Unexpected CCs with path-based subscribers: %v", ccs)
+	}
+	if ccs := (Arcanist{}).resolveCCs("", nil, lookupUser); len(ccs) != 0 {
+		t.Errorf("Unexpected CCs without a requester: %v", ccs)
+	}
+}
+
+func TestBuildReviewerUpdate(t *testing.T) {
+	arc := Arcanist{Config: Config{Accounts: map[string]string{"bot@example.com": "bot-owner"}}}
+	lookupUser := func(name string) (*user, error) {
+		if name == "unknown@example.com" {
+			return nil, nil
+		}
+		return &user{PHID: "PHID-USER-" + name}, nil
+	}
+	differentialReview := DifferentialReview{
+		ID:        "1",
+		PHID:      "PHID-DREV-1",
+		Reviewers: []string{"PHID-USER-existing", "PHID-PROJ-manual"},
+		CCs:       []string{"PHID-USER-manual"},
+	}
+	requests := []request.Request{
+		request.Request{Timestamp: "1", Requester: "someone@example.com", Reviewers: []string{"existing"}},
+		request.Request{Timestamp: "2", Requester: "someone@example.com", Reviewers: []string{"existing", "removed"}},
+		request.Request{
+			Timestamp: "3",
+			Requester: "bot@example.com",
+			Reviewers: []string{"existing", "removed", "added", "unknown@example.com", "added"},
+		},
+	}
+	reviewers, ccs := arc.buildReviewerUpdate(differentialReview, requests, "2", lookupUser)
+	if fmt.Sprint(reviewers) != "[PHID-USER-added]" || fmt.Sprint(ccs) != "[PHID-USER-bot-owner]" {
+		t.Errorf("Unexpected reviewers and CCs to add: %v, %v", reviewers, ccs)
+	}
+	if reviewers, _ := arc.buildReviewerUpdate(differentialReview, requests, "1", lookupUser); fmt.Sprint(reviewers) != "[PHID-USER-removed PHID-USER-added]" {
+		t.Errorf("Unexpected reviewers to add after a request that was not mirrored: %v", reviewers)
+	}
+	if reviewers, ccs := arc.buildReviewerUpdate(differentialReview, requests, "3", lookupUser); len(reviewers) != 0 || len(ccs) != 0 {
+		t.Errorf("Unexpected reviewers and CCs to add for the request that was already mirrored: %v, %v", reviewers, ccs)
+	}
+	if reviewers, ccs := arc.buildReviewerUpdate(differentialReview, requests, "", lookupUser); len(reviewers) != 0 || len(ccs) != 0 {
+		t.Errorf("Unexpected reviewers and CCs to add without a mirrored request: %v, %v", reviewers, ccs)
+	}
+
+	arc.Config.UseEditAPI = true
+	fields := arc.addReviewerFields(nil, differentialReview, reviewers, ccs)
+	if transactions := editTransactions(fields); len(transactions) != 2 ||
+		transactions[0].Type != "subscribers.add" || fmt.Sprint(transactions[0].Value) != "[PHID-USER-bot-owner]" ||
+		transactions[1].Type != "reviewers.add" || fmt.Sprint(transactions[1].Value) != "[PHID-USER-added]" {
+		t.Errorf("Unexpected edit transactions: %v", transactions)
+	}
+	arc.Config.UseEditAPI = false
+	fields = arc.addReviewerFields(map[string]interface{}{"title": "Title"}, differentialReview, reviewers, ccs)
+	if fmt.Sprint(fields["reviewerPHIDs"]) != "[PHID-USER-existing PHID-PROJ-manual PHID-USER-added]" ||
+		fmt.Sprint(fields["ccPHIDs"]) != "[PHID-USER-manual PHID-USER-bot-owner]" || fields["title"] != "Title" {
+		t.Errorf("The update dropped some of the existing reviewers or CCs: %v", fields)
+	}
+	if fields := arc.addReviewerFields(nil, differentialReview, nil, nil); fields != nil {
+		t.Errorf("Unexpected fields without any reviewers or CCs to add: %v", fields)
+	}
+
+	differentialReview.CCs = append(differentialReview.CCs, "PHID-USER-bot-owner")
+	differentialReview.Reviewers = append(differentialReview.Reviewers, "PHID-USER-added")
+	if reviewers, ccs := arc.buildReviewerUpdate(differentialReview, requests, "2", lookupUser); len(reviewers) != 0 || len(ccs) != 0 {
+		t.Errorf("Unexpected reviewers and CCs to add to an up-to-date revision: %v, %v", reviewers, ccs)
+	}
+}
+
+func TestUpdateRevision(t *testing.T) {
+	originalCallConduit := callConduit
+	defer func() { callConduit = originalCallConduit }()
+	var calls []string
+	callConduit = func(config Config, method string, request interface{}, response interface{}) {
+		switch method {
+		case "user.query":
+			phid := "PHID-USER-" + request.(userQueryRequest).Emails[0]
+			json.Unmarshal([]byte(`{"response": [{"phid": "`+phid+`"}]}`), response)
+		case "differential.revision.edit":
+			calls = append(calls, fmt.Sprint(request.(editRevisionRequest).Transactions))
+		default:
+			t.Fatalf("Unexpected Conduit call %s", method)
+		}
+	}
+	repo := repository.NewMockRepoForTest()
+	differentialReview := DifferentialReview{ID: "1", PHID: "PHID-DREV-1", Title: "Title"}
+	r := review.Review{Summary: &review.Summary{Revision: "A", AllRequests: []request.Request{
+		request.Request{Timestamp: "1", Description: "Title"},
+		request.Request{Timestamp: "2", Description: "Title", Reviewers: []string{"skipped@example.com"}},
+		request.Request{Timestamp: "3", Description: "New title", Reviewers: []string{"skipped@example.com", "added@example.com"}},
+	}}}
+	if err := recordMirroredRequest(repo, r.Revision, differentialReview.ID, "1"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		// Each pass uses a new Arcanist, like the mirror does after a restart.
+		arc := Arcanist{Config: Config{UseEditAPI: true, MirrorOwnsDescription: true}}
+		arc.updateRevision(repo, differentialReview, r)
+		differentialReview.Title = "New title"
+	}
+	if len(calls) != 1 || !strings.Contains(calls[0], "reviewers.add") || !strings.Contains(calls[0], "title") {
+		t.Fatalf("The description and reviewers were not updated in one call, or were updated again: %v", calls)
+	}
+	if !strings.Contains(calls[0], "[PHID-USER-skipped@example.com PHID-USER-added@example.com]") {
+		t.Errorf("The reviewers of the request that was not mirrored were not added: %v", calls)
+	}
+	if mirrored := loadMirroredRequest(repo, r.Revision, differentialReview.ID); mirrored != "3" {
+		t.Errorf("Unexpected mirrored request: %q", mirrored)
+	}
+
+	// Revisions without a recorded request only have the request recorded.
+	calls = nil
+	(Arcanist{Config: Config{UseEditAPI: true}}).updateRevision(repo, DifferentialReview{ID: "2", PHID: "PHID-DREV-2", Title: "New title"}, r)
+	if len(calls) != 0 || loadMirroredRequest(repo, r.Revision, "2") != "3" {
+		t.Errorf("Unexpected update of a revision without a mirrored request: %v", calls)
+	}
+}
+
+func TestCommitsToMirror(t *testing.T) {
+	commits := commitsToMirror([]string{"A", "B", "C", "D"}, []string{"A", "B"}, "D")
+	if fmt.Sprint(commits) != "[C D]" {
+		t.Errorf("Unexpected commits to mirror: %v", commits)
+	}
+	commits = commitsToMirror(nil, []string{"A"}, "D")
+	if fmt.Sprint(commits) != "[D]" {
+		t.Errorf("Unexpected commits to mirror without a commit list: %v", commits)
+	}
+}
+
+func TestBuildAbandonRequest(t *testing.T) {
+	message := "This review was abandoned because its branch was deleted"
+	request := buildAbandonRequest(DifferentialReview{ID: "1"}, message)
+	if request.RevisionID != "1" || request.Action != "abandon" || request.Message != message {
+		t.Errorf("Unexpected abandon request: %v", request)
+	}
+}
+
+func TestCommitHashes(t *testing.T) {
+	review := DifferentialReview{
+		ID: "1",
+		Hashes: [][]string{
+			[]string{treeHashType, "T"},
+			[]string{commitHashType, "A"},
+			[]string{commitHashType},
+			[]string{"hgcm", "H"},
+			[]string{commitHashType, "B", "extra"},
+			[]string{commitHashType, "C"},
+		},
+	}
+	commits := review.commitHashes()
+	if len(commits) != 2 || commits[0] != "A" || commits[1] != "C" {
+		t.Errorf("Unexpected commit hashes: %v", commits)
+	}
+}
+
+func TestMergeParsedFields(t *testing.T) {
+	fields := revisionFields{
+		Title:     "Heuristic title",
+		Summary:   "Heuristic title\n\nTest Plan: Ran it",
+		Reviewers: []string{"PHID-USER-2"},
+		CCs:       []string{"PHID-USER-3"},
+	}
+	parsed := map[string]interface{}{
+		"title":         "Parsed title",
+		"testPlan":      "Ran it",
+		"reviewerPHIDs": []interface{}{"PHID-USER-1"},
+	}
+	merged := mergeParsedFields(fields, parsed)
+	if merged["title"] != "Parsed title" || merged["testPlan"] != "Ran it" {
+		t.Errorf("The parsed fields were not preserved: %v", merged)
+	}
+	if merged["summary"] != fields.Summary {
+		t.Errorf("Unexpected summary: %v", merged["summary"])
+	}
+	if reviewers := fmt.Sprint(merged["reviewerPHIDs"]); reviewers != "[PHID-USER-1 PHID-USER-2]" {
+		t.Errorf("Unexpected reviewers: %s", reviewers)
+	}
+	if ccs := fmt.Sprint(merged["ccPHIDs"]); ccs != "[PHID-USER-3]" {
+		t.Errorf("Unexpected CCs: %s", ccs)
+	}
+	if title := mergeParsedFields(fields, nil)["title"]; title != fields.Title {
+		t.Errorf("Unexpected title when nothing was parsed: %v", title)
+	}
+	fields.TestPlan = "Placeholder"
+	if testPlan := mergeParsedFields(fields, parsed)["testPlan"]; testPlan != "Ran it" {
+		t.Errorf("The parsed test plan was replaced: %v", testPlan)
+	}
+	if testPlan := mergeParsedFields(fields, map[string]interface{}{"testPlan": " "})["testPlan"]; testPlan != "Placeholder" {
+		t.Errorf("An empty parsed test plan was not replaced: %v", testPlan)
+	}
+	fields.TestPlan = ""
+	if testPlan, ok := mergeParsedFields(fields, map[string]interface{}{"testPlan": ""})["testPlan"]; ok {
+		t.Errorf("An empty test plan was not dropped: %q", testPlan)
+	}
+}
+
+func TestTestPlan(t *testing.T) {
+	arc := Arcanist{Config: Config{DefaultTestPlan: "None given"}}
+	if _, summary, messageFields := arc.describe("Title\n\nTest Plan: Ran the tests"); len(messageFields) != 0 || !strings.Contains(summary, "Test Plan: Ran the tests") {
+		t.Errorf("Fields were parsed without being configured: %q, %v", summary, messageFields)
+	}
+	arc.Config.CommitMessageFields = map[string]string{"Test Plan": testPlanField}
+	_, _, messageFields := arc.describe("Title\n\nTest Plan: Ran the tests")
+	if testPlan := arc.testPlan(messageFields); testPlan != "Ran the tests" {
+		t.Errorf("Unexpected test plan from the description: %q", testPlan)
+	}
+	if testPlan := arc.testPlan(nil); testPlan != "None given" {
+		t.Errorf("Unexpected default test plan: %q", testPlan)
+	}
+	request, err := json.Marshal(createRevisionRequest{1, revisionFields{Title: "Title"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(request), "testPlan") {
+		t.Errorf("An empty test plan was sent: %s", request)
+	}
+}
+
+func TestCreateRevisionMergesParsedFields(t *testing.T) {
+	originalCallConduit := callConduit
+	defer func() { callConduit = originalCallConduit }()
+	var created createRevisionRequest
+	callConduit = func(config Config, method string, request interface{}, response interface{}) {
+		switch method {
+		case "differential.parsecommitmessage":
+			json.Unmarshal([]byte(`{"response": {"fields": {"testPlan": "Parsed", "bugID": "1234"}}}`), response)
+		case "differential.createrevision":
+			created = request.(createRevisionRequest)
+			json.Unmarshal([]byte(`{"response": {"revisionid": 7}}`), response)
+		}
+	}
+	arc := Arcanist{Config: Config{
+		ParseCommitMessage:  true,
+		CommitMessageFields: map[string]string{"Test Plan": testPlanField},
+	}}
+	req := request.Request{Description: "Title\n\nTest Plan: Ran the tests"}
+	if _, err := arc.createDifferentialRevision(repository.NewMockRepoForTest(), "A", "B", differentialDiff{ID: 3}, req); err != nil {
+		t.Fatal(err)
+	}
+	fields, ok := created.Fields.(map[string]interface{})
+	if !ok {
+		t.Fatalf("Unexpected revision fields: %v", created.Fields)
+	}
+	if fields[testPlanField] != "Ran the tests" || fields["bugID"] != "1234" {
+		t.Errorf("The parsed and configured fields were not merged: %v", fields)
+	}
+}
+
 func TestGenerateCommentRequests(t *testing.T) {
 	revisionID := "testReview"
 	diffReview := DifferentialReview{ID: revisionID}
@@ -71,7 +593,9 @@ func TestGenerateCommentRequests(t *testing.T) {
 			},
 		},
 	}
-	inlineRequests, commentRequests := diffReview.buildCommentRequests(comments, nil, commitToDiffMap)
+	hello := strings.Repeat("Hello\n", 50)
+	repo := fileRepo{repository.NewMockRepoForTest(), map[string]string{"ABCD:hello.txt": hello, "EFGH:hello.txt": hello}}
+	inlineRequests, commentRequests := Arcanist{}.buildCommentRequests(repo, diffReview, comments, nil, commitToDiffMap, "")
 	if inlineRequests == nil || commentRequests == nil {
 		t.Errorf("Failed to build the comment requests: %v, %v", inlineRequests, commentRequests)
 	}
@@ -103,6 +627,299 @@ func TestGenerateCommentRequests(t *testing.T) {
 	if secondInline.DiffID != "2" || !strings.HasSuffix(secondInline.Content, "A line comment") || secondInline.LineNumber != 42 {
 		t.Errorf("Unexpected second inline request: %v", secondInline)
 	}
+	markedRequests, _ := Arcanist{Config: Config{MarkProvenance: true}}.buildCommentRequests(repo, diffReview, comments, nil, commitToDiffMap, "")
+	if len(markedRequests) != 2 {
+		t.Errorf("Unexpected number of inline requests: %v", markedRequests)
+	}
+	for _, r := range markedRequests {
+		if !strings.HasSuffix(r.Content, "\n\n"+review_utils.ProvenanceTrailer) {
+			t.Errorf("Inline comment not marked as expected: %v", r)
+		}
+	}
+}
+
+func TestGenerateLeftSideCommentRequests(t *testing.T) {
+	diffReview := DifferentialReview{ID: "testReview"}
+	commitToDiffMap := map[string]string{
+		"ABCD": "1",
+		"EFGH": "2",
+	}
+	comments := []review.CommentThread{
+		review.CommentThread{
+			Comment: comment.Comment{
+				Timestamp: "01234",
+				Author:    "example@example.com",
+				Location: &comment.Location{
+					Commit: "BASE",
+					Path:   "removed.txt",
+					Range: &comment.Range{
+						StartLine: 7,
+					},
+				},
+				Description: "A comment on a deleted line",
+			},
+		},
+		review.CommentThread{
+			Comment: comment.Comment{
+				Timestamp: "01234",
+				Author:    "example@example.com",
+				Location: &comment.Location{
+					Commit: "ABCD",
+					Path:   "hello.txt",
+					Range: &comment.Range{
+						StartLine: 3,
+					},
+				},
+				Description: "A comment on an added line",
+			},
+		},
+	}
+	repo := fileRepo{repository.NewMockRepoForTest(), map[string]string{
+		"BASE:removed.txt": strings.Repeat("Goodbye\n", 10),
+		"ABCD:hello.txt":   strings.Repeat("Hello\n", 5),
+	}}
+	inlineRequests, _ := Arcanist{}.buildCommentRequests(repo, diffReview, comments, nil, commitToDiffMap, "BASE")
+	if len(inlineRequests) != 2 {
+		t.Fatalf("Unexpected number of inline requests: %v", inlineRequests)
+	}
+	leftInline := inlineRequests[0]
+	if leftInline.IsNewFile != 0 || leftInline.DiffID != "2" || leftInline.FilePath != "removed.txt" || leftInline.LineNumber != 7 {
+		t.Errorf("Unexpected left-hand side inline request: %v", leftInline)
+	}
+	rightInline := inlineRequests[1]
+	if rightInline.IsNewFile != 1 || rightInline.DiffID != "1" || rightInline.FilePath != "hello.txt" || rightInline.LineNumber != 3 {
+		t.Errorf("Unexpected right-hand side inline request: %v", rightInline)
+	}
+
+	// Without a base commit, the comment is on a commit without a diff, so it is moved to the
+	// right-hand side of the latest diff, where the file does not exist.
+	inlineRequests, commentRequests := Arcanist{}.buildCommentRequests(repo, diffReview, comments[:1], nil, commitToDiffMap, "")
+	if len(inlineRequests) != 0 || len(commentRequests) != 1 {
+		t.Errorf("Unexpected requests without a base commit: %v, %v", inlineRequests, commentRequests)
+	}
+}
+
+func TestGenerateRangeCommentRequests(t *testing.T) {
+	diffReview := DifferentialReview{ID: "testReview"}
+	commitToDiffMap := map[string]string{"ABCD": "1"}
+	rangeComment := func(description string, startLine, endLine uint32) review.CommentThread {
+		return review.CommentThread{
+			Comment: comment.Comment{
+				Timestamp: "01234",
+				Author:    "example@example.com",
+				Location: &comment.Location{
+					Commit: "ABCD",
+					Path:   "hello.txt",
+					Range: &comment.Range{
+						StartLine: startLine,
+						EndLine:   endLine,
+					},
+				},
+				Description: description,
+			},
+		}
+	}
+	comments := []review.CommentThread{
+		rangeComment("A comment on several lines", 10, 20),
+		rangeComment("A comment on one line", 10, 0),
+		rangeComment("A comment past the end of the file", 45, 60),
+	}
+	repo := fileRepo{repository.NewMockRepoForTest(), map[string]string{"ABCD:hello.txt": strings.Repeat("Hello\n", 50)}}
+	inlineRequests, _ := Arcanist{}.buildCommentRequests(repo, diffReview, comments, nil, commitToDiffMap, "")
+	if len(inlineRequests) != 3 {
+		t.Fatalf("Unexpected number of inline requests: %v", inlineRequests)
+	}
+	if r := inlineRequests[0]; r.LineNumber != 10 || r.LineLength != 10 {
+		t.Errorf("Unexpected request for a comment on several lines: %v", r)
+	}
+	if r := inlineRequests[1]; r.LineNumber != 10 || r.LineLength != 0 {
+		t.Errorf("Unexpected request for a comment on one line: %v", r)
+	}
+	if r := inlineRequests[2]; r.LineNumber != 45 || r.LineLength != 5 {
+		t.Errorf("Unexpected request for a comment past the end of the file: %v", r)
+	}
+
+	// Comments already in Phabricator with the same span are not posted again, but ones with
+	// the same start and a different span are.
+	existing := rangeComment("A comment on several lines", 10, 20).Comment
+	existing.Description = review_utils.QuoteDescription(existing)
+	inlineRequests, _ = Arcanist{}.buildCommentRequests(repo, diffReview, comments[:1], []comment.Comment{existing}, commitToDiffMap, "")
+	if len(inlineRequests) != 0 {
+		t.Errorf("Unexpected requests for an existing comment: %v", inlineRequests)
+	}
+	existing.Location.Range.EndLine = 15
+	inlineRequests, _ = Arcanist{}.buildCommentRequests(repo, diffReview, comments[:1], []comment.Comment{existing}, commitToDiffMap, "")
+	if len(inlineRequests) != 1 {
+		t.Errorf("Unexpected requests for a comment with a different span: %v", inlineRequests)
+	}
+}
+
+func TestPostInlineRequestsInThreadOrder(t *testing.T) {
+	requests := []createInlineRequest{
+		{RevisionID: "1", FilePath: "hello.txt", LineNumber: 1, Content: "comment"},
+		{RevisionID: "1", FilePath: "hello.txt", LineNumber: 1, Content: "reply"},
+		{RevisionID: "1", FilePath: "hello.txt", LineNumber: 1, Content: "second reply"},
+		{RevisionID: "1", FilePath: "hello.txt", LineNumber: 2, Content: "failing comment"},
+		{RevisionID: "1", FilePath: "hello.txt", LineNumber: 2, Content: "unposted reply"},
+		{RevisionID: "1", FilePath: "hello.txt", LineNumber: 3, Content: "other comment"},
+	}
+
+	var mutex sync.Mutex
+	var posted []string
+	createInline := func(request createInlineRequest) error {
+		time.Sleep(time.Millisecond)
+		mutex.Lock()
+		defer mutex.Unlock()
+		posted = append(posted, request.Content)
+		if request.Content == "failing comment" {
+			return fmt.Errorf("Failed to post %q", request.Content)
+		}
+		return nil
+	}
+	errs := postInlineRequests(requests, createInline, 3)
+	index := make(map[string]int)
+	for i, content := range posted {
+		index[content] = i
+	}
+	if _, ok := index["unposted reply"]; ok || len(posted) != 5 {
+		t.Errorf("Unexpected comments posted: %v", posted)
+	}
+	if !(index["comment"] < index["reply"] && index["reply"] < index["second reply"]) {
+		t.Errorf("The replies were not posted after their comment: %v", posted)
+	}
+	for i, request := range requests {
+		failed := request.Content == "failing comment" || request.Content == "unposted reply"
+		if (errs[i] != nil) != failed {
+			t.Errorf("Unexpected error for %q: %v", request.Content, errs[i])
+		}
+	}
+}
+
+func TestVerifyComments(t *testing.T) {
+	missing := []createInlineRequest{{RevisionID: "1", FilePath: "hello.txt", LineNumber: 1}}
+	testCases := []struct {
+		name string
+		// reads holds whether the comment is missing from each successive read.
+		reads           []bool
+		expectedReposts int
+	}{
+		{"Present", []bool{false}, 0},
+		{"Not readable yet", []bool{true, false}, 0},
+		{"Reposted", []bool{true, true, false}, 1},
+		{"Still missing", []bool{true, true, true, true}, commentVerificationRetries},
+	}
+	for _, testCase := range testCases {
+		reads, reposts, sleeps := 0, 0, 0
+		findMissing := func() ([]createInlineRequest, []createCommentRequest) {
+			if reads >= len(testCase.reads) {
+				t.Fatalf("%s: unexpected read %d", testCase.name, reads)
+			}
+			reads++
+			if testCase.reads[reads-1] {
+				return missing, nil
+			}
+			return nil, nil
+		}
+		repost := func(inlineRequests []createInlineRequest, commentRequests []createCommentRequest) {
+			if sleeps != reads/2 {
+				t.Errorf("%s: reposted after %d reads, without waiting to re-read", testCase.name, reads)
+			}
+			reposts++
+		}
+		sleep := func(time.Duration) { sleeps++ }
+		verifyComments("1", findMissing, repost, sleep)
+		if reposts != testCase.expectedReposts || reads != len(testCase.reads) {
+			t.Errorf("%s: unexpected reposts after %d reads: %d", testCase.name, reads, reposts)
+		}
+	}
+}
+
+func TestFindCommit(t *testing.T) {
+	diff := queryDiffItem{
+		SourceControlBaseRevision: "BASE",
+		Properties: map[string]interface{}{
+			"local:commits": map[string]interface{}{
+				"HEAD": map[string]interface{}{"commit": "HEAD", "time": "2"},
+			},
+		},
+	}
+	if commit := diff.findCommit(false); commit != "BASE" {
+		t.Errorf("Unexpected commit for the left-hand side: %q", commit)
+	}
+	if commit := diff.findCommit(true); commit != "HEAD" {
+		t.Errorf("Unexpected commit for the right-hand side: %q", commit)
+	}
+}
+
+func TestActAsCommentAuthors(t *testing.T) {
+	diffReview := DifferentialReview{ID: "1"}
+	inlineRequests := []createInlineRequest{
+		createInlineRequest{Content: "known@example.com:\n\nFirst", comment: comment.Comment{Author: "known@example.com", Description: "First"}},
+		createInlineRequest{Content: "unknown@example.com:\n\nSecond", comment: comment.Comment{Author: "unknown@example.com", Description: "Second"}},
+		createInlineRequest{Content: "known@example.com:\n\nThird", comment: comment.Comment{Author: "known@example.com", Description: "Third"}},
+	}
+	lookupUser := func(name string) (*user, error) {
+		if name == "known@example.com" {
+			return &user{PHID: "PHID-USER-1", Email: name}, nil
+		}
+		return nil, nil
+	}
+	arc := Arcanist{}
+	marked, _ := Arcanist{Config: Config{MarkProvenance: true}}.actAsCommentAuthors(diffReview, inlineRequests, lookupUser)
+	if content := marked[0].Content; content != "First\n\n"+review_utils.ProvenanceTrailer {
+		t.Errorf("The provenance of a comment posted as its author was not marked: %q", content)
+	}
+	inlineRequests, commentRequests := arc.actAsCommentAuthors(diffReview, inlineRequests, lookupUser)
+	if len(inlineRequests) != 3 {
+		t.Fatalf("Unexpected inline requests: %v", inlineRequests)
+	}
+	for _, i := range []int{0, 2} {
+		if r := inlineRequests[i]; r.Conduit == nil || r.Conduit.ActAsUser != "PHID-USER-1" || r.Content != r.comment.Description {
+			t.Errorf("Inline comment not posted as its author: %v", r)
+		}
+	}
+	if r := inlineRequests[1]; r.Conduit != nil || !strings.HasPrefix(r.Content, "unknown@example.com:") {
+		t.Errorf("Inline comment by an unknown author was not quoted: %v", r)
+	}
+	if len(commentRequests) != 2 {
+		t.Fatalf("Unexpected comment requests: %v", commentRequests)
+	}
+	if r := commentRequests[0]; r.Conduit == nil || r.Conduit.ActAsUser != "PHID-USER-1" || !r.AttachInlines {
+		t.Errorf("Unexpected comment request for the known author: %v", r)
+	}
+	if r := commentRequests[1]; r.Conduit != nil || !r.AttachInlines || r.RevisionID != "1" {
+		t.Errorf("Unexpected comment request for the quoted comments: %v", r)
+	}
+}
+
+func TestBuildDescriptionUpdate(t *testing.T) {
+	requests := []request.Request{
+		request.Request{Description: "Original title"},
+		request.Request{Description: "New title\n\nWith a summary"},
+	}
+	mirroredReview := DifferentialReview{ID: "1", Title: "Original title"}
+	editedReview := DifferentialReview{ID: "2", Title: "Title edited in Phabricator"}
+	updatedReview := DifferentialReview{ID: "3", Title: "New title", Summary: "New title\n\nWith a summary"}
+
+	arc := Arcanist{}
+	fields := arc.buildDescriptionUpdate(mirroredReview, requests)
+	if fields == nil || fields["title"] != "New title" || fields["summary"] != "New title\n\nWith a summary" {
+		t.Errorf("Unexpected description update for a mirrored review: %v", fields)
+	}
+	if fields := arc.buildDescriptionUpdate(editedReview, requests); fields != nil {
+		t.Errorf("Unexpected description update for an edited review: %v", fields)
+	}
+	if fields := arc.buildDescriptionUpdate(updatedReview, requests); fields != nil {
+		t.Errorf("Unexpected description update for an up-to-date review: %v", fields)
+	}
+
+	arc.Config.MirrorOwnsDescription = true
+	if fields := arc.buildDescriptionUpdate(editedReview, requests); fields == nil || fields["title"] != "New title" {
+		t.Errorf("Unexpected description update for an edited review: %v", fields)
+	}
+	if fields := arc.buildDescriptionUpdate(updatedReview, requests); fields != nil {
+		t.Errorf("Unexpected description update for an up-to-date review: %v", fields)
+	}
 }
 
 func TestGenerateUnitDiffProperty(t *testing.T) {
@@ -123,21 +940,58 @@ func TestGenerateUnitDiffProperty(t *testing.T) {
 		Status: "gibberish",
 	}
 
-	if prop, err := generateUnitDiffProperty(emptyReport); err != nil || prop != "" {
+	if prop, err := generateUnitDiffProperty([]ci.Report{emptyReport}, ""); err != nil || prop != "" {
 		t.Errorf("Failed to generate the diff property for an empty unit report: %q", prop)
 	}
-	if prop, err := generateUnitDiffProperty(statusOnlyReport); err != nil || prop != "" {
+	if prop, err := generateUnitDiffProperty([]ci.Report{statusOnlyReport}, ""); err != nil || prop != "" {
 		t.Errorf("Failed to generate the diff property for a status-only unit report: %q", prop)
 	}
-	if prop, err := generateUnitDiffProperty(failedReport); err != nil || prop != "[{\"name\":\"\",\"link\":\"example.com\",\"result\":\"fail\"}]" {
+	if prop, err := generateUnitDiffProperty([]ci.Report{failedReport}, ""); err != nil || prop != "[{\"name\":\"\",\"link\":\"example.com\",\"result\":\"fail\"}]" {
 		t.Errorf("Failed to generate the diff property for a failure unit report: %q", prop)
 	}
-	if prop, err := generateUnitDiffProperty(passedReport); err != nil || prop != "[{\"name\":\"\",\"link\":\"example.com\",\"result\":\"pass\"}]" {
+	if prop, err := generateUnitDiffProperty([]ci.Report{passedReport}, ""); err != nil || prop != "[{\"name\":\"\",\"link\":\"example.com\",\"result\":\"pass\"}]" {
 		t.Errorf("Failed to generate the diff property for a success unit report: %q", prop)
 	}
-	if prop, err := generateUnitDiffProperty(gibberishReport); err != nil || prop != "[{\"name\":\"\",\"link\":\"example.com\",\"result\":\"skip\"}]" {
+	if prop, err := generateUnitDiffProperty([]ci.Report{gibberishReport}, ""); err != nil || prop != "[{\"name\":\"\",\"link\":\"example.com\",\"result\":\"skip\"}]" {
 		t.Errorf("Failed to generate the diff property for a gibberish unit report: %q", prop)
 	}
+	if prop, err := generateUnitDiffProperty([]ci.Report{passedReport}, "CI"); err != nil || prop != "[{\"name\":\"CI\",\"link\":\"example.com\",\"result\":\"pass\"}]" {
+		t.Errorf("Failed to generate the diff property for a unit report with a default name: %q", prop)
+	}
+	passedReport.Agent = "Builder"
+	if prop, err := generateUnitDiffProperty([]ci.Report{passedReport}, "CI"); err != nil || prop != "[{\"name\":\"Builder\",\"link\":\"example.com\",\"result\":\"pass\"}]" {
+		t.Errorf("Failed to generate the diff property for a unit report with an agent: %q", prop)
+	}
+	if prop, err := generateUnitDiffProperty([]ci.Report{passedReport, failedReport, statusOnlyReport}, "CI"); err != nil ||
+		prop != "[{\"name\":\"Builder\",\"link\":\"example.com\",\"result\":\"pass\"},{\"name\":\"CI\",\"link\":\"example.com\",\"result\":\"fail\"}]" {
+		t.Errorf("Failed to generate the diff property for the unit reports of multiple agents: %q", prop)
+	}
+}
+
+func TestBuildCIReportCommentRequests(t *testing.T) {
+	diffReview := DifferentialReview{ID: "testReview"}
+	latestCIReports := map[string][]ci.Report{
+		"ABCD": {{URL: "example.com/1", Status: "gibberish"}},
+		"EFGH": {{URL: "example.com/2"}},
+		"IJKL": {{Status: "success"}},
+		"MNOP": {{URL: "example.com/3", Status: "success"}, {URL: "example.com/4", Status: "failure", Agent: "lint"}},
+	}
+	existingComments := []comment.Comment{
+		comment.Comment{Description: "Build success for MNOP: example.com/3"},
+	}
+	requests := buildCIReportCommentRequests(diffReview, latestCIReports, existingComments)
+	if len(requests) != 3 {
+		t.Fatalf("Unexpected number of CI report comment requests: %v", requests)
+	}
+	if requests[0].RevisionID != "testReview" || requests[0].Message != "Build gibberish for ABCD: example.com/1" {
+		t.Errorf("Unexpected CI report comment request: %v", requests[0])
+	}
+	if requests[1].RevisionID != "testReview" || requests[1].Message != "Build results for EFGH: example.com/2" {
+		t.Errorf("Unexpected CI report comment request: %v", requests[1])
+	}
+	if requests[2].Message != "Build failure for MNOP: example.com/4" {
+		t.Errorf("Unexpected CI report comment request for a second agent: %v", requests[2])
+	}
 }
 
 func TestGenerateLintDiffProperty(t *testing.T) {
@@ -195,18 +1049,606 @@ func TestGenerateLintDiffProperty(t *testing.T) {
 		},
 	}
 
-	if prop, err := generateLintDiffProperty(noResponse); err != nil || prop != "" {
+	if prop, err := generateLintDiffProperty(noResponse, ""); err != nil || prop != "" {
 		t.Errorf("Failed to convert an empty static analysis result")
 	}
-	if prop, err := generateLintDiffProperty(multipleEmptyResponses); err != nil || prop != "" {
+	if prop, err := generateLintDiffProperty(multipleEmptyResponses, ""); err != nil || prop != "" {
 		t.Errorf("Failed to convert a list of empty static analysis results")
 	}
 
-	prop, err := generateLintDiffProperty(testreview_utils)
+	prop, err := generateLintDiffProperty(testreview_utils, "")
 	if err != nil {
 		t.Errorf("Failed to convert the non-trivial analysis results")
 	}
 	if prop != "[{\"code\":\"Test\",\"severity\":\"warning\",\"path\":\"hello.txt\",\"line\":42,\"description\":\"Test 2\"},{\"code\":\"Test\",\"severity\":\"warning\",\"path\":\"hello.txt\",\"line\":1,\"description\":\"Test 4\"}]" {
 		t.Errorf("Wrong conversion for the non-trivial analysis results: %q", prop)
 	}
+
+	prop, err = generateLintDiffProperty(testreview_utils, "Linter")
+	if err != nil {
+		t.Errorf("Failed to convert the non-trivial analysis results")
+	}
+	if prop != "[{\"name\":\"Linter\",\"code\":\"Test\",\"severity\":\"warning\",\"path\":\"hello.txt\",\"line\":42,\"description\":\"Test 2\"},{\"name\":\"Linter\",\"code\":\"Test\",\"severity\":\"warning\",\"path\":\"hello.txt\",\"line\":1,\"description\":\"Test 4\"}]" {
+		t.Errorf("Wrong conversion for the named analysis results: %q", prop)
+	}
+}
+
+func TestBuildRejectionRequests(t *testing.T) {
+	accepted := true
+	rejected := false
+	rejection := comment.Comment{Author: "reviewer", Description: "Please fix this", Resolved: &rejected}
+	mirroredRejection := comment.Comment{Author: "reviewer", Description: "Already mirrored", Resolved: &rejected}
+	supersededRejection := comment.Comment{Author: "reviewer", Description: "Fixed since", Resolved: &rejected}
+	inlineRejection := comment.Comment{
+		Author:      "reviewer",
+		Description: "Not here",
+		Resolved:    &rejected,
+		Location:    &comment.Location{Commit: "A", Path: "foo.go"},
+	}
+	threads := []review.CommentThread{
+		{Comment: rejection},
+		{Comment: mirroredRejection},
+		{Comment: supersededRejection, Children: []review.CommentThread{
+			{Comment: comment.Comment{Author: "reviewer", Resolved: &accepted}},
+		}},
+		{Comment: inlineRejection},
+		{Comment: comment.Comment{Author: "reviewer", Description: "LGTM", Resolved: &accepted}},
+	}
+	existingComments := []comment.Comment{
+		comment.Comment{Author: "mirror", Description: review_utils.QuoteDescription(mirroredRejection)},
+	}
+	differentialReview := DifferentialReview{ID: "1"}
+	requests := (Arcanist{}).buildRejectionRequests(differentialReview, threads, existingComments)
+	if len(requests) != 1 {
+		t.Fatalf("Unexpected rejection requests: %v", requests)
+	}
+	if requests[0].Action != "reject" || requests[0].RevisionID != "1" || requests[0].Message != review_utils.QuoteDescription(rejection) {
+		t.Errorf("Unexpected rejection request: %v", requests[0])
+	}
+}
+
+func TestIsClosed(t *testing.T) {
+	open := DifferentialReview{Status: "0", StatusName: "Needs Review"}
+	closed := DifferentialReview{Status: "3", StatusName: "Closed"}
+	abandoned := DifferentialReview{Status: "4", StatusName: "Abandoned"}
+	if open.isClosed() || !closed.isClosed() || !abandoned.isClosed() {
+		t.Errorf("Unexpected default statuses: %v, %v, %v", open.isClosed(), closed.isClosed(), abandoned.isClosed())
+	}
+
+	config := Config{ClosedStatuses: []string{"published", "abandoned"}}
+	open = DifferentialReview{Status: "needs-review", StatusName: "Needs Review", config: config}
+	closed = DifferentialReview{Status: "published", StatusName: "Closed", config: config}
+	abandoned = DifferentialReview{Status: "7", StatusName: "Abandoned", config: config}
+	if open.isClosed() || !closed.isClosed() || !abandoned.isClosed() {
+		t.Errorf("Unexpected configured statuses: %v, %v, %v", open.isClosed(), closed.isClosed(), abandoned.isClosed())
+	}
+}
+
+func TestStatusCategory(t *testing.T) {
+	customConfig := Config{ClosedStatuses: []string{"published"}}
+	cases := []struct {
+		status, statusName string
+		config             Config
+		want               revisionStatus
+	}{
+		{"0", "Needs Review", Config{}, statusNeedsReview},
+		{"1", "Needs Revision", Config{}, statusNeedsRevision},
+		{"2", "Accepted", Config{}, statusAccepted},
+		{"3", "Closed", Config{}, statusClosed},
+		{"4", "Abandoned", Config{}, statusAbandoned},
+		{"5", "Changes Planned", Config{}, statusChangesPlanned},
+		{"6", "Draft", Config{}, statusOpen},
+		{"needs-review", "", customConfig, statusNeedsReview},
+		{"changes-planned", "", customConfig, statusChangesPlanned},
+		{"accepted", "", customConfig, statusAccepted},
+		{"published", "", customConfig, statusClosed},
+		{"abandoned", "Abandoned", customConfig, statusOpen},
+		{"", "changes planned", Config{}, statusChangesPlanned},
+		{"7", "Landed", Config{ClosedStatuses: []string{"7"}}, statusClosed},
+	}
+	for _, c := range cases {
+		differentialReview := DifferentialReview{Status: c.status, StatusName: c.statusName, config: c.config}
+		if got := differentialReview.statusCategory(); got != c.want {
+			t.Errorf("Unexpected category of the status %q (%q): got %v, want %v", c.status, c.statusName, got, c.want)
+		}
+	}
+}
+
+func TestExtractJSON(t *testing.T) {
+	cases := []struct {
+		output, response, skipped string
+	}{
+		{`{"response": 1}`, `{"response": 1}`, ""},
+		{"Warning: something\nMore text\n{\"response\": 1}\n", "{\"response\": 1}\n", "Warning: something\nMore text\n"},
+		{"Progress...\n  [1, 2]", "  [1, 2]", "Progress...\n"},
+		{"No JSON here", "No JSON here", ""},
+	}
+	for _, c := range cases {
+		response, skipped := extractJSON([]byte(c.output))
+		if string(response) != c.response || string(skipped) != c.skipped {
+			t.Errorf("Unexpected result of extracting the JSON from %q: %q, %q", c.output, response, skipped)
+		}
+	}
+}
+
+func TestConduitResult(t *testing.T) {
+	cases := []struct {
+		response, result string
+	}{
+		{`{"error": null, "errorMessage": null, "response": {}}`, metrics.ResultSuccess},
+		{`{"error": "", "response": {}}`, metrics.ResultSuccess},
+		{`{"error": "ERR-CONDUIT-CORE", "errorMessage": "Invalid request"}`, metrics.ResultError},
+		{`[1, 2]`, metrics.ResultSuccess},
+	}
+	for _, c := range cases {
+		if result := conduitResult([]byte(c.response)); result != c.result {
+			t.Errorf("Unexpected result for the Conduit response %s: %q", c.response, result)
+		}
+	}
+}
+
+func TestGenerateOrphanedCommentRequests(t *testing.T) {
+	diffReview := DifferentialReview{ID: "1"}
+	commitToDiffMap := map[string]string{"ABCD": "1", "EFGH": "2"}
+	repo := fileRepo{repository.NewMockRepoForTest(), map[string]string{
+		"ABCD:hello.txt": "One\nTwo\nThree\n",
+		"EFGH:hello.txt": "One\nTwo\n",
+	}}
+	lineComment := func(commit, path string, line uint32) review.CommentThread {
+		return review.CommentThread{
+			Comment: comment.Comment{
+				Author:      "example@example.com",
+				Location:    &comment.Location{Commit: commit, Path: path, Range: &comment.Range{StartLine: line}},
+				Description: fmt.Sprintf("On %s of %s", path, commit),
+			},
+		}
+	}
+	comments := []review.CommentThread{
+		// This line no longer exists.
+		lineComment("EFGH", "hello.txt", 3),
+		// This commit has no diff of its own, so the comment is moved to the latest diff.
+		lineComment("IJKL", "hello.txt", 2),
+		// This file does not exist in any diff.
+		lineComment("ABCD", "deleted.txt", 1),
+	}
+
+	inlineRequests, commentRequests := Arcanist{}.buildCommentRequests(repo, diffReview, comments, nil, commitToDiffMap, "")
+	if len(inlineRequests) != 2 || len(commentRequests) != 2 || !commentRequests[0].AttachInlines {
+		t.Fatalf("Unexpected requests: %v, %v", inlineRequests, commentRequests)
+	}
+	if inlineRequests[0].DiffID != "2" || inlineRequests[0].LineNumber != 2 {
+		t.Errorf("The comment on a removed line was not moved to the nearest line: %v", inlineRequests[0])
+	}
+	if inlineRequests[1].DiffID != "2" || inlineRequests[1].LineNumber != 2 {
+		t.Errorf("The comment on a commit without a diff was not moved to the latest diff: %v", inlineRequests[1])
+	}
+	if !strings.HasPrefix(commentRequests[1].Message, "On line 1 of deleted.txt at ABCD, example@example.com:") {
+		t.Errorf("The comment on a deleted file was not posted as a top-level comment: %v", commentRequests[1])
+	}
+
+	inlineRequests, _ = Arcanist{Config: Config{OrphanedComments: OrphanedCommentsFile}}.buildCommentRequests(repo, diffReview, comments, nil, commitToDiffMap, "")
+	if len(inlineRequests) != 2 || inlineRequests[0].LineNumber != 1 {
+		t.Errorf("The comment on a removed line was not moved to the start of the file: %v", inlineRequests)
+	}
+
+	inlineRequests, commentRequests = Arcanist{Config: Config{OrphanedComments: OrphanedCommentsTopLevel}}.buildCommentRequests(repo, diffReview, comments, nil, commitToDiffMap, "")
+	if len(inlineRequests) != 1 || len(commentRequests) != 3 {
+		t.Fatalf("Unexpected requests when posting orphaned comments as top-level comments: %v, %v", inlineRequests, commentRequests)
+	}
+	if !strings.HasPrefix(commentRequests[1].Message, "On line 3 of hello.txt at EFGH, ") {
+		t.Errorf("Unexpected top-level comment for the removed line: %v", commentRequests[1])
+	}
+
+	// Once posted, orphaned comments are recognized at their new locations.
+	existingComments := []comment.Comment{
+		comment.Comment{
+			Location:    &comment.Location{Commit: "EFGH", Path: "hello.txt", Range: &comment.Range{StartLine: 2}},
+			Description: review_utils.QuoteDescription(comments[0].Comment),
+		},
+		comment.Comment{Description: commentRequests[2].Message},
+	}
+	inlineRequests, commentRequests = Arcanist{}.buildCommentRequests(repo, diffReview, comments[:1], existingComments, commitToDiffMap, "")
+	if len(inlineRequests) != 0 || len(commentRequests) != 0 {
+		t.Errorf("Unexpected requests for a comment that was already moved: %v, %v", inlineRequests, commentRequests)
+	}
+	_, commentRequests = Arcanist{}.buildCommentRequests(repo, diffReview, comments[2:], existingComments, commitToDiffMap, "")
+	if len(commentRequests) != 0 {
+		t.Errorf("Unexpected requests for an orphaned comment that was already posted: %v", commentRequests)
+	}
+}
+
+func TestWithDefaultTargetRef(t *testing.T) {
+	r := review.Review{Summary: &review.Summary{}}
+	(Arcanist{}).withDefaultTargetRef(&r)
+	if r.Request.TargetRef != "" {
+		t.Errorf("Unexpected target ref without a default: %q", r.Request.TargetRef)
+	}
+	original := r.Summary
+	arc := Arcanist{DefaultTargetRef: "develop"}
+	arc.withDefaultTargetRef(&r)
+	if r.Request.TargetRef != "refs/heads/develop" {
+		t.Errorf("Unexpected default target ref: %q", r.Request.TargetRef)
+	}
+	if original.Request.TargetRef != "" {
+		t.Errorf("The original review summary was modified: %v", original)
+	}
+	r.Request.TargetRef = "refs/heads/release"
+	arc.withDefaultTargetRef(&r)
+	if r.Request.TargetRef != "refs/heads/release" {
+		t.Errorf("The request's own target ref was overridden: %q", r.Request.TargetRef)
+	}
+}
+
+func TestMirrorCommentsIntoReviewWithoutDiffs(t *testing.T) {
+	repo := repository.NewMockRepoForTest()
+	r, err := review.ListAll(repo)[0].Details()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// If this did not return early, then it would try to load the revision's comments and fail.
+	(Arcanist{}).mirrorCommentsIntoReview(repo, DifferentialReview{ID: "1"}, *r)
+}
+
+func TestBuildCloseEditRequest(t *testing.T) {
+	differentialReview := DifferentialReview{ID: "1", PHID: "PHID-DREV-1"}
+	request := buildCloseEditRequest(differentialReview, "Landed in master as M")
+	if request.ObjectIdentifier != "PHID-DREV-1" || len(request.Transactions) != 2 {
+		t.Fatalf("Unexpected close request: %v", request)
+	}
+	if request.Transactions[0].Type != "close" || request.Transactions[0].Value != true {
+		t.Errorf("Unexpected close transaction: %v", request.Transactions[0])
+	}
+	if request.Transactions[1].Type != "comment" || request.Transactions[1].Value != "Landed in master as M" {
+		t.Errorf("Unexpected reason for closing: %v", request.Transactions[1])
+	}
+	if request := buildCloseEditRequest(differentialReview, ""); len(request.Transactions) != 1 {
+		t.Errorf("Unexpected close request without a reason: %v", request)
+	}
+}
+
+func TestBuildCreateEditRequest(t *testing.T) {
+	fields := revisionFields{
+		Title:     "Title",
+		Summary:   "Summary",
+		TestPlan:  "Ran it",
+		Reviewers: []string{"PHID-USER-1"},
+		CCs:       []string{"PHID-USER-2"},
+	}
+	values := mergeParsedFields(fields, map[string]interface{}{"custom:field": "dropped"})
+	request := buildCreateEditRequest("PHID-DIFF-1", values)
+	if request.ObjectIdentifier != "" {
+		t.Errorf("Unexpected revision to edit, instead of creating one: %q", request.ObjectIdentifier)
+	}
+	var types []string
+	for _, transaction := range request.Transactions {
+		types = append(types, transaction.Type)
+	}
+	if fmt.Sprint(types) != "[update subscribers.add reviewers.add summary testPlan title]" {
+		t.Fatalf("Unexpected transactions: %v", request.Transactions)
+	}
+	if request.Transactions[0].Value != "PHID-DIFF-1" || fmt.Sprint(request.Transactions[2].Value) != "[PHID-USER-1]" ||
+		request.Transactions[5].Value != "Title" {
+		t.Errorf("Unexpected transaction values: %v", request.Transactions)
+	}
+	encoded, err := json.Marshal(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(encoded), "objectIdentifier") {
+		t.Errorf("The request to create a revision identified an object: %s", encoded)
+	}
+}
+
+func TestSelectRevisions(t *testing.T) {
+	manual := DifferentialReview{ID: "12", AuthorPHID: "PHID-USER-human"}
+	mirrored := DifferentialReview{ID: "9", AuthorPHID: "PHID-USER-mirror"}
+	open := []DifferentialReview{mirrored, manual}
+	ids := func(reviews []DifferentialReview) string {
+		var ids []string
+		for _, r := range reviews {
+			ids = append(ids, r.ID)
+		}
+		return strings.Join(ids, ",")
+	}
+	if selected := selectRevisions(open, "", "PHID-USER-mirror"); ids(selected) != "9,12" {
+		t.Errorf("Unexpected revisions selected by default: %v", selected)
+	}
+	if selected := selectRevisions(open, DuplicateRevisionsMirrorOwned, "PHID-USER-mirror"); ids(selected) != "9" {
+		t.Errorf("Unexpected mirror-owned revisions: %v", selected)
+	}
+	if selected := selectRevisions(open, DuplicateRevisionsNewest, "PHID-USER-mirror"); ids(selected) != "12" {
+		t.Errorf("Unexpected newest revision: %v", selected)
+	}
+	if selected := selectRevisions([]DifferentialReview{manual}, DuplicateRevisionsMirrorOwned, "PHID-USER-mirror"); ids(selected) != "12" {
+		t.Errorf("A single revision was not updated: %v", selected)
+	}
+}
+
+func TestHasDiffs(t *testing.T) {
+	if hasDiffs(nil) {
+		t.Error("A review without revisions has diffs")
+	}
+	if hasDiffs([]DifferentialReview{{ID: "1"}}) {
+		t.Error("A revision without diffs has diffs")
+	}
+	if !hasDiffs([]DifferentialReview{{ID: "1"}, {ID: "2", Diffs: []string{"3"}}}) {
+		t.Error("The diffs of the second revision were missed")
+	}
+}
+
+func TestIsUnchangedEmptyReview(t *testing.T) {
+	defer delete(emptyMergedReviews, "ABCD")
+	if isUnchangedEmptyReview("ABCD", "ABCD") {
+		t.Error("A review was unchanged before it was ever looked at")
+	}
+	storeInCache(emptyMergedReviews, "ABCD", "ABCD")
+	if !isUnchangedEmptyReview("ABCD", "ABCD") {
+		t.Error("The review was not remembered as empty")
+	}
+	if isUnchangedEmptyReview("ABCD", "EFGH") {
+		t.Error("The review was unchanged after getting a new head commit")
+	}
+}
+
+func TestMirrorStatusesWithoutNotes(t *testing.T) {
+	r := review.Review{Summary: &review.Summary{Repo: repository.NewMockRepoForTest(), Revision: "B"}}
+	reports := (Arcanist{}).mirrorStatusesForEachCommit(r, map[string]int{"B": 1})
+	if len(reports) != 0 {
+		t.Errorf("Unexpected CI reports for a commit without any CI notes: %v", reports)
+	}
+}
+
+func TestMissingDiffCommits(t *testing.T) {
+	threads := []review.CommentThread{
+		review.CommentThread{
+			Comment: comment.Comment{Location: &comment.Location{Commit: "A", Path: "hello.txt"}},
+			Children: []review.CommentThread{
+				review.CommentThread{Comment: comment.Comment{Location: &comment.Location{Commit: "C", Path: "hello.txt"}}},
+			},
+		},
+		review.CommentThread{Comment: comment.Comment{Location: &comment.Location{Commit: "B", Path: "hello.txt"}}},
+		review.CommentThread{Comment: comment.Comment{Location: &comment.Location{Commit: "C", Path: "world.txt"}}},
+		review.CommentThread{Comment: comment.Comment{Location: &comment.Location{Commit: "D"}}},
+		review.CommentThread{Comment: comment.Comment{Description: "A review-wide comment"}},
+	}
+	missing := missingDiffCommits(threads, map[string]string{"B": "2"})
+	if fmt.Sprint(missing) != "[A C]" {
+		t.Errorf("Unexpected commits with missing diffs: %v", missing)
+	}
+}
+
+func TestNewArcanistSettings(t *testing.T) {
+	arc := NewArcanist(Config{})
+	if arc.Config.requestTimeout() != defaultRequestTimeout || arc.Config.titleLengthLimit() != defaultTitleLengthLimit {
+		t.Errorf("Unexpected default settings: %v, %d", arc.Config.requestTimeout(), arc.Config.titleLengthLimit())
+	}
+	if callsign := arc.RepoCallsign(repository.NewMockRepoForTest()); callsign != "" {
+		t.Errorf("Unexpected callsign for the mock repo: %q", callsign)
+	}
+	if callsign := GuessCallsign("/var/repo/FE"); callsign != "FE" {
+		t.Errorf("Unexpected callsign under the default prefix: %q", callsign)
+	}
+
+	arc = NewArcanist(Config{RequestTimeout: 5, RepoDirPrefix: "/srv/phabricator", TitleLengthLimit: 10})
+	if arc.Config.requestTimeout() != 5*time.Second {
+		t.Errorf("Unexpected request timeout: %v", arc.Config.requestTimeout())
+	}
+	if callsign := arc.Config.GuessCallsign("/srv/phabricator/FE"); callsign != "FE" {
+		t.Errorf("Unexpected callsign under a custom prefix: %q", callsign)
+	}
+	if callsign := arc.Config.GuessCallsign("/var/repo/FE"); callsign != "" {
+		t.Errorf("Unexpected callsign outside of a custom prefix: %q", callsign)
+	}
+	if title, _, _ := arc.describe("A rather long title"); title != "A rath..." {
+		t.Errorf("Unexpected truncated title: %q", title)
+	}
+	if limit := (Config{TitleLengthLimit: 1}).titleLengthLimit(); limit != minTitleLengthLimit {
+		t.Errorf("Unexpected title length limit below the minimum: %d", limit)
+	}
+}
+
+// pathRepo is a repository.Repo at the given path.
+type pathRepo struct {
+	repository.Repo
+	path string
+}
+
+func (repo pathRepo) GetPath() string {
+	return repo.path
+}
+
+func TestListOpenReviews(t *testing.T) {
+	const (
+		repositoryFound    = `{"response": {"data": [{"phid": "PHID-REPO-1", "fields": {"callsign": "FE"}}]}}`
+		repositoryNotFound = `{"response": {"data": []}}`
+		noRevisions        = `{"response": {"data": [], "cursor": {"after": null}}}`
+		searchFailed       = `{"error": "ERR-CONDUIT-CALL", "errorMessage": "Unknown method"}`
+		openRevisions      = `{"response": [{"id": "1"}, {"id": "2"}, {"id": "3"}]}`
+	)
+	revisionPages := map[string]string{
+		"":  `{"response": {"data": [{"id": 1, "fields": {"repositoryPHID": "PHID-REPO-1"}}, {"id": 2, "fields": {"repositoryPHID": "PHID-REPO-1"}}], "cursor": {"after": "2"}}}`,
+		"2": `{"response": {"data": [{"id": 3, "fields": {"repositoryPHID": "PHID-REPO-1"}}], "cursor": {"after": null}}}`,
+	}
+	// These are every open revision on the instance. Revisions created before we set their
+	// repository have none.
+	everyRevision := map[string]string{
+		"": `{"response": {"data": [{"id": 1, "fields": {"repositoryPHID": "PHID-REPO-1"}}, {"id": 4, "fields": {"repositoryPHID": null}}, {"id": 5, "fields": {"repositoryPHID": "PHID-REPO-2"}}], "cursor": {"after": null}}}`,
+	}
+	testCases := []struct {
+		name              string
+		repository        string
+		revisions         map[string]string
+		withoutRepository bool
+		expectedIDs       []int
+		expectedQuery     bool
+		expectedLength    int
+	}{
+		{"Revisions of the repo", repositoryFound, revisionPages, false, []int{1, 2, 3}, true, 3},
+		{"Revisions without a repo", repositoryFound, revisionPages, true, []int{1, 2, 3, 4}, true, 3},
+		{"No revisions in the repo", repositoryFound, map[string]string{"": noRevisions}, false, nil, false, 0},
+		{"Only revisions without a repo", repositoryFound, map[string]string{"": noRevisions}, true, []int{4}, true, 3},
+		{"Revision search failed", repositoryFound, map[string]string{"": searchFailed}, false, nil, true, 3},
+		{"Unknown repo", repositoryNotFound, nil, false, nil, true, 3},
+	}
+
+	originalCallConduit := callConduit
+	defer func() { callConduit = originalCallConduit }()
+	for _, testCase := range testCases {
+		arc := NewArcanist(Config{ListRevisionsWithoutRepository: testCase.withoutRepository})
+		arc.Callsign = "FE"
+		delete(repositoryPHIDs, "FE")
+		var queried *queryRequest
+		callConduit = func(config Config, method string, request interface{}, response interface{}) {
+			var output string
+			switch method {
+			case "diffusion.repository.search":
+				output = testCase.repository
+			case "differential.revision.search":
+				search := request.(revisionSearchRequest)
+				switch fmt.Sprint(search.Constraints.RepositoryPHIDs) {
+				case "[PHID-REPO-1]":
+					output = testCase.revisions[search.After]
+				case "[]":
+					if !testCase.withoutRepository {
+						t.Errorf("%s: searched every open revision", testCase.name)
+					}
+					output = everyRevision[search.After]
+				default:
+					t.Fatalf("%s: unexpected repositories searched: %v", testCase.name, search.Constraints.RepositoryPHIDs)
+				}
+			case "differential.query":
+				r := request.(queryRequest)
+				queried = &r
+				output = openRevisions
+			default:
+				t.Fatalf("%s: unexpected Conduit call %s", testCase.name, method)
+			}
+			if err := json.Unmarshal([]byte(output), response); err != nil {
+				t.Fatal(err)
+			}
+		}
+		reviews := arc.ListOpenReviews(repository.NewMockRepoForTest())
+		if len(reviews) != testCase.expectedLength {
+			t.Errorf("%s: unexpected reviews: %v", testCase.name, reviews)
+		}
+		if (queried != nil) != testCase.expectedQuery {
+			t.Errorf("%s: unexpected differential.query call: %v", testCase.name, queried)
+		}
+		if queried != nil && fmt.Sprint(queried.IDs) != fmt.Sprint(testCase.expectedIDs) {
+			t.Errorf("%s: unexpected revisions queried: %v, expected %v", testCase.name, queried.IDs, testCase.expectedIDs)
+		}
+	}
+	delete(repositoryPHIDs, "FE")
+}
+
+func TestCallsign(t *testing.T) {
+	remoteURLs := map[string]string{
+		"/var/repo/FE":     "https://git.example.com/frontend",
+		"/home/me/backend": "https://git.example.com/backend",
+		"/home/me/tools":   "https://git.example.com/tools",
+	}
+	remoteCallsigns["https://git.example.com/tools"] = "TOOLS"
+	defer delete(remoteCallsigns, "https://git.example.com/tools")
+
+	arc := NewArcanist(Config{RemoteCallsigns: map[string]string{
+		"https://git.example.com/frontend": "WEB",
+		"https://git.example.com/backend":  "BE",
+	}})
+	mock := repository.NewMockRepoForTest()
+	for path, expected := range map[string]string{
+		"/var/repo/FE":     "WEB",
+		"/home/me/backend": "BE",
+		"/home/me/tools":   "TOOLS",
+		"/var/repo/OTHER":  "OTHER",
+	} {
+		arc.RemoteURL = remoteURLs[path]
+		if callsign := arc.RepoCallsign(pathRepo{mock, path}); callsign != expected {
+			t.Errorf("Unexpected callsign for %s: %q, expected %q", path, callsign, expected)
+		}
+	}
+
+	arc.Callsign = "EXPLICIT"
+	arc.RemoteURL = remoteURLs["/home/me/backend"]
+	if callsign := arc.RepoCallsign(pathRepo{mock, "/home/me/backend"}); callsign != "EXPLICIT" {
+		t.Errorf("Unexpected callsign despite an explicit one: %q", callsign)
+	}
+}
+
+func TestSetReplyTargets(t *testing.T) {
+	location := &comment.Location{Commit: "ABCD", Path: "main.go", Range: &comment.Range{StartLine: 3}}
+	parent := comment.Comment{Author: "reviewer@example.com", Location: location, Description: "Why?"}
+	parentHash, err := parent.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := comment.Comment{Author: "author@example.com", Location: location, Description: "Because", Parent: parentHash}
+	unmirroredReply := comment.Comment{Author: "author@example.com", Location: location, Description: "Also", Parent: "unknown"}
+	threads := []review.CommentThread{{
+		Hash:     parentHash,
+		Comment:  parent,
+		Children: []review.CommentThread{{Comment: reply}, {Comment: unmirroredReply}},
+	}}
+	requests := []createInlineRequest{{comment: reply}, {comment: unmirroredReply}}
+	existingComments := []comment.Comment{{Description: "Unrelated"}, parent}
+	setReplyTargets(requests, threads, existingComments, []string{"PHID-XCMT-1", "PHID-XCMT-2"})
+	if requests[0].ReplyToCommentPHID != "PHID-XCMT-2" {
+		t.Errorf("Unexpected reply target: %q", requests[0].ReplyToCommentPHID)
+	}
+	if requests[1].ReplyToCommentPHID != "" {
+		t.Errorf("A reply to an unmirrored comment was given a parent: %q", requests[1].ReplyToCommentPHID)
+	}
+}
+
+func TestCreateInlineReply(t *testing.T) {
+	originalCallConduit := callConduit
+	defer func() { callConduit = originalCallConduit }()
+	var calls []string
+	callConduit = func(config Config, method string, request interface{}, response interface{}) {
+		encoded, err := json.Marshal(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		calls = append(calls, method+" "+string(encoded))
+		if method == "differential.revision.edit" {
+			json.Unmarshal([]byte(`{"response": {"transactions": [{"phid": "PHID-XACT-3"}]}}`), response)
+		} else {
+			json.Unmarshal([]byte(`{"response": {"phid": "PHID-XCMT-3"}}`), response)
+		}
+	}
+	reply := createInlineRequest{
+		RevisionID:         "1",
+		DiffID:             "2",
+		FilePath:           "main.go",
+		LineNumber:         3,
+		IsNewFile:          rightHandSide,
+		Content:            "Because",
+		ReplyToCommentPHID: "PHID-XCMT-2",
+	}
+	if phids, err := (Config{UseEditAPI: true}).createInline(reply); err != nil || fmt.Sprint(phids) != "[PHID-XACT-3]" {
+		t.Errorf("Unexpected result of posting a reply: %v, %v", phids, err)
+	}
+	if phids, err := (Config{}).createInline(reply); err != nil || fmt.Sprint(phids) != "[PHID-XCMT-3]" {
+		t.Errorf("Unexpected result of posting an inline comment: %v, %v", phids, err)
+	}
+	if len(calls) != 2 ||
+		!strings.HasPrefix(calls[0], `differential.revision.edit {"objectIdentifier":"D1","transactions":[{"type":"inline"`) ||
+		!strings.Contains(calls[0], `"replyToCommentPHID":"PHID-XCMT-2"`) ||
+		!strings.HasPrefix(calls[1], "differential.createinline ") || strings.Contains(calls[1], "PHID-XCMT-2") {
+		t.Errorf("Unexpected Conduit calls for a reply: %v", calls)
+	}
+}
+
+func TestThreadsSince(t *testing.T) {
+	threads := []review.CommentThread{
+		{Hash: "old", Comment: comment.Comment{Timestamp: "100"}},
+		{Hash: "new", Comment: comment.Comment{Timestamp: "200"}},
+		{Hash: "unparsable", Comment: comment.Comment{Timestamp: "yesterday"}},
+	}
+	if recent := threadsSince(threads, 150); len(recent) != 2 || recent[0].Hash != "new" || recent[1].Hash != "unparsable" {
+		t.Errorf("Unexpected recent threads: %v", recent)
+	}
+	reports := map[string][]ci.Report{"abc": {{Timestamp: "100", URL: "old"}, {Timestamp: "200", URL: "new"}}, "def": {{Timestamp: "100"}}}
+	if recent := ciReportsSince(reports, 150); len(recent) != 1 || len(recent["abc"]) != 1 || recent["abc"][0].URL != "new" {
+		t.Errorf("Unexpected recent reports: %v", recent)
+	}
 }
@@ -0,0 +1,244 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package arcanist
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultMySQLHost = "127.0.0.1"
+	defaultMySQLPort = 3306
+)
+
+var (
+	// connection holds the settings for connecting to Phabricator, as set by UseConnection.
+	connection Config
+	// arcrcFile is the path of the private arcrc file that holds the Conduit token, if any.
+	arcrcFile string
+	// database is the pool of connections to Phabricator's database, as opened by UseConnection.
+	database *sql.DB
+)
+
+// arcrc models the parts of an arcrc file that hold the credentials for a Conduit API endpoint.
+type arcrc struct {
+	Hosts map[string]arcrcHost `json:"hosts"`
+}
+
+type arcrcHost struct {
+	Token string `json:"token"`
+}
+
+// UseConnection sets how we connect to Phabricator and its database, from the Conduit and
+// MySQL settings of the given config.
+//
+// The Conduit token is never passed on the command line of the "arc" command, where other
+// users could see it. Instead, it is written to a private arcrc file, which is removed when the
+// connection is replaced or closed.
+func UseConnection(config Config) error {
+	CloseConnection()
+	connection = config
+	// This only validates the settings; the connections are made as they are needed.
+	dsn, err := mysqlDSN(config)
+	if err != nil {
+		return err
+	}
+	database, err = sql.Open("mysql", dsn)
+	if err != nil {
+		return err
+	}
+	if config.ConduitToken == "" {
+		return nil
+	}
+	if config.ConduitURI == "" {
+		return fmt.Errorf("A Conduit token requires a Conduit URI")
+	}
+	contents, err := json.Marshal(arcrc{
+		Hosts: map[string]arcrcHost{config.ConduitURI: arcrcHost{Token: config.ConduitToken}},
+	})
+	if err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile("", "git-phabricator-mirror-arcrc")
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	// Temporary files are created only readable by their owner, but we do not rely on that.
+	if err := file.Chmod(0600); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	if _, err := file.Write(contents); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	arcrcFile = file.Name()
+	return nil
+}
+
+// CloseConnection closes the connection set by UseConnection, removing its arcrc file.
+func CloseConnection() {
+	if arcrcFile != "" {
+		if err := os.Remove(arcrcFile); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove the arcrc file %s: %v", arcrcFile, err)
+		}
+		arcrcFile = ""
+	}
+	if database != nil {
+		database.Close()
+		database = nil
+	}
+}
+
+// conduitURI returns the Conduit API endpoint in the config if it has one, or else the one passed
+// to UseConnection. It is empty if "arc" should fall back to its own configuration.
+func (config Config) conduitURI() string {
+	if config.ConduitURI != "" {
+		return config.ConduitURI
+	}
+	return connection.ConduitURI
+}
+
+// arcCommand returns the command that calls the given Conduit API method, at the endpoint
+// returned by conduitURI.
+func (config Config) arcCommand(ctx context.Context, method string) *exec.Cmd {
+	var args []string
+	if uri := config.conduitURI(); uri != "" {
+		args = append(args, "--conduit-uri", uri)
+	}
+	if arcrcFile != "" {
+		args = append(args, "--arcrc-file", arcrcFile)
+	}
+	args = append(args, "call-conduit", method)
+	return exec.CommandContext(ctx, "arc", args...)
+}
+
+// readMySQLOptions reads the settings in the [client] and [mysql] sections of the MySQL option
+// file at the given path, keyed by their names.
+//
+// The "!include" directives and the options without values are ignored.
+func readMySQLOptions(path string) (map[string]string, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	options := make(map[string]string)
+	inClientSection := false
+	for _, line := range strings.Split(string(contents), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") || strings.HasPrefix(line, "!"):
+			continue
+		case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+			section := strings.TrimSpace(line[1 : len(line)-1])
+			inClientSection = section == "client" || section == "mysql"
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if !inClientSection || len(parts) != 2 {
+			continue
+		}
+		name := strings.Replace(strings.TrimSpace(parts[0]), "_", "-", -1)
+		value := strings.TrimSpace(parts[1])
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		options[name] = value
+	}
+	return options, nil
+}
+
+// mysqlOptions returns the settings in the config's MySQL option file. It is not an error for the
+// default option file to be missing.
+func (config Config) mysqlOptions() (map[string]string, error) {
+	path := config.MySQLDefaultsFile
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, nil
+		}
+		options, err := readMySQLOptions(filepath.Join(home, ".my.cnf"))
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return options, err
+	}
+	return readMySQLOptions(path)
+}
+
+// mysqlDSN returns the data source name for connecting to Phabricator's database.
+//
+// The settings that are not in the config are read from its MySQL option file, so that the
+// mirror connects the same way as the mysql client.
+func mysqlDSN(config Config) (string, error) {
+	options, err := config.mysqlOptions()
+	if err != nil {
+		return "", fmt.Errorf("Failed to read the MySQL settings: %v", err)
+	}
+	if config.MySQLUser == "" {
+		config.MySQLUser = options["user"]
+	}
+	if config.MySQLPassword == "" {
+		config.MySQLPassword = options["password"]
+	}
+	if config.MySQLSocket == "" && config.MySQLHost == "" && config.MySQLPort == 0 {
+		// Like the mysql client, we only use the socket when connecting to the local host.
+		host := options["host"]
+		if socket := options["socket"]; socket != "" && (host == "" || host == "localhost") {
+			config.MySQLSocket = socket
+		} else {
+			config.MySQLHost = host
+		}
+		if port, ok := options["port"]; ok {
+			if config.MySQLPort, err = strconv.Atoi(port); err != nil {
+				return "", fmt.Errorf("Invalid MySQL port %q: %v", port, err)
+			}
+		}
+	}
+	dsn := mysql.NewConfig()
+	dsn.User = config.MySQLUser
+	dsn.Passwd = config.MySQLPassword
+	if config.MySQLSocket != "" {
+		dsn.Net = "unix"
+		dsn.Addr = config.MySQLSocket
+		return dsn.FormatDSN(), nil
+	}
+	host := config.MySQLHost
+	if host == "" {
+		host = defaultMySQLHost
+	}
+	port := config.MySQLPort
+	if port == 0 {
+		port = defaultMySQLPort
+	}
+	dsn.Net = "tcp"
+	dsn.Addr = net.JoinHostPort(host, strconv.Itoa(port))
+	return dsn.FormatDSN(), nil
+}
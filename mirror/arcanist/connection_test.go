@@ -0,0 +1,179 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package arcanist
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUseConnection(t *testing.T) {
+	defer UseConnection(Config{})
+	if err := UseConnection(Config{ConduitToken: "api-secret"}); err == nil {
+		t.Error("A Conduit token was accepted without a Conduit URI")
+	}
+	config := Config{
+		ConduitURI:    "https://phabricator.example.com/api/",
+		ConduitToken:  "api-secret",
+		MySQLHost:     "db.example.com",
+		MySQLUser:     "phabricator",
+		MySQLPassword: "mysql-secret",
+	}
+	if err := UseConnection(config); err != nil {
+		t.Fatal(err)
+	}
+	defer CloseConnection()
+
+	arc := Config{}.arcCommand(context.Background(), "differential.query")
+	if args := strings.Join(arc.Args, " "); strings.Contains(args, "api-secret") || !strings.HasSuffix(args, "call-conduit differential.query") {
+		t.Errorf("Unexpected arguments for arc: %q", args)
+	}
+	contents, err := ioutil.ReadFile(arcrcFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var written arcrc
+	if err := json.Unmarshal(contents, &written); err != nil || written.Hosts[config.ConduitURI].Token != "api-secret" {
+		t.Errorf("Unexpected arcrc file: %q", contents)
+	}
+
+	if info, err := os.Stat(arcrcFile); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Unexpected permissions for the arcrc file: %v, %v", info, err)
+	}
+
+	if database == nil {
+		t.Error("The database connection was not set up")
+	}
+
+	replaced := arcrcFile
+	if err := UseConnection(config); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(replaced); !os.IsNotExist(err) {
+		t.Errorf("The replaced arcrc file %s was not removed: %v", replaced, err)
+	}
+	closed := arcrcFile
+	CloseConnection()
+	if _, err := os.Stat(closed); !os.IsNotExist(err) || arcrcFile != "" || database != nil {
+		t.Errorf("The closed arcrc file %s was not removed: %v", closed, err)
+	}
+}
+
+func TestMySQLDSN(t *testing.T) {
+	file, err := ioutil.TempFile("", "my.cnf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.Close()
+	config := Config{MySQLUser: "phabricator", MySQLPassword: "mysql-secret", MySQLDefaultsFile: file.Name()}
+	if dsn, err := mysqlDSN(config); err != nil || !strings.HasPrefix(dsn, "phabricator:mysql-secret@tcp(127.0.0.1:3306)/") {
+		t.Errorf("Unexpected default DSN: %q, %v", dsn, err)
+	}
+	config.MySQLHost = "db.example.com"
+	config.MySQLPort = 3307
+	if dsn, err := mysqlDSN(config); err != nil || !strings.Contains(dsn, "@tcp(db.example.com:3307)/") {
+		t.Errorf("Unexpected DSN for a host and port: %q, %v", dsn, err)
+	}
+	config.MySQLSocket = "/var/run/mysqld/mysqld.sock"
+	if dsn, err := mysqlDSN(config); err != nil || !strings.Contains(dsn, "@unix(/var/run/mysqld/mysqld.sock)/") {
+		t.Errorf("Unexpected DSN for a socket: %q, %v", dsn, err)
+	}
+}
+
+func TestMySQLDefaultsFile(t *testing.T) {
+	file, err := ioutil.TempFile("", "my.cnf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(`# Written by the Phabricator install
+[mysqld]
+user = mysql
+
+[client]
+user = phabricator
+password = "mysql-secret"
+host = db.example.com
+port = 3307
+no-auto-rehash
+`)
+	file.Close()
+	config := Config{MySQLDefaultsFile: file.Name()}
+	if dsn, err := mysqlDSN(config); err != nil || !strings.HasPrefix(dsn, "phabricator:mysql-secret@tcp(db.example.com:3307)/") {
+		t.Errorf("Unexpected DSN from the defaults file: %q, %v", dsn, err)
+	}
+	config.MySQLUser = "mirror"
+	config.MySQLSocket = "/var/run/mysqld/mysqld.sock"
+	if dsn, err := mysqlDSN(config); err != nil || !strings.HasPrefix(dsn, "mirror:mysql-secret@unix(/var/run/mysqld/mysqld.sock)/") {
+		t.Errorf("The config did not override the defaults file: %q, %v", dsn, err)
+	}
+	config.MySQLDefaultsFile = file.Name() + ".missing"
+	if _, err := mysqlDSN(config); err == nil {
+		t.Error("Failed to report a missing defaults file")
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	if timeout := (Config{}).requestTimeout(); timeout != defaultRequestTimeout {
+		t.Errorf("Unexpected default request timeout: %v", timeout)
+	}
+	if timeout := (Config{RequestTimeout: 5}).requestTimeout(); timeout != 5*time.Second {
+		t.Errorf("Unexpected request timeout: %v", timeout)
+	}
+}
+
+func TestWithContext(t *testing.T) {
+	if ctx := (Config{}).context(); ctx != context.Background() {
+		t.Errorf("Unexpected default context: %v", ctx)
+	}
+	// This stands in for an "arc" command that is still running when the mirror is asked to stop.
+	dir, err := ioutil.TempDir("", "arc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	script := "#!/bin/sh\ncat >/dev/null\nsleep 1\necho '{\"error\":null,\"errorMessage\":null,\"response\":[\"D1\"]}'\n"
+	if err := ioutil.WriteFile(dir+"/arc", []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir+":"+os.Getenv("PATH"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	config := Config{}.WithContext(ctx)
+	if config.context() != ctx {
+		t.Errorf("Unexpected context: %v", config.context())
+	}
+	time.AfterFunc(100*time.Millisecond, cancel)
+	// A cancelled request would be fatal, and exit the test binary before it could report anything.
+	var response struct {
+		Response []string `json:"response"`
+	}
+	config.runArcCommandOrDie("differential.query", struct{}{}, &response)
+	if ctx.Err() == nil {
+		t.Error("The context was not cancelled while the Conduit request was running")
+	}
+	if len(response.Response) != 1 || response.Response[0] != "D1" {
+		t.Errorf("The Conduit request in progress did not finish: %v", response)
+	}
+}
@@ -27,99 +27,98 @@ package arcanist
 //  differential_changeset stores the diffs against which a comment was made.
 
 import (
-	"bytes"
+	"context"
+	"database/sql"
+	"errors"
 	"fmt"
 	"github.com/google/git-appraise/review/comment"
+	"github.com/google/git-phabricator-mirror/mirror/metrics"
+	"github.com/google/git-phabricator-mirror/mirror/parallel"
 	"log"
-	"os/exec"
-	"strconv"
-	"strings"
+	"math"
 	"time"
 )
 
 const (
 	// SQL query for differential "transactions". These are atomic operations on a review.
-	selectTransactionsQueryTemplate = `
+	// They are read newest first, so that only the latest ones need to be read.
+	selectTransactionsQuery = `
 select id, phid, authorPHID, dateCreated, transactionType, newValue, commentPHID
   from phabricator_differential.differential_transaction
-	where objectPHID="%s"
+	where objectPHID = ?
+		and id < ?
 		and viewPolicy="public"
 		and (transactionType = "differential:action" or
      transactionType = "differential:inline" or
      transactionType = "core:comment")
-  order by id;`
+  order by id desc
+  limit ?;`
 	// SQL query for differential "transaction comments". These are always tied
 	// to a differential "transaction" and include the body of a review comment.
-	selectTransactionCommentsQueryTemplate = `
-select phid, changesetID, lineNumber, replyToCommentPHID
+	selectTransactionCommentsQuery = `
+select phid, changesetID, lineNumber, lineLength, isNewFile, replyToCommentPHID, content
 	from phabricator_differential.differential_transaction_comment
-	where viewPolicy = "public" and transactionPHID = "%s";`
-	// SQL query for the contents of a differential "transaction comment". This
-	// is separated from the query for the other fields so that we don't have to
-	// worry about contents that include tabs, which mysql uses as the separator
-	// between multiple column values.
-	selectCommentContentsQueryTemplate = `
-select content from phabricator_differential.differential_transaction_comment
-	where phid = "%s";`
+	where viewPolicy = "public" and transactionPHID = ?;`
 	// SQL query to read the filename for a diff.
-	selectChangesetFilenameTemplate = `
+	selectChangesetFilenameQuery = `
 select filename from phabricator_differential.differential_changeset
-	where id = "%d";`
+	where id = ?;`
 	// SQL query to read the ID for a diff. We need this in order to be able
 	// to read the commit hash for a diff (which we do using the Differential API).
-	selectChangesetDiffTemplate = `
+	selectChangesetDiffQuery = `
 select diffID from phabricator_differential.differential_changeset
-	where id = "%d";`
+	where id = ?;`
 
 	// Timeout used for all SQL queries
 	sqlQueryTimeout = 1 * time.Minute
+
+	// defaultTransactionPageSize is the default maximum number of transactions read by a single SQL query.
+	defaultTransactionPageSize = 1000
+
+	// defaultCommentLoadChunkSize is the default maximum number of transaction comments that are
+	// held in memory at once while loading the comments of a review.
+	defaultCommentLoadChunkSize = 500
 )
 
-// runRawSqlCommandOrDie runs the given SQL command with no additional formatting
-// included in the output.
-//
-// Any errors that could occur here would be a sign of something being seriously
-// wrong, so they are treated as fatal. This makes it more evident that something
-// has gone wrong when the command is manually run by a user, and gives further
-// operations a clean-slate when this is run by supervisord with automatic restarts.
-func runRawSqlCommandOrDie(command string) string {
-	cmd := exec.Command("mysql", "-Ns", "-r", "-e", command)
-	var stdout bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Start()
-	go func() {
-		time.Sleep(sqlQueryTimeout)
-		cmd.Process.Kill()
-	}()
-	if err := cmd.Wait(); err != nil {
-		log.Println("Ran SQL command: ", command)
-		log.Fatal(err)
-	}
-	result := strings.TrimSuffix(stdout.String(), "\n")
-	return result
+// rowScanner is the part of *sql.Rows used to read a single row of a query result.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
 }
 
-// runRawSqlCommandOrDie runs the given SQL command.
+// runSqlQuery runs the given SQL query against the Phabricator database, with the given
+// arguments bound to its placeholders, and passes each row of the result to the given function.
+// The first error returned by that function is returned, and stops the reading of the result.
 //
-// Any errors that could occur here would be a sign of something being seriously
-// wrong, so they are treated as fatal. This makes it more evident that something
-// has gone wrong when the command is manually run by a user, and gives further
-// operations a clean-slate when this is run by supervisord with automatic restarts.
-func runSqlCommandOrDie(command string) string {
-	cmd := exec.Command("mysql", "-Ns", "-e", command)
-	var stdout bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Start()
-	go func() {
-		time.Sleep(sqlQueryTimeout)
-		cmd.Process.Kill()
-	}()
-	if err := cmd.Wait(); err != nil {
-		log.Println("Ran SQL command: ", command)
-		log.Fatal(err)
+// Unlike a failed Conduit request, a failure to run the query (e.g. because the database cannot
+// be reached) is returned rather than treated as fatal, so that a database outage or a bad
+// connection setting only stops the comments from being mirrored, rather than the whole mirror.
+//
+// The arguments are never interpolated into the query, so they need no escaping. The query is
+// cancelled once the config's context is done.
+func (config Config) runSqlQuery(scanRow func(row rowScanner) error, query string, args ...interface{}) error {
+	if database == nil {
+		return errors.New("Not connected to the Phabricator database")
+	}
+	ctx, cancel := context.WithTimeout(config.context(), sqlQueryTimeout)
+	defer cancel()
+	rows, err := database.QueryContext(ctx, query, args...)
+	if err != nil {
+		metrics.SQLQueries.WithLabelValues(metrics.ResultError).Inc()
+		return fmt.Errorf("Failed to run the SQL query %q: %v", query, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := scanRow(rows); err != nil {
+			metrics.SQLQueries.WithLabelValues(metrics.ResultError).Inc()
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		metrics.SQLQueries.WithLabelValues(metrics.ResultError).Inc()
+		return fmt.Errorf("Failed to read the results of the SQL query %q: %v", query, err)
 	}
-	result := strings.Trim(stdout.String(), "\n")
-	return result
+	metrics.SQLQueries.WithLabelValues(metrics.ResultSuccess).Inc()
+	return nil
 }
 
 // differentialDatabaseTransaction represents a user action on a code review.
@@ -138,134 +137,270 @@ type differentialDatabaseTransaction struct {
 
 type ReadTransactions func(reviewID string) ([]differentialDatabaseTransaction, error)
 
-func readDatabaseTransactions(reviewID string) ([]differentialDatabaseTransaction, error) {
+// readDatabaseTransactions reads the transactions of the given review, one page at a time, so
+// that a review with a huge number of transactions does not need a single huge query.
+//
+// If the config limits the number of transactions, then only the latest ones are read, plus one
+// more, from which loadComments can tell that older ones were left out.
+func (config Config) readDatabaseTransactions(reviewID string) ([]differentialDatabaseTransaction, error) {
 	var transactions []differentialDatabaseTransaction
-	result := runSqlCommandOrDie(fmt.Sprintf(selectTransactionsQueryTemplate, reviewID))
-	if strings.Trim(result, " ") == "" {
-		// There were no matching transactions
-		return nil, nil
-	}
-	// result will be a line-separated list of query results, each of which has 7 columns.
-	for _, line := range strings.Split(result, "\n") {
-		lineParts := strings.Split(line, "\t")
-		if len(lineParts) != 7 {
-			return nil, fmt.Errorf("Unexpected number of transaction parts: %v", lineParts)
+	beforeID := int64(math.MaxInt64)
+	for {
+		limit := config.transactionPageSize()
+		if max := config.MaxTransactions; max > 0 && max+1-len(transactions) < limit {
+			limit = max + 1 - len(transactions)
 		}
-		var transaction differentialDatabaseTransaction
-		transaction.PHID = lineParts[1]
-		transaction.AuthorPHID = lineParts[2]
-		timestamp, err := strconv.ParseUint(lineParts[3], 10, 32)
+		pageSize := 0
+		err := config.runSqlQuery(func(row rowScanner) error {
+			var id int64
+			var transaction differentialDatabaseTransaction
+			if err := row.Scan(&id, &transaction.PHID, &transaction.AuthorPHID, &transaction.DateCreated,
+				&transaction.Type, &transaction.NewValue, &transaction.CommentPHID); err != nil {
+				return err
+			}
+			if id < beforeID {
+				beforeID = id
+			}
+			pageSize++
+			transactions = append(transactions, transaction)
+			return nil
+		}, selectTransactionsQuery, reviewID, beforeID, limit)
 		if err != nil {
 			return nil, err
 		}
-		transaction.DateCreated = uint32(timestamp)
-		transaction.Type = lineParts[4]
-		if lineParts[5] != "NULL" {
-			transaction.NewValue = &lineParts[5]
-		}
-		if lineParts[6] != "NULL" {
-			transaction.CommentPHID = &lineParts[6]
+		if pageSize < limit || (config.MaxTransactions > 0 && len(transactions) > config.MaxTransactions) {
+			break
 		}
-		transactions = append(transactions, transaction)
+	}
+	// The transactions were read newest first, but are processed in the order they were made.
+	for i, j := 0, len(transactions)-1; i < j; i, j = i+1, j-1 {
+		transactions[i], transactions[j] = transactions[j], transactions[i]
 	}
 	return transactions, nil
 }
 
 // differentialDatabaseTransactionComment stores the actual contents of a code review comment.
 type differentialDatabaseTransactionComment struct {
-	PHID               string
-	Commit             string
-	FileName           string
-	LineNumber         uint32
+	PHID       string
+	Commit     string
+	FileName   string
+	LineNumber uint32
+	// LineLength is the number of lines that the comment spans after its first one.
+	LineLength         uint32
 	ReplyToCommentPHID *string
 	Content            string
 }
 
 type ReadTransactionComment func(transactionID string) (*differentialDatabaseTransactionComment, error)
 
-func readDatabaseTransactionComment(transactionID string) (*differentialDatabaseTransactionComment, error) {
-	result := runSqlCommandOrDie(fmt.Sprintf(selectTransactionCommentsQueryTemplate, transactionID))
-	// result will be a line separated list of query results, each of which includes 4 columns.
-	lines := strings.Split(result, "\n")
-	if len(lines) != 1 {
-		return nil, fmt.Errorf("Unexpected number of query results: %v", lines)
+func (config Config) readDatabaseTransactionComment(transactionID string) (*differentialDatabaseTransactionComment, error) {
+	var comments []differentialDatabaseTransactionComment
+	var changesetID sql.NullInt64
+	// The lineNumber column is NULL for comments that are not on a specific line (e.g. file-level
+	// comments or replies), so we treat that as line 0, which means the comment has no line.
+	var lineNumber sql.NullInt64
+	var isNewFile bool
+	err := config.runSqlQuery(func(row rowScanner) error {
+		var comment differentialDatabaseTransactionComment
+		if err := row.Scan(&comment.PHID, &changesetID, &lineNumber, &comment.LineLength, &isNewFile, &comment.ReplyToCommentPHID, &comment.Content); err != nil {
+			return err
+		}
+		comments = append(comments, comment)
+		return nil
+	}, selectTransactionCommentsQuery, transactionID)
+	if err != nil {
+		return nil, err
 	}
-	lineParts := strings.Split(lines[0], "\t")
-	if len(lineParts) != 4 {
-		return nil, fmt.Errorf("Unexpected size of query results: %v", lineParts)
+	if len(comments) != 1 {
+		return nil, fmt.Errorf("Unexpected number of query results: %v", comments)
 	}
-	var comment differentialDatabaseTransactionComment
-	comment.PHID = lineParts[0]
-	if lineParts[1] != "NULL" {
-		changesetID, err := strconv.ParseUint(lineParts[1], 10, 32)
+	comment := comments[0]
+	comment.LineNumber = uint32(lineNumber.Int64)
+	if changesetID.Valid {
+		err := config.runSqlQuery(func(row rowScanner) error {
+			return row.Scan(&comment.FileName)
+		}, selectChangesetFilenameQuery, changesetID.Int64)
 		if err != nil {
 			return nil, err
 		}
-		changesetResult := runSqlCommandOrDie(fmt.Sprintf(selectChangesetFilenameTemplate, changesetID))
-		// changesetResult should have a single query result, which only includes the filename.
-		comment.FileName = changesetResult
-		diffIDResult := runSqlCommandOrDie(fmt.Sprintf(selectChangesetDiffTemplate, changesetID))
-		diffID, err := strconv.Atoi(diffIDResult)
+		var diffID int
+		err = config.runSqlQuery(func(row rowScanner) error {
+			return row.Scan(&diffID)
+		}, selectChangesetDiffQuery, changesetID.Int64)
 		if err != nil {
-			log.Println(diffIDResult)
-			log.Fatal(err)
+			return nil, err
 		}
-		diff, err := readDiff(diffID)
+		diff, err := config.readDiff(diffID)
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
-		comment.Commit = diff.findLastCommit()
-	}
-	lineNumber, err := strconv.ParseUint(lineParts[2], 10, 32)
-	if err != nil {
-		return nil, err
-	}
-	comment.LineNumber = uint32(lineNumber)
-	if lineParts[3] != "NULL" {
-		comment.ReplyToCommentPHID = &lineParts[3]
+		comment.Commit = diff.findCommit(isNewFile)
 	}
-	// The next SQL command is structured to return a single result with a single column, so we
-	// don't need to parse it in any way.
-	comment.Content = runRawSqlCommandOrDie(fmt.Sprintf(selectCommentContentsQueryTemplate, comment.PHID))
 	return &comment, nil
 }
 
+// readTransactionComments reads the comments of all of the given transactions that have one,
+// running at most the given number of reads at a time.
+//
+// The results are indexed the same as the given transactions, so that the caller can still
+// process the comments in the order of their transactions.
+func readTransactionComments(transactions []differentialDatabaseTransaction, readTransactionComment ReadTransactionComment, concurrency int) ([]*differentialDatabaseTransactionComment, error) {
+	results := make([]*differentialDatabaseTransactionComment, len(transactions))
+	errs := make([]error, len(transactions))
+	parallel.Run(len(transactions), concurrency, func(i int) {
+		if transactions[i].CommentPHID != nil {
+			results[i], errs[i] = readTransactionComment(transactions[i].PHID)
+		}
+	})
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
 // LoadComments takes in a DifferentialReview and returns the associated comments.
+//
+// If the review was listed for a repo, then the comments that the mirror itself posted to the review are skipped.
 func (review DifferentialReview) LoadComments() []comment.Comment {
-	return LoadComments(review, readDatabaseTransactions, readDatabaseTransactionComment, lookupUser)
+	if review.repo != nil {
+		if reviewCommit := review.GetFirstCommit(review.repo); reviewCommit != "" {
+			review.mirrored = loadMirroredTransactions(review.repo, reviewCommit)
+		}
+	}
+	readTransactions, readTransactionComment := review.config.transactionReaders()
+	return LoadComments(review, readTransactions, readTransactionComment, review.config.lookupUser)
+}
+
+// LoadAllComments takes in a DifferentialReview and returns all of the associated comments,
+// including the ones that the mirror itself posted to the review.
+//
+// This is for comparing the comments with git-notes, which cannot be done without them, so
+// failing to read them is fatal.
+//
+// This is only run by an operator, rather than on every pass, so it reads every transaction,
+// regardless of Config.MaxTransactions.
+func (review DifferentialReview) LoadAllComments() []comment.Comment {
+	review.config.MaxTransactions = 0
+	comments, _, _, err := review.loadCommentsWithPHIDs()
+	if err != nil {
+		log.Fatal(err)
+	}
+	return comments
+}
+
+// loadCommentsWithPHIDs is like LoadAllComments, but also returns the PHID of the Phabricator
+// comment from which each comment was loaded, or the empty string if it has none (e.g. an accept),
+// and returns the error if the comments cannot be read.
+//
+// Unlike LoadAllComments, it only reads the latest Config.MaxTransactions transactions, and
+// returns the time since which the comments were loaded if older ones were left out, or zero.
+func (review DifferentialReview) loadCommentsWithPHIDs() ([]comment.Comment, []string, uint32, error) {
+	review = review.unfiltered()
+	readTransactions, readTransactionComment := review.config.transactionReaders()
+	return loadComments(review, readTransactions, readTransactionComment, review.config.lookupUser)
+}
+
+// unfiltered returns a copy of the given review from which every comment is loaded, including
+// those posted by the mirror, and those by authors that are not mirrored into git-notes.
+//
+// Those comments are only filtered out of what is written to git-notes. The comments against
+// which we check whether a git-appraise comment is already in Phabricator must include them, as
+// otherwise the matching git-appraise comments would be posted again on every pass.
+func (review DifferentialReview) unfiltered() DifferentialReview {
+	review.mirrored = nil
+	review.config.CommentAuthors = nil
+	review.config.IgnoredCommentAuthors = nil
+	return review
 }
 
+// LoadComments returns the comments of the given review, as read with the given functions.
+//
+// If the comments cannot be read (e.g. because the database cannot be reached), then the error is
+// logged and no comments are returned, which only delays mirroring them into git-notes.
 func LoadComments(review DifferentialReview, readTransactions ReadTransactions, readTransactionComment ReadTransactionComment, lookupUser UserLookup) []comment.Comment {
+	comments, _, _, err := loadComments(review, readTransactions, readTransactionComment, lookupUser)
+	if err != nil {
+		log.Printf("Failed to load the comments of D%s: %v", review.ID, err)
+		return nil
+	}
+	return comments
+}
+
+// loadComments does the work of LoadComments and loadCommentsWithPHIDs.
+//
+// The readers return at most one transaction more than Config.MaxTransactions, if that is set,
+// in which case the oldest one is left out, and the time of the oldest one that is kept is returned.
+func loadComments(review DifferentialReview, readTransactions ReadTransactions, readTransactionComment ReadTransactionComment, lookupUser UserLookup) ([]comment.Comment, []string, uint32, error) {
 
 	allTransactions, err := readTransactions(review.PHID)
 	if err != nil {
-		log.Fatal(err)
+		return nil, nil, 0, err
 	}
+	var since uint32
+	if max := review.config.MaxTransactions; max > 0 && len(allTransactions) > max {
+		log.Printf("Only loading the latest %d transactions of D%s", max, review.ID)
+		allTransactions = allTransactions[len(allTransactions)-max:]
+		since = allTransactions[0].DateCreated
+	}
+	var transactions []differentialDatabaseTransaction
+	for _, transaction := range allTransactions {
+		if review.mirrored[transaction.PHID] || (transaction.CommentPHID != nil && review.mirrored[*transaction.CommentPHID]) {
+			continue
+		}
+		if review.config.filtersAuthors() {
+			author, err := lookupUser(transaction.AuthorPHID)
+			if err != nil {
+				return nil, nil, 0, err
+			}
+			if !review.config.mirrorsAuthor(transaction.AuthorPHID, author) {
+				continue
+			}
+		}
+		if review.config.mirrorsTransactionType(transaction.Type) || transaction.Type == "differential:action" {
+			transactions = append(transactions, transaction)
+		}
+	}
+	// Reading the comments is by far the slowest part of this, so we do it (optionally) in parallel,
+	// for a chunk of transactions at a time. The comments are then processed in the order of their
+	// transactions, so that each parent is still seen before its replies.
+	var transactionComments []*differentialDatabaseTransactionComment
 	var comments []comment.Comment
-	commentsByPHID := make(map[string]comment.Comment)
+	// commentPHIDs holds the PHID of the transaction comment of each comment, if it has one.
+	var commentPHIDs []string
+	// commentsByPHID maps from the PHIDs of each transaction and transaction comment to the index of the corresponding comment.
+	commentsByPHID := make(map[string]int)
+	// replyToPHIDs maps from the index of each reply to the PHID of the comment it replies to.
+	replyToPHIDs := make(map[int]string)
 	rejectionCommentsByUser := make(map[string][]string)
 
 	log.Printf("LOADCOMMENTS: Returning %d transactions", len(allTransactions))
-	for _, transaction := range allTransactions {
+	chunkSize := review.config.commentLoadChunkSize()
+	for i, transaction := range transactions {
+		if i%chunkSize == 0 {
+			end := i + chunkSize
+			if end > len(transactions) {
+				end = len(transactions)
+			}
+			transactionComments, err = readTransactionComments(transactions[i:end], readTransactionComment, review.config.CommentLoadConcurrency)
+			if err != nil {
+				return nil, nil, 0, err
+			}
+		}
+		mirrored := review.config.mirrorsTransactionType(transaction.Type)
 		author, err := lookupUser(transaction.AuthorPHID)
 		if err != nil {
-			log.Fatal(err)
+			return nil, nil, 0, err
 		}
 		c := comment.Comment{
-			Author:    author.Email,
+			Author:    author.identity(),
 			Timestamp: fmt.Sprintf("%d", transaction.DateCreated),
 		}
-		if author.Email != "" {
-			c.Author = author.Email
-		} else {
-			c.Author = author.UserName
-		}
 
+		replyToPHID := ""
 		if transaction.CommentPHID != nil {
-			transactionComment, err := readTransactionComment(transaction.PHID)
-			if err != nil {
-				log.Fatal(err)
-			}
+			transactionComment := transactionComments[i%chunkSize]
 			if transactionComment.FileName != "" {
 				c.Location = &comment.Location{
 					Commit: transactionComment.Commit,
@@ -275,14 +410,19 @@ func LoadComments(review DifferentialReview, readTransactions ReadTransactions,
 					c.Location.Range = &comment.Range{
 						StartLine: transactionComment.LineNumber,
 					}
+					if transactionComment.LineLength > 0 {
+						c.Location.Range.EndLine = transactionComment.LineNumber + transactionComment.LineLength
+					}
 				}
 			}
 			c.Description = transactionComment.Content
 			if transactionComment.ReplyToCommentPHID != nil {
-				// We assume that the parent has to have been processed before the child,
-				// and enforce that by ordering the transactions in our queries.
-				if replyTo, ok := commentsByPHID[*transactionComment.ReplyToCommentPHID]; ok {
-					parentHash, err := replyTo.Hash()
+				replyToPHID = *transactionComment.ReplyToCommentPHID
+				// We expect the parent to have been processed before the child, and try to
+				// enforce that by ordering the transactions in our queries. Any replies that
+				// come before their parents anyway are resolved once all comments are loaded.
+				if replyTo, ok := commentsByPHID[replyToPHID]; ok {
+					parentHash, err := comments[replyTo].Hash()
 					if err != nil {
 						log.Fatal(err)
 					}
@@ -308,6 +448,7 @@ func LoadComments(review DifferentialReview, readTransactions ReadTransactions,
 						Parent:    rejectionCommentHash,
 					}
 					comments = append(comments, approveComment)
+					commentPHIDs = append(commentPHIDs, "")
 					log.Printf("LOADCOMMENTS: Received approval. Adding child comment %v with parent hash %x", approveComment, rejectionCommentHash)
 				}
 			} else if action == "\"reject\"" {
@@ -317,12 +458,26 @@ func LoadComments(review DifferentialReview, readTransactions ReadTransactions,
 
 		}
 
+		if !mirrored && c.Resolved == nil {
+			// This is an action that we were configured to skip, and it does not accept or reject the review.
+			continue
+		}
+
 		// Phabricator only publishes inline comments when you publish a top-level comment.
 		// This results in a lot of empty top-level comments, which we do not want to mirror.
 		// To work around this, we only return comments that are non-empty.
 		if c.Parent != "" || c.Location != nil || c.Description != "" || c.Resolved != nil {
 			comments = append(comments, c)
-			commentsByPHID[transaction.PHID] = c
+			commentsByPHID[transaction.PHID] = len(comments) - 1
+			commentPHID := ""
+			if transaction.CommentPHID != nil {
+				commentPHID = *transaction.CommentPHID
+				commentsByPHID[commentPHID] = len(comments) - 1
+			}
+			commentPHIDs = append(commentPHIDs, commentPHID)
+			if replyToPHID != "" {
+				replyToPHIDs[len(comments)-1] = replyToPHID
+			}
 
 			//If this was a rejection comment, add it to ordered comment hash
 			if c.Resolved != nil && *c.Resolved == false {
@@ -337,6 +492,36 @@ func LoadComments(review DifferentialReview, readTransactions ReadTransactions,
 		}
 	}
 
+	resolveReplies(comments, commentsByPHID, replyToPHIDs)
 	log.Printf("LOADCOMMENTS: Returning %d comments", len(comments))
-	return comments
+	return comments, commentPHIDs, since, nil
+}
+
+// resolveReplies sets the parent of each reply to the hash of the comment it replies to.
+//
+// Since a comment's hash depends on its parent, fixing the parent of one comment can change the
+// hash that its own replies need to point to. So, we repeat this until nothing changes, which takes
+// at most one iteration per comment, unless the replies form a cycle.
+func resolveReplies(comments []comment.Comment, commentsByPHID map[string]int, replyToPHIDs map[int]string) {
+	for iteration := 0; iteration <= len(comments); iteration++ {
+		changed := false
+		for i, replyToPHID := range replyToPHIDs {
+			parent, ok := commentsByPHID[replyToPHID]
+			if !ok {
+				continue
+			}
+			parentHash, err := comments[parent].Hash()
+			if err != nil {
+				log.Fatal(err)
+			}
+			if comments[i].Parent != parentHash {
+				comments[i].Parent = parentHash
+				changed = true
+			}
+		}
+		if !changed {
+			return
+		}
+	}
+	log.Printf("LOADCOMMENTS: Failed to resolve the parents of %d replies", len(replyToPHIDs))
 }
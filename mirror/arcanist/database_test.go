@@ -17,7 +17,13 @@ limitations under the License.
 package arcanist
 
 import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
 	"github.com/google/git-appraise/review/comment"
+	"io"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -95,6 +101,73 @@ func TestLoadComments(t *testing.T) {
 
 }
 
+func TestLoadCommentsOfSomeTypes(t *testing.T) {
+	acceptAction := "\"accept\""
+	commentPHID := "comment"
+	readTransactions := func(reviewID string) ([]differentialDatabaseTransaction, error) {
+		accept := BuildTransactionForUser("u1", acceptAction, 1)
+		topLevel := differentialDatabaseTransaction{PHID: "top", AuthorPHID: "u1", DateCreated: 2, Type: "core:comment", CommentPHID: &commentPHID}
+		inline := differentialDatabaseTransaction{PHID: "inline", AuthorPHID: "u1", DateCreated: 3, Type: "differential:inline", CommentPHID: &commentPHID}
+		return []differentialDatabaseTransaction{accept, topLevel, inline}, nil
+	}
+	readTransactionComment := func(transactionID string) (*differentialDatabaseTransactionComment, error) {
+		return &differentialDatabaseTransactionComment{PHID: transactionID, Content: "A comment on " + transactionID}, nil
+	}
+	review := DifferentialReview{ID: "testReview"}
+	if comments := LoadComments(review, readTransactions, readTransactionComment, MockLookupUser); len(comments) != 3 {
+		t.Errorf("Unexpected comments when mirroring every transaction type: %v", comments)
+	}
+
+	review.config.CommentTransactionTypes = []string{"differential:inline"}
+	comments := LoadComments(review, readTransactions, readTransactionComment, MockLookupUser)
+	if len(comments) != 2 {
+		t.Fatalf("Unexpected comments when only mirroring inline comments: %v", comments)
+	}
+	if comments[0].Resolved == nil || !*comments[0].Resolved {
+		t.Errorf("Unexpected acceptance comment: %v", comments[0])
+	}
+	if comments[1].Description != "A comment on inline" {
+		t.Errorf("Unexpected inline comment: %v", comments[1])
+	}
+}
+
+func TestLoadCommentsWithOutOfOrderReplies(t *testing.T) {
+	parentPHID := "XCMT-parent"
+	childPHID := "XCMT-child"
+	grandchildPHID := "XCMT-grandchild"
+	readTransactions := func(reviewID string) ([]differentialDatabaseTransaction, error) {
+		return []differentialDatabaseTransaction{
+			differentialDatabaseTransaction{PHID: "grandchild", AuthorPHID: "u1", DateCreated: 1, Type: "core:comment", CommentPHID: &grandchildPHID},
+			differentialDatabaseTransaction{PHID: "child", AuthorPHID: "u2", DateCreated: 2, Type: "core:comment", CommentPHID: &childPHID},
+			differentialDatabaseTransaction{PHID: "parent", AuthorPHID: "u1", DateCreated: 3, Type: "core:comment", CommentPHID: &parentPHID},
+		}, nil
+	}
+	readTransactionComment := func(transactionID string) (*differentialDatabaseTransactionComment, error) {
+		c := &differentialDatabaseTransactionComment{PHID: "XCMT-" + transactionID, Content: "A comment on " + transactionID}
+		if transactionID == "grandchild" {
+			c.ReplyToCommentPHID = &childPHID
+		} else if transactionID == "child" {
+			c.ReplyToCommentPHID = &parentPHID
+		}
+		return c, nil
+	}
+	review := DifferentialReview{ID: "testReview"}
+	comments := LoadComments(review, readTransactions, readTransactionComment, MockLookupUser)
+	if len(comments) != 3 {
+		t.Fatalf("Unexpected comments: %v", comments)
+	}
+	grandchild, child, parent := comments[0], comments[1], comments[2]
+	if parent.Parent != "" {
+		t.Errorf("Unexpected parent of a top-level comment: %v", parent)
+	}
+	if child.Parent != getHash(parent) {
+		t.Errorf("The reply was not linked to its parent: %v", child)
+	}
+	if grandchild.Parent != getHash(child) {
+		t.Errorf("The nested reply was not linked to its parent: %v", grandchild)
+	}
+}
+
 func validateExpectedComments(existingComments []comment.Comment, expectedComments []comment.Comment) bool {
 	for i, actual := range existingComments {
 		if actual.Timestamp != expectedComments[i].Timestamp ||
@@ -179,3 +252,335 @@ func getHash(c comment.Comment) string {
 	}
 	return cHash
 }
+
+func TestReadTransactionComments(t *testing.T) {
+	commentPHID := "comment"
+	var transactions []differentialDatabaseTransaction
+	for i := 0; i < 10; i++ {
+		transactions = append(transactions, differentialDatabaseTransaction{PHID: fmt.Sprintf("transaction%d", i), CommentPHID: &commentPHID})
+	}
+	transactions = append(transactions, differentialDatabaseTransaction{PHID: "withoutComment"})
+
+	readTransactionComment := func(transactionID string) (*differentialDatabaseTransactionComment, error) {
+		return &differentialDatabaseTransactionComment{PHID: transactionID}, nil
+	}
+	comments, err := readTransactionComments(transactions, readTransactionComment, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, transaction := range transactions {
+		if transaction.CommentPHID == nil {
+			if comments[i] != nil {
+				t.Errorf("Unexpected comment for a transaction without one: %v", comments[i])
+			}
+		} else if comments[i] == nil || comments[i].PHID != transaction.PHID {
+			t.Errorf("Unexpected comment for %q: %v", transaction.PHID, comments[i])
+		}
+	}
+
+	failingRead := func(transactionID string) (*differentialDatabaseTransactionComment, error) {
+		return nil, fmt.Errorf("Failed to read %q", transactionID)
+	}
+	if _, err := readTransactionComments(transactions, failingRead, 3); err == nil {
+		t.Errorf("Failed to report an error reading the comments")
+	}
+}
+
+func TestLoadCommentsFromSomeAuthors(t *testing.T) {
+	commentPHID := "comment"
+	readTransactions := func(reviewID string) ([]differentialDatabaseTransaction, error) {
+		human := differentialDatabaseTransaction{PHID: "human", AuthorPHID: "PHID-USER-human", DateCreated: 1, Type: "core:comment", CommentPHID: &commentPHID}
+		bot := differentialDatabaseTransaction{PHID: "bot", AuthorPHID: "PHID-USER-herald", DateCreated: 2, Type: "core:comment", CommentPHID: &commentPHID}
+		return []differentialDatabaseTransaction{human, bot}, nil
+	}
+	readTransactionComment := func(transactionID string) (*differentialDatabaseTransactionComment, error) {
+		return &differentialDatabaseTransactionComment{PHID: transactionID, Content: "A comment on " + transactionID}, nil
+	}
+	lookupUser := func(userPHID string) (*user, error) {
+		if userPHID == "PHID-USER-herald" {
+			return &user{PHID: userPHID, UserName: "herald"}, nil
+		}
+		return &user{PHID: userPHID, UserName: "human", Email: "human@example.com"}, nil
+	}
+	review := DifferentialReview{ID: "testReview"}
+	if comments := LoadComments(review, readTransactions, readTransactionComment, lookupUser); len(comments) != 2 {
+		t.Errorf("Unexpected comments when mirroring every author: %v", comments)
+	}
+
+	review.config.IgnoredCommentAuthors = []string{"herald"}
+	comments := LoadComments(review, readTransactions, readTransactionComment, lookupUser)
+	if len(comments) != 1 || comments[0].Author != "human@example.com" {
+		t.Errorf("Unexpected comments when ignoring a bot: %v", comments)
+	}
+
+	review.config.IgnoredCommentAuthors = nil
+	review.config.CommentAuthors = []string{"PHID-USER-herald"}
+	comments = LoadComments(review, readTransactions, readTransactionComment, lookupUser)
+	if len(comments) != 1 || comments[0].Author != "herald" {
+		t.Errorf("Unexpected comments when only mirroring one author: %v", comments)
+	}
+	// The comments checked for those already in Phabricator include every author's.
+	if comments := LoadComments(review.unfiltered(), readTransactions, readTransactionComment, lookupUser); len(comments) != 2 {
+		t.Errorf("Unexpected unfiltered comments when only mirroring one author: %v", comments)
+	}
+}
+
+func TestLoadCommentsInChunks(t *testing.T) {
+	var transactions []differentialDatabaseTransaction
+	for i := 0; i < 5; i++ {
+		commentPHID := fmt.Sprintf("comment-%d", i)
+		transactions = append(transactions, differentialDatabaseTransaction{
+			PHID:        fmt.Sprintf("transaction-%d", i),
+			AuthorPHID:  "PHID-USER-1",
+			DateCreated: uint32(i),
+			Type:        "core:comment",
+			CommentPHID: &commentPHID,
+		})
+	}
+	readTransactions := func(reviewID string) ([]differentialDatabaseTransaction, error) {
+		return transactions, nil
+	}
+	readTransactionComment := func(transactionID string) (*differentialDatabaseTransactionComment, error) {
+		return &differentialDatabaseTransactionComment{PHID: transactionID, Content: transactionID}, nil
+	}
+	review := DifferentialReview{ID: "testReview", config: Config{CommentLoadChunkSize: 2}}
+	comments, _, since, err := loadComments(review, readTransactions, readTransactionComment, MockLookupUser)
+	if err != nil || len(comments) != 5 || comments[0].Description != "transaction-0" || comments[4].Description != "transaction-4" {
+		t.Errorf("Unexpected comments loaded in chunks: %v, %v", comments, err)
+	}
+	if since != 0 {
+		t.Errorf("Unexpected time since which the comments were loaded: %d", since)
+	}
+
+	// The readers return one more transaction than the limit, if the revision has that many.
+	review.config.MaxTransactions = 4
+	comments, _, since, err = loadComments(review, readTransactions, readTransactionComment, MockLookupUser)
+	if err != nil || len(comments) != 4 || comments[0].Description != "transaction-1" || since != 1 {
+		t.Errorf("Unexpected comments when loading at most 4 transactions: %v, %d, %v", comments, since, err)
+	}
+	review.config.MaxTransactions = 5
+	if comments, _, since, err = loadComments(review, readTransactions, readTransactionComment, MockLookupUser); err != nil || len(comments) != 5 || since != 0 {
+		t.Errorf("Unexpected comments when loading at most 5 transactions: %v, %d, %v", comments, since, err)
+	}
+}
+
+// fakeQueryResult answers the given SQL query, with the given bound arguments, with rows of values.
+type fakeQueryResult func(query string, args []driver.Value) [][]driver.Value
+
+// fakeDriver is a database/sql driver whose queries are answered by the fakeQueryResult
+// named by the data source name.
+type fakeDriver struct{}
+
+var (
+	fakeResultsMutex sync.Mutex
+	fakeResults      = make(map[string]fakeQueryResult)
+)
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	fakeResultsMutex.Lock()
+	defer fakeResultsMutex.Unlock()
+	return fakeConn{fakeResults[name]}, nil
+}
+
+type fakeConn struct {
+	result fakeQueryResult
+}
+
+func (conn fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return fakeStmt{query, conn.result}, nil
+}
+
+func (fakeConn) Close() error {
+	return nil
+}
+
+func (fakeConn) Begin() (driver.Tx, error) {
+	return nil, fmt.Errorf("Transactions are not supported")
+}
+
+type fakeStmt struct {
+	query  string
+	result fakeQueryResult
+}
+
+func (fakeStmt) Close() error {
+	return nil
+}
+
+func (fakeStmt) NumInput() int {
+	return -1
+}
+
+func (fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, fmt.Errorf("Only queries are supported")
+}
+
+func (stmt fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return &fakeRows{values: stmt.result(stmt.query, args)}, nil
+}
+
+type fakeRows struct {
+	values [][]driver.Value
+}
+
+func (rows *fakeRows) Columns() []string {
+	if len(rows.values) == 0 {
+		return nil
+	}
+	columns := make([]string, len(rows.values[0]))
+	for i := range columns {
+		columns[i] = fmt.Sprintf("column%d", i)
+	}
+	return columns
+}
+
+func (rows *fakeRows) Close() error {
+	return nil
+}
+
+func (rows *fakeRows) Next(dest []driver.Value) error {
+	if len(rows.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, rows.values[0])
+	rows.values = rows.values[1:]
+	return nil
+}
+
+func init() {
+	sql.Register("fake-phabricator", fakeDriver{})
+}
+
+// useFakeDatabase points the database connection at one whose queries are answered by the
+// given function, until the returned function is called.
+func useFakeDatabase(t *testing.T, result fakeQueryResult) func() {
+	fakeResultsMutex.Lock()
+	fakeResults[t.Name()] = result
+	fakeResultsMutex.Unlock()
+	db, err := sql.Open("fake-phabricator", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := database
+	database = db
+	return func() {
+		db.Close()
+		database = previous
+	}
+}
+
+func TestReadDatabaseTransactions(t *testing.T) {
+	defer useFakeDatabase(t, func(query string, args []driver.Value) [][]driver.Value {
+		if len(args) != 3 || args[0] != "PHID-DREV-1" {
+			t.Errorf("Unexpected arguments for the transactions query: %v", args)
+		}
+		// The transactions are read newest first.
+		return [][]driver.Value{
+			{int64(12), "PHID-XACT-2", "PHID-USER-2", int64(200), "differential:action", []byte("\"accept\""), nil},
+			{int64(7), "PHID-XACT-1", "PHID-USER-1", int64(100), "core:comment", nil, "PHID-XCMT-1"},
+		}
+	})()
+	transactions, err := Config{}.readDatabaseTransactions("PHID-DREV-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(transactions) != 2 || transactions[0].DateCreated != 100 || transactions[1].Type != "differential:action" {
+		t.Fatalf("Unexpected transactions: %v", transactions)
+	}
+	if transactions[0].NewValue != nil || transactions[0].CommentPHID == nil || *transactions[0].CommentPHID != "PHID-XCMT-1" {
+		t.Errorf("Unexpected values for the comment transaction: %v", transactions[0])
+	}
+	if transactions[1].NewValue == nil || *transactions[1].NewValue != "\"accept\"" || transactions[1].CommentPHID != nil {
+		t.Errorf("Unexpected values for the accept transaction: %v", transactions[1])
+	}
+}
+
+func TestReadLatestDatabaseTransactions(t *testing.T) {
+	// The review has transactions with the IDs 1 through 10.
+	var queries [][]driver.Value
+	defer useFakeDatabase(t, func(query string, args []driver.Value) [][]driver.Value {
+		queries = append(queries, args)
+		var rows [][]driver.Value
+		id := args[1].(int64) - 1
+		if id > 10 {
+			id = 10
+		}
+		for ; id > 0 && len(rows) < int(args[2].(int64)); id-- {
+			rows = append(rows, []driver.Value{id, fmt.Sprintf("PHID-XACT-%d", id), "PHID-USER-1", id, "core:comment", nil, nil})
+		}
+		return rows
+	})()
+	transactions, err := Config{TransactionPageSize: 4}.readDatabaseTransactions("PHID-DREV-1")
+	if err != nil || len(transactions) != 10 || transactions[0].PHID != "PHID-XACT-1" || transactions[9].PHID != "PHID-XACT-10" {
+		t.Errorf("Unexpected transactions: %v, %v", transactions, err)
+	}
+	if len(queries) != 3 || queries[1][1] != int64(7) || queries[2][1] != int64(3) {
+		t.Errorf("Unexpected pages of transactions: %v", queries)
+	}
+
+	// Only one more than the latest 5 are read, from which loadComments can tell that older ones were left out.
+	queries = nil
+	transactions, err = Config{TransactionPageSize: 4, MaxTransactions: 5}.readDatabaseTransactions("PHID-DREV-1")
+	if err != nil || len(transactions) != 6 || transactions[0].PHID != "PHID-XACT-5" || transactions[5].PHID != "PHID-XACT-10" {
+		t.Errorf("Unexpected latest transactions: %v, %v", transactions, err)
+	}
+	if len(queries) != 2 || queries[1][2] != int64(2) {
+		t.Errorf("Unexpected pages of the latest transactions: %v", queries)
+	}
+}
+
+func TestReadDatabaseTransactionComment(t *testing.T) {
+	content := "A comment\twith a tab,\nand a newline"
+	defer useFakeDatabase(t, func(query string, args []driver.Value) [][]driver.Value {
+		return [][]driver.Value{{"PHID-XCMT-1", nil, nil, 0, true, "PHID-XCMT-0", content}}
+	})()
+	transactionComment, err := Config{}.readDatabaseTransactionComment("PHID-XACT-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if transactionComment.PHID != "PHID-XCMT-1" || transactionComment.Content != content || transactionComment.LineNumber != 0 {
+		t.Errorf("Unexpected transaction comment: %v", transactionComment)
+	}
+	if transactionComment.ReplyToCommentPHID == nil || *transactionComment.ReplyToCommentPHID != "PHID-XCMT-0" {
+		t.Errorf("Unexpected parent of the transaction comment: %v", transactionComment.ReplyToCommentPHID)
+	}
+}
+
+func TestSqlQueriesEscapePHIDs(t *testing.T) {
+	phid := `PHID-DREV-1" or "1" = "1`
+	queries := 0
+	defer useFakeDatabase(t, func(query string, args []driver.Value) [][]driver.Value {
+		queries++
+		if strings.Contains(query, phid) || strings.Contains(query, "PHID-") {
+			t.Errorf("A PHID was interpolated into the query %q", query)
+		}
+		if len(args) == 0 || args[0] != phid {
+			t.Errorf("The PHID was not bound to the query: %v", args)
+		}
+		return nil
+	})()
+	if transactions, err := (Config{}).readDatabaseTransactions(phid); err != nil || len(transactions) != 0 {
+		t.Errorf("Unexpected transactions: %v, %v", transactions, err)
+	}
+	if _, err := (Config{}).readDatabaseTransactionComment(phid); err == nil {
+		t.Error("Failed to report a missing transaction comment")
+	}
+	if queries != 2 {
+		t.Errorf("Unexpected number of queries: %d", queries)
+	}
+}
+
+func TestDatabaseErrorsAreReturned(t *testing.T) {
+	previous := database
+	database = nil
+	defer func() {
+		database = previous
+	}()
+	if _, err := (Config{}).readDatabaseTransactions("PHID-DREV-1"); err == nil {
+		t.Error("Failed to report the missing database connection")
+	}
+	review := DifferentialReview{PHID: "PHID-DREV-1", config: Config{TransactionSource: TransactionSourceDatabase}}
+	if _, _, _, err := review.loadCommentsWithPHIDs(); err == nil {
+		t.Error("Failed to report the comments that could not be loaded")
+	}
+}
@@ -23,8 +23,11 @@ import (
 	"github.com/google/git-appraise/repository"
 	"github.com/google/git-appraise/review/request"
 	"log"
+	"path"
 	"sort"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type differentialCreateRawDiffRequest struct {
@@ -49,6 +52,8 @@ type queryDiffItem struct {
 	ID         string        `json:"id"`
 	Changes    []interface{} `json:"changes"`
 	Properties interface{}   `json:"properties"`
+	// SourceControlBaseRevision is the commit that the diff is against.
+	SourceControlBaseRevision string `json:"sourceControlBaseRevision"`
 }
 
 type differentialQueryDiffsResponse struct {
@@ -57,17 +62,62 @@ type differentialQueryDiffsResponse struct {
 	Response     map[string]queryDiffItem `json:"response"`
 }
 
-func readDiff(diffID int) (*queryDiffItem, error) {
-	queryRequest := differentialQueryDiffsRequest{IDs: []int{diffID}}
+// readDiff reads the diff with the given ID, or returns nil if Phabricator does not return it.
+func (config Config) readDiff(diffID int) (*queryDiffItem, error) {
+	diffs, err := config.readDiffs([]int{diffID})
+	if err != nil {
+		return nil, err
+	}
+	if diff, ok := diffs[diffID]; ok {
+		return &diff, nil
+	}
+	return nil, nil
+}
+
+// readDiffs reads all of the given diffs with a single request, and returns them keyed by ID.
+//
+// Diffs that Phabricator does not return are left out.
+func (config Config) readDiffs(diffIDs []int) (map[int]queryDiffItem, error) {
+	diffs := make(map[int]queryDiffItem)
+	if len(diffIDs) == 0 {
+		return diffs, nil
+	}
+	queryRequest := differentialQueryDiffsRequest{IDs: diffIDs}
 	var queryResponse differentialQueryDiffsResponse
-	runArcCommandOrDie("differential.querydiffs", queryRequest, &queryResponse)
+	config.runArcCommandOrDie("differential.querydiffs", queryRequest, &queryResponse)
 	if queryResponse.Error != "" {
 		return nil, fmt.Errorf(queryResponse.ErrorMessage)
 	}
-	if diff, ok := queryResponse.Response[strconv.Itoa(diffID)]; ok {
-		return &diff, nil
+	for _, diffID := range diffIDs {
+		if diff, ok := queryResponse.Response[strconv.Itoa(diffID)]; ok {
+			diffs[diffID] = diff
+		}
 	}
-	return nil, nil
+	return diffs, nil
+}
+
+// mapCommitsToDiffs returns maps from the last commit of each of the given diffs to its ID, as
+// both a string and an int. The diffs are read from the given results of readDiffs.
+//
+// If several diffs are for the same commit, then the last of them is used.
+func mapCommitsToDiffs(diffIDs []int, diffs map[int]queryDiffItem) (map[string]string, map[string]int) {
+	commitToDiffMap := make(map[string]string)
+	commitToDiffIDMap := make(map[string]int)
+	for _, diffID := range diffIDs {
+		diff, ok := diffs[diffID]
+		if !ok {
+			log.Printf("Skipping the diff %d, as it could not be read", diffID)
+			continue
+		}
+		lastCommit := diff.findLastCommit()
+		if lastCommit == "" {
+			log.Printf("Skipping the diff %d, as we could not find its commit", diffID)
+			continue
+		}
+		commitToDiffMap[lastCommit] = strconv.Itoa(diffID)
+		commitToDiffIDMap[lastCommit] = diffID
+	}
+	return commitToDiffMap, commitToDiffIDMap
 }
 
 // Differential does not actually store the commit hash for the right hand side of a diff.
@@ -110,6 +160,145 @@ func (diff *queryDiffItem) findLastCommit() string {
 	return ""
 }
 
+// findCommit returns the commit whose contents are shown on the given side of the diff: the
+// base commit of the diff for its left-hand side, and the last commit in it for its right-hand side.
+func (diff *queryDiffItem) findCommit(isNewFile bool) string {
+	if !isNewFile && diff.SourceControlBaseRevision != "" {
+		return diff.SourceControlBaseRevision
+	}
+	return diff.findLastCommit()
+}
+
+// DiffNote is the format of the notes that record the Differential diff uploaded for a commit.
+type DiffNote struct {
+	RevisionID string `json:"revisionID"`
+	DiffID     int    `json:"diffID"`
+}
+
+// recordDiff records, in the configured notes ref, that the given diff of the given revision was uploaded for the given commit.
+//
+// Nothing is written if that has already been recorded.
+func (arc Arcanist) recordDiff(repo repository.Repo, commit, revisionID string, diffID int) {
+	if arc.Config.DiffNotesRef == "" {
+		return
+	}
+	for _, existing := range repo.GetNotes(arc.Config.DiffNotesRef, commit) {
+		var note DiffNote
+		if err := json.Unmarshal([]byte(existing), &note); err == nil && note.DiffID == diffID {
+			return
+		}
+	}
+	note, err := json.Marshal(DiffNote{RevisionID: revisionID, DiffID: diffID})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := repo.AppendNote(arc.Config.DiffNotesRef, commit, repository.Note(note)); err != nil {
+		log.Printf("Failed to record the diff %d for %s: %v", diffID, commit, err)
+	}
+}
+
+// changedFiles returns the paths of the files changed between the given commits.
+func changedFiles(repo repository.Repo, from, to string) ([]string, error) {
+	names, err := repo.Diff(from, to, "-M", "--no-ext-diff", "--name-only")
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, name := range strings.Split(names, "\n") {
+		if name = strings.TrimSpace(name); name != "" {
+			paths = append(paths, name)
+		}
+	}
+	return paths, nil
+}
+
+// countChangedFiles returns the number of files changed between the given commits.
+func countChangedFiles(repo repository.Repo, from, to string) (int, error) {
+	paths, err := changedFiles(repo, from, to)
+	return len(paths), err
+}
+
+// wholeFileContextLines is enough lines of context to include the whole of any reasonable file.
+const wholeFileContextLines = 0x7fff
+
+// fallbackContextLines is the number of lines of context used for diffs that would otherwise be too large.
+const fallbackContextLines = 3
+
+// matchesPathPattern reports whether or not the given path matches the given pattern.
+//
+// Patterns use the syntax of path.Match against the whole path, except that a pattern ending
+// in "/" matches everything under that directory.
+func matchesPathPattern(pattern, filePath string) bool {
+	if strings.HasSuffix(pattern, "/") {
+		return strings.HasPrefix(filePath, pattern)
+	}
+	matched, err := path.Match(pattern, filePath)
+	return err == nil && matched
+}
+
+// diffHeaderPrefix starts the header of each file's section in a git diff.
+const diffHeaderPrefix = "diff --git a/"
+
+// excludePaths removes the sections for files that match any of the given patterns from the given diff.
+//
+// A renamed file is removed if either its old or its new path matches.
+func excludePaths(rawDiff string, patterns []string) string {
+	if len(patterns) == 0 {
+		return rawDiff
+	}
+	var kept []string
+	excluded := false
+	for _, line := range strings.SplitAfter(rawDiff, "\n") {
+		if strings.HasPrefix(line, diffHeaderPrefix) {
+			paths := strings.TrimSpace(strings.TrimPrefix(line, diffHeaderPrefix))
+			oldPath, newPath := paths, paths
+			if i := strings.LastIndex(paths, " b/"); i >= 0 {
+				oldPath, newPath = paths[:i], paths[i+len(" b/"):]
+			}
+			excluded = false
+			for _, pattern := range patterns {
+				if matchesPathPattern(pattern, oldPath) || matchesPathPattern(pattern, newPath) {
+					excluded = true
+				}
+			}
+		}
+		if !excluded {
+			kept = append(kept, line)
+		}
+	}
+	return strings.Join(kept, "")
+}
+
+// diffWithContext generates the raw diff between the given commits with the given lines of context,
+// leaving out the files that are excluded by the config.
+func (arc Arcanist) diffWithContext(repo repository.Repo, from, to string, contextLines int) (string, error) {
+	diff, err := repo.Diff(from, to, "-M", "--no-ext-diff", "--no-textconv",
+		"--src-prefix=a/", "--dst-prefix=b/",
+		fmt.Sprintf("-U%d", contextLines), "--no-color")
+	if err != nil {
+		return "", err
+	}
+	return excludePaths(diff, arc.Config.ExcludedPaths), nil
+}
+
+// getRawDiff generates the raw diff between the given commits, in the format Phabricator expects.
+//
+// Unless configured otherwise, the diff includes the whole of each changed file, since Differential
+// cannot show context that is not in the diff. If that makes the diff larger than the configured
+// maximum, then it is regenerated with only a few lines of context instead.
+func (arc Arcanist) getRawDiff(repo repository.Repo, from, to string) (string, error) {
+	if arc.Config.DiffContextLines > 0 {
+		return arc.diffWithContext(repo, from, to, arc.Config.DiffContextLines)
+	}
+	diff, err := arc.diffWithContext(repo, from, to, wholeFileContextLines)
+	if err != nil || arc.Config.MaxWholeFileDiffSize <= 0 || len(diff) <= arc.Config.MaxWholeFileDiffSize {
+		return diff, err
+	}
+	log.Printf("The diff for %s..%s is %d bytes with whole-file context, so only including %d lines of context",
+		from, to, len(diff), fallbackContextLines)
+	return arc.diffWithContext(repo, from, to, fallbackContextLines)
+}
+
 // getDiffChanges takes two revisions from which to generate a "git diff", and returns a
 // slice of "changes" objects that represent that diff as parsed by Phabricator.
 func (arc Arcanist) getDiffChanges(repo repository.Repo, from, to string) ([]interface{}, error) {
@@ -117,21 +306,19 @@ func (arc Arcanist) getDiffChanges(repo repository.Repo, from, to string) ([]int
 	// We need to pass a list of "changes" JSON objects that contain the parsed diff contents.
 	// The simplest way to do that parsing seems to be to create a rawDiff and have Phabricator
 	// parse it on the server side. We then read back that diff, and return the changes from it.
-	rawDiff, err := repo.Diff(from, to, "-M", "--no-ext-diff", "--no-textconv",
-		"--src-prefix=a/", "--dst-prefix=b/",
-		fmt.Sprintf("-U%d", 0x7fff), "--no-color")
+	rawDiff, err := arc.getRawDiff(repo, from, to)
 	if err != nil {
 		return nil, err
 	}
 	createRequest := differentialCreateRawDiffRequest{Diff: rawDiff}
 	var createResponse differentialCreateRawDiffResponse
-	runArcCommandOrDie("differential.createrawdiff", createRequest, &createResponse)
+	arc.Config.runArcCommandOrDie("differential.createrawdiff", createRequest, &createResponse)
 	if createResponse.Error != "" {
 		return nil, fmt.Errorf(createResponse.ErrorMessage)
 	}
 	diffID := createResponse.Response.ID
 
-	diff, err := readDiff(diffID)
+	diff, err := arc.Config.readDiff(diffID)
 	if err != nil {
 		return nil, err
 	}
@@ -148,14 +335,16 @@ type differentialCreateDiffRequest struct {
 	SourceControlSystem       string        `json:"sourceControlSystem,omitempty"`
 	SourceMachine             string        `json:"sourceMachine,omitempty"`
 	SourcePath                string        `json:"sourcePath,omitempty"`
+	RepositoryPHID            string        `json:"repositoryPHID,omitempty"`
 	LintStatus                string        `json:"lintStatus,omitempty"`
 	UnitStatus                string        `json:"unitStatus,omitempty"`
 	Changes                   []interface{} `json:"changes,omitempty"`
 }
 
 type differentialDiff struct {
-	ID  int    `json:"diffid,omitempty"`
-	URI string `json:"uri,omitempty"`
+	ID   int    `json:"diffid,omitempty"`
+	PHID string `json:"phid,omitempty"`
+	URI  string `json:"uri,omitempty"`
 }
 
 type differentialCreateDiffResponse struct {
@@ -182,7 +371,7 @@ func (arc Arcanist) setDiffProperty(diffID int, name, value string) error {
 		Data: value,
 	}
 	var setPropertyResponse differentialSetDiffPropertyResponse
-	runArcCommandOrDie("differential.setdiffproperty", setPropertyRequest, &setPropertyResponse)
+	arc.Config.runArcCommandOrDie("differential.setdiffproperty", setPropertyRequest, &setPropertyResponse)
 	if setPropertyResponse.Error != "" {
 		return errors.New(setPropertyResponse.ErrorMessage)
 	}
@@ -200,10 +389,73 @@ type CommitDetails struct {
 	Summary     string   `json:"summary,omitempty"`
 }
 
+type diffusionQueryCommitsRequest struct {
+	Names []string `json:"names"`
+}
+
+type diffusionQueryCommitsResponse struct {
+	Error        string `json:"error,omitempty"`
+	ErrorMessage string `json:"errorMessage,omitempty"`
+	Response     struct {
+		// IdentifierMap maps from each of the requested names that was found to the commit's PHID.
+		IdentifierMap map[string]string `json:"identifierMap,omitempty"`
+	} `json:"response,omitempty"`
+}
+
+// isImported reports whether or not Phabricator has imported the given commit of the repo with the given callsign.
+//
+// This corresponds to calling the diffusion.querycommits API.
+func (config Config) isImported(callsign, commit string) (bool, error) {
+	name := "r" + callsign + commit
+	request := diffusionQueryCommitsRequest{Names: []string{name}}
+	var response diffusionQueryCommitsResponse
+	config.runArcCommandOrDie("diffusion.querycommits", request, &response)
+	if response.Error != "" {
+		return false, errors.New(response.ErrorMessage)
+	}
+	_, ok := response.Response.IdentifierMap[name]
+	return ok, nil
+}
+
+// importPollInterval is how often we check whether or not Phabricator has imported a commit.
+var importPollInterval = 5 * time.Second
+
+// waitForImport waits, for up to the configured timeout, for Phabricator to import the given commit.
+//
+// It returns whether or not the commit has been imported. If we cannot tell, e.g. because the repo's
+// callsign is unknown or no timeout is configured, then we assume that it has been. The wait ends
+// early, with the commit reported as not imported, once the config's context is done.
+func (arc Arcanist) waitForImport(repo repository.Repo, commit string) bool {
+	if arc.Config.BaseImportTimeout <= 0 {
+		return true
+	}
+	callsign := arc.RepoCallsign(repo)
+	if callsign == "" {
+		return true
+	}
+	deadline := time.Now().Add(time.Duration(arc.Config.BaseImportTimeout) * time.Second)
+	for {
+		imported, err := arc.Config.isImported(callsign, commit)
+		if err != nil {
+			log.Print(err)
+			return true
+		}
+		if imported || time.Now().Add(importPollInterval).After(deadline) {
+			return imported
+		}
+		select {
+		case <-time.After(importPollInterval):
+		case <-arc.Config.context().Done():
+			return false
+		}
+	}
+}
+
 // createDifferentialDiff generates a Phabricator resource that represents a diff between two revisions.
 //
 // The generated resource includes metadata about how the diff was generated, and a JSON representation
-// of the changes from the diff, as parsed by Phabricator.
+// of the changes from the diff, as parsed by Phabricator. If the repo's Diffusion PHID is known, then the
+// diff (and thus any revision created from it) is associated with that repository.
 func (arc Arcanist) createDifferentialDiff(repo repository.Repo, mergeBase, revision string, req request.Request, priorDiffs []string) (*differentialDiff, error) {
 	repoCommitDetails, err := repo.GetCommitDetails(revision)
 	if err != nil {
@@ -222,33 +474,44 @@ func (arc Arcanist) createDifferentialDiff(repo repository.Repo, mergeBase, revi
 		return nil, err
 	}
 	createRequest := differentialCreateDiffRequest{
-		Branch:                    abbreviateRefName(req.ReviewRef),
-		SourceControlSystem:       "git",
-		SourceControlBaseRevision: string(mergeBase),
-		SourcePath:                repo.GetPath(),
-		LintStatus:                "skip",
-		UnitStatus:                "skip",
-		Changes:                   changes,
+		Branch:              abbreviateRefName(req.ReviewRef),
+		SourceControlSystem: "git",
+		SourcePath:          repo.GetPath(),
+		RepositoryPHID:      arc.repositoryPHID(repo),
+		LintStatus:          "skip",
+		UnitStatus:          "skip",
+		Changes:             changes,
+	}
+	// Our diffs include only as much context around each change as getRawDiff uses, which may not
+	// be the whole file, so Phabricator reads the rest of each file from the base revision.
+	// However, if we specify a base revision that Phabricator has not imported, then it fails to
+	// render the surrounding context.
+	if arc.waitForImport(repo, mergeBase) {
+		createRequest.SourceControlBaseRevision = mergeBase
+	} else {
+		log.Printf("Uploading the diff for %s without a base revision, as Phabricator has not imported %s", revision, mergeBase)
 	}
 	var createResponse differentialCreateDiffResponse
-	runArcCommandOrDie("differential.creatediff", createRequest, &createResponse)
+	arc.Config.runArcCommandOrDie("differential.creatediff", createRequest, &createResponse)
 	if createResponse.Error != "" {
 		return nil, fmt.Errorf(createResponse.ErrorMessage)
 	}
 
-	localCommits := make(map[string]interface{})
+	var priorDiffIDs []int
 	for _, priorDiff := range priorDiffs {
 		diffID, err := strconv.Atoi(priorDiff)
 		if err != nil {
 			return nil, err
 		}
-		queryRequest := differentialQueryDiffsRequest{[]int{diffID}}
-		var queryResponse differentialQueryDiffsResponse
-		runArcCommandOrDie("differential.querydiffs", queryRequest, &queryResponse)
-		if queryResponse.Error != "" {
-			return nil, fmt.Errorf(queryResponse.ErrorMessage)
-		}
-		priorProperty := queryResponse.Response[priorDiff].Properties
+		priorDiffIDs = append(priorDiffIDs, diffID)
+	}
+	priorDiffItems, err := arc.Config.readDiffs(priorDiffIDs)
+	if err != nil {
+		return nil, err
+	}
+	localCommits := make(map[string]interface{})
+	for _, diffID := range priorDiffIDs {
+		priorProperty := priorDiffItems[diffID].Properties
 		if priorPropertyMap, ok := priorProperty.(map[string]interface{}); ok {
 			if localCommitsProperty, ok := priorPropertyMap["local:commits"]; ok {
 				if priorLocalCommits, ok := localCommitsProperty.(map[string]interface{}); ok {
@@ -17,7 +17,13 @@ limitations under the License.
 package arcanist
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/git-appraise/repository"
+	"strings"
 	"testing"
+	"time"
 )
 
 func verifyMalformedDiff(t *testing.T, malformedDiff *queryDiffItem) {
@@ -70,3 +76,164 @@ func TestFindLastCommit(t *testing.T) {
 		Properties: "props",
 	})
 }
+
+func TestMapCommitsToDiffs(t *testing.T) {
+	diffForCommit := func(commit string) queryDiffItem {
+		return queryDiffItem{
+			Properties: map[string]interface{}{
+				"local:commits": map[string]interface{}{
+					commit: map[string]interface{}{
+						"time": "012345",
+					},
+				},
+			},
+		}
+	}
+	diffs := map[int]queryDiffItem{
+		1: diffForCommit("ABCD"),
+		2: diffForCommit("EFGH"),
+		3: diffForCommit("ABCD"),
+		4: queryDiffItem{Properties: "props"},
+	}
+	commitToDiffMap, commitToDiffIDMap := mapCommitsToDiffs([]int{1, 2, 3, 4, 5}, diffs)
+	if len(commitToDiffMap) != 2 || commitToDiffMap["ABCD"] != "3" || commitToDiffMap["EFGH"] != "2" {
+		t.Errorf("Unexpected map from commits to diffs: %v", commitToDiffMap)
+	}
+	if len(commitToDiffIDMap) != 2 || commitToDiffIDMap["ABCD"] != 3 || commitToDiffIDMap["EFGH"] != 2 {
+		t.Errorf("Unexpected map from commits to diff IDs: %v", commitToDiffIDMap)
+	}
+}
+
+// changedFilesRepo is a repository.Repo in which every diff changes the given files.
+type changedFilesRepo struct {
+	repository.Repo
+	files []string
+}
+
+func (repo changedFilesRepo) Diff(left, right string, diffArgs ...string) (string, error) {
+	return strings.Join(repo.files, "\n") + "\n", nil
+}
+
+func TestSkipOversizedDiff(t *testing.T) {
+	repo := changedFilesRepo{repository.NewMockRepoForTest(), []string{"a.go", "b.go", "c.go"}}
+	if count, err := countChangedFiles(repo, "A", "B"); err != nil || count != 3 {
+		t.Errorf("Unexpected count of changed files: %d, %v", count, err)
+	}
+	if (Arcanist{}).skipOversizedDiff(repo, nil, "A", "B") {
+		t.Errorf("Skipped a diff without a limit on the changed files")
+	}
+	if (Arcanist{Config: Config{MaxChangedFiles: 3}}).skipOversizedDiff(repo, nil, "A", "B") {
+		t.Errorf("Skipped a diff within the limit on the changed files")
+	}
+	if !(Arcanist{Config: Config{MaxChangedFiles: 2}}).skipOversizedDiff(repo, nil, "A", "B") {
+		t.Errorf("Failed to skip a diff that changes too many files")
+	}
+	request := buildOversizedDiffComment(DifferentialReview{ID: "1"}, "B", 3, 2)
+	if request.RevisionID != "1" || request.Message != "The diff for B was not uploaded, as it changes 3 files, which is more than the limit of 2." {
+		t.Errorf("Unexpected comment for a skipped diff: %v", request)
+	}
+}
+
+func TestRecordDiff(t *testing.T) {
+	repo := repository.NewMockRepoForTest()
+	(Arcanist{}).recordDiff(repo, "B", "1", 2)
+	arc := Arcanist{Config: Config{DiffNotesRef: "refs/notes/devtools/phabricator/diffs"}}
+	arc.recordDiff(repo, "B", "1", 2)
+	arc.recordDiff(repo, "B", "1", 2)
+	arc.recordDiff(repo, "B", "1", 3)
+	notes := repo.GetNotes(arc.Config.DiffNotesRef, "B")
+	if len(notes) != 2 || string(notes[0]) != `{"revisionID":"1","diffID":2}` || string(notes[1]) != `{"revisionID":"1","diffID":3}` {
+		t.Errorf("Unexpected diff notes: %q", notes)
+	}
+}
+
+// contextRepo is a repository.Repo whose diffs are as many bytes as their lines of context.
+type contextRepo struct {
+	repository.Repo
+}
+
+func (repo contextRepo) Diff(left, right string, diffArgs ...string) (string, error) {
+	for _, arg := range diffArgs {
+		var lines int
+		if _, err := fmt.Sscanf(arg, "-U%d", &lines); err == nil {
+			return strings.Repeat("x", lines), nil
+		}
+	}
+	return "", errors.New("No context size")
+}
+
+func TestGetRawDiffContext(t *testing.T) {
+	repo := contextRepo{repository.NewMockRepoForTest()}
+	checkContext := func(config Config, expected int) {
+		diff, err := (Arcanist{Config: config}).getRawDiff(repo, "A", "B")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(diff) != expected {
+			t.Errorf("Unexpected lines of context with %+v: %d", config, len(diff))
+		}
+	}
+	checkContext(Config{}, wholeFileContextLines)
+	checkContext(Config{DiffContextLines: 10}, 10)
+	checkContext(Config{MaxWholeFileDiffSize: wholeFileContextLines}, wholeFileContextLines)
+	checkContext(Config{MaxWholeFileDiffSize: 100}, fallbackContextLines)
+}
+
+func TestExcludePaths(t *testing.T) {
+	rawDiff := `diff --git a/main.go b/main.go
+--- a/main.go
++++ b/main.go
+@@ -1 +1 @@
+-package old
++package main
+diff --git a/vendor/lib/lib.go b/vendor/lib/lib.go
+--- a/vendor/lib/lib.go
++++ b/vendor/lib/lib.go
+@@ -1 +1 @@
+-package old
++package lib
+diff --git a/api.pb.go b/api.pb.go
+--- a/api.pb.go
++++ b/api.pb.go
+@@ -1 +1 @@
+-package old
++package api
+`
+	if diff := excludePaths(rawDiff, nil); diff != rawDiff {
+		t.Errorf("The diff was modified without any excluded paths: %q", diff)
+	}
+	expected := `diff --git a/main.go b/main.go
+--- a/main.go
++++ b/main.go
+@@ -1 +1 @@
+-package old
++package main
+`
+	if diff := excludePaths(rawDiff, []string{"vendor/", "*.pb.go"}); diff != expected {
+		t.Errorf("Unexpected diff after excluding paths: %q", diff)
+	}
+}
+
+func TestWaitForImport(t *testing.T) {
+	originalCallConduit, originalPollInterval := callConduit, importPollInterval
+	defer func() { callConduit, importPollInterval = originalCallConduit, originalPollInterval }()
+	queries := 0
+	callConduit = func(config Config, method string, request interface{}, response interface{}) {
+		if method != "diffusion.querycommits" {
+			t.Fatalf("Unexpected Conduit call %s", method)
+		}
+		queries++
+	}
+	importPollInterval = time.Hour
+	arc := Arcanist{Callsign: "FE"}
+	if !arc.waitForImport(repository.NewMockRepoForTest(), "A") || queries != 0 {
+		t.Errorf("Did not keep the base revision without waiting, when there is no import timeout (%d queries)", queries)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	arc.Config = Config{BaseImportTimeout: 24 * 60 * 60}.WithContext(ctx)
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if arc.waitForImport(repository.NewMockRepoForTest(), "A") || queries != 1 {
+		t.Errorf("Unexpected result of waiting for an import that was cancelled (%d queries)", queries)
+	}
+}
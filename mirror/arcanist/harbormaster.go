@@ -0,0 +1,148 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package arcanist
+
+import (
+	"fmt"
+	"github.com/google/git-appraise/review/ci"
+)
+
+type diffSearchConstraints struct {
+	IDs []int `json:"ids"`
+}
+
+type diffSearchRequest struct {
+	Constraints diffSearchConstraints `json:"constraints"`
+}
+
+type diffSearchResponse struct {
+	Error        string `json:"error,omitempty"`
+	ErrorMessage string `json:"errorMessage,omitempty"`
+	Response     struct {
+		Data []struct {
+			ID   int    `json:"id"`
+			PHID string `json:"phid"`
+		} `json:"data"`
+	} `json:"response,omitempty"`
+}
+
+// diffPHIDs caches the PHIDs of diffs, which never change, keyed by the Conduit API endpoint
+// and the diff ID.
+var diffPHIDs = make(map[string]string)
+
+// diffPHID returns the PHID of the diff with the given ID.
+//
+// This corresponds to calling the differential.diff.search API, the first time that each diff is looked up.
+func (config Config) diffPHID(diffID int) (string, error) {
+	key := fmt.Sprintf("%s %d", config.conduitURI(), diffID)
+	if phid, ok := lookupCache(diffPHIDs, key); ok {
+		return phid, nil
+	}
+	request := diffSearchRequest{Constraints: diffSearchConstraints{IDs: []int{diffID}}}
+	var response diffSearchResponse
+	config.runArcCommandOrDie("differential.diff.search", request, &response)
+	if response.Error != "" {
+		return "", fmt.Errorf("Failed to look up diff %d: %s", diffID, response.ErrorMessage)
+	}
+	for _, diff := range response.Response.Data {
+		if diff.ID == diffID {
+			storeInCache(diffPHIDs, key, diff.PHID)
+			return diff.PHID, nil
+		}
+	}
+	return "", fmt.Errorf("Failed to look up diff %d, as it does not exist", diffID)
+}
+
+type harbormasterUnitResult struct {
+	Name    string `json:"name"`
+	Result  string `json:"result"`
+	Details string `json:"details,omitempty"`
+}
+
+type harbormasterMessageRequest struct {
+	// Receiver is the PHID of either a build target, or of a buildable object such as a diff.
+	Receiver string                   `json:"receiver"`
+	Type     string                   `json:"type"`
+	Unit     []harbormasterUnitResult `json:"unit,omitempty"`
+}
+
+type harbormasterMessageResponse struct {
+	Error        string `json:"error,omitempty"`
+	ErrorMessage string `json:"errorMessage,omitempty"`
+}
+
+// translateReportStatusToHarbormasterMessageType returns the type of Harbormaster message that
+// reports a CI report with the given status.
+//
+// Reports that have neither succeeded nor failed are still running, which Harbormaster calls "work".
+func translateReportStatusToHarbormasterMessageType(status string) string {
+	switch status {
+	case "success":
+		return "pass"
+	case "failure":
+		return "fail"
+	default:
+		return "work"
+	}
+}
+
+// buildHarbormasterMessage generates the harbormaster.sendmessage request that reports the given
+// CI reports, each from a different agent, to the receiver with the given PHID.
+//
+// The build fails if any of the reports failed, and is still running if any of the others are.
+// Finished reports each include a unit result, labeled with the report's agent, or with the
+// given default name if the report has no agent, and linking to the report's URL.
+func buildHarbormasterMessage(receiver string, reports []ci.Report, defaultName string) harbormasterMessageRequest {
+	request := harbormasterMessageRequest{Receiver: receiver, Type: "pass"}
+	for _, report := range reports {
+		messageType := translateReportStatusToHarbormasterMessageType(report.Status)
+		if messageType == "fail" || (messageType == "work" && request.Type == "pass") {
+			request.Type = messageType
+		}
+		if messageType == "work" {
+			continue
+		}
+		name := report.Agent
+		if name == "" {
+			name = defaultName
+		}
+		request.Unit = append(request.Unit, harbormasterUnitResult{
+			Name:    name,
+			Result:  translateReportStatusToDifferentialUnitResult(report.Status),
+			Details: report.URL,
+		})
+	}
+	return request
+}
+
+// sendHarbormasterMessage reports the given CI reports for the diff with the given ID to Harbormaster.
+//
+// The message is sent to the diff itself, rather than to one of its build targets, as the results
+// come from outside of Harbormaster. Harbormaster keeps them as an external build of the diff.
+func (arc Arcanist) sendHarbormasterMessage(diffID int, reports []ci.Report) error {
+	diffPHID, err := arc.Config.diffPHID(diffID)
+	if err != nil {
+		return err
+	}
+	request := buildHarbormasterMessage(diffPHID, reports, arc.Config.UnitResultName)
+	var response harbormasterMessageResponse
+	arc.Config.runArcCommandOrDie("harbormaster.sendmessage", request, &response)
+	if response.Error != "" {
+		return fmt.Errorf("Failed to report the build status of diff %d: %s", diffID, response.ErrorMessage)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package arcanist
+
+import (
+	"encoding/json"
+	"github.com/google/git-appraise/review/ci"
+	"testing"
+)
+
+func TestDiffPHIDIsCached(t *testing.T) {
+	originalCallConduit := callConduit
+	defer func() { callConduit = originalCallConduit }()
+	searches := 0
+	callConduit = func(config Config, method string, request interface{}, response interface{}) {
+		if method != "differential.diff.search" {
+			t.Fatalf("Unexpected Conduit call %s", method)
+		}
+		searches++
+		if err := json.Unmarshal([]byte(`{"response": {"data": [{"id": 7, "phid": "PHID-DIFF-7"}]}}`), response); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config := Config{ConduitURI: "https://phabricator.example.com/api/"}
+	defer delete(diffPHIDs, config.conduitURI()+" 7")
+	for i := 0; i < 2; i++ {
+		if phid, err := config.diffPHID(7); err != nil || phid != "PHID-DIFF-7" {
+			t.Errorf("Unexpected PHID for diff 7: %q, %v", phid, err)
+		}
+	}
+	if searches != 1 {
+		t.Errorf("Diff 7 was searched for %d times", searches)
+	}
+	if _, err := config.diffPHID(8); err == nil {
+		t.Error("Failed to report a missing diff")
+	}
+}
+
+func TestBuildHarbormasterMessage(t *testing.T) {
+	cases := []struct {
+		report     ci.Report
+		wantType   string
+		wantResult string
+		wantName   string
+	}{
+		{ci.Report{Status: "success", URL: "https://ci/1", Agent: "builder"}, "pass", "pass", "builder"},
+		{ci.Report{Status: "failure", URL: "https://ci/2"}, "fail", "fail", "CI"},
+		{ci.Report{URL: "https://ci/3", Agent: "builder"}, "work", "", ""},
+	}
+	for _, c := range cases {
+		request := buildHarbormasterMessage("PHID-DIFF-1", []ci.Report{c.report}, "CI")
+		if request.Receiver != "PHID-DIFF-1" || request.Type != c.wantType {
+			t.Errorf("Unexpected message for %v: %v", c.report, request)
+		}
+		if c.wantResult == "" {
+			if len(request.Unit) != 0 {
+				t.Errorf("Unexpected unit results for %v: %v", c.report, request.Unit)
+			}
+			continue
+		}
+		if len(request.Unit) != 1 || request.Unit[0].Result != c.wantResult ||
+			request.Unit[0].Name != c.wantName || request.Unit[0].Details != c.report.URL {
+			t.Errorf("Unexpected unit results for %v: %v", c.report, request.Unit)
+		}
+	}
+
+	reports := []ci.Report{
+		{Status: "success", Agent: "build"},
+		{Status: "", Agent: "integration"},
+		{Status: "failure", Agent: "lint"},
+	}
+	if request := buildHarbormasterMessage("PHID-DIFF-1", reports, "CI"); request.Type != "fail" || len(request.Unit) != 2 {
+		t.Errorf("Unexpected message for the reports of multiple agents: %v", request)
+	}
+	if request := buildHarbormasterMessage("PHID-DIFF-1", reports[:2], "CI"); request.Type != "work" || len(request.Unit) != 1 {
+		t.Errorf("Unexpected message while some of the agents are still running: %v", request)
+	}
+}
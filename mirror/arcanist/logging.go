@@ -0,0 +1,117 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package arcanist
+
+import (
+	"encoding/json"
+	"log"
+	"regexp"
+	"strings"
+)
+
+// redacted replaces the values that are removed from logged Conduit payloads.
+const redacted = "<redacted>"
+
+var (
+	// logConduitPayloads specifies whether or not to log the full request and response of each Conduit call.
+	logConduitPayloads bool
+	// redactEmails specifies whether or not to remove email addresses from logged Conduit payloads.
+	redactEmails bool
+	// verbose specifies whether or not to log the details that are only needed for debugging.
+	verbose bool
+)
+
+var emailPattern = regexp.MustCompile(`[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+\.[a-zA-Z]+`)
+
+// LogConduitPayloads turns on logging of the full requests and responses of Conduit calls.
+//
+// Fields that hold credentials (e.g. tokens) are always redacted from the logged payloads,
+// while email addresses are only redacted if redactEmailAddresses is true.
+func LogConduitPayloads(redactEmailAddresses bool) {
+	logConduitPayloads = true
+	redactEmails = redactEmailAddresses
+}
+
+// LogVerbosely turns on logging of details that are only needed for debugging, such as the
+// entries of a revision's hashes that were skipped.
+func LogVerbosely() {
+	verbose = true
+}
+
+// logVerbose logs the given message, formatted as with log.Printf, if LogVerbosely was called.
+func logVerbose(format string, v ...interface{}) {
+	if verbose {
+		log.Printf(format, v...)
+	}
+}
+
+// isSensitiveField reports whether or not the field with the given name holds credentials.
+func isSensitiveField(name string) bool {
+	name = strings.ToLower(name)
+	return strings.Contains(name, "token") || strings.Contains(name, "password") ||
+		strings.Contains(name, "secret") || strings.Contains(name, "certificate")
+}
+
+// redactValue removes the sensitive parts of a parsed JSON value.
+func redactValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for name, fieldValue := range v {
+			if isSensitiveField(name) {
+				v[name] = redacted
+			} else {
+				v[name] = redactValue(fieldValue)
+			}
+		}
+		return v
+	case []interface{}:
+		for i, element := range v {
+			v[i] = redactValue(element)
+		}
+		return v
+	case string:
+		if redactEmails {
+			return emailPattern.ReplaceAllString(v, redacted)
+		}
+		return v
+	}
+	return value
+}
+
+// redactPayload removes the sensitive parts of a Conduit request or response.
+func redactPayload(payload []byte) string {
+	var value interface{}
+	if err := json.Unmarshal(payload, &value); err != nil {
+		// The payload is not JSON (e.g. an error message from arc), so there are no fields to redact.
+		if redactEmails {
+			return emailPattern.ReplaceAllString(string(payload), redacted)
+		}
+		return string(payload)
+	}
+	redactedPayload, err := json.Marshal(redactValue(value))
+	if err != nil {
+		return redacted
+	}
+	return string(redactedPayload)
+}
+
+// logConduitPayload logs the given Conduit request or response, if enabled.
+func logConduitPayload(kind string, payload []byte) {
+	if logConduitPayloads {
+		log.Printf("Conduit %s: %s", kind, redactPayload(payload))
+	}
+}
@@ -0,0 +1,38 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package arcanist
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRedactPayload(t *testing.T) {
+	payload := []byte(`{"api.token":"api-secret","response":[{"userName":"alice","primaryEmail":"alice@example.com"}]}`)
+	redactEmails = false
+	if result := redactPayload(payload); strings.Contains(result, "api-secret") || !strings.Contains(result, "alice@example.com") {
+		t.Errorf("Unexpected redaction of credentials only: %s", result)
+	}
+	redactEmails = true
+	defer func() { redactEmails = false }()
+	if result := redactPayload(payload); strings.Contains(result, "api-secret") || strings.Contains(result, "alice@example.com") || !strings.Contains(result, "alice") {
+		t.Errorf("Unexpected redaction of credentials and emails: %s", result)
+	}
+	if result := redactPayload([]byte("Error: bob@example.com")); strings.Contains(result, "bob@example.com") {
+		t.Errorf("Unexpected redaction of a non-JSON payload: %s", result)
+	}
+}
@@ -0,0 +1,224 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package arcanist
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// fieldEndingLabels are the labels of the lines that end a field even though they are not one of
+// the configured headers: the fields that Differential recognizes in a commit message, and the
+// trailers that git and its tools add to one. Any other "Label: value" line is part of the field.
+var fieldEndingLabels = []string{
+	// Differential fields.
+	"Summary",
+	"Test Plan",
+	"Reviewers",
+	"Reviewed By",
+	"Subscribers",
+	"CC",
+	"Maniphest Tasks",
+	"Tags",
+	"Revert Plan",
+	"Depends On",
+	"Auditors",
+	"Differential Revision",
+	// Git trailers.
+	"Signed-off-by",
+	"Acked-by",
+	"Reviewed-by",
+	"Tested-by",
+	"Reported-by",
+	"Co-authored-by",
+	"Change-Id",
+}
+
+// endsField returns whether the given line starts with one of the fieldEndingLabels.
+func endsField(line string) bool {
+	for _, label := range fieldEndingLabels {
+		if len(line) > len(label) && strings.EqualFold(line[:len(label)], label) && line[len(label)] == ':' {
+			return true
+		}
+	}
+	return false
+}
+
+// sortedHeaders returns the given field headers in the order in which they are matched: longest
+// first, so that a header is never cut short by another that is a prefix of it, and then
+// alphabetically.
+func sortedHeaders(headers map[string]string) []string {
+	var sorted []string
+	for header := range headers {
+		sorted = append(sorted, header)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if len(sorted[i]) != len(sorted[j]) {
+			return len(sorted[i]) > len(sorted[j])
+		}
+		return sorted[i] < sorted[j]
+	})
+	return sorted
+}
+
+// splitCommitMessageFields separates the recognized fields from the rest of a review description.
+//
+// A field starts with a line that begins with one of the given headers followed by a ':', and
+// continues until the next line that starts another field or one of the fieldEndingLabels. The
+// returned map is keyed by field name, and the returned description holds everything that was not
+// part of a recognized field, including any git trailers.
+func splitCommitMessageFields(description string, headers map[string]string) (string, map[string]string) {
+	var remainder []string
+	fields := make(map[string]string)
+	inField := false
+	currentField := ""
+	sorted := sortedHeaders(headers)
+	for _, line := range strings.Split(description, "\n") {
+		headerFound := false
+		for _, header := range sorted {
+			if strings.HasPrefix(line, header+":") {
+				headerFound = true
+				inField = true
+				currentField = headers[header]
+				line = strings.TrimPrefix(line, header+":")
+				break
+			}
+		}
+		if !headerFound && endsField(line) {
+			inField = false
+		}
+		if !inField {
+			remainder = append(remainder, line)
+		} else if headerFound && fields[currentField] != "" {
+			fields[currentField] += "\n\n" + line
+		} else if headerFound {
+			fields[currentField] = line
+		} else {
+			fields[currentField] += "\n" + line
+		}
+	}
+	for field, value := range fields {
+		if field == "" || strings.TrimSpace(value) == "" {
+			delete(fields, field)
+		} else {
+			fields[field] = strings.TrimSpace(value)
+		}
+	}
+	return strings.TrimSpace(strings.Join(remainder, "\n")), fields
+}
+
+// keptTrailer is the trailer that stripTrailers never removes, as it links a commit to its revision.
+const keptTrailer = "Differential Revision"
+
+// stripTrailers removes the lines for the given git trailers (e.g. "Signed-off-by") from the
+// last paragraph of the given description, which is where git puts them.
+//
+// Trailers are matched case-insensitively, and the "Differential Revision" trailer is kept.
+func stripTrailers(description string, trailers []string) string {
+	if len(trailers) == 0 {
+		return description
+	}
+	lines := strings.Split(strings.TrimRight(description, "\n"), "\n")
+	start := len(lines)
+	for start > 0 && strings.TrimSpace(lines[start-1]) != "" {
+		start--
+	}
+	if start == 0 {
+		// The description is a single paragraph, so it cannot have any trailers.
+		return description
+	}
+	kept := lines[:start]
+	for _, line := range lines[start:] {
+		stripped := false
+		for _, trailer := range trailers {
+			token := strings.TrimSuffix(strings.TrimSpace(trailer), ":")
+			if strings.EqualFold(token, keptTrailer) {
+				continue
+			}
+			if len(line) > len(token) && strings.EqualFold(line[:len(token)], token) && line[len(token)] == ':' {
+				stripped = true
+				break
+			}
+		}
+		if !stripped {
+			kept = append(kept, line)
+		}
+	}
+	return strings.TrimRight(strings.Join(kept, "\n"), "\n")
+}
+
+type phidLookupRequest struct {
+	Names []string `json:"names"`
+}
+
+type phidLookupResponse struct {
+	Error        string `json:"error,omitempty"`
+	ErrorMessage string `json:"errorMessage,omitempty"`
+	Response     map[string]struct {
+		PHID string `json:"phid"`
+	} `json:"response,omitempty"`
+}
+
+// lookupPHIDs resolves the given object names (e.g. "T123") into their PHIDs.
+//
+// This corresponds to calling the phid.lookup API. Names that are unknown are skipped.
+func (config Config) lookupPHIDs(names []string) ([]string, error) {
+	request := phidLookupRequest{Names: names}
+	var response phidLookupResponse
+	config.runArcCommandOrDie("phid.lookup", request, &response)
+	if response.Error != "" {
+		return nil, fmt.Errorf("Failed to look up the PHIDs of %v: %s", names, response.ErrorMessage)
+	}
+	var phids []string
+	for _, name := range names {
+		if object, ok := response.Response[name]; ok {
+			phids = append(phids, object.PHID)
+		}
+	}
+	return phids, nil
+}
+
+// revisionFieldValues converts the fields parsed out of a review description into values for
+// the Differential revision fields.
+//
+// Fields whose names end in "PHIDs" hold lists of objects, so their values are split into
+// names and then resolved using the given lookup function.
+func revisionFieldValues(fields map[string]string, lookup func(names []string) ([]string, error)) map[string]interface{} {
+	values := make(map[string]interface{})
+	for field, value := range fields {
+		if !strings.HasSuffix(field, "PHIDs") {
+			values[field] = value
+			continue
+		}
+		names := strings.FieldsFunc(value, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\n' || r == '\t'
+		})
+		phids, err := lookup(names)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		var phidValues []interface{}
+		for _, phid := range phids {
+			phidValues = append(phidValues, phid)
+		}
+		values[field] = phidValues
+	}
+	return values
+}
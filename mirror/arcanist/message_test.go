@@ -0,0 +1,107 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package arcanist
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSplitCommitMessageFields(t *testing.T) {
+	description := `Add a feature
+
+This adds a feature.
+
+Test Plan: Ran the unit tests,
+and tried it by hand.
+
+Tasks: T1, T2
+Differential Revision: https://phabricator.example.com/D1
+Signed-off-by: Someone
+Change-Id: I0123456789`
+	headers := map[string]string{
+		"Test Plan":             "testPlan",
+		"Tasks":                 "maniphestTaskPHIDs",
+		"Differential Revision": "",
+	}
+	remainder, fields := splitCommitMessageFields(description, headers)
+	if remainder != "Add a feature\n\nThis adds a feature.\n\nSigned-off-by: Someone\nChange-Id: I0123456789" {
+		t.Errorf("Unexpected remainder of the description: %q", remainder)
+	}
+	if fields["testPlan"] != "Ran the unit tests,\nand tried it by hand." {
+		t.Errorf("Unexpected test plan: %q", fields["testPlan"])
+	}
+	if len(fields) != 2 {
+		t.Errorf("Unexpected fields: %v", fields)
+	}
+	values := revisionFieldValues(fields, func(names []string) ([]string, error) {
+		var phids []string
+		for _, name := range names {
+			phids = append(phids, "PHID-TASK-"+name)
+		}
+		return phids, nil
+	})
+	if tasks := fmt.Sprint(values["maniphestTaskPHIDs"]); tasks != "[PHID-TASK-T1 PHID-TASK-T2]" {
+		t.Errorf("Unexpected tasks: %s", tasks)
+	}
+
+	remainder, fields = splitCommitMessageFields(description, nil)
+	if remainder != description || len(fields) != 0 {
+		t.Errorf("Fields were parsed despite no headers being recognized: %q, %v", remainder, fields)
+	}
+
+	// Only the known fields and trailers end a field.
+	_, fields = splitCommitMessageFields("Title\n\nTest Plan: Ran it.\nNote: it passed.\nReviewers: someone", map[string]string{"Test Plan": "testPlan"})
+	if fields["testPlan"] != "Ran it.\nNote: it passed." {
+		t.Errorf("Unexpected test plan with a colon in it: %q", fields["testPlan"])
+	}
+
+	// The longest matching header wins, no matter the order of the map.
+	for i := 0; i < 10; i++ {
+		_, fields = splitCommitMessageFields("Title\n\nTest Plan: Ran it", map[string]string{"Test": "test", "Test Plan": "testPlan"})
+		if fields["testPlan"] != "Ran it" || len(fields) != 1 {
+			t.Fatalf("Unexpected fields for overlapping headers: %v", fields)
+		}
+	}
+}
+
+func TestStripTrailers(t *testing.T) {
+	description := `Add a feature
+
+Signed-off-by: is mentioned in the body, but is not a trailer here.
+
+Change-Id: I0123456789
+signed-off-by: Someone <someone@example.com>
+Reviewed-by: Someone Else <else@example.com>
+Differential Revision: https://phabricator.example.com/D1`
+	trailers := []string{"Signed-off-by", "Change-Id:", "Reviewed-by", "Differential Revision"}
+	expected := `Add a feature
+
+Signed-off-by: is mentioned in the body, but is not a trailer here.
+
+Differential Revision: https://phabricator.example.com/D1`
+	if stripped := stripTrailers(description, trailers); stripped != expected {
+		t.Errorf("Unexpected description after stripping trailers: %q", stripped)
+	}
+	if stripped := stripTrailers(description, nil); stripped != description {
+		t.Errorf("The description was modified without any trailers to strip: %q", stripped)
+	}
+	title := "Change-Id: the title of a single-paragraph description"
+	if stripped := stripTrailers(title, trailers); stripped != title {
+		t.Errorf("A single-paragraph description was modified: %q", stripped)
+	}
+}
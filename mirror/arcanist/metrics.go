@@ -0,0 +1,87 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package arcanist
+
+import (
+	"github.com/google/git-appraise/review"
+	"sync"
+)
+
+// The reasons for which a comment may be dropped rather than mirrored into Phabricator.
+const (
+	// DropReasonReviewWide is for comments that are not on a file, which we do not mirror yet.
+	DropReasonReviewWide = "review-wide"
+	// DropReasonNoDiff is for comments that could not be matched to any of the revision's diffs.
+	DropReasonNoDiff = "no-diff"
+)
+
+// maxDroppedCommentHashes is the maximum number of hashes held in droppedCommentHashes.
+const maxDroppedCommentHashes = 10000
+
+var (
+	droppedCommentsMutex sync.Mutex
+	// droppedCommentHashes holds the hashes of the comments counted in droppedComments, so that
+	// each comment is only counted once, no matter how many times we try to mirror it.
+	//
+	// Only the latest maxDroppedCommentHashes are held, in the order of droppedCommentHashOrder,
+	// so a comment that is dropped long after it was first counted may be counted again.
+	droppedCommentHashes    = make(map[string]bool)
+	droppedCommentHashOrder []string
+	droppedComments         = make(map[string]int)
+)
+
+// DroppedComments returns the number of comments that were dropped rather than mirrored into
+// Phabricator, keyed by the reason (e.g. DropReasonNoDiff).
+func DroppedComments() map[string]int {
+	droppedCommentsMutex.Lock()
+	defer droppedCommentsMutex.Unlock()
+	counts := make(map[string]int)
+	for reason, count := range droppedComments {
+		counts[reason] = count
+	}
+	return counts
+}
+
+// recordDroppedThread counts the comments in the given thread as dropped for the given reason.
+func recordDroppedThread(thread review.CommentThread, reason string) {
+	droppedCommentsMutex.Lock()
+	defer droppedCommentsMutex.Unlock()
+	recordDroppedThreadLocked(thread, reason)
+}
+
+func recordDroppedThreadLocked(thread review.CommentThread, reason string) {
+	if thread.Hash == "" || !droppedCommentHashes[thread.Hash] {
+		if thread.Hash != "" {
+			addDroppedCommentHashLocked(thread.Hash)
+		}
+		droppedComments[reason]++
+	}
+	for _, child := range thread.Children {
+		recordDroppedThreadLocked(child, reason)
+	}
+}
+
+// addDroppedCommentHashLocked adds the given hash to droppedCommentHashes, evicting the oldest
+// hash once it holds maxDroppedCommentHashes.
+func addDroppedCommentHashLocked(hash string) {
+	if len(droppedCommentHashOrder) >= maxDroppedCommentHashes {
+		delete(droppedCommentHashes, droppedCommentHashOrder[0])
+		droppedCommentHashOrder = droppedCommentHashOrder[1:]
+	}
+	droppedCommentHashes[hash] = true
+	droppedCommentHashOrder = append(droppedCommentHashOrder, hash)
+}
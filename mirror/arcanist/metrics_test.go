@@ -0,0 +1,85 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package arcanist
+
+import (
+	"fmt"
+	"github.com/google/git-appraise/repository"
+	"github.com/google/git-appraise/review"
+	"github.com/google/git-appraise/review/comment"
+	"testing"
+)
+
+func TestDroppedComments(t *testing.T) {
+	before := DroppedComments()
+	threads := []review.CommentThread{
+		review.CommentThread{
+			Hash:    "review-wide-comment",
+			Comment: comment.Comment{Description: "Looks good"},
+			Children: []review.CommentThread{
+				review.CommentThread{Hash: "review-wide-reply", Comment: comment.Comment{Description: "Thanks"}},
+			},
+		},
+		review.CommentThread{
+			Hash: "unknown-diff-comment",
+			Comment: comment.Comment{
+				Location:    &comment.Location{Commit: "UNKNOWN", Path: "hello.txt"},
+				Description: "A file comment",
+			},
+		},
+	}
+	repo := repository.NewMockRepoForTest()
+	for i := 0; i < 2; i++ {
+		// Trying to mirror the same comments again must not count them again.
+		Arcanist{}.buildCommentRequests(repo, DifferentialReview{ID: "1"}, threads, nil, nil, "")
+	}
+	after := DroppedComments()
+	if dropped := after[DropReasonReviewWide] - before[DropReasonReviewWide]; dropped != 2 {
+		t.Errorf("Unexpected number of dropped review-wide comments: %d", dropped)
+	}
+	if dropped := after[DropReasonNoDiff] - before[DropReasonNoDiff]; dropped != 1 {
+		t.Errorf("Unexpected number of comments dropped for lack of a diff: %d", dropped)
+	}
+
+	unresolved := false
+	rejection := review.CommentThread{
+		Hash:    "rejection",
+		Comment: comment.Comment{Description: "Needs work", Resolved: &unresolved},
+		Children: []review.CommentThread{
+			review.CommentThread{Hash: "rejection-reply", Comment: comment.Comment{Description: "Will do"}},
+		},
+	}
+	before = DroppedComments()
+	Arcanist{Config: Config{MirrorRejections: true}}.buildCommentRequests(repo, DifferentialReview{ID: "1"}, []review.CommentThread{rejection}, nil, nil, "")
+	if dropped := DroppedComments()[DropReasonReviewWide] - before[DropReasonReviewWide]; dropped != 1 {
+		t.Errorf("Unexpected number of dropped comments for a mirrored rejection: %d", dropped)
+	}
+}
+
+func TestDroppedCommentHashesAreBounded(t *testing.T) {
+	before := DroppedComments()
+	for i := 0; i <= maxDroppedCommentHashes; i++ {
+		recordDroppedThread(review.CommentThread{Hash: fmt.Sprintf("bounded-%d", i)}, DropReasonNoDiff)
+	}
+	if len(droppedCommentHashes) > maxDroppedCommentHashes || droppedCommentHashes["bounded-0"] {
+		t.Errorf("The dropped comment hashes grew to %d", len(droppedCommentHashes))
+	}
+	recordDroppedThread(review.CommentThread{Hash: fmt.Sprintf("bounded-%d", maxDroppedCommentHashes)}, DropReasonNoDiff)
+	if dropped := DroppedComments()[DropReasonNoDiff] - before[DropReasonNoDiff]; dropped != maxDroppedCommentHashes+1 {
+		t.Errorf("Unexpected number of comments dropped: %d", dropped)
+	}
+}
@@ -0,0 +1,178 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package arcanist
+
+import (
+	"encoding/json"
+	"github.com/google/git-appraise/repository"
+	"log"
+	"sync"
+)
+
+// MirroredTransactionsRef is the notes ref in which we record the Phabricator transactions that the
+// mirror itself created for a review, so that they are not mirrored back into git-notes, and the
+// latest request of the review whose reviewers were mirrored into each of its revisions.
+//
+// The notes are attached to the first commit of each review.
+const MirroredTransactionsRef = "refs/notes/devtools/phabricator/mirrored"
+
+// mirroredTransactions is the format of each note in MirroredTransactionsRef.
+type mirroredTransactions struct {
+	PHIDs []string `json:"phids,omitempty"`
+	// RevisionID and Request record that the reviewers and requester of the request with the
+	// timestamp Request were mirrored into the revision with the ID RevisionID.
+	RevisionID string `json:"revisionID,omitempty"`
+	Request    string `json:"request,omitempty"`
+}
+
+// loadMirroredTransactions returns the set of PHIDs of transactions that the mirror created for
+// the review of the given commit.
+func loadMirroredTransactions(repo repository.Repo, reviewCommit string) map[string]bool {
+	phids := make(map[string]bool)
+	for _, note := range repo.GetNotes(MirroredTransactionsRef, reviewCommit) {
+		var transactions mirroredTransactions
+		if err := json.Unmarshal([]byte(note), &transactions); err != nil {
+			log.Printf("Ignoring a malformed note of mirrored transactions: %q", note)
+			continue
+		}
+		for _, phid := range transactions.PHIDs {
+			phids[phid] = true
+		}
+	}
+	return phids
+}
+
+// recordMirroredTransactions records that the mirror created the given transactions for the review of the given commit.
+func recordMirroredTransactions(repo repository.Repo, reviewCommit string, phids []string) error {
+	if len(phids) == 0 {
+		return nil
+	}
+	note, err := json.Marshal(mirroredTransactions{PHIDs: phids})
+	if err != nil {
+		return err
+	}
+	return repo.AppendNote(MirroredTransactionsRef, reviewCommit, repository.Note(note))
+}
+
+// loadMirroredRequest returns the timestamp of the latest request of the review of the given commit
+// whose reviewers and requester were mirrored into the revision with the given ID, or the empty
+// string if none were recorded.
+func loadMirroredRequest(repo repository.Repo, reviewCommit, revisionID string) string {
+	timestamp := ""
+	for _, note := range repo.GetNotes(MirroredTransactionsRef, reviewCommit) {
+		var mirrored mirroredTransactions
+		if err := json.Unmarshal([]byte(note), &mirrored); err == nil && mirrored.RevisionID == revisionID && mirrored.Request != "" {
+			timestamp = mirrored.Request
+		}
+	}
+	return timestamp
+}
+
+// recordMirroredRequest records that the reviewers and requester of the request with the given
+// timestamp were mirrored into the revision with the given ID, for the review of the given commit.
+func recordMirroredRequest(repo repository.Repo, reviewCommit, revisionID, timestamp string) error {
+	note, err := json.Marshal(mirroredTransactions{RevisionID: revisionID, Request: timestamp})
+	if err != nil {
+		return err
+	}
+	return repo.AppendNote(MirroredTransactionsRef, reviewCommit, repository.Note(note))
+}
+
+// postedComments accumulates what the mirror posted into a revision, so that it can be recorded
+// with recordMirroredTransactions. It is safe to use from concurrent posts.
+type postedComments struct {
+	mutex sync.Mutex
+	// phids are the PHIDs of the transactions and inline comments that Phabricator reported creating.
+	phids []string
+	// messages maps the PHID of each user that we posted top-level comments on behalf of, or the
+	// empty string for the mirror's own account, to the messages of those comments.
+	messages map[string]map[string]bool
+}
+
+func newPostedComments() *postedComments {
+	return &postedComments{messages: make(map[string]map[string]bool)}
+}
+
+// addPHIDs records the given PHIDs, which Phabricator reported creating.
+func (posted *postedComments) addPHIDs(phids []string) {
+	posted.mutex.Lock()
+	defer posted.mutex.Unlock()
+	posted.phids = append(posted.phids, phids...)
+}
+
+// addMessage records the message of the given top-level comment, if it has one.
+func (posted *postedComments) addMessage(request createCommentRequest) {
+	if request.Message == "" {
+		return
+	}
+	author := ""
+	if request.Conduit != nil {
+		author = request.Conduit.ActAsUser
+	}
+	posted.mutex.Lock()
+	defer posted.mutex.Unlock()
+	if posted.messages[author] == nil {
+		posted.messages[author] = make(map[string]bool)
+	}
+	posted.messages[author][request.Message] = true
+}
+
+// messagesByAuthor returns the recorded messages, keyed by the PHID of their author, where the
+// given PHID is that of the mirror's own account.
+func (posted *postedComments) messagesByAuthor(selfPHID string) map[string]map[string]bool {
+	posted.mutex.Lock()
+	defer posted.mutex.Unlock()
+	messages := make(map[string]map[string]bool)
+	for author, authorMessages := range posted.messages {
+		if author == "" {
+			author = selfPHID
+		}
+		if messages[author] == nil {
+			messages[author] = make(map[string]bool)
+		}
+		for message := range authorMessages {
+			messages[author][message] = true
+		}
+	}
+	return messages
+}
+
+// postedMessageTransactions returns the PHIDs of the transactions in after that are not in
+// before, and that hold one of the given messages by the author that posted it.
+//
+// The contents of those transactions' comments are read with the given function.
+func postedMessageTransactions(before, after []differentialDatabaseTransaction, messages map[string]map[string]bool, readTransactionComment ReadTransactionComment) []string {
+	existing := make(map[string]bool)
+	for _, transaction := range before {
+		existing[transaction.PHID] = true
+	}
+	var phids []string
+	for _, transaction := range after {
+		if existing[transaction.PHID] || len(messages[transaction.AuthorPHID]) == 0 || transaction.CommentPHID == nil {
+			continue
+		}
+		transactionComment, err := readTransactionComment(transaction.PHID)
+		if err != nil {
+			log.Printf("Not recording the transaction %s as mirrored, as its comment could not be read: %v", transaction.PHID, err)
+			continue
+		}
+		if transactionComment != nil && messages[transaction.AuthorPHID][transactionComment.Content] {
+			phids = append(phids, transaction.PHID)
+		}
+	}
+	return phids
+}
@@ -0,0 +1,97 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package arcanist
+
+import (
+	"github.com/google/git-appraise/repository"
+	"reflect"
+	"testing"
+)
+
+func TestMirroredTransactions(t *testing.T) {
+	repo := repository.NewMockRepoForTest()
+	if phids := loadMirroredTransactions(repo, "A"); len(phids) != 0 {
+		t.Errorf("Unexpected mirrored transactions: %v", phids)
+	}
+	if err := recordMirroredTransactions(repo, "A", []string{"PHID-XACT-1", "PHID-XACT-2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := recordMirroredTransactions(repo, "A", []string{"PHID-XACT-3"}); err != nil {
+		t.Fatal(err)
+	}
+	repo.AppendNote(MirroredTransactionsRef, "A", repository.Note("not JSON"))
+	expected := map[string]bool{"PHID-XACT-1": true, "PHID-XACT-2": true, "PHID-XACT-3": true}
+	if phids := loadMirroredTransactions(repo, "A"); !reflect.DeepEqual(phids, expected) {
+		t.Errorf("Unexpected mirrored transactions: %v", phids)
+	}
+}
+
+func TestPostedMessageTransactions(t *testing.T) {
+	commentPHID := "PHID-XCMT"
+	before := []differentialDatabaseTransaction{{PHID: "old", AuthorPHID: "mirror", CommentPHID: &commentPHID}}
+	after := append(before,
+		differentialDatabaseTransaction{PHID: "ours", AuthorPHID: "mirror", CommentPHID: &commentPHID},
+		differentialDatabaseTransaction{PHID: "actedAs", AuthorPHID: "author", CommentPHID: &commentPHID},
+		differentialDatabaseTransaction{PHID: "humanAsAuthor", AuthorPHID: "author", CommentPHID: &commentPHID},
+		differentialDatabaseTransaction{PHID: "human", AuthorPHID: "human", CommentPHID: &commentPHID},
+		differentialDatabaseTransaction{PHID: "accept", AuthorPHID: "mirror"})
+	contents := map[string]string{
+		"old":           "Mirrored",
+		"ours":          "Mirrored",
+		"actedAs":       "Quoted",
+		"humanAsAuthor": "Written in Phabricator",
+		"human":         "Mirrored",
+	}
+	readTransactionComment := func(transactionID string) (*differentialDatabaseTransactionComment, error) {
+		return &differentialDatabaseTransactionComment{Content: contents[transactionID]}, nil
+	}
+	posted := newPostedComments()
+	posted.addMessage(createCommentRequest{Message: "Mirrored"})
+	posted.addMessage(createCommentRequest{Message: "Quoted", Conduit: &conduitMetadata{ActAsUser: "author"}})
+	posted.addMessage(createCommentRequest{AttachInlines: true})
+	phids := postedMessageTransactions(before, after, posted.messagesByAuthor("mirror"), readTransactionComment)
+	if !reflect.DeepEqual(phids, []string{"ours", "actedAs"}) {
+		t.Errorf("Unexpected posted transactions: %v", phids)
+	}
+}
+
+func TestLoadCommentsSkipsMirroredTransactions(t *testing.T) {
+	review := DifferentialReview{ID: "testReview"}
+	allComments := LoadComments(review, MockReadTransactions, MockReadTransactionComment, MockLookupUser)
+	transactions, _ := MockReadTransactions(review.ID)
+	review.mirrored = map[string]bool{transactions[0].PHID: true}
+	comments := LoadComments(review, MockReadTransactions, MockReadTransactionComment, MockLookupUser)
+	if len(comments) >= len(allComments) {
+		t.Errorf("Failed to skip a mirrored transaction: %v", comments)
+	}
+}
+
+func TestLoadCommentsSkipsMirroredComments(t *testing.T) {
+	review := DifferentialReview{ID: "testReview"}
+	allComments := LoadComments(review, MockReadTransactions, MockReadTransactionComment, MockLookupUser)
+	commentPHID := "PHID-XCMT-inline"
+	readTransactions := func(reviewID string) ([]differentialDatabaseTransaction, error) {
+		transactions, err := MockReadTransactions(reviewID)
+		transactions[0].CommentPHID = &commentPHID
+		return transactions, err
+	}
+	review.mirrored = map[string]bool{commentPHID: true}
+	comments := LoadComments(review, readTransactions, MockReadTransactionComment, MockLookupUser)
+	if len(comments) >= len(allComments) {
+		t.Errorf("Failed to skip a mirrored comment: %v", comments)
+	}
+}
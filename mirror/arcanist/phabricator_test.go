@@ -0,0 +1,370 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package arcanist
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/google/git-appraise/repository"
+	"github.com/google/git-appraise/review"
+	"github.com/google/git-appraise/review/comment"
+	"github.com/google/git-appraise/review/request"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeMirrorEmail is the email of the account that the mirror uses in fakePhabricator.
+const fakeMirrorEmail = "mirror@example.com"
+
+// fakePhabricator is an in-memory stand-in for the Conduit API of Phabricator, which records the
+// diffs, revisions, and comments that the mirror creates. Its call method replaces callConduit.
+//
+// Every email address is a user, whose PHID is the address prefixed with "PHID-USER-".
+type fakePhabricator struct {
+	mutex     sync.Mutex
+	revisions []*DifferentialReview
+	// diffs maps from the ID of each diff to the commits in its "local:commits" property.
+	diffs map[int]map[string]interface{}
+	// transactions maps from the PHID of each revision to its transactions, oldest first.
+	transactions map[string][]searchTransaction
+}
+
+func newFakePhabricator() *fakePhabricator {
+	return &fakePhabricator{
+		diffs:        make(map[int]map[string]interface{}),
+		transactions: make(map[string][]searchTransaction),
+	}
+}
+
+// userPHID returns the PHID of the user with the given email.
+func userPHID(email string) string {
+	return "PHID-USER-" + email
+}
+
+// actor returns the PHID of the user that a request with the given metadata is made by.
+func actor(conduit *conduitMetadata) string {
+	if conduit != nil && conduit.ActAsUser != "" {
+		return conduit.ActAsUser
+	}
+	return userPHID(fakeMirrorEmail)
+}
+
+func (fake *fakePhabricator) revision(id string) *DifferentialReview {
+	for _, revision := range fake.revisions {
+		if revision.ID == id {
+			return revision
+		}
+	}
+	return nil
+}
+
+// matches reports whether or not the given revision is returned by the given differential.query request.
+func (fake *fakePhabricator) matches(revision DifferentialReview, query queryRequest) bool {
+	if len(query.IDs) > 0 {
+		found := false
+		for _, id := range query.IDs {
+			found = found || strconv.Itoa(id) == revision.ID
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(query.CommitHashes) > 0 {
+		found := false
+		for _, hash := range query.CommitHashes {
+			for _, hashPair := range revision.Hashes {
+				found = found || fmt.Sprint(hash) == fmt.Sprint(hashPair)
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	closed := revision.Status == differentialClosedStatus || revision.Status == differentialAbandonedStatus
+	return query.Status != "status-open" || !closed
+}
+
+func (fake *fakePhabricator) newDiff() int {
+	id := len(fake.diffs) + 1
+	fake.diffs[id] = nil
+	return id
+}
+
+// attachDiff makes the diff with the given ID the latest diff of the given revision.
+func (fake *fakePhabricator) attachDiff(revision *DifferentialReview, diffID int) {
+	revision.Diffs = append(revision.Diffs, strconv.Itoa(diffID))
+	for commit := range fake.diffs[diffID] {
+		hashPair := []string{commitHashType, commit}
+		found := false
+		for _, existing := range revision.Hashes {
+			found = found || fmt.Sprint(existing) == fmt.Sprint(hashPair)
+		}
+		if !found {
+			revision.Hashes = append(revision.Hashes, hashPair)
+		}
+	}
+}
+
+// addTransaction adds a transaction of the given type, by the given author and with a comment
+// with the given content, to the revision with the given PHID. It returns the PHID of the comment.
+func (fake *fakePhabricator) addTransaction(revisionPHID, transactionType, authorPHID, content string, fields json.RawMessage) string {
+	id := 1
+	for _, transactions := range fake.transactions {
+		id += len(transactions)
+	}
+	transaction := searchTransaction{
+		ID:          id,
+		PHID:        fmt.Sprintf("PHID-XACT-%d", id),
+		Type:        transactionType,
+		AuthorPHID:  authorPHID,
+		DateCreated: uint32(id),
+		Fields:      fields,
+	}
+	var transactionComment searchTransactionComment
+	transactionComment.PHID = fmt.Sprintf("PHID-XCMT-%d", id)
+	transactionComment.Content.Raw = content
+	transaction.Comments = []searchTransactionComment{transactionComment}
+	fake.transactions[revisionPHID] = append(fake.transactions[revisionPHID], transaction)
+	return transactionComment.PHID
+}
+
+// comments returns the content of the comments on the given revision.
+func (fake *fakePhabricator) comments(revision *DifferentialReview) []string {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	var contents []string
+	for _, transaction := range fake.transactions[revision.PHID] {
+		contents = append(contents, transaction.Comments[0].Content.Raw)
+	}
+	return contents
+}
+
+// findRevision returns the revision that includes the given commit, if any.
+func (fake *fakePhabricator) findRevision(commit string) *DifferentialReview {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	for _, revision := range fake.revisions {
+		for _, hashPair := range revision.Hashes {
+			if len(hashPair) == 2 && hashPair[0] == commitHashType && hashPair[1] == commit {
+				return revision
+			}
+		}
+	}
+	return nil
+}
+
+func (fake *fakePhabricator) call(config Config, method string, request interface{}, response interface{}) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	switch method {
+	case "differential.query":
+		query := request.(queryRequest)
+		var revisions []DifferentialReview
+		for _, revision := range fake.revisions {
+			if fake.matches(*revision, query) {
+				revisions = append(revisions, *revision)
+			}
+		}
+		response.(*queryResponse).Response = revisions
+	case "differential.createrawdiff":
+		response.(*differentialCreateRawDiffResponse).Response.ID = fake.newDiff()
+	case "differential.creatediff":
+		id := fake.newDiff()
+		response.(*differentialCreateDiffResponse).Response = differentialDiff{ID: id, PHID: fmt.Sprintf("PHID-DIFF-%d", id)}
+	case "differential.setdiffproperty":
+		property := request.(differentialSetDiffPropertyRequest)
+		if property.Name == "local:commits" {
+			var commits map[string]interface{}
+			if err := json.Unmarshal([]byte(property.Data), &commits); err == nil {
+				fake.diffs[property.ID] = commits
+			}
+		}
+	case "differential.querydiffs":
+		diffs := make(map[string]queryDiffItem)
+		for _, id := range request.(differentialQueryDiffsRequest).IDs {
+			if commits, ok := fake.diffs[id]; ok {
+				diffs[strconv.Itoa(id)] = queryDiffItem{
+					ID:         strconv.Itoa(id),
+					Properties: map[string]interface{}{"local:commits": commits},
+				}
+			}
+		}
+		response.(*differentialQueryDiffsResponse).Response = diffs
+	case "differential.createrevision":
+		id := len(fake.revisions) + 1
+		revision := &DifferentialReview{ID: strconv.Itoa(id), PHID: fmt.Sprintf("PHID-DREV-%d", id), Status: "0"}
+		fake.revisions = append(fake.revisions, revision)
+		fake.attachDiff(revision, request.(createRevisionRequest).DiffID)
+		response.(*createRevisionResponse).Response = differentialRevision{RevisionID: id}
+	case "differential.updaterevision":
+		update := request.(differentialUpdateRevisionRequest)
+		if revision := fake.revision(update.ID); revision != nil && update.DiffID != "" {
+			diffID, _ := strconv.Atoi(update.DiffID)
+			fake.attachDiff(revision, diffID)
+		}
+	case "differential.close":
+		if revision := fake.revision(strconv.Itoa(request.(differentialCloseRequest).ID)); revision != nil {
+			revision.Status = differentialClosedStatus
+		}
+	case "differential.createcomment":
+		c := request.(createCommentRequest)
+		if revision := fake.revision(c.RevisionID); revision != nil && c.Message != "" {
+			fake.addTransaction(revision.PHID, "comment", actor(c.Conduit), c.Message, nil)
+		}
+	case "differential.createinline":
+		inline := request.(createInlineRequest)
+		if revision := fake.revision(inline.RevisionID); revision != nil {
+			diffID, _ := strconv.Atoi(inline.DiffID)
+			fields, _ := json.Marshal(map[string]interface{}{
+				"diff":      map[string]int{"id": diffID},
+				"path":      inline.FilePath,
+				"line":      inline.LineNumber,
+				"length":    inline.LineLength,
+				"isNewFile": inline.IsNewFile == rightHandSide,
+			})
+			response.(*createInlineResponse).Response.PHID = fake.addTransaction(revision.PHID, "inline", actor(inline.Conduit), inline.Content, fields)
+		}
+	case "transaction.search":
+		response.(*transactionSearchResponse).Response.Data = fake.transactions[request.(transactionSearchRequest).ObjectIdentifier]
+	case "user.query":
+		query := request.(userQueryRequest)
+		var users []user
+		for _, email := range query.Emails {
+			users = append(users, user{PHID: userPHID(email), Email: email})
+		}
+		for _, phid := range query.IDs {
+			users = append(users, user{PHID: phid, Email: strings.TrimPrefix(phid, userPHID(""))})
+		}
+		response.(*userQueryResponse).Response = users
+	case "user.whoami":
+		response.(*whoAmIResponse).Response = user{PHID: userPHID(fakeMirrorEmail), Email: fakeMirrorEmail}
+	}
+}
+
+// useFakePhabricator replaces callConduit and the user caches for the duration of a test, and
+// returns the function that restores them.
+func useFakePhabricator(fake *fakePhabricator) func() {
+	originalCallConduit := callConduit
+	originalQueryCache, originalLookupCache, originalMirrorCache := userQueryCache, userLookupCache, mirrorUserCache
+	callConduit = fake.call
+	userQueryCache, userLookupCache, mirrorUserCache = make(map[string]cachedUser), make(map[string]cachedUser), make(map[string]cachedUser)
+	return func() {
+		callConduit = originalCallConduit
+		userQueryCache, userLookupCache, mirrorUserCache = originalQueryCache, originalLookupCache, originalMirrorCache
+	}
+}
+
+// ensureRequestsExist mirrors every review of the given repo into Phabricator, and returns them.
+func ensureRequestsExist(t *testing.T, arc Arcanist, repo repository.Repo) []review.Review {
+	var reviews []review.Review
+	for _, summary := range review.ListAll(repo) {
+		r, err := summary.Details()
+		if err != nil {
+			t.Fatal(err)
+		}
+		arc.EnsureRequestExists(repo, *r)
+		reviews = append(reviews, *r)
+	}
+	return reviews
+}
+
+func TestMirrorIntoFakePhabricator(t *testing.T) {
+	fake := newFakePhabricator()
+	defer useFakePhabricator(fake)()
+	repo := repository.NewMockRepoForTest()
+	defer func() {
+		for _, summary := range review.ListAll(repo) {
+			delete(closedRevisionsMap, summary.Revision)
+			delete(emptyMergedReviews, summary.Revision)
+		}
+	}()
+	arc := NewArcanist(Config{TransactionSource: TransactionSourceConduit})
+
+	var open review.Review
+	for _, r := range ensureRequestsExist(t, arc, repo) {
+		revision := fake.findRevision(r.Revision)
+		if !r.Submitted && (revision == nil || len(revision.Diffs) == 0) {
+			t.Errorf("The open review %q was not mirrored: %v", r.Revision, revision)
+		}
+		if r.Submitted && revision != nil {
+			t.Errorf("A revision was created for the submitted review %q: %v", r.Revision, revision)
+		}
+		if !r.Submitted && open.Revision == "" {
+			open = r
+		}
+	}
+	if open.Revision == "" {
+		t.Fatal("The mock repo has no open reviews")
+	}
+	revision := fake.findRevision(open.Revision)
+
+	// Mirror a comment from git-notes into the revision.
+	gitNote, err := comment.Comment{
+		Timestamp:   "1",
+		Author:      "reviewer@example.com",
+		Description: "Please add a test",
+	}.Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.AppendNote(comment.Ref, open.Revision, gitNote); err != nil {
+		t.Fatal(err)
+	}
+	ensureRequestsExist(t, arc, repo)
+	mirrored := false
+	for _, content := range fake.comments(revision) {
+		mirrored = mirrored || strings.Contains(content, "Please add a test")
+	}
+	if !mirrored {
+		t.Errorf("The git-notes comment was not mirrored into D%s: %q", revision.ID, fake.comments(revision))
+	}
+
+	// Read a comment made in Phabricator, while skipping those that the mirror posted.
+	fake.mutex.Lock()
+	fake.addTransaction(revision.PHID, "comment", userPHID("author@example.com"), "Done", nil)
+	fake.mutex.Unlock()
+	var openReview *DifferentialReview
+	for _, phabricatorReview := range arc.ListOpenReviews(repo) {
+		if r, ok := phabricatorReview.(DifferentialReview); ok && r.GetFirstCommit(repo) == open.Revision {
+			openReview = &r
+		}
+	}
+	if openReview == nil {
+		t.Fatalf("D%s is not listed as open for the review %q", revision.ID, open.Revision)
+	}
+	comments := openReview.LoadComments()
+	if len(comments) != 1 || comments[0].Description != "Done" || comments[0].Author != "author@example.com" {
+		t.Errorf("Unexpected comments read from D%s: %v", revision.ID, comments)
+	}
+
+	// Retarget the review at its own commit, so that it counts as merged.
+	merged := open.Request
+	merged.TargetRef = open.Revision
+	mergedNote, err := merged.Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.AppendNote(request.Ref, open.Revision, mergedNote); err != nil {
+		t.Fatal(err)
+	}
+	ensureRequestsExist(t, arc, repo)
+	if revision.Status != differentialClosedStatus {
+		t.Errorf("D%s was not closed once its review was merged", revision.ID)
+	}
+}
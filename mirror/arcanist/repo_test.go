@@ -0,0 +1,271 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package arcanist
+
+import (
+	"fmt"
+	"github.com/google/git-appraise/repository"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+// commitGraphRepo is a repository.Repo that only knows about the given commits.
+//
+// It implements the methods that inspect the commit graph the same way that git does, so that
+// tests can exercise merge bases and commit ranges without a real git repo. The refs map names
+// to commits, and each commit is also its own hash.
+type commitGraphRepo struct {
+	repository.Repo
+	commits map[string]repository.CommitDetails
+	refs    map[string]string
+}
+
+func (repo commitGraphRepo) resolve(ref string) (string, error) {
+	if commit, ok := repo.refs[ref]; ok {
+		return commit, nil
+	}
+	if _, ok := repo.commits[ref]; ok {
+		return ref, nil
+	}
+	return "", fmt.Errorf("Unknown ref %q", ref)
+}
+
+func (repo commitGraphRepo) VerifyCommit(hash string) error {
+	_, err := repo.resolve(hash)
+	return err
+}
+
+func (repo commitGraphRepo) VerifyGitRef(ref string) error {
+	_, err := repo.resolve(ref)
+	return err
+}
+
+func (repo commitGraphRepo) GetCommitHash(ref string) (string, error) {
+	return repo.resolve(ref)
+}
+
+func (repo commitGraphRepo) ResolveRefCommit(ref string) (string, error) {
+	return repo.resolve(ref)
+}
+
+func (repo commitGraphRepo) GetCommitDetails(ref string) (*repository.CommitDetails, error) {
+	commit, err := repo.resolve(ref)
+	if err != nil {
+		return nil, err
+	}
+	details := repo.commits[commit]
+	return &details, nil
+}
+
+func (repo commitGraphRepo) GetCommitTime(ref string) (string, error) {
+	details, err := repo.GetCommitDetails(ref)
+	if err != nil {
+		return "", err
+	}
+	return details.Time, nil
+}
+
+func (repo commitGraphRepo) GetLastParent(ref string) (string, error) {
+	details, err := repo.GetCommitDetails(ref)
+	if err != nil {
+		return "", err
+	}
+	if len(details.Parents) == 0 {
+		return "", nil
+	}
+	return details.Parents[len(details.Parents)-1], nil
+}
+
+// ancestors returns the set of commits reachable from the given ref, including the commit itself.
+func (repo commitGraphRepo) ancestors(ref string) (map[string]bool, error) {
+	commit, err := repo.resolve(ref)
+	if err != nil {
+		return nil, err
+	}
+	reachable := make(map[string]bool)
+	pending := []string{commit}
+	for len(pending) > 0 {
+		next := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if reachable[next] {
+			continue
+		}
+		reachable[next] = true
+		pending = append(pending, repo.commits[next].Parents...)
+	}
+	return reachable, nil
+}
+
+func (repo commitGraphRepo) IsAncestor(ancestor, descendant string) (bool, error) {
+	ancestorCommit, err := repo.resolve(ancestor)
+	if err != nil {
+		return false, err
+	}
+	reachable, err := repo.ancestors(descendant)
+	if err != nil {
+		return false, err
+	}
+	return reachable[ancestorCommit], nil
+}
+
+// byTime sorts commits from oldest to newest, breaking ties by hash.
+type byTime struct {
+	commits []string
+	repo    commitGraphRepo
+}
+
+func (b byTime) Len() int      { return len(b.commits) }
+func (b byTime) Swap(i, j int) { b.commits[i], b.commits[j] = b.commits[j], b.commits[i] }
+func (b byTime) Less(i, j int) bool {
+	left, _ := strconv.Atoi(b.repo.commits[b.commits[i]].Time)
+	right, _ := strconv.Atoi(b.repo.commits[b.commits[j]].Time)
+	if left != right {
+		return left < right
+	}
+	return b.commits[i] < b.commits[j]
+}
+
+func (repo commitGraphRepo) sortByTime(commits []string) {
+	sort.Sort(byTime{commits, repo})
+}
+
+// MergeBase returns the newest of the common ancestors of the given refs that is not an
+// ancestor of another common ancestor.
+func (repo commitGraphRepo) MergeBase(a, b string) (string, error) {
+	fromA, err := repo.ancestors(a)
+	if err != nil {
+		return "", err
+	}
+	fromB, err := repo.ancestors(b)
+	if err != nil {
+		return "", err
+	}
+	var common []string
+	for commit := range fromA {
+		if fromB[commit] {
+			common = append(common, commit)
+		}
+	}
+	var bases []string
+	for _, candidate := range common {
+		isBest := true
+		for _, other := range common {
+			if other == candidate {
+				continue
+			}
+			if isAncestor, _ := repo.IsAncestor(candidate, other); isAncestor {
+				isBest = false
+				break
+			}
+		}
+		if isBest {
+			bases = append(bases, candidate)
+		}
+	}
+	if len(bases) == 0 {
+		return "", fmt.Errorf("There is no merge base of %q and %q", a, b)
+	}
+	repo.sortByTime(bases)
+	return bases[len(bases)-1], nil
+}
+
+// ListCommitsBetween matches "git rev-list --reverse --ancestry-path from..to", returning the
+// commits that descend from the first ref and lead to the second, from oldest to newest.
+func (repo commitGraphRepo) ListCommitsBetween(from, to string) ([]string, error) {
+	fromCommit, err := repo.resolve(from)
+	if err != nil {
+		return nil, err
+	}
+	excluded, err := repo.ancestors(from)
+	if err != nil {
+		return nil, err
+	}
+	included, err := repo.ancestors(to)
+	if err != nil {
+		return nil, err
+	}
+	var commits []string
+	for commit := range included {
+		if excluded[commit] {
+			continue
+		}
+		if isDescendant, _ := repo.IsAncestor(fromCommit, commit); isDescendant {
+			commits = append(commits, commit)
+		}
+	}
+	repo.sortByTime(commits)
+	return commits, nil
+}
+
+// fileRepo is a repository.Repo that only has the given files, keyed by "<commit>:<path>".
+type fileRepo struct {
+	repository.Repo
+	files map[string]string
+}
+
+func (repo fileRepo) Show(commit, path string) (string, error) {
+	if contents, ok := repo.files[commit+":"+path]; ok {
+		return contents, nil
+	}
+	return "", fmt.Errorf("There is no %q at %q", path, commit)
+}
+
+func TestCommitGraphRepo(t *testing.T) {
+	// X is merged into the review of B and C with the merge commit D, and the review is
+	// then merged into master with M.
+	repo := commitGraphRepo{
+		commits: map[string]repository.CommitDetails{
+			"A": repository.CommitDetails{Time: "0"},
+			"X": repository.CommitDetails{Time: "1", Parents: []string{"A"}},
+			"B": repository.CommitDetails{Time: "2", Parents: []string{"A"}},
+			"C": repository.CommitDetails{Time: "3", Parents: []string{"B"}},
+			"D": repository.CommitDetails{Time: "4", Parents: []string{"C", "X"}},
+			"N": repository.CommitDetails{Time: "5", Parents: []string{"A"}},
+			"M": repository.CommitDetails{Time: "6", Parents: []string{"N", "D"}},
+		},
+		refs: map[string]string{
+			"refs/heads/master": "M",
+			"refs/heads/review": "D",
+		},
+	}
+	if base, err := repo.MergeBase("refs/heads/review", "N"); err != nil || base != "A" {
+		t.Errorf("Unexpected merge base of the review and N: %q, %v", base, err)
+	}
+	if base, err := repo.MergeBase("refs/heads/review", "refs/heads/master"); err != nil || base != "D" {
+		t.Errorf("Unexpected merge base of the review and master: %q, %v", base, err)
+	}
+	if commits, err := repo.ListCommitsBetween("A", "refs/heads/review"); err != nil || !reflect.DeepEqual(commits, []string{"X", "B", "C", "D"}) {
+		t.Errorf("Unexpected commits in the review: %v, %v", commits, err)
+	}
+	if commits, err := repo.ListCommitsBetween("B", "refs/heads/master"); err != nil || !reflect.DeepEqual(commits, []string{"C", "D", "M"}) {
+		t.Errorf("Unexpected commits between B and master: %v, %v", commits, err)
+	}
+	if isAncestor, err := repo.IsAncestor("X", "refs/heads/master"); err != nil || !isAncestor {
+		t.Errorf("X was not reported as an ancestor of master: %v", err)
+	}
+	if isAncestor, err := repo.IsAncestor("N", "refs/heads/review"); err != nil || isAncestor {
+		t.Errorf("N was reported as an ancestor of the review: %v", err)
+	}
+	if landing := findLandingCommit(repo, "D", "refs/heads/master"); landing != "M" {
+		t.Errorf("Unexpected landing commit for the merged review: %q", landing)
+	}
+	if landing := findLandingCommit(repo, "X", "refs/heads/master"); landing != "D" {
+		t.Errorf("Unexpected landing commit for a commit merged into the review: %q", landing)
+	}
+}
@@ -0,0 +1,93 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package arcanist
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// subscriberRule CCs the given users on revisions that change a path matching the given pattern.
+type subscriberRule struct {
+	Pattern string
+	Users   []string
+}
+
+// matches reports whether or not the given changed path is covered by the rule.
+func (rule subscriberRule) matches(changedPath string) bool {
+	return matchesPathPattern(rule.Pattern, changedPath)
+}
+
+// parseSubscriberRules reads the subscriber rules in the given input.
+//
+// Each non-empty line that does not start with "#" holds a path pattern followed by the
+// Phabricator users (by username or email) to CC on revisions that change a matching path.
+func parseSubscriberRules(input io.Reader) ([]subscriberRule, error) {
+	var rules []subscriberRule
+	scanner := bufio.NewScanner(input)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("Malformed subscriber rule on line %d: %q", lineNumber, line)
+		}
+		if _, err := path.Match(fields[0], ""); err != nil {
+			return nil, fmt.Errorf("Malformed path pattern on line %d: %q", lineNumber, fields[0])
+		}
+		rules = append(rules, subscriberRule{Pattern: fields[0], Users: fields[1:]})
+	}
+	return rules, scanner.Err()
+}
+
+// readSubscriberRules reads the subscriber rules from the file at the given path.
+func readSubscriberRules(rulesPath string) ([]subscriberRule, error) {
+	file, err := os.Open(rulesPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return parseSubscriberRules(file)
+}
+
+// pathSubscribers returns the users to CC on a revision that changes the given paths, in the
+// order in which the rules list them.
+func pathSubscribers(rules []subscriberRule, changedPaths []string) []string {
+	var users []string
+	seen := make(map[string]bool)
+	for _, rule := range rules {
+		for _, changedPath := range changedPaths {
+			if !rule.matches(changedPath) {
+				continue
+			}
+			for _, user := range rule.Users {
+				if !seen[user] {
+					seen[user] = true
+					users = append(users, user)
+				}
+			}
+			break
+		}
+	}
+	return users
+}
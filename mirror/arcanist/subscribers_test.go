@@ -0,0 +1,49 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package arcanist
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPathSubscribers(t *testing.T) {
+	rules, err := parseSubscriberRules(strings.NewReader(`
+# Notify the writers about any documentation changes.
+docs/       tech-writers
+*.proto     api-council  api-lead@example.com
+src/*/BUILD build-cop    tech-writers
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 3 {
+		t.Fatalf("Unexpected subscriber rules: %v", rules)
+	}
+	subscribers := pathSubscribers(rules, []string{"service.proto", "src/server/BUILD", "docs/guide/intro.md"})
+	expected := []string{"tech-writers", "api-council", "api-lead@example.com", "build-cop"}
+	if !reflect.DeepEqual(subscribers, expected) {
+		t.Errorf("Unexpected subscribers: %v", subscribers)
+	}
+	if subscribers := pathSubscribers(rules, []string{"src/server/main.go"}); len(subscribers) != 0 {
+		t.Errorf("Unexpected subscribers for an unmatched path: %v", subscribers)
+	}
+	if _, err := parseSubscriberRules(strings.NewReader("docs/\n")); err == nil {
+		t.Error("Failed to reject a rule without any subscribers")
+	}
+}
@@ -0,0 +1,237 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package arcanist
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// transactionSearchPageSize is the maximum number of transactions read by a single transaction.search call.
+const transactionSearchPageSize = 100
+
+// transactionSearchActions maps from the types of the transactions returned by transaction.search
+// that accept or reject a revision, to the values of the corresponding database transactions.
+var transactionSearchActions = map[string]string{
+	"accept":          "\"accept\"",
+	"reject":          "\"reject\"",
+	"request-changes": "\"reject\"",
+}
+
+type transactionSearchRequest struct {
+	ObjectIdentifier string `json:"objectIdentifier"`
+	After            string `json:"after,omitempty"`
+	Limit            int    `json:"limit"`
+}
+
+type transactionSearchResponse struct {
+	Error        string                  `json:"error,omitempty"`
+	ErrorMessage string                  `json:"errorMessage,omitempty"`
+	Response     transactionSearchResult `json:"response,omitempty"`
+}
+
+type transactionSearchResult struct {
+	Data   []searchTransaction `json:"data"`
+	Cursor struct {
+		After *string `json:"after"`
+	} `json:"cursor"`
+}
+
+type searchTransaction struct {
+	ID          int    `json:"id"`
+	PHID        string `json:"phid"`
+	Type        string `json:"type"`
+	AuthorPHID  string `json:"authorPHID"`
+	DateCreated uint32 `json:"dateCreated"`
+	// Comments holds every version of the transaction's comment, the latest first.
+	Comments []searchTransactionComment `json:"comments"`
+	// Fields depends on the type of the transaction. It is an empty JSON array, rather than an
+	// object, for transactions without any fields, so it is only parsed for inline comments.
+	Fields json.RawMessage `json:"fields"`
+}
+
+type searchTransactionComment struct {
+	PHID    string `json:"phid"`
+	Removed bool   `json:"removed"`
+	Content struct {
+		Raw string `json:"raw"`
+	} `json:"content"`
+}
+
+type inlineTransactionFields struct {
+	Diff struct {
+		ID int `json:"id"`
+	} `json:"diff"`
+	Path               string  `json:"path"`
+	Line               uint32  `json:"line"`
+	Length             uint32  `json:"length"`
+	ReplyToCommentPHID *string `json:"replyToCommentPHID"`
+	// IsNewFile is false for comments on the left-hand side of the diff. Comments for which
+	// it is not reported are treated as being on the right-hand side.
+	IsNewFile *bool `json:"isNewFile"`
+}
+
+// conduitTransactionComment is a comment read through transaction.search, along with the diff
+// it was made on, if any, from which we read its commit when the comment is needed.
+type conduitTransactionComment struct {
+	comment   differentialDatabaseTransactionComment
+	diffID    int
+	isNewFile bool
+}
+
+// conduitTransactionReader reads transactions through the transaction.search API, rather than
+// from Phabricator's database.
+//
+// That API returns each transaction along with its comment, so the comments are kept until
+// they are read, rather than being requested separately.
+type conduitTransactionReader struct {
+	config   Config
+	mutex    sync.Mutex
+	comments map[string]conduitTransactionComment
+}
+
+func newConduitTransactionReader(config Config) *conduitTransactionReader {
+	return &conduitTransactionReader{config: config, comments: make(map[string]conduitTransactionComment)}
+}
+
+// readTransactions implements ReadTransactions, returning the transactions in the order they were made.
+//
+// Like readDatabaseTransactions, if the config limits the number of transactions, then only the
+// latest ones are read, plus one more. transaction.search returns the newest transactions first.
+func (reader *conduitTransactionReader) readTransactions(reviewID string) ([]differentialDatabaseTransaction, error) {
+	var results []searchTransaction
+	// read is the number of the transactions read so far that are converted by convertSearchTransactions.
+	read := 0
+	max := reader.config.MaxTransactions
+	request := transactionSearchRequest{ObjectIdentifier: reviewID, Limit: transactionSearchPageSize}
+	for {
+		var response transactionSearchResponse
+		reader.config.runArcCommandOrDie("transaction.search", request, &response)
+		if response.Error != "" {
+			return nil, fmt.Errorf("Failed to read the transactions of %s: %s", reviewID, response.ErrorMessage)
+		}
+		for _, result := range response.Response.Data {
+			if isConvertedTransaction(result) {
+				read++
+			}
+		}
+		results = append(results, response.Response.Data...)
+		after := response.Response.Cursor.After
+		if after == nil || *after == "" || (max > 0 && read > max) {
+			break
+		}
+		request.After = *after
+	}
+	transactions, comments, err := convertSearchTransactions(results)
+	if err != nil {
+		return nil, err
+	}
+	if max > 0 && len(transactions) > max+1 {
+		transactions = transactions[len(transactions)-max-1:]
+	}
+	reader.mutex.Lock()
+	defer reader.mutex.Unlock()
+	for transactionID, c := range comments {
+		reader.comments[transactionID] = c
+	}
+	return transactions, nil
+}
+
+// readTransactionComment implements ReadTransactionComment for transactions previously returned by readTransactions.
+func (reader *conduitTransactionReader) readTransactionComment(transactionID string) (*differentialDatabaseTransactionComment, error) {
+	reader.mutex.Lock()
+	c, ok := reader.comments[transactionID]
+	reader.mutex.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("Unknown transaction comment %s", transactionID)
+	}
+	if c.diffID != 0 {
+		diff, err := reader.config.readDiff(c.diffID)
+		if err != nil {
+			return nil, err
+		}
+		if diff == nil {
+			return nil, fmt.Errorf("Failed to read the diff %d of the comment %s", c.diffID, c.comment.PHID)
+		}
+		c.comment.Commit = diff.findCommit(c.isNewFile)
+	}
+	return &c.comment, nil
+}
+
+// isConvertedTransaction reports whether or not convertSearchTransactions converts the given
+// transaction, which it does for comments, inline comments, and the actions that we mirror.
+func isConvertedTransaction(result searchTransaction) bool {
+	_, isAction := transactionSearchActions[result.Type]
+	return result.Type == "comment" || result.Type == "inline" || isAction
+}
+
+// convertSearchTransactions converts the results of transaction.search into the same form as
+// the transactions read from the database, keeping only the types of transactions that we read
+// from there. The comments of the transactions are returned keyed by transaction PHID.
+func convertSearchTransactions(results []searchTransaction) ([]differentialDatabaseTransaction, map[string]conduitTransactionComment, error) {
+	sort.Slice(results, func(i, j int) bool { return results[i].ID < results[j].ID })
+	var transactions []differentialDatabaseTransaction
+	comments := make(map[string]conduitTransactionComment)
+	for _, result := range results {
+		transaction := differentialDatabaseTransaction{
+			PHID:        result.PHID,
+			AuthorPHID:  result.AuthorPHID,
+			DateCreated: result.DateCreated,
+		}
+		switch result.Type {
+		case "comment":
+			transaction.Type = "core:comment"
+		case "inline":
+			transaction.Type = "differential:inline"
+		default:
+			if !isConvertedTransaction(result) {
+				continue
+			}
+			action := transactionSearchActions[result.Type]
+			transaction.Type = "differential:action"
+			transaction.NewValue = &action
+		}
+		if len(result.Comments) > 0 && !result.Comments[0].Removed {
+			version := result.Comments[0]
+			c := conduitTransactionComment{
+				comment: differentialDatabaseTransactionComment{
+					PHID:    version.PHID,
+					Content: version.Content.Raw,
+				},
+			}
+			if result.Type == "inline" {
+				var fields inlineTransactionFields
+				if err := json.Unmarshal(result.Fields, &fields); err != nil {
+					return nil, nil, fmt.Errorf("Failed to parse the fields of the inline comment %s: %v", result.PHID, err)
+				}
+				c.diffID = fields.Diff.ID
+				c.isNewFile = fields.IsNewFile == nil || *fields.IsNewFile
+				c.comment.FileName = fields.Path
+				c.comment.LineNumber = fields.Line
+				c.comment.LineLength = fields.Length
+				c.comment.ReplyToCommentPHID = fields.ReplyToCommentPHID
+			}
+			commentPHID := version.PHID
+			transaction.CommentPHID = &commentPHID
+			comments[result.PHID] = c
+		}
+		transactions = append(transactions, transaction)
+	}
+	return transactions, comments, nil
+}
@@ -0,0 +1,121 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package arcanist
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+const transactionSearchData = `[
+  {"id": 3, "phid": "PHID-XACT-3", "type": "accept", "authorPHID": "PHID-USER-2", "dateCreated": 300, "comments": [], "fields": []},
+  {"id": 2, "phid": "PHID-XACT-2", "type": "inline", "authorPHID": "PHID-USER-2", "dateCreated": 200,
+   "comments": [{"phid": "PHID-XCMT-2", "removed": false, "content": {"raw": "Typo"}}],
+   "fields": {"diff": {"id": 0, "phid": "PHID-DIFF-1"}, "path": "main.go", "line": 42, "length": 1, "replyToCommentPHID": "PHID-XCMT-1", "isDone": false}},
+  {"id": 1, "phid": "PHID-XACT-1", "type": "comment", "authorPHID": "PHID-USER-1", "dateCreated": 100,
+   "comments": [{"phid": "PHID-XCMT-1", "removed": false, "content": {"raw": "Please take a look"}}], "fields": []},
+  {"id": 4, "phid": "PHID-XACT-4", "type": "comment", "authorPHID": "PHID-USER-1", "dateCreated": 400,
+   "comments": [{"phid": "PHID-XCMT-4", "removed": true, "content": {"raw": ""}}], "fields": []},
+  {"id": 5, "phid": "PHID-XACT-5", "type": "title", "authorPHID": "PHID-USER-1", "dateCreated": 500, "comments": [], "fields": {"old": "a", "new": "b"}}
+]`
+
+func TestConvertSearchTransactions(t *testing.T) {
+	var results []searchTransaction
+	if err := json.Unmarshal([]byte(transactionSearchData), &results); err != nil {
+		t.Fatal(err)
+	}
+	transactions, comments, err := convertSearchTransactions(results)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(transactions) != 4 {
+		t.Fatalf("Unexpected transactions: %v", transactions)
+	}
+	expectedTypes := []string{"core:comment", "differential:inline", "differential:action", "core:comment"}
+	for i, transaction := range transactions {
+		if transaction.Type != expectedTypes[i] || transaction.DateCreated != uint32(100*(i+1)) {
+			t.Errorf("Unexpected transaction %d: %v", i, transaction)
+		}
+	}
+	if action := transactions[2].NewValue; action == nil || *action != "\"accept\"" || transactions[2].CommentPHID != nil {
+		t.Errorf("Unexpected values for the accept transaction: %v", transactions[2])
+	}
+	if transactions[3].CommentPHID != nil {
+		t.Errorf("A removed comment was kept: %v", transactions[3])
+	}
+	inline, ok := comments["PHID-XACT-2"]
+	if !ok || inline.comment.PHID != "PHID-XCMT-2" || inline.comment.FileName != "main.go" || inline.comment.LineNumber != 42 ||
+		inline.comment.ReplyToCommentPHID == nil || *inline.comment.ReplyToCommentPHID != "PHID-XCMT-1" {
+		t.Errorf("Unexpected inline comment: %v", inline)
+	}
+	if len(comments) != 2 || comments["PHID-XACT-1"].comment.Content != "Please take a look" {
+		t.Errorf("Unexpected comments: %v", comments)
+	}
+}
+
+func TestLoadCommentsThroughConduit(t *testing.T) {
+	var results []searchTransaction
+	if err := json.Unmarshal([]byte(transactionSearchData), &results); err != nil {
+		t.Fatal(err)
+	}
+	reader := newConduitTransactionReader(Config{})
+	readTransactions := func(reviewID string) ([]differentialDatabaseTransaction, error) {
+		transactions, comments, err := convertSearchTransactions(results)
+		for transactionID, c := range comments {
+			reader.comments[transactionID] = c
+		}
+		return transactions, err
+	}
+	review := DifferentialReview{PHID: "PHID-DREV-1"}
+	comments := LoadComments(review, readTransactions, reader.readTransactionComment, MockLookupUser)
+	if len(comments) != 3 || comments[0].Description != "Please take a look" || comments[1].Description != "Typo" {
+		t.Errorf("Unexpected comments: %v", comments)
+	}
+	if _, err := reader.readTransactionComment("PHID-XACT-unknown"); err == nil {
+		t.Error("Failed to report an unknown transaction comment")
+	}
+}
+
+func TestReadLatestTransactionsThroughConduit(t *testing.T) {
+	// transaction.search returns the newest transactions first.
+	pages := map[string]string{
+		"":  `{"response": {"data": [{"id": 5, "phid": "PHID-XACT-5", "type": "title", "fields": []}, {"id": 4, "phid": "PHID-XACT-4", "type": "comment", "fields": []}], "cursor": {"after": "4"}}}`,
+		"4": `{"response": {"data": [{"id": 3, "phid": "PHID-XACT-3", "type": "accept", "fields": []}, {"id": 2, "phid": "PHID-XACT-2", "type": "comment", "fields": []}], "cursor": {"after": "2"}}}`,
+		"2": `{"response": {"data": [{"id": 1, "phid": "PHID-XACT-1", "type": "comment", "fields": []}], "cursor": {"after": null}}}`,
+	}
+	originalCallConduit := callConduit
+	defer func() { callConduit = originalCallConduit }()
+	calls := 0
+	callConduit = func(config Config, method string, request interface{}, response interface{}) {
+		calls++
+		if err := json.Unmarshal([]byte(pages[request.(transactionSearchRequest).After]), response); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	transactions, err := newConduitTransactionReader(Config{}).readTransactions("PHID-DREV-1")
+	if err != nil || len(transactions) != 4 || transactions[0].PHID != "PHID-XACT-1" || calls != 3 {
+		t.Errorf("Unexpected transactions: %v, %v, after %d calls", transactions, err, calls)
+	}
+
+	// Only one more than the latest transaction is read, and the title change does not count.
+	calls = 0
+	transactions, err = newConduitTransactionReader(Config{MaxTransactions: 1}).readTransactions("PHID-DREV-1")
+	if err != nil || len(transactions) != 2 || transactions[0].PHID != "PHID-XACT-3" || transactions[1].PHID != "PHID-XACT-4" || calls != 2 {
+		t.Errorf("Unexpected latest transactions: %v, %v, after %d calls", transactions, err, calls)
+	}
+}
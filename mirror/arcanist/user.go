@@ -18,6 +18,7 @@ package arcanist
 
 import (
 	"fmt"
+	"sync"
 	"time"
 )
 
@@ -34,6 +35,14 @@ type user struct {
 	Email    string `json:"primaryEmail,omitempty"`
 }
 
+// identity returns how the user is identified in git-notes, which is by their email if known.
+func (u user) identity() string {
+	if u.Email != "" {
+		return u.Email
+	}
+	return u.UserName
+}
+
 type cachedUser struct {
 	User *user
 	Time time.Time
@@ -51,6 +60,10 @@ type whoAmIResponse struct {
 	Response     user   `json:"response,omitempty"`
 }
 
+// userCacheMutex guards the user caches and their expiry, as the users may be looked up while
+// mirroring multiple repos at the same time.
+var userCacheMutex sync.Mutex
+
 var userQueryCache = make(map[string]cachedUser)
 var userLookupCache = make(map[string]cachedUser)
 
@@ -59,16 +72,42 @@ var userLookupCache = make(map[string]cachedUser)
 // reasonable limit, so we are just starting with 5 minutes as an initial value.
 var userCacheDuration = -(time.Minute * 5)
 
+// missingUserCacheDuration limits how long we remember that there is no user for a key, so
+// that an account created in Phabricator after the lookup is found soon afterwards. We still
+// cache those results, as e.g. the authors of comments from outside of Phabricator would
+// otherwise be looked up again for every one of their comments.
+const missingUserCacheDuration = -time.Minute
+
+// SetUserCacheTTL sets how long the details of Phabricator users, including the mirror's own
+// account, are cached before being looked up again.
+func SetUserCacheTTL(ttl time.Duration) {
+	userCacheMutex.Lock()
+	defer userCacheMutex.Unlock()
+	userCacheDuration = -ttl
+}
+
+// userCacheLookup returns the user cached under the given key in the given cache, or looks
+// it up with the given function and caches it, if it is not cached or has expired.
+//
+// The lock on the cache is not held while looking up the user, so concurrent lookups of the
+// same key may both call the function.
 func userCacheLookup(key string, cache map[string]cachedUser, f func() (*user, error)) (*user, error) {
-	if cachedValue, ok := cache[key]; ok {
-		if cachedValue.Time.After(time.Now().Add(userCacheDuration)) {
-			return cachedValue.User, nil
-		}
+	userCacheMutex.Lock()
+	cachedValue, ok := cache[key]
+	duration := userCacheDuration
+	userCacheMutex.Unlock()
+	if ok && cachedValue.User == nil && duration < missingUserCacheDuration {
+		duration = missingUserCacheDuration
+	}
+	if ok && cachedValue.Time.After(time.Now().Add(duration)) {
+		return cachedValue.User, nil
 	}
 	result, err := f()
 	if err != nil {
 		return result, err
 	}
+	userCacheMutex.Lock()
+	defer userCacheMutex.Unlock()
 	cache[key] = cachedUser{
 		User: result,
 		Time: time.Now(),
@@ -76,22 +115,29 @@ func userCacheLookup(key string, cache map[string]cachedUser, f func() (*user, e
 	return result, nil
 }
 
+// userCacheKey returns the key under which the user with the given key is cached, for the
+// Phabricator install that the config connects to. The same name or PHID may be a different
+// user on a different install.
+func (config Config) userCacheKey(key string) string {
+	return config.conduitURI() + " " + key
+}
+
 // queryUser returns the Phabricator user with the given name, or nil if there is none.
 //
 // Since we do not know if the name is an email address or a username, we first try
 // to find a user whose email matches the name, and then fall back to a username
 // search if that fails.
-func queryUser(name string) (*user, error) {
-	return userCacheLookup(name, userQueryCache, func() (*user, error) {
+func (config Config) queryUser(name string) (*user, error) {
+	return userCacheLookup(config.userCacheKey(name), userQueryCache, func() (*user, error) {
 		emailQueryRequest := userQueryRequest{Emails: []string{name}}
 		var queryResponse userQueryResponse
-		runArcCommandOrDie("user.query", emailQueryRequest, &queryResponse)
+		config.runArcCommandOrDie("user.query", emailQueryRequest, &queryResponse)
 		if queryResponse.Error != "" {
 			return nil, fmt.Errorf("Failed to query the Phabricator users: %s", queryResponse.ErrorMessage)
 		}
 		if len(queryResponse.Response) == 0 {
 			usernameQueryRequest := userQueryRequest{UserNames: []string{name}}
-			runArcCommandOrDie("user.query", usernameQueryRequest, &queryResponse)
+			config.runArcCommandOrDie("user.query", usernameQueryRequest, &queryResponse)
 			if queryResponse.Error != "" {
 				return nil, fmt.Errorf("Failed to query the Phabricator users: %s", queryResponse.ErrorMessage)
 			}
@@ -106,11 +152,11 @@ func queryUser(name string) (*user, error) {
 type UserLookup func(userPHID string) (*user, error)
 
 // lookupUser reads the Phabricator user given the corresponding unique ID.
-func lookupUser(userPHID string) (*user, error) {
-	return userCacheLookup(userPHID, userLookupCache, func() (*user, error) {
+func (config Config) lookupUser(userPHID string) (*user, error) {
+	return userCacheLookup(config.userCacheKey(userPHID), userLookupCache, func() (*user, error) {
 		queryRequest := userQueryRequest{IDs: []string{userPHID}}
 		var queryResponse userQueryResponse
-		runArcCommandOrDie("user.query", queryRequest, &queryResponse)
+		config.runArcCommandOrDie("user.query", queryRequest, &queryResponse)
 		if queryResponse.Error != "" {
 			return nil, fmt.Errorf("Failed to query the Phabricator users: %s", queryResponse.ErrorMessage)
 		}
@@ -121,18 +167,25 @@ func lookupUser(userPHID string) (*user, error) {
 	})
 }
 
-var mirrorUser *user = nil
+// mirrorUserCache holds the Phabricator user for the mirroring tool, under the cache key for the
+// empty string of each Phabricator install.
+//
+// This expires like the other cached users, so that changes to the mirror's account (e.g.
+// migrating it to a new email address) are picked up without a restart.
+var mirrorUserCache = make(map[string]cachedUser)
 
 // whoAmI returns the Phabricator user for the mirroring tool.
-func whoAmI() (user, error) {
-	if mirrorUser != nil {
-		return *mirrorUser, nil
-	}
-	var response whoAmIResponse
-	runArcCommandOrDie("user.whoami", struct{}{}, &response)
-	if response.Error != "" {
-		return user{}, fmt.Errorf("Failed to lookup the current user: %s", response.ErrorMessage)
+func (config Config) whoAmI() (user, error) {
+	mirrorUser, err := userCacheLookup(config.userCacheKey(""), mirrorUserCache, func() (*user, error) {
+		var response whoAmIResponse
+		config.runArcCommandOrDie("user.whoami", struct{}{}, &response)
+		if response.Error != "" {
+			return nil, fmt.Errorf("Failed to lookup the current user: %s", response.ErrorMessage)
+		}
+		return &response.Response, nil
+	})
+	if err != nil {
+		return user{}, err
 	}
-	mirrorUser = &response.Response
 	return *mirrorUser, nil
 }
@@ -0,0 +1,128 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package arcanist
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUserCacheExpiry(t *testing.T) {
+	defer SetUserCacheTTL(5 * time.Minute)
+	cache := make(map[string]cachedUser)
+	lookups := 0
+	lookup := func() (*user, error) {
+		lookups++
+		return &user{PHID: "PHID-USER-mirror"}, nil
+	}
+
+	SetUserCacheTTL(time.Hour)
+	userCacheLookup("", cache, lookup)
+	userCacheLookup("", cache, lookup)
+	if lookups != 1 {
+		t.Errorf("Unexpected number of lookups of a cached user: %d", lookups)
+	}
+
+	SetUserCacheTTL(0)
+	userCacheLookup("", cache, lookup)
+	if lookups != 2 {
+		t.Errorf("An expired user was not looked up again: %d", lookups)
+	}
+}
+
+func TestMissingUserCacheExpiry(t *testing.T) {
+	defer SetUserCacheTTL(5 * time.Minute)
+	SetUserCacheTTL(time.Hour)
+	cache := map[string]cachedUser{
+		"missing@example.com": cachedUser{Time: time.Now().Add(2 * missingUserCacheDuration)},
+		"found@example.com":   cachedUser{User: &user{PHID: "PHID-USER-found"}, Time: time.Now().Add(2 * missingUserCacheDuration)},
+	}
+	lookups := 0
+	lookup := func() (*user, error) {
+		lookups++
+		return nil, nil
+	}
+	if u, _ := userCacheLookup("found@example.com", cache, lookup); u == nil || lookups != 0 {
+		t.Errorf("A cached user was looked up again: %v, %d", u, lookups)
+	}
+	userCacheLookup("missing@example.com", cache, lookup)
+	if lookups != 1 {
+		t.Errorf("A missing user was not looked up again after %v: %d", -missingUserCacheDuration, lookups)
+	}
+}
+
+func TestUserCacheKey(t *testing.T) {
+	defer UseConnection(Config{})
+	UseConnection(Config{})
+	first := Config{ConduitURI: "https://first.example.com/api/"}
+	second := Config{ConduitURI: "https://second.example.com/api/"}
+	if first.userCacheKey("PHID-USER-1") == second.userCacheKey("PHID-USER-1") {
+		t.Error("The users of different Phabricator installs are cached under the same key")
+	}
+	if (Config{}).userCacheKey("PHID-USER-1") == first.userCacheKey("PHID-USER-1") {
+		t.Error("The users of the default install are cached under the key for another install")
+	}
+}
+
+// TestUserCacheConcurrently is meant to be run with "-race", to check that the user caches are
+// safe to use while mirroring multiple repos at the same time.
+func TestUserCacheConcurrently(t *testing.T) {
+	defer SetUserCacheTTL(5 * time.Minute)
+	userCacheMutex.Lock()
+	originalQueryCache, originalLookupCache := userQueryCache, userLookupCache
+	userQueryCache, userLookupCache = make(map[string]cachedUser), make(map[string]cachedUser)
+	defer func() {
+		userCacheMutex.Lock()
+		defer userCacheMutex.Unlock()
+		userQueryCache, userLookupCache = originalQueryCache, originalLookupCache
+	}()
+	for i := 0; i < 10; i++ {
+		phid := fmt.Sprintf("PHID-USER-%d", i)
+		email := fmt.Sprintf("user%d@example.com", i)
+		userLookupCache[Config{}.userCacheKey(phid)] = cachedUser{User: &user{PHID: phid, Email: email}, Time: time.Now()}
+		userQueryCache[Config{}.userCacheKey(email)] = cachedUser{User: &user{PHID: phid, Email: email}, Time: time.Now()}
+	}
+	userCacheMutex.Unlock()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				phid := fmt.Sprintf("PHID-USER-%d", i%10)
+				if u, err := (Config{}).lookupUser(phid); err != nil || u == nil || u.PHID != phid {
+					t.Errorf("Unexpected user for %s: %v, %v", phid, u, err)
+				}
+				email := fmt.Sprintf("user%d@example.com", i%10)
+				if u, err := (Config{}).queryUser(email); err != nil || u == nil || u.Email != email {
+					t.Errorf("Unexpected user for %s: %v, %v", email, u, err)
+				}
+				key := fmt.Sprintf("new%d-%d", g, i)
+				userCacheLookup(key, userQueryCache, func() (*user, error) {
+					return &user{PHID: key}, nil
+				})
+				if i%25 == 0 {
+					SetUserCacheTTL(time.Hour)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+}
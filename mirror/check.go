@@ -0,0 +1,116 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/git-appraise/repository"
+	"github.com/google/git-appraise/review"
+	"github.com/google/git-appraise/review/comment"
+	review_utils "github.com/google/git-phabricator-mirror/mirror/review"
+	"strings"
+)
+
+// Divergence describes a way in which a review differs between git-notes and Phabricator.
+type Divergence struct {
+	// Revision is the first commit of the review.
+	Revision string
+	// Description explains what differs.
+	Description string
+}
+
+func (d Divergence) String() string {
+	return fmt.Sprintf("%s: %s", d.Revision, d.Description)
+}
+
+// flattenThreads returns every comment in the given threads, including the replies.
+func flattenThreads(threads []review.CommentThread) []comment.Comment {
+	var comments []comment.Comment
+	for _, thread := range threads {
+		comments = append(comments, thread.Comment)
+		comments = append(comments, flattenThreads(thread.Children)...)
+	}
+	return comments
+}
+
+// describeComment returns a short, single line description of the given comment.
+func describeComment(c comment.Comment) string {
+	description := strings.SplitN(c.Description, "\n", 2)[0]
+	if c.Location != nil && c.Location.Path != "" {
+		return fmt.Sprintf("%s on %s: %q", c.Author, c.Location.Path, description)
+	}
+	return fmt.Sprintf("%s: %q", c.Author, description)
+}
+
+// findDivergences compares the reviews of the given repo in git-notes with their revisions in
+// the given review tool, and returns the differences between the two.
+//
+// Nothing is written to either side, so this is safe to run alongside the mirror.
+func findDivergences(repo repository.Repo, tool review_utils.Tool) ([]Divergence, error) {
+	var divergences []Divergence
+	openRevisions := make(map[string]bool)
+	for _, phabricatorReview := range tool.ListOpenReviews(repo) {
+		reviewCommit := phabricatorReview.GetFirstCommit(repo)
+		if reviewCommit == "" {
+			// The revision is not for this repo.
+			continue
+		}
+		openRevisions[reviewCommit] = true
+		r, err := review.GetSummary(repo, reviewCommit)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read the review of %s: %v", reviewCommit, err)
+		} else if r == nil {
+			divergences = append(divergences, Divergence{reviewCommit, "open in Phabricator, but missing from git-notes"})
+			continue
+		}
+		if r.Submitted {
+			divergences = append(divergences, Divergence{reviewCommit, "submitted in git-notes, but still open in Phabricator"})
+		}
+		for _, c := range phabricatorReview.LoadComments() {
+			if !hasOverlap(c, r.Comments) {
+				divergences = append(divergences, Divergence{reviewCommit, "comment missing from git-notes by " + describeComment(c)})
+			}
+		}
+		phabricatorComments := phabricatorReview.LoadAllComments()
+		for _, c := range flattenThreads(r.Comments) {
+			found := false
+			for _, other := range phabricatorComments {
+				if review_utils.Overlaps(other, c) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				divergences = append(divergences, Divergence{reviewCommit, "comment missing from Phabricator by " + describeComment(c)})
+			}
+		}
+	}
+	for _, r := range review.ListOpen(repo) {
+		if !openRevisions[r.Revision] {
+			divergences = append(divergences, Divergence{r.Revision, "open in git-notes, but has no open revision in Phabricator"})
+		}
+	}
+	return divergences, nil
+}
+
+// Check compares the reviews of the given repo in git-notes with their revisions in Phabricator,
+// and returns the differences between the two, without fixing any of them.
+func Check(repo repository.Repo, config Config) ([]Divergence, error) {
+	repo, arc := setUp(context.Background(), repo, config)
+	return findDivergences(repo, arc)
+}
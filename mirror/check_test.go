@@ -0,0 +1,106 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mirror
+
+import (
+	"github.com/google/git-appraise/repository"
+	"github.com/google/git-appraise/review"
+	"github.com/google/git-appraise/review/comment"
+	phabricatorReview "github.com/google/git-phabricator-mirror/mirror/review"
+	"strings"
+	"testing"
+)
+
+// openReviewsTool is a review_utils.Tool that lists the given reviews as open, and changes nothing.
+type openReviewsTool []phabricatorReview.PhabricatorReview
+
+func (tool openReviewsTool) EnsureRequestExists(repo repository.Repo, r review.Review) {}
+
+func (tool openReviewsTool) ListOpenReviews(repo repository.Repo) []phabricatorReview.PhabricatorReview {
+	return tool
+}
+
+func (tool openReviewsTool) Refresh(repo repository.Repo) {}
+
+// mirroredTool returns an openReviewsTool that lists each open review of the given repo with its
+// comments, as if they had all been mirrored, along with any extra comments given for it.
+func mirroredTool(repo repository.Repo, extraComments map[string][]comment.Comment) openReviewsTool {
+	var tool openReviewsTool
+	for _, r := range review.ListOpen(repo) {
+		comments := append(flattenThreads(r.Comments), extraComments[r.Revision]...)
+		tool = append(tool, mockOpenReview{r.Revision, comments})
+	}
+	return tool
+}
+
+func TestFindDivergences(t *testing.T) {
+	resetMirrorState()
+	defer resetMirrorState()
+	repo := repository.NewMockRepoForTest()
+	open := findOpenReview(t, repo)
+	if divergences, err := findDivergences(repo, mirroredTool(repo, nil)); err != nil || len(divergences) != 0 {
+		t.Fatalf("Unexpected divergences for fully mirrored reviews: %v, %v", divergences, err)
+	}
+
+	phabricatorOnly := map[string][]comment.Comment{
+		open.Revision: {{
+			Timestamp:   "2",
+			Author:      "reviewer@example.com",
+			Description: "Only in Phabricator",
+		}},
+	}
+	tool := mirroredTool(repo, phabricatorOnly)
+	gitNote, err := comment.Comment{
+		Timestamp:   "3",
+		Author:      "author@example.com",
+		Description: "Only in git-notes",
+	}.Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.AppendNote(comment.Ref, open.Revision, gitNote); err != nil {
+		t.Fatal(err)
+	}
+	notesBefore := len(repo.GetNotes(comment.Ref, open.Revision))
+	divergences, err := findDivergences(repo, tool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(divergences) != 2 ||
+		!strings.Contains(divergences[0].Description, "Only in Phabricator") ||
+		!strings.Contains(divergences[1].Description, "Only in git-notes") {
+		t.Errorf("Unexpected divergences for the comments: %v", divergences)
+	}
+	if notes := repo.GetNotes(comment.Ref, open.Revision); len(notes) != notesBefore {
+		t.Errorf("Checking the repo wrote to its notes: %v", notes)
+	}
+
+	// Leave out the revision of the review, as if it were closed.
+	var closed openReviewsTool
+	for _, r := range tool {
+		if r.(mockOpenReview).revision != open.Revision {
+			closed = append(closed, r)
+		}
+	}
+	divergences, err = findDivergences(repo, closed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(divergences) != 1 || divergences[0].Revision != open.Revision {
+		t.Errorf("Unexpected divergences for the closed revision: %v", divergences)
+	}
+}
@@ -0,0 +1,319 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mirror
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/google/git-appraise/repository"
+	"github.com/google/git-appraise/review/analyses"
+	"github.com/google/git-appraise/review/ci"
+	"github.com/google/git-appraise/review/comment"
+	"github.com/google/git-appraise/review/request"
+	"github.com/google/git-phabricator-mirror/mirror/arcanist"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Config holds the mirror settings that are read from a configuration file.
+type Config struct {
+	// Arcanist holds the settings for how reviews are mirrored into Phabricator.
+	Arcanist arcanist.Config `json:"arcanist"`
+
+	// NoteBatchSize is the maximum number of comments that are written to a review's notes in a
+	// single git operation. If it is not set, then each comment is written separately.
+	NoteBatchSize int `json:"noteBatchSize,omitempty"`
+
+	// Repos holds settings that only apply to some of the mirrored repos.
+	//
+	// If multiple entries match a repo and set the same field, the first one wins.
+	Repos []RepoConfig `json:"repos,omitempty"`
+
+	// Callsigns, if non-empty, restricts mirroring to the repos with one of the listed
+	// Phabricator callsigns. Repos whose callsign cannot be determined are not mirrored.
+	Callsigns []string `json:"callsigns,omitempty"`
+}
+
+// RepoConfig holds the settings for the repos whose paths match Pattern.
+type RepoConfig struct {
+	// Pattern is matched against the repo's path using the syntax of filepath.Match.
+	//
+	// An empty pattern matches every repo.
+	Pattern string `json:"pattern"`
+
+	// SyncPeriod is the expected number of seconds between subsequent syncs of the repo.
+	SyncPeriod int `json:"syncPeriod,omitempty"`
+
+	// RequestRef is the notes ref from which to read review requests, if the repo
+	// does not use the standard git-appraise ref.
+	RequestRef string `json:"requestRef,omitempty"`
+
+	// Callsign is the Phabricator callsign of the repo. If it is not set, then the callsign
+	// is guessed from the repo's path.
+	Callsign string `json:"callsign,omitempty"`
+
+	// PullRefPattern restricts which notes refs are fetched from the remote when syncing.
+	// If it is not set, then every git-appraise notes ref ("refs/notes/devtools/*") is fetched.
+	PullRefPattern string `json:"pullRefPattern,omitempty"`
+
+	// PushRefs lists the notes refs that are pushed to the remote when syncing, either as full
+	// refs or relative to "refs/notes/devtools/" (e.g. "discuss"). If it is not set, then every
+	// git-appraise notes ref is pushed.
+	PushRefs []string `json:"pushRefs,omitempty"`
+
+	// MetadataRefs lists which of the git-appraise notes refs (for requests, comments, CI
+	// results, and static analyses) are read as review metadata, either as full refs or relative
+	// to "refs/notes/devtools/" (e.g. "reviews"). The others are ignored, as if they were empty.
+	// If it is not set, then all of them are read.
+	MetadataRefs []string `json:"metadataRefs,omitempty"`
+
+	// DefaultTargetRef is the ref (or branch name) into which reviews are merged when their
+	// requests do not specify a target ref, for repos whose main branch is not the default.
+	DefaultTargetRef string `json:"defaultTargetRef,omitempty"`
+
+	// MinReviewAge is the number of seconds that must pass after the latest commit of a review
+	// before it is mirrored, so that a series of pushes is mirrored as a single update.
+	MinReviewAge int `json:"minReviewAge,omitempty"`
+
+	// MaxReviewsPerPass is the maximum number of reviews that are mirrored in each direction
+	// during a single pass over the repo, so that a burst of new reviews in one repo does not
+	// hold up the others. The remaining reviews are mirrored in later passes, in a round-robin.
+	MaxReviewsPerPass int `json:"maxReviewsPerPass,omitempty"`
+}
+
+// ReadConfig reads the JSON-encoded config stored in the given file, and validates its settings.
+func ReadConfig(path string) (Config, error) {
+	var config Config
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	if err := json.Unmarshal(bytes, &config); err != nil {
+		return config, err
+	}
+	return config, config.Arcanist.Validate()
+}
+
+// matchingRepos returns the entries in config.Repos that apply to the repo at the given path.
+func (config Config) matchingRepos(repoPath string) []RepoConfig {
+	var matches []RepoConfig
+	for _, repoConfig := range config.Repos {
+		if repoConfig.Pattern == "" {
+			matches = append(matches, repoConfig)
+		} else if matched, err := filepath.Match(repoConfig.Pattern, repoPath); err == nil && matched {
+			matches = append(matches, repoConfig)
+		}
+	}
+	return matches
+}
+
+// SyncPeriod returns the expected time between subsequent syncs of the repo at the given path.
+//
+// Repos without an explicit sync period use the given default.
+func (config Config) SyncPeriod(repoPath string, defaultPeriod time.Duration) time.Duration {
+	for _, repoConfig := range config.matchingRepos(repoPath) {
+		if repoConfig.SyncPeriod > 0 {
+			return time.Duration(repoConfig.SyncPeriod) * time.Second
+		}
+	}
+	return defaultPeriod
+}
+
+// ShortestSyncPeriod returns the shortest sync period of any repo.
+//
+// This is how often we need to check for repos that are due to be synced.
+func (config Config) ShortestSyncPeriod(defaultPeriod time.Duration) time.Duration {
+	shortest := defaultPeriod
+	for _, repoConfig := range config.Repos {
+		period := time.Duration(repoConfig.SyncPeriod) * time.Second
+		if period > 0 && period < shortest {
+			shortest = period
+		}
+	}
+	return shortest
+}
+
+// notesRefs returns the mapping from the standard git-appraise notes refs to the custom
+// refs that replace them for the repo at the given path.
+func (config Config) notesRefs(repoPath string) map[string]string {
+	refs := make(map[string]string)
+	for _, repoConfig := range config.matchingRepos(repoPath) {
+		if _, ok := refs[request.Ref]; !ok && repoConfig.RequestRef != "" {
+			refs[request.Ref] = repoConfig.RequestRef
+		}
+	}
+	return refs
+}
+
+// pullRefPattern returns the pattern of the notes refs to fetch when syncing the repo at the given path.
+func (config Config) pullRefPattern(repoPath string) string {
+	for _, repoConfig := range config.matchingRepos(repoPath) {
+		if repoConfig.PullRefPattern != "" {
+			return repoConfig.PullRefPattern
+		}
+	}
+	return defaultNotesRefPattern
+}
+
+// pushRefPatterns returns the patterns of the notes refs to push when syncing the repo at the given path.
+func (config Config) pushRefPatterns(repoPath string) []string {
+	for _, repoConfig := range config.matchingRepos(repoPath) {
+		if len(repoConfig.PushRefs) == 0 {
+			continue
+		}
+		var patterns []string
+		for _, ref := range repoConfig.PushRefs {
+			if !strings.HasPrefix(ref, "refs/") {
+				ref = notesRefPrefix + ref
+			}
+			patterns = append(patterns, ref)
+		}
+		return patterns
+	}
+	return []string{defaultNotesRefPattern}
+}
+
+// metadataRefs are the git-appraise notes refs that hold review metadata.
+var metadataRefs = []string{request.Ref, comment.Ref, ci.Ref, analyses.Ref}
+
+// ignoredMetadataRefs returns the git-appraise notes refs that should not be read as review
+// metadata in the repo at the given path, or nil if all of them should be.
+func (config Config) ignoredMetadataRefs(repoPath string) map[string]bool {
+	for _, repoConfig := range config.matchingRepos(repoPath) {
+		if len(repoConfig.MetadataRefs) == 0 {
+			continue
+		}
+		read := make(map[string]bool)
+		for _, ref := range repoConfig.MetadataRefs {
+			if !strings.HasPrefix(ref, "refs/") {
+				ref = notesRefPrefix + ref
+			}
+			read[ref] = true
+		}
+		ignored := make(map[string]bool)
+		for _, ref := range metadataRefs {
+			if !read[ref] {
+				ignored[ref] = true
+			}
+		}
+		return ignored
+	}
+	return nil
+}
+
+// minReviewAge returns how old the latest commit of a review in the repo at the given path must be for it to be mirrored.
+func (config Config) minReviewAge(repoPath string) time.Duration {
+	for _, repoConfig := range config.matchingRepos(repoPath) {
+		if repoConfig.MinReviewAge > 0 {
+			return time.Duration(repoConfig.MinReviewAge) * time.Second
+		}
+	}
+	return 0
+}
+
+// maxReviewsPerPass returns the maximum number of reviews to mirror in each direction during a
+// pass over the repo at the given path, or zero if there is no maximum.
+func (config Config) maxReviewsPerPass(repoPath string) int {
+	for _, repoConfig := range config.matchingRepos(repoPath) {
+		if repoConfig.MaxReviewsPerPass > 0 {
+			return repoConfig.MaxReviewsPerPass
+		}
+	}
+	return 0
+}
+
+// defaultTargetRef returns the target ref to use for review requests without one in the repo at
+// the given path, or the empty string if the requests should be left as is.
+func (config Config) defaultTargetRef(repoPath string) string {
+	for _, repoConfig := range config.matchingRepos(repoPath) {
+		if repoConfig.DefaultTargetRef != "" {
+			return repoConfig.DefaultTargetRef
+		}
+	}
+	return ""
+}
+
+// explicitCallsign returns the Phabricator callsign set for the repo at the given path, or the
+// empty string if there is none.
+func (config Config) explicitCallsign(repoPath string) string {
+	for _, repoConfig := range config.matchingRepos(repoPath) {
+		if repoConfig.Callsign != "" {
+			return repoConfig.Callsign
+		}
+	}
+	return ""
+}
+
+// Callsign returns the Phabricator callsign of the given repo, or the empty string if it cannot
+// be determined. It is found the same way as when the repo is mirrored, which may look it up in
+// Phabricator by the repo's remote URL.
+func (config Config) Callsign(repo repository.Repo) string {
+	repo, arc := setUp(context.Background(), repo, config)
+	return arc.RepoCallsign(repo)
+}
+
+// IsAllowed reports whether or not the given repo should be mirrored.
+func (config Config) IsAllowed(repo repository.Repo) bool {
+	repo, arc := setUp(context.Background(), repo, config)
+	return config.allows(repo, arc)
+}
+
+// allows reports whether or not the given repo, set up with the given Arcanist, should be mirrored.
+func (config Config) allows(repo repository.Repo, arc arcanist.Arcanist) bool {
+	if len(config.Callsigns) == 0 {
+		return true
+	}
+	callsign := arc.RepoCallsign(repo)
+	for _, allowed := range config.Callsigns {
+		if callsign != "" && callsign == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// environmentPrefix starts the names of the environment variables that override config settings.
+const environmentPrefix = "GPM_"
+
+// ApplyEnvironment overrides the settings in the given config with those set in the environment,
+// as read by the given lookup function (e.g. os.LookupEnv).
+//
+// This is mainly for injecting credentials, so that they appear in neither the config file
+// nor the command line. The supported variables are GPM_CONDUIT_URI, GPM_CONDUIT_TOKEN,
+// GPM_MYSQL_HOST, GPM_MYSQL_USER, and GPM_MYSQL_PASSWORD.
+func ApplyEnvironment(config *Config, lookupEnv func(name string) (string, bool)) {
+	settings := map[string]*string{
+		"CONDUIT_URI":    &config.Arcanist.ConduitURI,
+		"CONDUIT_TOKEN":  &config.Arcanist.ConduitToken,
+		"MYSQL_HOST":     &config.Arcanist.MySQLHost,
+		"MYSQL_USER":     &config.Arcanist.MySQLUser,
+		"MYSQL_PASSWORD": &config.Arcanist.MySQLPassword,
+	}
+	for name, setting := range settings {
+		if value, ok := lookupEnv(environmentPrefix + name); ok {
+			*setting = value
+		}
+	}
+}
+
+// FlagEnvironmentVariable returns the name of the environment variable that sets the default
+// value of the command line flag with the given name, e.g. GPM_SYNC_PERIOD for "sync_period".
+func FlagEnvironmentVariable(flagName string) string {
+	return environmentPrefix + strings.ToUpper(flagName)
+}
@@ -0,0 +1,192 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mirror
+
+import (
+	"github.com/google/git-appraise/repository"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReadConfig(t *testing.T) {
+	for contents, valid := range map[string]bool{
+		`{"arcanist": {"mergedAction": "close-with-comment"}}`:                      true,
+		`{"arcanist": {"mergedAction": "tag", "mergedProject": "#landed"}}`:         true,
+		`{"arcanist": {"mergedAction": "tag"}}`:                                     false,
+		`{"arcanist": {"mergedAction": "abandon"}}`:                                 false,
+		`{"arcanist": {"mergedAction": "close"}, "repos": [{"pattern": "/var/*"}]}`: true,
+	} {
+		file, err := ioutil.TempFile("", "git-phabricator-mirror-config")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(file.Name())
+		if _, err := file.WriteString(contents); err != nil {
+			t.Fatal(err)
+		}
+		file.Close()
+		if _, err := ReadConfig(file.Name()); (err == nil) != valid {
+			t.Errorf("Unexpected result for the config %s: %v", contents, err)
+		}
+	}
+}
+
+func TestSyncPeriod(t *testing.T) {
+	config := Config{
+		Repos: []RepoConfig{
+			RepoConfig{Pattern: "/var/repo/HOT*", SyncPeriod: 5},
+			RepoConfig{Pattern: "/var/repo/ARCHIVE", SyncPeriod: 3600},
+			RepoConfig{Pattern: "/var/repo/*", SyncPeriod: 10},
+		},
+	}
+	defaultPeriod := 30 * time.Second
+	if period := config.SyncPeriod("/var/repo/HOTREPO", defaultPeriod); period != 5*time.Second {
+		t.Errorf("Unexpected sync period for a hot repo: %v", period)
+	}
+	if period := config.SyncPeriod("/var/repo/ARCHIVE", defaultPeriod); period != time.Hour {
+		t.Errorf("Unexpected sync period for an archived repo: %v", period)
+	}
+	if period := config.SyncPeriod("/var/repo/OTHER", defaultPeriod); period != 10*time.Second {
+		t.Errorf("Unexpected sync period for a pattern-matched repo: %v", period)
+	}
+	if period := config.SyncPeriod("/home/repo", defaultPeriod); period != defaultPeriod {
+		t.Errorf("Unexpected sync period for an unconfigured repo: %v", period)
+	}
+	if period := config.ShortestSyncPeriod(defaultPeriod); period != 5*time.Second {
+		t.Errorf("Unexpected shortest sync period: %v", period)
+	}
+}
+
+func TestCallsignAllowlist(t *testing.T) {
+	defer useRemoteURLs(map[string]string{"/home/user/server": "https://git.example.com/backend"})()
+	config := Config{
+		Repos: []RepoConfig{
+			RepoConfig{Pattern: "/home/*/frontend", Callsign: "FE"},
+		},
+		Callsigns: []string{"FE", "BE"},
+	}
+	config.Arcanist.RemoteCallsigns = map[string]string{"https://git.example.com/backend": "BE"}
+	repo := func(path string) repository.Repo {
+		return pathRepo{repository.NewMockRepoForTest(), path}
+	}
+	if !config.IsAllowed(repo("/home/user/frontend")) {
+		t.Error("A repo with an explicitly configured callsign was not allowed")
+	}
+	if !config.IsAllowed(repo("/var/repo/BE")) {
+		t.Error("A repo with a guessed callsign was not allowed")
+	}
+	if !config.IsAllowed(repo("/home/user/server")) {
+		t.Error("A repo with a callsign mapped from its remote URL was not allowed")
+	}
+	if callsign := config.Callsign(repo("/home/user/server")); callsign != "BE" {
+		t.Errorf("Unexpected callsign for a repo with a mapped remote URL: %q", callsign)
+	}
+	if config.IsAllowed(repo("/var/repo/OTHER")) {
+		t.Error("A repo that is not in the allowlist was allowed")
+	}
+	if config.IsAllowed(repo("/home/user/backend")) {
+		t.Error("A repo with an unknown callsign was allowed")
+	}
+	if !(Config{}).IsAllowed(repo("/home/user/backend")) {
+		t.Error("A repo was not allowed despite there being no allowlist")
+	}
+}
+
+func TestPullRefPattern(t *testing.T) {
+	config := Config{
+		Repos: []RepoConfig{
+			RepoConfig{Pattern: "/var/repo/SHARED", PullRefPattern: "refs/notes/devtools/discuss"},
+		},
+	}
+	if pattern := config.pullRefPattern("/var/repo/SHARED"); pattern != "refs/notes/devtools/discuss" {
+		t.Errorf("Unexpected pull pattern for a configured repo: %q", pattern)
+	}
+	if pattern := config.pullRefPattern("/var/repo/OTHER"); pattern != defaultNotesRefPattern {
+		t.Errorf("Unexpected pull pattern for an unconfigured repo: %q", pattern)
+	}
+}
+
+func TestPushRefPatterns(t *testing.T) {
+	config := Config{
+		Repos: []RepoConfig{
+			RepoConfig{Pattern: "/var/repo/SHARED", PushRefs: []string{"discuss", "refs/notes/devtools/reviews"}},
+		},
+	}
+	patterns := config.pushRefPatterns("/var/repo/SHARED")
+	if !reflect.DeepEqual(patterns, []string{"refs/notes/devtools/discuss", "refs/notes/devtools/reviews"}) {
+		t.Errorf("Unexpected push patterns for a configured repo: %q", patterns)
+	}
+	patterns = config.pushRefPatterns("/var/repo/OTHER")
+	if !reflect.DeepEqual(patterns, []string{defaultNotesRefPattern}) {
+		t.Errorf("Unexpected push patterns for an unconfigured repo: %q", patterns)
+	}
+}
+
+func TestIgnoredMetadataRefs(t *testing.T) {
+	config := Config{
+		Repos: []RepoConfig{
+			RepoConfig{Pattern: "/var/repo/SHARED", MetadataRefs: []string{"reviews", "refs/notes/devtools/discuss"}},
+		},
+	}
+	ignored := config.ignoredMetadataRefs("/var/repo/SHARED")
+	if !reflect.DeepEqual(ignored, map[string]bool{"refs/notes/devtools/ci": true, "refs/notes/devtools/analyses": true}) {
+		t.Errorf("Unexpected ignored refs for a configured repo: %v", ignored)
+	}
+	if ignored := config.ignoredMetadataRefs("/var/repo/OTHER"); len(ignored) != 0 {
+		t.Errorf("Unexpected ignored refs for an unconfigured repo: %v", ignored)
+	}
+}
+
+func TestDefaultTargetRef(t *testing.T) {
+	config := Config{
+		Repos: []RepoConfig{
+			RepoConfig{Pattern: "/var/repo/DEV", DefaultTargetRef: "develop"},
+		},
+	}
+	if ref := config.defaultTargetRef("/var/repo/DEV"); ref != "develop" {
+		t.Errorf("Unexpected default target ref for a configured repo: %q", ref)
+	}
+	if ref := config.defaultTargetRef("/var/repo/OTHER"); ref != "" {
+		t.Errorf("Unexpected default target ref for an unconfigured repo: %q", ref)
+	}
+}
+
+func TestApplyEnvironment(t *testing.T) {
+	config := Config{}
+	config.Arcanist.MySQLUser = "from-file"
+	config.Arcanist.MySQLHost = "db.example.com"
+	env := map[string]string{
+		"GPM_MYSQL_USER":     "from-env",
+		"GPM_MYSQL_PASSWORD": "secret",
+	}
+	ApplyEnvironment(&config, func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	})
+	if config.Arcanist.MySQLUser != "from-env" || config.Arcanist.MySQLPassword != "secret" {
+		t.Errorf("The environment did not override the config: %+v", config.Arcanist)
+	}
+	if config.Arcanist.MySQLHost != "db.example.com" {
+		t.Errorf("A setting missing from the environment was overridden: %q", config.Arcanist.MySQLHost)
+	}
+	if name := FlagEnvironmentVariable("sync_period"); name != "GPM_SYNC_PERIOD" {
+		t.Errorf("Unexpected environment variable for a flag: %q", name)
+	}
+}
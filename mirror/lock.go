@@ -0,0 +1,119 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mirror
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// lockFileName is the name of the file, in the git directory of each repo, that is locked while
+// the repo is being processed.
+const lockFileName = "git-phabricator-mirror.lock"
+
+// lockRetryInterval is how long we wait between attempts to lock the lock file of a repo that
+// another process is holding.
+const lockRetryInterval = 100 * time.Millisecond
+
+var (
+	repoLocksMutex sync.Mutex
+	// repoLocks maps from the path of each repo to a semaphore that is held while the repo is
+	// being processed, so that (e.g.) a pass of the polling loop and an on-demand sync of the
+	// same repo cannot both create its diffs or append to its notes.
+	repoLocks = make(map[string]chan struct{})
+)
+
+// repoLock returns the semaphore for the repo at the given path.
+func repoLock(path string) chan struct{} {
+	repoLocksMutex.Lock()
+	defer repoLocksMutex.Unlock()
+	lock, ok := repoLocks[path]
+	if !ok {
+		lock = make(chan struct{}, 1)
+		repoLocks[path] = lock
+	}
+	return lock
+}
+
+// lockFilePath returns the path of the lock file for the repo at the given path, which is in its
+// ".git" directory, or in the repo itself if it is bare. It is empty if the repo does not exist.
+func lockFilePath(path string) string {
+	gitDir := filepath.Join(path, ".git")
+	if info, err := os.Stat(gitDir); err == nil && info.IsDir() {
+		return filepath.Join(gitDir, lockFileName)
+	}
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		return filepath.Join(path, lockFileName)
+	}
+	return ""
+}
+
+// lockRepo waits until no one else is processing the repo at the given path, and returns
+// the function that must be called once we are done with it.
+//
+// This holds a lock on a file in the repo, as well as a lock within this process, so that other
+// processes (e.g. the "rebuild" command) wait for this one as well.
+//
+// If the given context is done before the repo could be locked, then this gives up, and returns
+// the context's error.
+func lockRepo(ctx context.Context, path string) (func(), error) {
+	lock := repoLock(path)
+	select {
+	case lock <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	lockFile := lockFilePath(path)
+	if lockFile == "" {
+		return func() { <-lock }, nil
+	}
+	file, err := os.OpenFile(lockFile, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		<-lock
+		return nil, err
+	}
+	if err := lockFileContext(ctx, file); err != nil {
+		file.Close()
+		<-lock
+		return nil, err
+	}
+	return func() {
+		// Closing the file releases the lock on it.
+		file.Close()
+		<-lock
+	}, nil
+}
+
+// lockFileContext takes an exclusive lock on the given file, retrying while another process
+// holds it, until the given context is done.
+func lockFileContext(ctx context.Context, file *os.File) error {
+	for {
+		err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err != syscall.EWOULDBLOCK {
+			return err
+		}
+		select {
+		case <-time.After(lockRetryInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,111 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mirror
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestLockRepoAcrossProcesses(t *testing.T) {
+	dir, err := ioutil.TempDir("", "repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(filepath.Join(dir, ".git"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	lockFile := lockFilePath(dir)
+	if lockFile != filepath.Join(dir, ".git", lockFileName) {
+		t.Errorf("Unexpected lock file: %q", lockFile)
+	}
+	// This stands in for another process, as separately opened files are locked independently.
+	other, err := os.OpenFile(lockFile, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Flock(int(other.Fd()), syscall.LOCK_EX); err != nil {
+		t.Fatal(err)
+	}
+	locked := make(chan func())
+	go func() {
+		unlock, err := lockRepo(context.Background(), dir)
+		if err != nil {
+			t.Error(err)
+		}
+		locked <- unlock
+	}()
+	select {
+	case <-locked:
+		t.Fatal("Locked a repo that another process was using")
+	case <-time.After(50 * time.Millisecond):
+	}
+	other.Close()
+	unlock := <-locked
+	if unlock != nil {
+		unlock()
+	}
+}
+
+func TestLockRepoStopsWhenCancelled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(filepath.Join(dir, ".git"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// This stands in for another process, as separately opened files are locked independently.
+	other, err := os.OpenFile(lockFilePath(dir), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if err := syscall.Flock(int(other.Fd()), syscall.LOCK_EX); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if unlock, err := lockRepo(ctx, dir); err != context.DeadlineExceeded {
+		t.Errorf("Unexpected result of locking a repo that another process was using: %v", err)
+		if unlock != nil {
+			unlock()
+		}
+	}
+
+	// The lock within this process is released when giving up, so that the repo can still be
+	// locked once the other process is done with it.
+	other.Close()
+	unlock, err := lockRepo(context.Background(), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Another goroutine of this process gives up on waiting for the lock within the process.
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := lockRepo(ctx, dir); err != context.DeadlineExceeded {
+		t.Errorf("Unexpected result of locking a repo that was already locked: %v", err)
+	}
+	unlock()
+}
@@ -0,0 +1,95 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package metrics defines the Prometheus metrics that describe the mirror's activity.
+//
+// The metrics are registered with the default Prometheus registry, from which they can be
+// served with promhttp.Handler.
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The results with which Conduit calls and SQL queries are labeled.
+const (
+	ResultSuccess = "success"
+	// ResultError is for Conduit calls that returned an error, e.g. for an invalid request, or
+	// that failed outright, e.g. by timing out or returning malformed output, and for SQL queries
+	// that failed, e.g. because the database could not be reached.
+	ResultError = "error"
+)
+
+// The directions in which comments are mirrored.
+const (
+	DirectionToPhabricator = "to-phabricator"
+	DirectionToGit         = "to-git"
+)
+
+// The actions with which revisions are closed.
+const (
+	ActionClosed    = "closed"
+	ActionAbandoned = "abandoned"
+)
+
+var (
+	// ConduitCalls counts the Conduit calls made through arc, by method and result.
+	ConduitCalls = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "git_phabricator_mirror_conduit_calls_total",
+		Help: "Number of Conduit calls made through arc, by method and result.",
+	}, []string{"method", "result"})
+
+	// SQLQueries counts the queries run against the Phabricator database, by result.
+	SQLQueries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "git_phabricator_mirror_sql_queries_total",
+		Help: "Number of queries run against the Phabricator database, by result.",
+	}, []string{"result"})
+
+	// GitOperations counts the operations performed on the mirrored repos, by operation (e.g. "AppendNote").
+	GitOperations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "git_phabricator_mirror_git_operations_total",
+		Help: "Number of operations performed on the mirrored git repos, by operation.",
+	}, []string{"operation"})
+
+	// CommentsMirrored counts the comments mirrored in each direction.
+	CommentsMirrored = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "git_phabricator_mirror_comments_mirrored_total",
+		Help: "Number of comments mirrored, by direction.",
+	}, []string{"direction"})
+
+	// ReviewsCreated counts the Differential revisions created for reviews.
+	ReviewsCreated = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "git_phabricator_mirror_reviews_created_total",
+		Help: "Number of Differential revisions created for git-appraise reviews.",
+	})
+
+	// ReviewsClosed counts the Differential revisions closed or abandoned, by action.
+	ReviewsClosed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "git_phabricator_mirror_reviews_closed_total",
+		Help: "Number of Differential revisions closed or abandoned, by action.",
+	}, []string{"action"})
+
+	// SyncDuration tracks how long each pass over a repo takes, by repo path.
+	SyncDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "git_phabricator_mirror_sync_duration_seconds",
+		Help:    "Time taken by each pass over a repo, by repo path.",
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 14),
+	}, []string{"repo"})
+)
+
+func init() {
+	prometheus.MustRegister(ConduitCalls, SQLQueries, GitOperations, CommentsMirrored, ReviewsCreated, ReviewsClosed, SyncDuration)
+}
@@ -18,21 +18,42 @@ limitations under the License.
 package mirror
 
 import (
+	"context"
+	"crypto/sha1"
+	"fmt"
 	"github.com/google/git-appraise/repository"
 	"github.com/google/git-appraise/review"
 	"github.com/google/git-appraise/review/comment"
 	"github.com/google/git-phabricator-mirror/mirror/arcanist"
+	"github.com/google/git-phabricator-mirror/mirror/metrics"
 	review_utils "github.com/google/git-phabricator-mirror/mirror/review"
+	"io"
 	"log"
+	"os/exec"
+	"strconv"
+	"time"
 )
 
-var arc = arcanist.Arcanist{}
-
-// processedStates is used to keep track of the state of each repository at the last time we processed it.
-// That, in turn, is used to avoid re-processing a repo if its state has not changed.
-var processedStates = make(map[string]string)
-var existingComments = make(map[string][]review.CommentThread)
-var openReviews = make(map[string][]review_utils.PhabricatorReview)
+// nextBatch returns which of the count items to process in this pass, when at most max may be
+// processed, and whether or not that includes all of them. Zero or less means there is no maximum.
+//
+// The batches cycle through the items in a round-robin, starting from the given cursor, which is
+// then advanced past the items returned, so that no item is starved.
+func nextBatch(cursor *int, count, max int) (batch map[int]bool, complete bool) {
+	batch = make(map[int]bool)
+	if max <= 0 || count <= max {
+		for i := 0; i < count; i++ {
+			batch[i] = true
+		}
+		return batch, true
+	}
+	start := *cursor % count
+	for i := 0; i < max; i++ {
+		batch[(start+i)%count] = true
+	}
+	*cursor = (start + max) % count
+	return batch, false
+}
 
 func hasOverlap(newComment comment.Comment, existingComments []review.CommentThread) bool {
 	for _, existing := range existingComments {
@@ -45,35 +66,220 @@ func hasOverlap(newComment comment.Comment, existingComments []review.CommentThr
 	return false
 }
 
-func mirrorRepoToReview(repo repository.Repo, tool review_utils.Tool, syncToRemote bool) {
-	if syncToRemote {
-		repo.PullNotes("origin", "refs/notes/devtools/*")
+// isEmptyRepo reports whether or not the repo at the given path has no commits yet.
+//
+// That is the case exactly when "git rev-parse --verify --quiet HEAD" exits with a status of 1
+// without printing anything. Any other failure (e.g. the path not being a git repo at all) is
+// returned, rather than being mistaken for an empty repo.
+func isEmptyRepo(ctx context.Context, repoPath string) (bool, error) {
+	out, err := gitCommand(ctx, repoPath, "rev-parse", "--verify", "--quiet", "HEAD").CombinedOutput()
+	if err == nil {
+		return false, nil
 	}
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 && len(out) == 0 {
+		return true, nil
+	}
+	return false, fmt.Errorf("Failed to check whether %s has any commits: %v %s", repoPath, err, out)
+}
 
-	stateHash, err := repo.GetRepoStateHash()
+// mirrorApprovals records the approval state of each reviewer of the given review, if it
+// has changed since the last time it was recorded.
+func mirrorApprovals(repo repository.Repo, reviewCommit string, reviewers []string, comments []comment.Comment) {
+	approvals := review_utils.ComputeApprovals(reviewers, comments)
+	latest := review_utils.LatestApprovals(repo.GetNotes(review_utils.ApprovalsRef, reviewCommit))
+	if latest.Matches(approvals) {
+		return
+	}
+	note, err := review_utils.Approvals{
+		Timestamp: strconv.FormatInt(time.Now().Unix(), 10),
+		Reviewers: approvals,
+	}.Write()
 	if err != nil {
 		log.Fatal(err)
 	}
-	if processedStates[repo.GetPath()] != stateHash {
+	log.Printf("Recording approvals: %s", string(note))
+	repo.AppendNote(review_utils.ApprovalsRef, reviewCommit, note)
+}
+
+// repoStateHash returns a hash of the state of the given repo, which changes whenever it has
+// anything new to mirror.
+//
+// Besides the state hash of the repo, this explicitly covers the commits of the notes refs that
+// hold review metadata, so that new comments and other metadata trigger a re-sync even if no
+// branches have moved.
+func repoStateHash(repo repository.Repo) (string, error) {
+	stateHash, err := repo.GetRepoStateHash()
+	if err != nil {
+		return "", err
+	}
+	hash := sha1.New()
+	io.WriteString(hash, stateHash)
+	for _, ref := range metadataRefs {
+		// The refs that do not exist yet are hashed without a commit.
+		commit, _ := repo.GetCommitHash(ref)
+		fmt.Fprintf(hash, "\n%s %s", ref, commit)
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
+
+// notesRefPrefix is the prefix of the notes refs in which git-appraise stores review metadata.
+const notesRefPrefix = "refs/notes/devtools/"
+
+// defaultNotesRefPattern matches the notes refs in which git-appraise stores review metadata.
+const defaultNotesRefPattern = notesRefPrefix + "*"
+
+// mirrorOptions holds the settings for how a single repo is mirrored.
+type mirrorOptions struct {
+	// syncToRemote specifies that the notes refs that match pullRefPattern are pulled from the
+	// remote before mirroring, and that those that match pushRefPatterns are pushed back afterwards.
+	syncToRemote    bool
+	pullRefPattern  string
+	pushRefPatterns []string
+
+	// minReviewAge is how old the head commit of a review must be before we mirror it.
+	minReviewAge time.Duration
+
+	// noteBatchSize is how many new comments to write to a review with each git operation.
+	noteBatchSize int
+
+	// maxReviewsPerPass is the maximum number of reviews to mirror in each direction in a single
+	// pass over the repo, or zero for no maximum.
+	maxReviewsPerPass int
+
+	// ctx stops the pass over the repo once it is done, if it is set.
+	ctx context.Context
+}
+
+// context returns the context of the pass over the repo.
+func (options mirrorOptions) context() context.Context {
+	if options.ctx == nil {
+		return context.Background()
+	}
+	return options.ctx
+}
+
+// interrupted returns the reason that the pass over the repo should stop early, if any.
+func (options mirrorOptions) interrupted() error {
+	return options.context().Err()
+}
+
+// isTooRecent reports whether or not the head commit of the given review is newer than the given
+// age, in which case the review may still be in the middle of being pushed.
+func isTooRecent(repo repository.Repo, r review.Review, minAge time.Duration) bool {
+	if minAge <= 0 || r.Submitted {
+		return false
+	}
+	head, err := r.GetHeadCommit()
+	if err != nil {
+		return false
+	}
+	commitTime, err := repo.GetCommitTime(head)
+	if err != nil {
+		return false
+	}
+	seconds, err := strconv.ParseInt(commitTime, 10, 64)
+	if err != nil {
+		return false
+	}
+	return time.Since(time.Unix(seconds, 0)) < minAge
+}
+
+// mirrorRepoToReview mirrors the reviews in the given repo to and from the given review tool.
+//
+// Reviews whose head commits are newer than the minimum review age are skipped, and the repo is
+// processed again on the next pass, even if it has not changed. The same goes for reviews beyond
+// the maximum number to process per pass.
+func mirrorRepoToReview(repo repository.Repo, tool review_utils.Tool, options mirrorOptions) error {
+	timer := newRepoTimer()
+	defer func() {
+		log.Printf("Finished processing %v in %v", repo, timer.finish(repo.GetPath()))
+	}()
+
+	if options.syncToRemote {
+		phaseStart := time.Now()
+		err := pullNotesWithRetry(options.context(), repo, "origin", options.pullRefPattern)
+		timer.track(PhaseRemoteSync, phaseStart)
+		if err != nil {
+			return fmt.Errorf("Failed to pull updates from the repo %v: %v", repo, err)
+		}
+	}
+
+	stateHash, err := repoStateHash(repo)
+	if err != nil {
+		empty, emptyErr := isEmptyRepo(options.context(), repo.GetPath())
+		if emptyErr != nil {
+			return fmt.Errorf("Failed to read the state of the repo %v: %v (%v)", repo, err, emptyErr)
+		}
+		if empty {
+			// Reading the state of a repo fails if it has no refs, but in that case
+			// there is simply nothing to mirror yet.
+			return nil
+		}
+		return fmt.Errorf("Failed to read the state of the repo %v: %v", repo, err)
+	}
+	if !state.isProcessed(repo.GetPath(), stateHash) {
 		log.Print("Mirroring repo: ", repo)
-		for _, r := range review.ListAll(repo) {
+		phaseStart := time.Now()
+		allReviews := review.ListAll(repo)
+		timer.track(PhaseReviewEnumeration, phaseStart)
+		state.setExistingComments(allReviews)
+		batch, complete := state.nextReviewBatch(repo.GetPath(), len(allReviews), options.maxReviewsPerPass)
+		deferred := !complete
+		if deferred {
+			log.Printf("Only mirroring %d of the %d reviews in %v during this pass", len(batch), len(allReviews), repo)
+		}
+		for i, r := range allReviews {
+			if !batch[i] {
+				continue
+			}
+			if err := options.interrupted(); err != nil {
+				return fmt.Errorf("Stopped mirroring the reviews of %v: %v", repo, err)
+			}
 			reviewJson, err := r.GetJSON()
 			if err != nil {
 				log.Fatal(err)
 			}
 			log.Println("Mirroring review: ", reviewJson)
-			existingComments[r.Revision] = r.Comments
 			reviewDetails, err := r.Details()
-			if err == nil {
+			if err == nil && isTooRecent(repo, *reviewDetails, options.minReviewAge) {
+				log.Printf("Deferring the review of %s, as its head commit is less than %v old", r.Revision, options.minReviewAge)
+				deferred = true
+			} else if err == nil {
+				phaseStart := time.Now()
 				tool.EnsureRequestExists(repo, *reviewDetails)
+				timer.track(PhaseDiffCreation, phaseStart)
 			}
 		}
-		openReviews[repo.GetPath()] = tool.ListOpenReviews(repo)
-		processedStates[repo.GetPath()] = stateHash
+		phaseStart = time.Now()
+		state.setOpenReviews(repo.GetPath(), tool.ListOpenReviews(repo))
+		timer.track(PhaseReviewEnumeration, phaseStart)
+		if !deferred {
+			state.markProcessed(repo.GetPath(), stateHash)
+		}
 		tool.Refresh(repo)
+	} else if !state.hasOpenReviews(repo.GetPath()) {
+		// The repo was processed before the mirror restarted, so we only need to catch up
+		// on what the comment mirroring below relies upon.
+		phaseStart := time.Now()
+		state.setExistingComments(review.ListAll(repo))
+		state.setOpenReviews(repo.GetPath(), tool.ListOpenReviews(repo))
+		timer.track(PhaseReviewEnumeration, phaseStart)
 	}
+	commentsStart := time.Now()
+	repoOpenReviews := state.openReviewsFor(repo.GetPath())
+	commentBatch, _ := state.nextCommentBatch(repo.GetPath(), len(repoOpenReviews), options.maxReviewsPerPass)
+	// The comments that fail to be appended are retried on the next pass, but they are still
+	// reported as a failure of this one, after mirroring the comments of the other reviews.
+	failedAppends := 0
+	var appendErr error
 ReviewLoop:
-	for _, phabricatorReview := range openReviews[repo.GetPath()] {
+	for i, phabricatorReview := range repoOpenReviews {
+		if !commentBatch[i] {
+			continue
+		}
+		if err := options.interrupted(); err != nil {
+			return fmt.Errorf("Stopped mirroring the comments of %v: %v", repo, err)
+		}
 		if reviewCommit := phabricatorReview.GetFirstCommit(repo); reviewCommit != "" {
 			log.Println("Processing review: ", reviewCommit)
 			r, err := review.GetSummary(repo, reviewCommit)
@@ -83,9 +289,12 @@ ReviewLoop:
 				log.Printf("Skipping unknown review %q", reviewCommit)
 				continue ReviewLoop
 			}
-			revisionComments := existingComments[reviewCommit]
+			revisionComments := state.existingCommentsFor(reviewCommit)
 			log.Printf("Loaded %d comments for %v\n", len(revisionComments), reviewCommit)
-			for _, c := range phabricatorReview.LoadComments() {
+			phabricatorComments := phabricatorReview.LoadComments()
+			var newNotes []repository.Note
+			skipped := 0
+			for _, c := range phabricatorComments {
 				if !hasOverlap(c, revisionComments) {
 					// The comment is new.
 					note, err := c.Write()
@@ -93,22 +302,128 @@ ReviewLoop:
 						log.Fatal(err)
 					}
 					log.Printf("Appending a comment: %s", string(note))
-					repo.AppendNote(comment.Ref, reviewCommit, note)
+					newNotes = append(newNotes, note)
 				} else {
 					log.Printf("Skipping '%v', as it has already been written\n", c)
+					skipped++
 				}
 			}
+			appended := len(newNotes)
+			if err := appendNotes(repo, comment.Ref, reviewCommit, newNotes, options.noteBatchSize); err != nil {
+				log.Printf("Failed to append the new comments to %v: %v", reviewCommit, err)
+				failedAppends++
+				appendErr = err
+			} else {
+				metrics.CommentsMirrored.WithLabelValues(metrics.DirectionToGit).Add(float64(appended))
+			}
+			log.Printf("Loaded %d comments from Phabricator for %v: appended %d, skipped %d as already written", len(phabricatorComments), reviewCommit, appended, skipped)
+			mirrorApprovals(repo, reviewCommit, phabricatorReview.GetReviewers(), phabricatorComments)
 		}
 	}
-	if syncToRemote {
-		if err := repo.PushNotes("origin", "refs/notes/devtools/*"); err != nil {
-			log.Printf("Failed to push updates to the repo %v: %v\n", repo, err)
+	timer.track(PhaseCommentMirroring, commentsStart)
+	if options.syncToRemote {
+		phaseStart := time.Now()
+		for _, pattern := range options.pushRefPatterns {
+			if err := repo.PushNotes("origin", pattern); err != nil {
+				timer.track(PhaseRemoteSync, phaseStart)
+				return fmt.Errorf("Failed to push updates to the repo %v: %v", repo, err)
+			}
 		}
+		timer.track(PhaseRemoteSync, phaseStart)
+	}
+	if failedAppends > 0 {
+		return fmt.Errorf("Failed to append the new comments to %d reviews in %v: %v", failedAppends, repo, appendErr)
 	}
+	return nil
 }
 
 // Repo mirrors the given repository using the system-wide installation of
 // the "arcanist" command line tool.
-func Repo(repo repository.Repo, syncToRemote bool) {
-	mirrorRepoToReview(repo, arc, syncToRemote)
+//
+// The returned error reports failures that may be transient, such as being
+// unable to sync with the remote, and which are worth retrying on a later pass.
+//
+// This does not check the callsign allowlist in the config, so callers that mirror every repo
+// they find have to leave out the ones that Config.IsAllowed rejects.
+//
+// If LimitGitProcesses has been called, then the git operations performed on
+// the repository count against that limit.
+//
+// Different repos may be mirrored at the same time, from different goroutines, in which case their
+// Conduit requests and database queries overlap. If the repo is already being processed (e.g.
+// by another goroutine, or by another process), then this waits for that to finish.
+func Repo(repo repository.Repo, config Config, syncToRemote bool) error {
+	return RepoContext(context.Background(), repo, config, syncToRemote)
+}
+
+// RepoContext is like Repo, except that it stops early, returning an error, once the given
+// context is done. That kills the database queries, and the git commands that the mirror runs
+// itself, which are in progress, and stops it from starting to mirror any more reviews. Conduit
+// requests in progress are left to finish, as a failed one would stop the whole mirror. It also
+// stops waiting for the repo to be unlocked, if it is being processed by someone else.
+func RepoContext(ctx context.Context, repo repository.Repo, config Config, syncToRemote bool) error {
+	unlock, err := lockRepo(ctx, repo.GetPath())
+	if err != nil {
+		return fmt.Errorf("Failed to lock the repo %v: %v", repo, err)
+	}
+	defer unlock()
+	return mirrorRepo(ctx, repo, config, syncToRemote)
+}
+
+// mirrorRepo does the work of RepoContext, for callers that already hold the lock on the repo.
+func mirrorRepo(ctx context.Context, repo repository.Repo, config Config, syncToRemote bool) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("Not mirroring repo %v: %v", repo, err)
+	}
+	config.Arcanist = config.Arcanist.WithContext(ctx)
+	repo, arc := setUp(ctx, repo, config)
+	options := mirrorOptions{
+		ctx:               ctx,
+		syncToRemote:      syncToRemote,
+		pullRefPattern:    config.pullRefPattern(repo.GetPath()),
+		pushRefPatterns:   config.pushRefPatterns(repo.GetPath()),
+		minReviewAge:      config.minReviewAge(repo.GetPath()),
+		noteBatchSize:     config.NoteBatchSize,
+		maxReviewsPerPass: config.maxReviewsPerPass(repo.GetPath()),
+	}
+	return mirrorRepoToReview(repo, arc, options)
+}
+
+// setUp wraps the given repo as specified by the config, and creates the Arcanist instance for it.
+func setUp(ctx context.Context, repo repository.Repo, config Config) (repository.Repo, arcanist.Arcanist) {
+	bounded := boundedRepo{repo, gitProcesses, ctx}
+	repo = bounded
+	if refs := config.notesRefs(repo.GetPath()); len(refs) > 0 {
+		repo = notesRefRepo{repo, refs}
+	}
+	if ignored := config.ignoredMetadataRefs(repo.GetPath()); len(ignored) > 0 {
+		repo = metadataRefRepo{repo, ignored}
+	}
+	arc := arcanist.NewArcanist(config.Arcanist)
+	arc.Callsign = config.explicitCallsign(repo.GetPath())
+	arc.DefaultTargetRef = config.defaultTargetRef(repo.GetPath())
+	arc.RemoteURL = bounded.remoteURL()
+	return repo, arc
+}
+
+// Rebuild recreates the Phabricator diffs for the review of the given revision in the given repo.
+//
+// This is meant to be triggered by an operator, to repair revisions whose diffs are in a bad state.
+//
+// This waits for any pass over the repo, including one in the running mirror, to finish first.
+func Rebuild(repo repository.Repo, config Config, revision string) error {
+	unlock, err := lockRepo(context.Background(), repo.GetPath())
+	if err != nil {
+		return fmt.Errorf("Failed to lock the repo %v: %v", repo, err)
+	}
+	defer unlock()
+	repo, arc := setUp(context.Background(), repo, config)
+	return arc.RebuildDiffs(repo, revision)
+}
+
+// PreviewDiff returns the raw diff that would be uploaded to Phabricator for the review of the
+// given revision in the given repo, without creating anything in Phabricator.
+func PreviewDiff(repo repository.Repo, config Config, revision string) (string, error) {
+	repo, arc := setUp(context.Background(), repo, config)
+	return arc.PreviewDiff(repo, revision)
 }
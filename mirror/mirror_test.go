@@ -17,15 +17,25 @@ limitations under the License.
 package mirror
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"github.com/google/git-appraise/repository"
 	"github.com/google/git-appraise/review"
+	"github.com/google/git-appraise/review/comment"
 	"github.com/google/git-appraise/review/request"
 	phabricatorReview "github.com/google/git-phabricator-mirror/mirror/review"
+	"io/ioutil"
+	"os"
+	"sort"
 	"testing"
+	"time"
 )
 
 type mockReviewTool struct {
 	Requests map[string]request.Request
+	// Comments, if set, makes each mirrored request an open review with these comments.
+	Comments []comment.Comment
 }
 
 func (tool *mockReviewTool) EnsureRequestExists(repo repository.Repo, r review.Review) {
@@ -33,6 +43,40 @@ func (tool *mockReviewTool) EnsureRequestExists(repo repository.Repo, r review.R
 }
 
 func (tool *mockReviewTool) ListOpenReviews(repo repository.Repo) []phabricatorReview.PhabricatorReview {
+	if tool.Comments == nil {
+		return nil
+	}
+	var revisions []string
+	for revision := range tool.Requests {
+		revisions = append(revisions, revision)
+	}
+	sort.Strings(revisions)
+	var open []phabricatorReview.PhabricatorReview
+	for _, revision := range revisions {
+		open = append(open, mockOpenReview{revision, tool.Comments})
+	}
+	return open
+}
+
+// mockOpenReview is an open review of the given commit, with the given comments.
+type mockOpenReview struct {
+	revision string
+	comments []comment.Comment
+}
+
+func (r mockOpenReview) LoadComments() []comment.Comment {
+	return r.comments
+}
+
+func (r mockOpenReview) LoadAllComments() []comment.Comment {
+	return r.comments
+}
+
+func (r mockOpenReview) GetFirstCommit(repo repository.Repo) string {
+	return r.revision
+}
+
+func (r mockOpenReview) GetReviewers() []string {
 	return nil
 }
 
@@ -40,10 +84,310 @@ func (tool *mockReviewTool) Refresh(repo repository.Repo) {}
 
 func TestMirrorRepo(t *testing.T) {
 	repo := repository.NewMockRepoForTest()
-	tool := mockReviewTool{make(map[string]request.Request)}
+	tool := mockReviewTool{Requests: make(map[string]request.Request)}
 	syncToRemote := true
-	mirrorRepoToReview(repo, &tool, syncToRemote)
+	if err := mirrorRepoToReview(repo, &tool, mirrorOptions{syncToRemote: syncToRemote, pullRefPattern: defaultNotesRefPattern, pushRefPatterns: []string{defaultNotesRefPattern}}); err != nil {
+		t.Fatal(err)
+	}
 	if len(tool.Requests) != len(review.ListAll(repo)) {
 		t.Errorf("Review requests are not what we expected: %v", tool.Requests)
 	}
+	timing, ok := RepoTimings()[repo.GetPath()]
+	if !ok || timing.Total <= 0 {
+		t.Errorf("The time taken to mirror the repo was not recorded: %v", timing)
+	}
+	if _, ok := timing.Phases[PhaseRemoteSync]; !ok {
+		t.Errorf("The time taken to sync with the remote was not recorded: %v", timing)
+	}
+}
+
+// brokenStateRepo is a repository.Repo whose state cannot be read.
+type brokenStateRepo struct {
+	repository.Repo
+}
+
+func (repo brokenStateRepo) GetRepoStateHash() (string, error) {
+	return "", errors.New("failed to read the repo state")
+}
+
+// newGitDir returns a new temporary directory, in which git is run with the given sets of
+// arguments. The directory is removed by the returned function.
+func newGitDir(t *testing.T, commands ...[]string) (string, func()) {
+	dir, err := ioutil.TempDir("", "repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range commands {
+		args = append([]string{"-c", "user.name=Mirror", "-c", "user.email=mirror@example.com"}, args...)
+		if out, err := gitCommand(context.Background(), dir, args...).CombinedOutput(); err != nil {
+			os.RemoveAll(dir)
+			t.Fatalf("git %v failed: %v %s", args, err, out)
+		}
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func TestIsEmptyRepo(t *testing.T) {
+	emptyDir, cleanup := newGitDir(t, []string{"init", "-q"})
+	defer cleanup()
+	if empty, err := isEmptyRepo(context.Background(), emptyDir); err != nil || !empty {
+		t.Errorf("The empty repo was not detected: %v, %v", empty, err)
+	}
+	repoDir, cleanup := newGitDir(t, []string{"init", "-q"}, []string{"commit", "-q", "--allow-empty", "-m", "First"})
+	defer cleanup()
+	if empty, err := isEmptyRepo(context.Background(), repoDir); err != nil || empty {
+		t.Errorf("The repo with a commit was reported as empty: %v, %v", empty, err)
+	}
+	notRepoDir, cleanup := newGitDir(t)
+	defer cleanup()
+	if empty, err := isEmptyRepo(context.Background(), notRepoDir); err == nil || empty {
+		t.Errorf("Failed to report that a directory is not a repo: %v, %v", empty, err)
+	}
+}
+
+func TestMirrorRepoWithUnreadableState(t *testing.T) {
+	tool := mockReviewTool{Requests: make(map[string]request.Request)}
+	emptyDir, cleanup := newGitDir(t, []string{"init", "-q"})
+	defer cleanup()
+	emptyRepo := brokenStateRepo{pathRepo{repository.NewMockRepoForTest(), emptyDir}}
+	if err := mirrorRepoToReview(emptyRepo, &tool, mirrorOptions{pullRefPattern: defaultNotesRefPattern}); err != nil {
+		t.Errorf("Unexpected error mirroring an empty repo: %v", err)
+	}
+	repoDir, cleanup := newGitDir(t, []string{"init", "-q"}, []string{"commit", "-q", "--allow-empty", "-m", "First"})
+	defer cleanup()
+	brokenRepo := brokenStateRepo{pathRepo{repository.NewMockRepoForTest(), repoDir}}
+	if err := mirrorRepoToReview(brokenRepo, &tool, mirrorOptions{pullRefPattern: defaultNotesRefPattern}); err == nil {
+		t.Errorf("Failed to report an error reading the state of a repo")
+	}
+	if len(tool.Requests) != 0 {
+		t.Errorf("Unexpected review requests: %v", tool.Requests)
+	}
+}
+
+// notesRepo is a repository.Repo whose notes refs get a new commit every time that a note is
+// appended to them, as they do in a real repo, regardless of how the underlying repo stores notes.
+type notesRepo struct {
+	repository.Repo
+	// appends counts the notes appended to each ref.
+	appends map[string]int
+}
+
+func (repo notesRepo) AppendNote(ref, revision string, note repository.Note) error {
+	if err := repo.Repo.AppendNote(ref, revision, note); err != nil {
+		return err
+	}
+	repo.appends[ref]++
+	return nil
+}
+
+func (repo notesRepo) GetCommitHash(ref string) (string, error) {
+	if appends, ok := repo.appends[ref]; ok {
+		return fmt.Sprintf("%s-%d", ref, appends), nil
+	}
+	return repo.Repo.GetCommitHash(ref)
+}
+
+// TestMirrorRepoAfterNewComment checks that adding a comment, without moving any branches,
+// changes the state of the repo so that it is processed again.
+func TestMirrorRepoAfterNewComment(t *testing.T) {
+	resetMirrorState()
+	defer resetMirrorState()
+	repo := notesRepo{repository.NewMockRepoForTest(), map[string]int{comment.Ref: 0}}
+	tool := mockReviewTool{Requests: make(map[string]request.Request)}
+	if err := mirrorRepoToReview(repo, &tool, mirrorOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	processed, ok := state.processedState(repo.GetPath())
+	if !ok || len(tool.Requests) == 0 {
+		t.Fatal("The repo was not processed")
+	}
+
+	// Without any changes, the repo is not processed again.
+	tool.Requests = make(map[string]request.Request)
+	if err := mirrorRepoToReview(repo, &tool, mirrorOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(tool.Requests) != 0 {
+		t.Fatalf("The unchanged repo was processed again: %v", tool.Requests)
+	}
+
+	note, err := comment.Comment{
+		Timestamp:   "4",
+		Author:      "reviewer@example.com",
+		Description: "A new comment",
+	}.Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.AppendNote(comment.Ref, review.ListAll(repo)[0].Revision, note); err != nil {
+		t.Fatal(err)
+	}
+	stateHash, err := repoStateHash(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stateHash == processed {
+		t.Errorf("The state hash %q did not change after adding a comment", stateHash)
+	}
+	if err := mirrorRepoToReview(repo, &tool, mirrorOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(tool.Requests) == 0 {
+		t.Error("The repo was not processed again after adding a comment")
+	}
+	if reprocessed, _ := state.processedState(repo.GetPath()); reprocessed != stateHash {
+		t.Errorf("Unexpected state after processing the new comment: %q instead of %q", reprocessed, stateHash)
+	}
+}
+
+func TestMirrorRepoDefersRecentReviews(t *testing.T) {
+	resetMirrorState()
+	repo := repository.NewMockRepoForTest()
+	tool := mockReviewTool{Requests: make(map[string]request.Request)}
+	// The commits in the mock repo are from 1970, so this treats them as recent.
+	century := 100 * 365 * 24 * time.Hour
+	if err := mirrorRepoToReview(repo, &tool, mirrorOptions{minReviewAge: century}); err != nil {
+		t.Fatal(err)
+	}
+	for revision := range tool.Requests {
+		r, err := review.GetSummary(repo, revision)
+		if err != nil || r == nil || !r.Submitted {
+			t.Errorf("The recent review of %s was mirrored", revision)
+		}
+	}
+	if len(tool.Requests) >= len(review.ListAll(repo)) {
+		t.Errorf("No reviews were deferred: %v", tool.Requests)
+	}
+	if _, ok := state.processedState(repo.GetPath()); ok {
+		t.Errorf("The repo was marked as processed, despite deferring some of its reviews")
+	}
+
+	if err := mirrorRepoToReview(repo, &tool, mirrorOptions{minReviewAge: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	if len(tool.Requests) != len(review.ListAll(repo)) {
+		t.Errorf("Review requests are not what we expected: %v", tool.Requests)
+	}
+}
+
+func TestMirrorRepoLimitsReviewsPerPass(t *testing.T) {
+	resetMirrorState()
+	repo := repository.NewMockRepoForTest()
+	tool := mockReviewTool{Requests: make(map[string]request.Request)}
+	secondRequest := repository.Note(`{"timestamp": "0", "reviewRef": "refs/heads/review", "targetRef": "refs/heads/master", "requester": "b@example.com", "description": "Second review"}`)
+	if err := repo.AppendNote(request.Ref, "D", secondRequest); err != nil {
+		t.Fatal(err)
+	}
+	total := len(review.ListAll(repo))
+	if total < 2 {
+		t.Fatalf("The mock repo has too few reviews: %d", total)
+	}
+	for pass := 1; pass < total; pass++ {
+		if err := mirrorRepoToReview(repo, &tool, mirrorOptions{maxReviewsPerPass: 1}); err != nil {
+			t.Fatal(err)
+		}
+		if len(tool.Requests) != pass {
+			t.Errorf("Unexpected number of reviews mirrored after %d passes: %d", pass, len(tool.Requests))
+		}
+		if _, ok := state.processedState(repo.GetPath()); ok {
+			t.Errorf("The repo was marked as processed after %d passes, despite reviews remaining", pass)
+		}
+	}
+	if err := mirrorRepoToReview(repo, &tool, mirrorOptions{maxReviewsPerPass: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if len(tool.Requests) != total {
+		t.Errorf("Not every review was mirrored after %d passes: %v", total, tool.Requests)
+	}
+}
+
+func TestMirrorRepoStopsWhenCancelled(t *testing.T) {
+	resetMirrorState()
+	defer resetMirrorState()
+	repo := repository.NewMockRepoForTest()
+	tool := mockReviewTool{Requests: make(map[string]request.Request)}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := mirrorRepoToReview(repo, &tool, mirrorOptions{ctx: ctx}); err == nil {
+		t.Error("Failed to report that mirroring the repo was cancelled")
+	}
+	if len(tool.Requests) != 0 {
+		t.Errorf("Reviews were mirrored after mirroring the repo was cancelled: %v", tool.Requests)
+	}
+	if _, ok := state.processedState(repo.GetPath()); ok {
+		t.Error("The repo was marked as processed, despite mirroring it being cancelled")
+	}
+	if err := RepoContext(ctx, repo, Config{}, false); err == nil {
+		t.Error("Failed to report that mirroring the repo was cancelled before it started")
+	}
+}
+
+func TestNextBatch(t *testing.T) {
+	cursor := 0
+	if batch, complete := nextBatch(&cursor, 3, 0); len(batch) != 3 || !complete {
+		t.Errorf("Unexpected batch without a maximum: %v", batch)
+	}
+	var seen []int
+	for pass := 0; pass < 3; pass++ {
+		batch, complete := nextBatch(&cursor, 5, 2)
+		if len(batch) != 2 || complete {
+			t.Errorf("Unexpected batch: %v", batch)
+		}
+		for i := 0; i < 5; i++ {
+			if batch[i] {
+				seen = append(seen, i)
+			}
+		}
+	}
+	// The third batch wraps around, from the last item back to the first.
+	if fmt.Sprint(seen) != "[0 1 2 3 0 4]" {
+		t.Errorf("Unexpected round-robin batches: %v", seen)
+	}
+}
+
+// resetMirrorState forgets everything that was cached by previous calls to mirrorRepoToReview.
+func resetMirrorState() {
+	state = newMirrorState()
+}
+
+// findOpenReview returns a review in the given repo that is still open.
+func findOpenReview(t *testing.T, repo repository.Repo) review.Summary {
+	for _, r := range review.ListAll(repo) {
+		if !r.Submitted {
+			return r
+		}
+	}
+	t.Fatal("The mock repo has no open reviews")
+	return review.Summary{}
+}
+
+// failingAppendRepo is a repository.Repo that fails to append any notes.
+type failingAppendRepo struct {
+	repository.Repo
+}
+
+func (repo failingAppendRepo) AppendNote(ref, revision string, note repository.Note) error {
+	return errors.New("failed to append a note")
+}
+
+func TestMirrorRepoReportsFailedAppends(t *testing.T) {
+	resetMirrorState()
+	defer resetMirrorState()
+	repo := repository.NewMockRepoForTest()
+	tool := mockReviewTool{Requests: make(map[string]request.Request)}
+	findOpenReview(t, repo)
+	if err := mirrorRepoToReview(repo, &tool, mirrorOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	tool.Comments = []comment.Comment{{
+		Timestamp:   "2",
+		Author:      "author@example.com",
+		Description: "Done",
+	}}
+	if err := mirrorRepoToReview(failingAppendRepo{repo}, &tool, mirrorOptions{}); err == nil {
+		t.Error("A failure to append the comments from Phabricator was not reported")
+	}
+	if err := mirrorRepoToReview(repo, &tool, mirrorOptions{}); err != nil {
+		t.Errorf("Unexpected error after the comments could be appended: %v", err)
+	}
 }
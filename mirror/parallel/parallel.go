@@ -0,0 +1,72 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package parallel runs functions concurrently, with a bound on how many of them run at once.
+package parallel
+
+import (
+	"sync"
+)
+
+// Limiter bounds how many functions run through it at once. A nil Limiter has no bound.
+type Limiter chan struct{}
+
+// NewLimiter returns a Limiter that runs at most the given number of functions at once. A limit
+// of zero or less means there is no bound.
+func NewLimiter(limit int) Limiter {
+	if limit <= 0 {
+		return nil
+	}
+	return make(Limiter, limit)
+}
+
+// Do runs the given function, once fewer than the limiter's limit of other functions are running
+// through it.
+func (limiter Limiter) Do(f func()) {
+	if limiter != nil {
+		limiter <- struct{}{}
+		defer func() { <-limiter }()
+	}
+	f()
+}
+
+// Run calls the given function with each index from 0 up to n, running at most the given number
+// of calls at a time, and returns once every call has returned. A limit of less than one runs the
+// calls one at a time.
+//
+// The calls are started in the order of their indices, but they may finish in any order, so the
+// function should store its results at its index rather than append them.
+func Run(n, limit int, f func(i int)) {
+	if limit < 1 {
+		limit = 1
+	}
+	limiter := NewLimiter(limit)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		// The slot is taken before starting the goroutine, so that we never have more than the
+		// limit of goroutines waiting around.
+		limiter <- struct{}{}
+		go func(i int) {
+			defer func() {
+				<-limiter
+				wg.Done()
+			}()
+			f(i)
+		}(i)
+	}
+	wg.Wait()
+}
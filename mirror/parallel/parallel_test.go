@@ -0,0 +1,79 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package parallel
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRun(t *testing.T) {
+	for _, limit := range []int{0, 1, 3} {
+		var mutex sync.Mutex
+		running, maxRunning := 0, 0
+		called := make([]int, 10)
+		Run(len(called), limit, func(i int) {
+			mutex.Lock()
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			mutex.Unlock()
+			time.Sleep(5 * time.Millisecond)
+			mutex.Lock()
+			running--
+			called[i]++
+			mutex.Unlock()
+		})
+		expectedMax := limit
+		if expectedMax < 1 {
+			expectedMax = 1
+		}
+		if maxRunning > expectedMax {
+			t.Errorf("Ran %d calls at once, despite a limit of %d", maxRunning, limit)
+		}
+		if expectedMax > 1 && maxRunning < 2 {
+			t.Errorf("Ran the calls one at a time, despite a limit of %d", limit)
+		}
+		for i, calls := range called {
+			if calls != 1 {
+				t.Errorf("Called %d %d times with a limit of %d", i, calls, limit)
+			}
+		}
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	limiter := NewLimiter(1)
+	limiter <- struct{}{}
+	done := make(chan struct{})
+	go limiter.Do(func() { close(done) })
+	select {
+	case <-done:
+		t.Fatal("The function ran while the limiter was full")
+	case <-time.After(10 * time.Millisecond):
+	}
+	<-limiter
+	<-done
+
+	ran := false
+	NewLimiter(0).Do(func() { ran = true })
+	if !ran {
+		t.Error("The function did not run without a limit")
+	}
+}
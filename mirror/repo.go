@@ -0,0 +1,376 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/git-appraise/repository"
+	"github.com/google/git-phabricator-mirror/mirror/metrics"
+	"github.com/google/git-phabricator-mirror/mirror/parallel"
+	"log"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// gitProcesses is shared by every mirrored repo, and bounds how many git subprocesses may run at
+// once. A nil value means there is no bound.
+var gitProcesses parallel.Limiter
+
+// LimitGitProcesses caps the number of git subprocesses that may run simultaneously
+// across all of the mirrored repos. A limit of zero or less removes the cap.
+func LimitGitProcesses(limit int) {
+	gitProcesses = parallel.NewLimiter(limit)
+}
+
+// boundedRepo wraps a repository.Repo so that each call that runs git has to
+// first acquire a slot in the given limiter, unless that is nil. Either way,
+// the calls are counted in metrics.GitOperations.
+//
+// The git-backed implementation of repository.Repo runs (at most) one git
+// subprocess per method call, and none of those methods call each other, so
+// bounding the concurrent calls bounds the concurrent subprocesses.
+//
+// The git commands that we run ourselves, rather than through repository.Repo, are killed once
+// the given context is done, if it is set. The git-appraise library does not take a context, so
+// the commands that it runs are left to finish.
+type boundedRepo struct {
+	repository.Repo
+	limiter parallel.Limiter
+	ctx     context.Context
+}
+
+// context returns the context for the git commands that we run for the repo.
+func (repo boundedRepo) context() context.Context {
+	if repo.ctx == nil {
+		return context.Background()
+	}
+	return repo.ctx
+}
+
+// gitCommand returns the git command with the given arguments for the repo at the given path,
+// which is killed once the given context is done.
+func gitCommand(ctx context.Context, repoPath string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = repoPath
+	return cmd
+}
+
+func (repo boundedRepo) run(operation string, f func()) {
+	metrics.GitOperations.WithLabelValues(operation).Inc()
+	repo.limiter.Do(f)
+}
+
+func (repo boundedRepo) GetRepoStateHash() (hash string, err error) {
+	repo.run("GetRepoStateHash", func() { hash, err = repo.Repo.GetRepoStateHash() })
+	return
+}
+
+func (repo boundedRepo) VerifyCommit(hash string) (err error) {
+	repo.run("VerifyCommit", func() { err = repo.Repo.VerifyCommit(hash) })
+	return
+}
+
+func (repo boundedRepo) VerifyGitRef(ref string) (err error) {
+	repo.run("VerifyGitRef", func() { err = repo.Repo.VerifyGitRef(ref) })
+	return
+}
+
+func (repo boundedRepo) GetCommitHash(ref string) (hash string, err error) {
+	repo.run("GetCommitHash", func() { hash, err = repo.Repo.GetCommitHash(ref) })
+	return
+}
+
+func (repo boundedRepo) ResolveRefCommit(ref string) (commit string, err error) {
+	repo.run("ResolveRefCommit", func() { commit, err = repo.Repo.ResolveRefCommit(ref) })
+	return
+}
+
+func (repo boundedRepo) GetCommitMessage(ref string) (message string, err error) {
+	repo.run("GetCommitMessage", func() { message, err = repo.Repo.GetCommitMessage(ref) })
+	return
+}
+
+func (repo boundedRepo) GetCommitTime(ref string) (commitTime string, err error) {
+	repo.run("GetCommitTime", func() { commitTime, err = repo.Repo.GetCommitTime(ref) })
+	return
+}
+
+func (repo boundedRepo) GetLastParent(ref string) (parent string, err error) {
+	repo.run("GetLastParent", func() { parent, err = repo.Repo.GetLastParent(ref) })
+	return
+}
+
+func (repo boundedRepo) GetCommitDetails(ref string) (details *repository.CommitDetails, err error) {
+	repo.run("GetCommitDetails", func() { details, err = repo.Repo.GetCommitDetails(ref) })
+	return
+}
+
+func (repo boundedRepo) MergeBase(a, b string) (mergeBase string, err error) {
+	repo.run("MergeBase", func() { mergeBase, err = repo.Repo.MergeBase(a, b) })
+	return
+}
+
+func (repo boundedRepo) IsAncestor(ancestor, descendant string) (isAncestor bool, err error) {
+	repo.run("IsAncestor", func() { isAncestor, err = repo.Repo.IsAncestor(ancestor, descendant) })
+	return
+}
+
+func (repo boundedRepo) Diff(left, right string, diffArgs ...string) (diff string, err error) {
+	repo.run("Diff", func() { diff, err = repo.Repo.Diff(left, right, diffArgs...) })
+	return
+}
+
+func (repo boundedRepo) ListCommitsBetween(from, to string) (commits []string, err error) {
+	repo.run("ListCommitsBetween", func() { commits, err = repo.Repo.ListCommitsBetween(from, to) })
+	return
+}
+
+func (repo boundedRepo) GetNotes(ref, revision string) (notes []repository.Note) {
+	repo.run("GetNotes", func() { notes = repo.Repo.GetNotes(ref, revision) })
+	return
+}
+
+func (repo boundedRepo) AppendNote(ref, revision string, note repository.Note) (err error) {
+	repo.run("AppendNote", func() { err = repo.Repo.AppendNote(ref, revision, note) })
+	return
+}
+
+func (repo boundedRepo) ListNotedRevisions(notesRef string) (revisions []string) {
+	repo.run("ListNotedRevisions", func() { revisions = repo.Repo.ListNotedRevisions(notesRef) })
+	return
+}
+
+func (repo boundedRepo) PushNotes(remote, notesRefPattern string) (err error) {
+	repo.run("PushNotes", func() { err = repo.Repo.PushNotes(remote, notesRefPattern) })
+	return
+}
+
+func (repo boundedRepo) PullNotes(remote, notesRefPattern string) (err error) {
+	repo.run("PullNotes", func() { err = repo.Repo.PullNotes(remote, notesRefPattern) })
+	return
+}
+
+// appendNotes appends the given notes to the given revision, combining up to batchSize of them
+// into each call to AppendNote, so that a burst of new notes does not run one git subprocess each.
+//
+// This relies on git-appraise storing one note per line, so that the combined notes are read
+// back as separate notes. A batch size of one or less appends each note on its own.
+func appendNotes(repo repository.Repo, ref, revision string, notes []repository.Note, batchSize int) error {
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	for len(notes) > 0 {
+		n := batchSize
+		if n > len(notes) {
+			n = len(notes)
+		}
+		var lines []string
+		for _, note := range notes[:n] {
+			lines = append(lines, string(note))
+		}
+		if err := repo.AppendNote(ref, revision, repository.Note(strings.Join(lines, "\n"))); err != nil {
+			return err
+		}
+		notes = notes[n:]
+	}
+	return nil
+}
+
+// remoteURLsMutex guards remoteURLs, as repos may be mirrored concurrently.
+var remoteURLsMutex sync.Mutex
+
+// remoteURLs caches the URLs of the "origin" remotes of repos, keyed by their paths, as they
+// are needed on every pass over each repo, but rarely change.
+var remoteURLs = make(map[string]string)
+
+// readRemoteURL returns the URL of the "origin" remote of the repo at the given path.
+var readRemoteURL = func(ctx context.Context, repoPath string) (string, error) {
+	output, err := gitCommand(ctx, repoPath, "config", "--get", "remote.origin.url").Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// remoteURL returns the URL of the "origin" remote of the repo, or the empty string if it has
+// none. This is only read from git the first time it is needed for each repo.
+func (repo boundedRepo) remoteURL() string {
+	remoteURLsMutex.Lock()
+	url, ok := remoteURLs[repo.GetPath()]
+	remoteURLsMutex.Unlock()
+	if ok {
+		return url
+	}
+	var err error
+	repo.run("RemoteURL", func() { url, err = readRemoteURL(repo.context(), repo.GetPath()) })
+	if err != nil {
+		// This is expected for repos without an "origin" remote.
+		url = ""
+	}
+	remoteURLsMutex.Lock()
+	defer remoteURLsMutex.Unlock()
+	remoteURLs[repo.GetPath()] = url
+	return url
+}
+
+// notesRefRepo wraps a repository.Repo so that the notes refs used by git-appraise
+// (e.g. request.Ref) can be replaced with custom refs.
+//
+// This is for repos that store their review metadata in a custom layout. The git-appraise
+// library always reads from its own, standard refs, so we redirect those to the custom ones.
+type notesRefRepo struct {
+	repository.Repo
+	// refs maps from a standard notes ref to the custom ref that replaces it.
+	refs map[string]string
+}
+
+func (repo notesRefRepo) mapRef(ref string) string {
+	if mapped, ok := repo.refs[ref]; ok {
+		return mapped
+	}
+	return ref
+}
+
+func (repo notesRefRepo) GetNotes(ref, revision string) []repository.Note {
+	return repo.Repo.GetNotes(repo.mapRef(ref), revision)
+}
+
+func (repo notesRefRepo) AppendNote(ref, revision string, note repository.Note) error {
+	return repo.Repo.AppendNote(repo.mapRef(ref), revision, note)
+}
+
+func (repo notesRefRepo) ListNotedRevisions(notesRef string) []string {
+	return repo.Repo.ListNotedRevisions(repo.mapRef(notesRef))
+}
+
+// unmatchedRefs returns the custom refs that would not be included in a push or pull of the given pattern.
+func (repo notesRefRepo) unmatchedRefs(notesRefPattern string) []string {
+	var unmatched []string
+	for _, ref := range repo.refs {
+		if matched, err := path.Match(notesRefPattern, ref); err != nil || !matched {
+			unmatched = append(unmatched, ref)
+		}
+	}
+	return unmatched
+}
+
+func (repo notesRefRepo) PushNotes(remote, notesRefPattern string) error {
+	if err := repo.Repo.PushNotes(remote, notesRefPattern); err != nil {
+		return err
+	}
+	for _, ref := range repo.unmatchedRefs(notesRefPattern) {
+		if err := repo.Repo.PushNotes(remote, ref); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (repo notesRefRepo) PullNotes(remote, notesRefPattern string) error {
+	if err := repo.Repo.PullNotes(remote, notesRefPattern); err != nil {
+		return err
+	}
+	for _, ref := range repo.unmatchedRefs(notesRefPattern) {
+		if err := repo.Repo.PullNotes(remote, ref); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// metadataRefRepo wraps a repository.Repo so that the given notes refs read as if they were empty.
+//
+// This is for repos that have unrelated notes under the git-appraise refs, so that the mirror
+// does not try to interpret them as review metadata.
+type metadataRefRepo struct {
+	repository.Repo
+	ignored map[string]bool
+}
+
+func (repo metadataRefRepo) GetNotes(ref, revision string) []repository.Note {
+	if repo.ignored[ref] {
+		return nil
+	}
+	return repo.Repo.GetNotes(ref, revision)
+}
+
+// AppendNote refuses to write to the ignored refs, since we could not tell what is already in them.
+func (repo metadataRefRepo) AppendNote(ref, revision string, note repository.Note) error {
+	if repo.ignored[ref] {
+		return fmt.Errorf("Not writing to the notes ref %q, as it is not read as review metadata", ref)
+	}
+	return repo.Repo.AppendNote(ref, revision, note)
+}
+
+func (repo metadataRefRepo) ListNotedRevisions(notesRef string) []string {
+	if repo.ignored[notesRef] {
+		return nil
+	}
+	return repo.Repo.ListNotedRevisions(notesRef)
+}
+
+// notesMergeAttempts is the number of times we try to pull notes before giving up.
+const notesMergeAttempts = 3
+
+// notesMergeRetryDelay is how long we wait before retrying a failed pull of notes.
+var notesMergeRetryDelay = 5 * time.Second
+
+// abortNotesMerge cleans up after a failed notes merge in the repo at the given path.
+//
+// Pulling notes merges the remote notes into the local ones, and if that fails (e.g. because
+// another process holds the lock on a notes ref), then the merge can be left in progress. That
+// would cause every subsequent merge to fail as well, so we abort it to get back to a clean state.
+var abortNotesMerge = func(ctx context.Context, repoPath string) error {
+	return gitCommand(ctx, repoPath, "notes", "merge", "--abort").Run()
+}
+
+// abortMerge runs abortNotesMerge for the repo, bounded by its limiter like its other git calls.
+func (repo boundedRepo) abortMerge() (err error) {
+	repo.run("AbortNotesMerge", func() { err = abortNotesMerge(repo.context(), repo.GetPath()) })
+	return
+}
+
+// pullNotesWithRetry pulls the notes matching the given pattern from the given remote.
+//
+// If the pull fails, then any partially-completed notes merge is aborted, and the pull is retried,
+// unless the given context is done by then.
+func pullNotesWithRetry(ctx context.Context, repo repository.Repo, remote, notesRefPattern string) error {
+	var err error
+	for attempt := 1; attempt <= notesMergeAttempts; attempt++ {
+		if err = repo.PullNotes(remote, notesRefPattern); err == nil {
+			return nil
+		}
+		log.Printf("Failed to pull the notes for %v (attempt %d of %d): %v", repo, attempt, notesMergeAttempts, err)
+		// The given repo may wrap a boundedRepo, but that does not bound calls outside of repository.Repo.
+		if abortErr := (boundedRepo{repo, gitProcesses, ctx}).abortMerge(); abortErr != nil {
+			// This is expected if the failure happened before any merge was started.
+			log.Printf("Failed to abort the notes merge for %v: %v", repo, abortErr)
+		}
+		if attempt < notesMergeAttempts {
+			select {
+			case <-time.After(notesMergeRetryDelay):
+			case <-ctx.Done():
+				return fmt.Errorf("%v (%v)", err, ctx.Err())
+			}
+		}
+	}
+	return err
+}
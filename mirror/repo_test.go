@@ -0,0 +1,265 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mirror
+
+import (
+	"context"
+	"errors"
+	"github.com/google/git-appraise/repository"
+	"github.com/google/git-appraise/review/request"
+	"github.com/google/git-phabricator-mirror/mirror/metrics"
+	"github.com/google/git-phabricator-mirror/mirror/parallel"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// slowRepo records the maximum number of concurrent MergeBase calls.
+type slowRepo struct {
+	repository.Repo
+	mutex   sync.Mutex
+	running int
+	maxSeen int
+}
+
+func (repo *slowRepo) MergeBase(a, b string) (string, error) {
+	repo.mutex.Lock()
+	repo.running++
+	if repo.running > repo.maxSeen {
+		repo.maxSeen = repo.running
+	}
+	repo.mutex.Unlock()
+	time.Sleep(10 * time.Millisecond)
+	repo.mutex.Lock()
+	repo.running--
+	repo.mutex.Unlock()
+	return repo.Repo.MergeBase(a, b)
+}
+
+func TestBoundedRepo(t *testing.T) {
+	slow := &slowRepo{Repo: repository.NewMockRepoForTest()}
+	repo := boundedRepo{slow, parallel.NewLimiter(2), nil}
+	parallel.Run(10, 10, func(int) {
+		repo.MergeBase("refs/heads/master", "refs/heads/master")
+	})
+	if slow.maxSeen > 2 {
+		t.Errorf("Unexpected number of concurrent git calls: %d", slow.maxSeen)
+	}
+}
+
+func TestBoundedRepoCountsOperations(t *testing.T) {
+	counter := metrics.GitOperations.WithLabelValues("MergeBase")
+	before := testutil.ToFloat64(counter)
+	repo := boundedRepo{repository.NewMockRepoForTest(), nil, nil}
+	repo.MergeBase("refs/heads/master", "refs/heads/master")
+	repo.MergeBase("refs/heads/master", "refs/heads/master")
+	if counted := testutil.ToFloat64(counter) - before; counted != 2 {
+		t.Errorf("Unexpected number of git operations counted without a limiter: %v", counted)
+	}
+}
+
+// useRemoteURLs makes the repos at the given paths have the given remote URLs, and every other
+// repo have none, until the returned function is called.
+func useRemoteURLs(urls map[string]string) func() {
+	original := readRemoteURL
+	readRemoteURL = func(ctx context.Context, repoPath string) (string, error) {
+		if url, ok := urls[repoPath]; ok {
+			return url, nil
+		}
+		return "", errors.New("no remote")
+	}
+	resetRemoteURLs := func() {
+		remoteURLsMutex.Lock()
+		defer remoteURLsMutex.Unlock()
+		remoteURLs = make(map[string]string)
+	}
+	resetRemoteURLs()
+	return func() {
+		readRemoteURL = original
+		resetRemoteURLs()
+	}
+}
+
+func TestRemoteURL(t *testing.T) {
+	defer useRemoteURLs(map[string]string{"/var/repo/R": "https://git.example.com/r"})()
+	counter := metrics.GitOperations.WithLabelValues("RemoteURL")
+	before := testutil.ToFloat64(counter)
+	repo := boundedRepo{pathRepo{repository.NewMockRepoForTest(), "/var/repo/R"}, nil, nil}
+	for i := 0; i < 2; i++ {
+		if url := repo.remoteURL(); url != "https://git.example.com/r" {
+			t.Errorf("Unexpected remote URL: %q", url)
+		}
+	}
+	if read := testutil.ToFloat64(counter) - before; read != 1 {
+		t.Errorf("Unexpected number of times the remote URL was read: %v", read)
+	}
+	if url := (boundedRepo{pathRepo{repository.NewMockRepoForTest(), "/var/repo/S"}, nil, nil}).remoteURL(); url != "" {
+		t.Errorf("Unexpected remote URL for a repo without one: %q", url)
+	}
+}
+
+func TestNotesRefRepo(t *testing.T) {
+	mockRepo := repository.NewMockRepoForTest()
+	customRef := "refs/notes/custom/requests"
+	repo := notesRefRepo{mockRepo, map[string]string{request.Ref: customRef}}
+	note := repository.Note("{}")
+	if err := repo.AppendNote(request.Ref, "ABCD", note); err != nil {
+		t.Fatal(err)
+	}
+	if notes := mockRepo.GetNotes(customRef, "ABCD"); len(notes) != 1 || string(notes[0]) != string(note) {
+		t.Errorf("The note was not written to the custom ref: %v", notes)
+	}
+	if notes := mockRepo.GetNotes(request.Ref, "ABCD"); len(notes) != 0 {
+		t.Errorf("The note was written to the standard ref: %v", notes)
+	}
+	if revisions := repo.ListNotedRevisions(request.Ref); len(revisions) != 1 || revisions[0] != "ABCD" {
+		t.Errorf("Unexpected noted revisions: %v", revisions)
+	}
+	if unmatched := repo.unmatchedRefs("refs/notes/devtools/*"); len(unmatched) != 1 || unmatched[0] != customRef {
+		t.Errorf("Unexpected unmatched refs: %v", unmatched)
+	}
+	if unmatched := repo.unmatchedRefs("refs/notes/custom/*"); len(unmatched) != 0 {
+		t.Errorf("Unexpected unmatched refs: %v", unmatched)
+	}
+}
+
+func TestMetadataRefRepo(t *testing.T) {
+	mockRepo := repository.NewMockRepoForTest()
+	repo := metadataRefRepo{mockRepo, map[string]bool{request.Ref: true}}
+	revisions := mockRepo.ListNotedRevisions(request.Ref)
+	if len(revisions) == 0 {
+		t.Fatal("The mock repo does not have any requests")
+	}
+	if ignored := repo.ListNotedRevisions(request.Ref); len(ignored) != 0 {
+		t.Errorf("Unexpected revisions with requests in an ignored ref: %v", ignored)
+	}
+	if notes := repo.GetNotes(request.Ref, revisions[0]); len(notes) != 0 {
+		t.Errorf("Unexpected notes in an ignored ref: %v", notes)
+	}
+	if err := repo.AppendNote(request.Ref, revisions[0], repository.Note("{}")); err == nil {
+		t.Error("A note was written to an ignored ref")
+	}
+}
+
+// flakyPullRepo is a repository.Repo whose first few pulls fail.
+type flakyPullRepo struct {
+	repository.Repo
+	failures int
+	pulls    int
+}
+
+func (repo *flakyPullRepo) PullNotes(remote, notesRefPattern string) error {
+	repo.pulls++
+	if repo.pulls <= repo.failures {
+		return errors.New("failed to lock the notes ref")
+	}
+	return nil
+}
+
+func TestPullNotesWithRetry(t *testing.T) {
+	originalAbortNotesMerge, originalRetryDelay, originalGitProcesses := abortNotesMerge, notesMergeRetryDelay, gitProcesses
+	defer func() {
+		abortNotesMerge, notesMergeRetryDelay, gitProcesses = originalAbortNotesMerge, originalRetryDelay, originalGitProcesses
+	}()
+	LimitGitProcesses(1)
+	aborts := 0
+	abortNotesMerge = func(ctx context.Context, repoPath string) error {
+		if len(gitProcesses) != 1 {
+			t.Error("A notes merge was aborted without holding a git process slot")
+		}
+		aborts++
+		return nil
+	}
+	notesMergeRetryDelay = 0
+	repo := &flakyPullRepo{Repo: repository.NewMockRepoForTest(), failures: 2}
+	if err := pullNotesWithRetry(context.Background(), repo, "origin", "refs/notes/devtools/*"); err != nil {
+		t.Errorf("Unexpected error after a transient failure: %v", err)
+	}
+	if repo.pulls != 3 || aborts != 2 {
+		t.Errorf("Unexpected number of pulls (%d) or aborted merges (%d)", repo.pulls, aborts)
+	}
+	repo = &flakyPullRepo{Repo: repository.NewMockRepoForTest(), failures: notesMergeAttempts}
+	if err := pullNotesWithRetry(context.Background(), repo, "origin", "refs/notes/devtools/*"); err == nil {
+		t.Errorf("Failed to report a persistent failure")
+	}
+}
+
+func TestGitCommandCancelled(t *testing.T) {
+	// This stands in for a git command that hangs.
+	dir, err := ioutil.TempDir("", "git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(dir+"/git", []byte("#!/bin/sh\nexec sleep 60\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir+":"+os.Getenv("PATH"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	repo := boundedRepo{pathRepo{repository.NewMockRepoForTest(), dir}, nil, ctx}
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	if err := repo.abortMerge(); err == nil {
+		t.Error("A cancelled git command succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 30*time.Second {
+		t.Errorf("The cancelled git command was not killed, and ran for %v", elapsed)
+	}
+}
+
+// countingRepo counts the calls to AppendNote.
+type countingRepo struct {
+	repository.Repo
+	appends int
+}
+
+func (repo *countingRepo) AppendNote(ref, revision string, note repository.Note) error {
+	repo.appends++
+	return repo.Repo.AppendNote(ref, revision, note)
+}
+
+func TestAppendNotes(t *testing.T) {
+	repo := &countingRepo{Repo: repository.NewMockRepoForTest()}
+	notes := []repository.Note{[]byte("1"), []byte("2"), []byte("3"), []byte("4"), []byte("5")}
+	if err := appendNotes(repo, "refs/notes/test", "A", notes, 2); err != nil {
+		t.Fatal(err)
+	}
+	if repo.appends != 3 {
+		t.Errorf("Unexpected number of appends for batches of two: %d", repo.appends)
+	}
+	var lines []string
+	for _, note := range repo.GetNotes("refs/notes/test", "A") {
+		lines = append(lines, strings.Split(string(note), "\n")...)
+	}
+	if strings.Join(lines, ",") != "1,2,3,4,5" {
+		t.Errorf("Unexpected notes after batched appends: %q", lines)
+	}
+
+	repo.appends = 0
+	if err := appendNotes(repo, "refs/notes/test", "B", notes, 0); err != nil {
+		t.Fatal(err)
+	}
+	if repo.appends != len(notes) {
+		t.Errorf("Unexpected number of appends without batching: %d", repo.appends)
+	}
+}
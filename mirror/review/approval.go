@@ -0,0 +1,89 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package review
+
+import (
+	"encoding/json"
+	"github.com/google/git-appraise/repository"
+	"github.com/google/git-appraise/review/comment"
+	"reflect"
+)
+
+// ApprovalsRef is the git-notes ref under which we record the approval state of each reviewer.
+//
+// This is under "refs/notes/devtools/", so that it is synced along with the rest of the review metadata.
+const ApprovalsRef = "refs/notes/devtools/approvals"
+
+// The possible approval states of a reviewer.
+const (
+	Accepted = "accepted"
+	Rejected = "rejected"
+	NoVote   = "none"
+)
+
+// Approvals summarizes whether each reviewer has accepted or rejected a review.
+type Approvals struct {
+	Timestamp string `json:"timestamp,omitempty"`
+	// Reviewers maps from each reviewer to their approval state.
+	Reviewers map[string]string `json:"reviewers"`
+}
+
+// ComputeApprovals determines the current approval state of each reviewer, based on the given
+// list of reviewers and the comments in which they accepted or rejected the review.
+//
+// The comments must be in chronological order, so that the last accept or reject by each user
+// takes precedence. Users who are not listed as reviewers, but who did accept or reject the
+// review, are included as well.
+func ComputeApprovals(reviewers []string, comments []comment.Comment) map[string]string {
+	approvals := make(map[string]string)
+	for _, reviewer := range reviewers {
+		approvals[reviewer] = NoVote
+	}
+	for _, c := range comments {
+		if c.Resolved == nil || c.Author == "" {
+			continue
+		}
+		if *c.Resolved {
+			approvals[c.Author] = Accepted
+		} else {
+			approvals[c.Author] = Rejected
+		}
+	}
+	return approvals
+}
+
+// LatestApprovals returns the most recently recorded approval state from the given notes, if any.
+func LatestApprovals(notes []repository.Note) *Approvals {
+	for i := len(notes) - 1; i >= 0; i-- {
+		var approvals Approvals
+		if err := json.Unmarshal([]byte(notes[i]), &approvals); err == nil && approvals.Reviewers != nil {
+			return &approvals
+		}
+	}
+	return nil
+}
+
+// Matches reports whether or not the recorded approvals are the same as the given approval states.
+func (approvals *Approvals) Matches(reviewers map[string]string) bool {
+	return approvals != nil && reflect.DeepEqual(approvals.Reviewers, reviewers)
+}
+
+// Write serializes the approvals into a git-note.
+func (approvals Approvals) Write() (repository.Note, error) {
+	bytes, err := json.Marshal(approvals)
+	return repository.Note(bytes), err
+}
@@ -0,0 +1,55 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package review
+
+import (
+	"github.com/google/git-appraise/repository"
+	"github.com/google/git-appraise/review/comment"
+	"testing"
+)
+
+func TestComputeApprovals(t *testing.T) {
+	accept := true
+	reject := false
+	comments := []comment.Comment{
+		comment.Comment{Author: "alice", Resolved: &reject},
+		comment.Comment{Author: "bob", Description: "Looks interesting"},
+		comment.Comment{Author: "carol", Resolved: &reject},
+		comment.Comment{Author: "alice", Resolved: &accept},
+	}
+	approvals := ComputeApprovals([]string{"alice", "bob"}, comments)
+	expected := map[string]string{
+		"alice": Accepted,
+		"bob":   NoVote,
+		"carol": Rejected,
+	}
+	recorded := &Approvals{Reviewers: expected}
+	if !recorded.Matches(approvals) {
+		t.Errorf("Unexpected approvals: %v", approvals)
+	}
+	note, err := recorded.Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+	latest := LatestApprovals([]repository.Note{repository.Note("not json"), note, repository.Note("{}")})
+	if !latest.Matches(approvals) {
+		t.Errorf("Unexpected latest approvals: %v", latest)
+	}
+	if LatestApprovals(nil).Matches(approvals) {
+		t.Errorf("Missing approvals matched the computed ones")
+	}
+}
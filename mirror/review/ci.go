@@ -0,0 +1,60 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package review
+
+import (
+	"github.com/google/git-appraise/repository"
+	"github.com/google/git-appraise/review/ci"
+	"log"
+	"sort"
+	"strconv"
+)
+
+// GetAllLatestCIReports returns the most recent CI report from each agent in the given notes,
+// ordered by agent.
+//
+// Reports without an agent are treated as coming from a single, unnamed agent, so that at most
+// one of them is returned, as with ci.GetLatestCIReport.
+//
+// Reports whose timestamps cannot be parsed are logged and skipped, so that a single corrupt
+// note does not hide the rest.
+func GetAllLatestCIReports(notes []repository.Note) ([]ci.Report, error) {
+	reportsByAgent := make(map[string][]ci.Report)
+	for _, report := range ci.ParseAllValid(notes) {
+		if _, err := strconv.Atoi(report.Timestamp); err != nil {
+			log.Printf("Skipping the CI report %v, as its timestamp is not valid: %v", report, err)
+			continue
+		}
+		reportsByAgent[report.Agent] = append(reportsByAgent[report.Agent], report)
+	}
+	var agents []string
+	for agent := range reportsByAgent {
+		agents = append(agents, agent)
+	}
+	sort.Strings(agents)
+	var latestReports []ci.Report
+	for _, agent := range agents {
+		latest, err := ci.GetLatestCIReport(reportsByAgent[agent])
+		if err != nil {
+			return nil, err
+		}
+		if latest != nil {
+			latestReports = append(latestReports, *latest)
+		}
+	}
+	return latestReports, nil
+}
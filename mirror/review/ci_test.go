@@ -0,0 +1,74 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package review
+
+import (
+	"github.com/google/git-appraise/repository"
+	"testing"
+)
+
+func TestGetAllLatestCIReports(t *testing.T) {
+	notes := []repository.Note{
+		repository.Note(`{"timestamp": "1", "status": "failure", "agent": "build"}`),
+		repository.Note(`{"timestamp": "3", "status": "success", "agent": "build"}`),
+		repository.Note(`{"timestamp": "2", "status": "failure", "agent": "lint"}`),
+		repository.Note(`{"timestamp": "4", "url": "example.com/1"}`),
+		repository.Note(`{"timestamp": "5", "url": "example.com/2"}`),
+		repository.Note(`not a report`),
+	}
+	reports, err := GetAllLatestCIReports(notes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 3 {
+		t.Fatalf("Unexpected reports: %v", reports)
+	}
+	if reports[0].Agent != "" || reports[0].URL != "example.com/2" {
+		t.Errorf("Unexpected latest report without an agent: %v", reports[0])
+	}
+	if reports[1].Agent != "build" || reports[1].Status != "success" {
+		t.Errorf("Unexpected latest report from the build agent: %v", reports[1])
+	}
+	if reports[2].Agent != "lint" || reports[2].Status != "failure" {
+		t.Errorf("Unexpected latest report from the lint agent: %v", reports[2])
+	}
+	if reports, err := GetAllLatestCIReports(nil); err != nil || len(reports) != 0 {
+		t.Errorf("Unexpected reports without any notes: %v, %v", reports, err)
+	}
+}
+
+func TestGetAllLatestCIReportsWithInvalidTimestamps(t *testing.T) {
+	notes := []repository.Note{
+		repository.Note(`{"timestamp": "2", "status": "success", "agent": "build"}`),
+		repository.Note(`{"timestamp": "garbage", "status": "failure", "agent": "build"}`),
+		repository.Note(`{"status": "failure", "agent": "lint"}`),
+		repository.Note(`{"timestamp": "1", "status": "failure", "agent": "integration"}`),
+		repository.Note(`{"timestamp": "3.5", "status": "success", "agent": "integration"}`),
+	}
+	reports, err := GetAllLatestCIReports(notes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 2 || reports[0].Agent != "build" || reports[0].Status != "success" ||
+		reports[1].Agent != "integration" || reports[1].Status != "failure" {
+		t.Errorf("Unexpected reports when some timestamps are invalid: %v", reports)
+	}
+	reports, err = GetAllLatestCIReports(notes[1:3])
+	if err != nil || len(reports) != 0 {
+		t.Errorf("Unexpected reports when every timestamp is invalid: %v, %v", reports, err)
+	}
+}
@@ -23,6 +23,10 @@ import (
 	"strings"
 )
 
+// ProvenanceTrailer is a line that the mirror may append to the comments it quotes,
+// in order to mark them as having been posted by the mirror.
+const ProvenanceTrailer = "Mirrored-By: git-phabricator-mirror"
+
 // QuoteDescription generates the description that quotes the given comment.
 //
 // This is for when one user (such as our mirroring bot) needs to post a comment
@@ -31,20 +35,44 @@ func QuoteDescription(comment comment.Comment) string {
 	return comment.Author + ":\n\n" + comment.Description
 }
 
+// QuoteDescriptionWithProvenance is like QuoteDescription, but also appends the
+// ProvenanceTrailer to the generated description.
+func QuoteDescriptionWithProvenance(comment comment.Comment) string {
+	return AppendProvenance(QuoteDescription(comment))
+}
+
+// AppendProvenance appends the ProvenanceTrailer to the given description.
+func AppendProvenance(description string) string {
+	return description + "\n\n" + ProvenanceTrailer
+}
+
+// stripProvenance removes the ProvenanceTrailer from the given description, if present.
+//
+// Since descriptions can come back from Phabricator with their newlines escaped, we
+// handle both the escaped and the unescaped form of the trailer's separator.
+func stripProvenance(description string) string {
+	if strings.HasSuffix(description, "\n\n"+ProvenanceTrailer) {
+		return strings.TrimSuffix(description, "\n\n"+ProvenanceTrailer)
+	}
+	return strings.TrimSuffix(description, "\\n\\n"+ProvenanceTrailer)
+}
+
 // isQuote determines if the given comment is a quote of the other comment.
 //
 // For these purposes, a quote is a sequence of:
 // 1. The comment's author
 // 2. A separator composed of a ':' and two newlines
 // 3. The quoted comment's description.
+// 4. Optionally, two newlines followed by the ProvenanceTrailer.
 func isQuote(comment, other comment.Comment) bool {
-	if comment.Description == QuoteDescription(other) {
+	description := stripProvenance(comment.Description)
+	if description == QuoteDescription(other) {
 		return true
 	}
-	if comment.Description == strings.Replace(QuoteDescription(other), "\n", "\\n", -1) {
+	if description == strings.Replace(QuoteDescription(other), "\n", "\\n", -1) {
 		return true
 	}
-	if strings.Replace(comment.Description, "\n", "\\n", -1) == QuoteDescription(other) {
+	if strings.Replace(description, "\n", "\\n", -1) == QuoteDescription(other) {
 		return true
 	}
 	return false
@@ -55,7 +83,7 @@ func isQuote(comment, other comment.Comment) bool {
 // Here, rough equivalence means that the two descriptions are the same, or that one
 // is a quote of the other posted on behalf of another user.
 func descriptionOverlaps(comment, other comment.Comment) bool {
-	if comment.Description == other.Description {
+	if stripProvenance(comment.Description) == stripProvenance(other.Description) {
 		return true
 	}
 	if isQuote(comment, other) {
@@ -79,7 +107,26 @@ func LocationOverlaps(location, other comment.Location) bool {
 	if location.Range == nil || other.Range == nil {
 		return false
 	}
-	return location.Range.StartLine == other.Range.StartLine
+	if location.Range.StartLine != other.Range.StartLine {
+		return false
+	}
+	// Comments written before ranges could span multiple lines have no end line, even if they
+	// were mirrored from multi-line comments, so they overlap ranges with any end.
+	if location.Range.EndLine == 0 || other.Range.EndLine == 0 {
+		return true
+	}
+	return EndLine(*location.Range) == EndLine(*other.Range)
+}
+
+// EndLine returns the last line of the given range.
+//
+// Ranges that do not specify an end, such as those written before ranges could span multiple
+// lines, cover just their start line.
+func EndLine(r comment.Range) uint32 {
+	if r.EndLine < r.StartLine {
+		return r.StartLine
+	}
+	return r.EndLine
 }
 
 // resolvedOverlaps determines if the two provided comments have the same resolved value
@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"github.com/google/git-appraise/review"
 	"github.com/google/git-appraise/review/comment"
+	"strings"
 	"testing"
 )
 
@@ -54,6 +55,48 @@ With some text in it.`
 		t.Errorf("%v and %v do not overlap", quotedComment, originalComment)
 	}
 
+	markedComment := quotedComment
+	markedComment.Description = QuoteDescriptionWithProvenance(originalComment)
+	if !Overlaps(originalComment, markedComment) {
+		t.Errorf("%v and %v do not overlap", originalComment, markedComment)
+	}
+	if !Overlaps(markedComment, quotedComment) {
+		t.Errorf("%v and %v do not overlap", markedComment, quotedComment)
+	}
+	markedComment.Description = strings.Replace(markedComment.Description, "\n", "\\n", -1)
+	if !Overlaps(markedComment, originalComment) {
+		t.Errorf("%v and %v do not overlap", markedComment, originalComment)
+	}
+	otherComment := originalComment
+	otherComment.Description = "Some other description"
+	if Overlaps(otherComment, markedComment) {
+		t.Errorf("%v and %v overlap", otherComment, markedComment)
+	}
+}
+
+func TestLocationOverlapsRanges(t *testing.T) {
+	location := func(r comment.Range) comment.Location {
+		return comment.Location{Commit: "ABCDEFG", Path: "hello.txt", Range: &r}
+	}
+	singleLine := location(comment.Range{StartLine: 10})
+	if !LocationOverlaps(singleLine, location(comment.Range{StartLine: 10, EndLine: 10})) {
+		t.Errorf("A range without an end does not overlap the same single line")
+	}
+	if !LocationOverlaps(singleLine, location(comment.Range{StartLine: 10, EndLine: 20})) {
+		t.Errorf("A range without an end, as written before ranges could span multiple lines, does not overlap a multi-line range")
+	}
+	if LocationOverlaps(location(comment.Range{StartLine: 10, EndLine: 10}), location(comment.Range{StartLine: 10, EndLine: 20})) {
+		t.Errorf("A single line overlaps a range spanning multiple lines")
+	}
+	if LocationOverlaps(singleLine, location(comment.Range{StartLine: 11, EndLine: 20})) {
+		t.Errorf("A range without an end overlaps a range with a different start")
+	}
+	if LocationOverlaps(location(comment.Range{StartLine: 10, EndLine: 15}), location(comment.Range{StartLine: 10, EndLine: 20})) {
+		t.Errorf("Ranges with different ends overlap")
+	}
+	if !LocationOverlaps(location(comment.Range{StartLine: 10, EndLine: 20}), location(comment.Range{StartLine: 10, EndLine: 20})) {
+		t.Errorf("Identical ranges do not overlap")
+	}
 }
 
 func TestResolvedOverlaps(t *testing.T) {
@@ -28,8 +28,15 @@ type PhabricatorReview interface {
 	// LoadComments returns the comments for a review
 	LoadComments() []comment.Comment
 
+	// LoadAllComments returns the comments for a review, including those that the mirror itself
+	// posted there from git-notes
+	LoadAllComments() []comment.Comment
+
 	// GetFirstCommit returns the first commit that is included in the review
 	GetFirstCommit(repo repository.Repo) string
+
+	// GetReviewers returns the reviewers of the review, identified the same way as comment authors
+	GetReviewers() []string
 }
 
 // Tool represents our interface to the code review portion of Phabricator.
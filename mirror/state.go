@@ -0,0 +1,269 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mirror
+
+import (
+	"encoding/json"
+	"github.com/google/git-appraise/repository"
+	"github.com/google/git-appraise/review"
+	review_utils "github.com/google/git-phabricator-mirror/mirror/review"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// mirrorState holds what the mirror remembers between its passes over the repos.
+//
+// Multiple repos may be mirrored at the same time, so it is only accessed through its methods,
+// which are safe to call from multiple goroutines.
+type mirrorState struct {
+	mutex sync.RWMutex
+
+	// processedStates holds the state of each repo, keyed by path, at the last time we
+	// processed it. That is used to avoid re-processing a repo if its state has not changed.
+	processedStates map[string]string
+
+	// existingComments holds the comment threads of each review, keyed by revision.
+	existingComments map[string][]review.CommentThread
+
+	// openReviews holds the open Phabricator reviews for each repo, keyed by path.
+	openReviews map[string][]review_utils.PhabricatorReview
+
+	// reviewCursors and commentCursors hold, for each repo, where the next pass should start
+	// mirroring reviews and comments respectively, when there are more than it may process.
+	reviewCursors  map[string]int
+	commentCursors map[string]int
+}
+
+func newMirrorState() *mirrorState {
+	return &mirrorState{
+		processedStates:  make(map[string]string),
+		existingComments: make(map[string][]review.CommentThread),
+		openReviews:      make(map[string][]review_utils.PhabricatorReview),
+		reviewCursors:    make(map[string]int),
+		commentCursors:   make(map[string]int),
+	}
+}
+
+// state is shared by every repo that the mirror processes.
+var state = newMirrorState()
+
+// isProcessed reports whether or not the repo at the given path was fully processed while in the given state.
+func (s *mirrorState) isProcessed(repoPath, stateHash string) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	processed, ok := s.processedStates[repoPath]
+	return ok && processed == stateHash
+}
+
+// markProcessed records that the repo at the given path was fully processed while in the given state.
+func (s *mirrorState) markProcessed(repoPath, stateHash string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.processedStates[repoPath] = stateHash
+}
+
+// processedState returns the state in which the repo at the given path was last fully
+// processed, and whether or not it ever was.
+func (s *mirrorState) processedState(repoPath string) (string, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	stateHash, ok := s.processedStates[repoPath]
+	return stateHash, ok
+}
+
+// setExistingComments records the comment threads of each of the given reviews.
+func (s *mirrorState) setExistingComments(reviews []review.Summary) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, r := range reviews {
+		s.existingComments[r.Revision] = r.Comments
+	}
+}
+
+// existingCommentsFor returns the comment threads last recorded for the review of the given revision.
+func (s *mirrorState) existingCommentsFor(revision string) []review.CommentThread {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.existingComments[revision]
+}
+
+// setOpenReviews records the open Phabricator reviews for the repo at the given path.
+func (s *mirrorState) setOpenReviews(repoPath string, reviews []review_utils.PhabricatorReview) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.openReviews[repoPath] = reviews
+}
+
+// openReviewsFor returns the open Phabricator reviews last recorded for the repo at the given path.
+func (s *mirrorState) openReviewsFor(repoPath string) []review_utils.PhabricatorReview {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.openReviews[repoPath]
+}
+
+// hasOpenReviews reports whether or not the open Phabricator reviews of the repo at the given
+// path have been recorded since the mirror started.
+func (s *mirrorState) hasOpenReviews(repoPath string) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	_, ok := s.openReviews[repoPath]
+	return ok
+}
+
+// nextReviewBatch is like nextBatch, for the reviews of the repo at the given path.
+func (s *mirrorState) nextReviewBatch(repoPath string, count, max int) (map[int]bool, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	cursor := s.reviewCursors[repoPath]
+	batch, complete := nextBatch(&cursor, count, max)
+	s.reviewCursors[repoPath] = cursor
+	return batch, complete
+}
+
+// nextCommentBatch is like nextBatch, for the open Phabricator reviews of the repo at the given
+// path whose comments are to be mirrored.
+func (s *mirrorState) nextCommentBatch(repoPath string, count, max int) (map[int]bool, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	cursor := s.commentCursors[repoPath]
+	batch, complete := nextBatch(&cursor, count, max)
+	s.commentCursors[repoPath] = cursor
+	return batch, complete
+}
+
+// RepoStatus summarizes the state of a repo, as of the mirror's last pass over it.
+type RepoStatus struct {
+	Path string `json:"path"`
+	// StateHash is the state in which the repo was last fully processed, if it ever was.
+	StateHash string `json:"stateHash,omitempty"`
+	// LastSync is when the last pass over the repo finished, whether or not it succeeded.
+	LastSync    time.Time `json:"lastSync"`
+	OpenReviews int       `json:"openReviews"`
+}
+
+// statuses returns the status of each repo that is either in the state, or in the given
+// timings, ordered by path.
+func (s *mirrorState) statuses(timings map[string]RepoTiming) []RepoStatus {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	paths := make(map[string]bool)
+	for path := range s.processedStates {
+		paths[path] = true
+	}
+	for path := range s.openReviews {
+		paths[path] = true
+	}
+	for path := range timings {
+		paths[path] = true
+	}
+	statuses := make([]RepoStatus, 0, len(paths))
+	for path := range paths {
+		statuses = append(statuses, RepoStatus{
+			Path:        path,
+			StateHash:   s.processedStates[path],
+			LastSync:    timings[path].Finished,
+			OpenReviews: len(s.openReviews[path]),
+		})
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Path < statuses[j].Path })
+	return statuses
+}
+
+// Statuses returns the status of each repo that the mirror has processed, or loaded the state
+// of, since it started, ordered by path.
+//
+// This is safe to call while repos are being mirrored, e.g. to serve it for monitoring.
+func Statuses() []RepoStatus {
+	return state.statuses(RepoTimings())
+}
+
+// saveProcessedStates writes the processed state of each repo to the given file, as a JSON
+// object mapping repo paths to state hashes.
+//
+// The file is replaced atomically, so that it is never left half-written if the mirror is
+// stopped in the middle of saving it.
+func (s *mirrorState) saveProcessedStates(path string) error {
+	s.mutex.RLock()
+	bytes, err := json.Marshal(s.processedStates)
+	s.mutex.RUnlock()
+	if err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	_, err = file.Write(bytes)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+// loadProcessedStates reads the processed states saved by saveProcessedStates from the given
+// file, keeping only those of the repos whose paths are in the given set.
+//
+// A missing file is not an error, as there is nothing saved before the first pass.
+func (s *mirrorState) loadProcessedStates(path string, repoPaths map[string]bool) error {
+	bytes, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var saved map[string]string
+	if err := json.Unmarshal(bytes, &saved); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for repoPath, stateHash := range saved {
+		if repoPaths[repoPath] {
+			s.processedStates[repoPath] = stateHash
+		}
+	}
+	return nil
+}
+
+// SaveProcessedStates writes the state in which each repo was last fully processed to the given file.
+//
+// Loading the file with LoadProcessedStates after a restart saves the mirror from having to
+// process every repo again from scratch.
+func SaveProcessedStates(path string) error {
+	return state.saveProcessedStates(path)
+}
+
+// LoadProcessedStates reads the states saved by SaveProcessedStates from the given file, so
+// that repos which have not changed since then are not processed again.
+//
+// Only the states of the given repos are kept, so that those of repos that were since removed
+// are dropped.
+func LoadProcessedStates(path string, repos []repository.Repo) error {
+	repoPaths := make(map[string]bool)
+	for _, repo := range repos {
+		repoPaths[repo.GetPath()] = true
+	}
+	return state.loadProcessedStates(path, repoPaths)
+}
@@ -0,0 +1,199 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mirror
+
+import (
+	"fmt"
+	"github.com/google/git-appraise/repository"
+	"github.com/google/git-appraise/review"
+	"github.com/google/git-appraise/review/comment"
+	"github.com/google/git-appraise/review/request"
+	"github.com/google/git-phabricator-mirror/mirror/parallel"
+	review_utils "github.com/google/git-phabricator-mirror/mirror/review"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// pathRepo is a repository.Repo at the given path.
+type pathRepo struct {
+	repository.Repo
+	path string
+}
+
+func (repo pathRepo) GetPath() string {
+	return repo.path
+}
+
+// TestMirrorReposConcurrently is meant to be run with "-race" (as "make test" does), to check
+// that the state shared by the repos being mirrored is safe to use from multiple goroutines,
+// including while mirroring the comments of their open reviews.
+func TestMirrorReposConcurrently(t *testing.T) {
+	resetMirrorState()
+	defer resetMirrorState()
+	phabricatorComment := comment.Comment{
+		Timestamp:   "5",
+		Author:      "reviewer@example.com",
+		Description: "A comment made in Phabricator",
+	}
+	var repos []repository.Repo
+	var tools []*mockReviewTool
+	for i := 0; i < 2; i++ {
+		repos = append(repos, pathRepo{repository.NewMockRepoForTest(), fmt.Sprintf("/var/repo/R%d", i)})
+		tools = append(tools, &mockReviewTool{
+			Requests: make(map[string]request.Request),
+			Comments: []comment.Comment{phabricatorComment},
+		})
+	}
+	errs := make([]error, len(repos))
+	parallel.Run(len(repos), len(repos), func(i int) {
+		for pass := 0; pass < 4 && errs[i] == nil; pass++ {
+			errs[i] = mirrorRepoToReview(repos[i], tools[i], mirrorOptions{maxReviewsPerPass: 1})
+		}
+	})
+	for i, repo := range repos {
+		if errs[i] != nil {
+			t.Errorf("Failed to mirror %s: %v", repo.GetPath(), errs[i])
+		}
+		if len(tools[i].Requests) != len(review.ListAll(repo)) {
+			t.Errorf("Unexpected reviews mirrored for %s: %v", repo.GetPath(), tools[i].Requests)
+		}
+		if _, ok := state.processedState(repo.GetPath()); !ok {
+			t.Errorf("The repo %s was not marked as processed", repo.GetPath())
+		}
+		if len(state.openReviewsFor(repo.GetPath())) == 0 {
+			t.Errorf("The open reviews of %s were not recorded", repo.GetPath())
+		}
+		for revision := range tools[i].Requests {
+			r, err := review.GetSummary(repo, revision)
+			if err != nil || r == nil || !hasComment(r.Comments, phabricatorComment) {
+				t.Errorf("The Phabricator comment was not mirrored into the review of %s in %s", revision, repo.GetPath())
+			}
+		}
+	}
+}
+
+// hasComment reports whether the given threads include the given comment.
+func hasComment(threads []review.CommentThread, c comment.Comment) bool {
+	for _, thread := range threads {
+		if thread.Comment.Description == c.Description || hasComment(thread.Children, c) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestMirrorState(t *testing.T) {
+	s := newMirrorState()
+	if s.isProcessed("/var/repo/R", "") {
+		t.Error("A repo was processed before it was ever marked")
+	}
+	s.markProcessed("/var/repo/R", "hash")
+	if !s.isProcessed("/var/repo/R", "hash") || s.isProcessed("/var/repo/R", "other") {
+		t.Error("The processed state of the repo was not recorded")
+	}
+	threads := []review.CommentThread{{Hash: "comment"}}
+	s.setExistingComments([]review.Summary{{Revision: "ABCD", Comments: threads}})
+	if comments := s.existingCommentsFor("ABCD"); len(comments) != 1 || comments[0].Hash != "comment" {
+		t.Errorf("Unexpected existing comments: %v", comments)
+	}
+	if batch, complete := s.nextReviewBatch("/var/repo/R", 3, 2); len(batch) != 2 || complete || !batch[0] || !batch[1] {
+		t.Errorf("Unexpected first batch of reviews: %v, %v", batch, complete)
+	}
+	if batch, _ := s.nextReviewBatch("/var/repo/R", 3, 2); !batch[2] || !batch[0] {
+		t.Errorf("The second batch of reviews did not continue from the first: %v", batch)
+	}
+	if batch, _ := s.nextCommentBatch("/var/repo/R", 3, 2); !batch[0] || !batch[1] {
+		t.Errorf("The batches of comments were not tracked separately from those of reviews: %v", batch)
+	}
+}
+
+func TestStatuses(t *testing.T) {
+	s := newMirrorState()
+	s.markProcessed("/var/repo/B", "hash")
+	s.setOpenReviews("/var/repo/B", make([]review_utils.PhabricatorReview, 2))
+	finished := time.Unix(100, 0)
+	statuses := s.statuses(map[string]RepoTiming{"/var/repo/A": {Finished: finished}})
+	if len(statuses) != 2 {
+		t.Fatalf("Unexpected statuses: %v", statuses)
+	}
+	if statuses[0].Path != "/var/repo/A" || statuses[0].StateHash != "" || !statuses[0].LastSync.Equal(finished) {
+		t.Errorf("Unexpected status of a repo that was never fully processed: %v", statuses[0])
+	}
+	if statuses[1].Path != "/var/repo/B" || statuses[1].StateHash != "hash" || statuses[1].OpenReviews != 2 ||
+		!statuses[1].LastSync.IsZero() {
+		t.Errorf("Unexpected status of a processed repo: %v", statuses[1])
+	}
+}
+
+func TestSaveAndLoadProcessedStates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "git-phabricator-mirror-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+
+	s := newMirrorState()
+	if err := s.loadProcessedStates(path, map[string]bool{"/var/repo/R": true}); err != nil {
+		t.Errorf("Failed to load the states before any were saved: %v", err)
+	}
+	s.markProcessed("/var/repo/R", "hash")
+	s.markProcessed("/var/repo/Removed", "other")
+	if err := s.saveProcessedStates(path); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := newMirrorState()
+	if err := loaded.loadProcessedStates(path, map[string]bool{"/var/repo/R": true}); err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.isProcessed("/var/repo/R", "hash") {
+		t.Error("The saved state of the repo was not loaded")
+	}
+	if _, ok := loaded.processedState("/var/repo/Removed"); ok {
+		t.Error("The saved state of a repo that no longer exists was loaded")
+	}
+	if loaded.hasOpenReviews("/var/repo/R") {
+		t.Error("The open reviews of the repo were recorded before it was mirrored")
+	}
+}
+
+// TestMirrorRepoAfterLoadingState checks that repos which were processed before a restart
+// still have their Phabricator comments mirrored.
+func TestMirrorRepoAfterLoadingState(t *testing.T) {
+	resetMirrorState()
+	defer resetMirrorState()
+	repo := repository.NewMockRepoForTest()
+	stateHash, err := repoStateHash(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.markProcessed(repo.GetPath(), stateHash)
+	tool := mockReviewTool{Requests: make(map[string]request.Request)}
+	if err := mirrorRepoToReview(repo, &tool, mirrorOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(tool.Requests) != 0 {
+		t.Errorf("Reviews were mirrored again for an unchanged repo: %v", tool.Requests)
+	}
+	if !state.hasOpenReviews(repo.GetPath()) {
+		t.Error("The open reviews of the repo were not loaded")
+	}
+}
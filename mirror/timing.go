@@ -0,0 +1,101 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mirror
+
+import (
+	"fmt"
+	"github.com/google/git-phabricator-mirror/mirror/metrics"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The phases into which we break down the time spent mirroring a repo.
+const (
+	PhaseRemoteSync        = "remote-sync"
+	PhaseReviewEnumeration = "review-enumeration"
+	PhaseDiffCreation      = "diff-creation"
+	PhaseCommentMirroring  = "comment-mirroring"
+)
+
+// RepoTiming records how long the most recent pass over a repo took.
+type RepoTiming struct {
+	Finished time.Time
+	Total    time.Duration
+	// Phases maps from each phase (e.g. PhaseRemoteSync) to the time spent in it.
+	Phases map[string]time.Duration
+}
+
+// String returns a human-readable summary of the timing, e.g. for logging.
+func (timing RepoTiming) String() string {
+	var phases []string
+	for phase, duration := range timing.Phases {
+		phases = append(phases, fmt.Sprintf("%s: %v", phase, duration))
+	}
+	sort.Strings(phases)
+	return fmt.Sprintf("%v (%s)", timing.Total, strings.Join(phases, ", "))
+}
+
+var (
+	repoTimingsMutex sync.Mutex
+	repoTimings      = make(map[string]RepoTiming)
+)
+
+// RepoTimings returns the timing of the most recent pass over each repo, keyed by repo path.
+func RepoTimings() map[string]RepoTiming {
+	repoTimingsMutex.Lock()
+	defer repoTimingsMutex.Unlock()
+	timings := make(map[string]RepoTiming)
+	for path, timing := range repoTimings {
+		timings[path] = timing
+	}
+	return timings
+}
+
+// repoTimer measures the time spent in each phase of a single pass over a repo.
+type repoTimer struct {
+	start  time.Time
+	phases map[string]time.Duration
+}
+
+func newRepoTimer() *repoTimer {
+	return &repoTimer{
+		start:  time.Now(),
+		phases: make(map[string]time.Duration),
+	}
+}
+
+// track adds the time since the given start time to the given phase.
+func (timer *repoTimer) track(phase string, start time.Time) {
+	timer.phases[phase] += time.Since(start)
+}
+
+// finish records the timing of the pass over the repo at the given path, both in the
+// repo timings and in metrics.SyncDuration.
+func (timer *repoTimer) finish(repoPath string) RepoTiming {
+	timing := RepoTiming{
+		Finished: time.Now(),
+		Total:    time.Since(timer.start),
+		Phases:   timer.phases,
+	}
+	repoTimingsMutex.Lock()
+	repoTimings[repoPath] = timing
+	repoTimingsMutex.Unlock()
+	metrics.SyncDuration.WithLabelValues(repoPath).Observe(timing.Total.Seconds())
+	return timing
+}